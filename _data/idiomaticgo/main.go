@@ -46,7 +46,7 @@ func setup() {
 	/*if !document.Body().HasChildNodes() {
 		var buf bytes.Buffer
 		returnURL := dom.GetWindow().Location().Pathname + dom.GetWindow().Location().Search
-		err = idiomaticgo.RenderBodyInnerHTML(context.TODO(), &buf, issuesService, http.Notifications{}, authenticatedUser, returnURL)
+		err = idiomaticgo.RenderBodyInnerHTML(context.TODO(), &buf, issuesService, http.Notifications{}, authenticatedUser, csrfToken, returnURL)
 		if err != nil {
 			log.Println(err)
 			return
@@ -60,12 +60,13 @@ func setup() {
 // httpClient gives an *http.Client for making API requests.
 func httpClient() *http.Client {
 	cookies := &http.Request{Header: http.Header{"Cookie": {document.Cookie()}}}
-	if accessToken, err := cookies.Cookie("accessToken"); err == nil {
-		// Authenticated client.
-		src := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: accessToken.Value},
-		)
-		return oauth2.NewClient(context.Background(), src)
+	if csrfToken, err := cookies.Cookie("csrfToken"); err == nil {
+		// Authenticated client. The session cookie is HttpOnly,
+		// so use it to get short-lived API tokens instead.
+		src := oauth2.ReuseTokenSource(nil, homehttp.TokenSource{CSRFToken: csrfToken.Value})
+		// Send CSRF token with state-changing requests.
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: &homehttp.CSRFTransport{Token: csrfToken.Value}})
+		return oauth2.NewClient(ctx, src)
 	}
 	// Not authenticated client.
 	return http.DefaultClient
@@ -0,0 +1,201 @@
+// passkey contains the frontend code for registering passkeys
+// and signing in with them.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gopherjs/gopherjs/js"
+	"github.com/shurcooL/go/gopherjs_http/jsutil"
+	homehttp "github.com/shurcooL/home/http"
+	"github.com/shurcooL/home/internal/webauthn"
+	"honnef.co/go/js/dom"
+)
+
+var document = dom.GetWindow().Document().(dom.HTMLDocument)
+
+func main() {
+	js.Global.Set("RegisterPasskey", jsutil.Wrap(RegisterPasskey))
+	js.Global.Set("SignInWithPasskey", jsutil.Wrap(SignInWithPasskey))
+}
+
+// RegisterPasskey registers a new passkey for the signed in user,
+// named after the value of the passkey-name input.
+func RegisterPasskey(button dom.HTMLElement) {
+	name := document.GetElementByID("passkey-name").(*dom.HTMLInputElement).Value
+	if name == "" {
+		dom.GetWindow().Alert("Please give the passkey a name.")
+		return
+	}
+	button.SetAttribute("disabled", "disabled")
+	go func() {
+		defer button.RemoveAttribute("disabled")
+		returnURL, err := registerPasskey(name)
+		if err != nil {
+			dom.GetWindow().Alert("Adding passkey failed: " + err.Error())
+			return
+		}
+		dom.GetWindow().Location().Href = returnURL
+	}()
+}
+
+// SignInWithPasskey signs in with a passkey, and then navigates
+// to the return URL in the data-return attribute of button.
+func SignInWithPasskey(button dom.HTMLElement) {
+	button.SetAttribute("disabled", "disabled")
+	go func() {
+		defer button.RemoveAttribute("disabled")
+		returnURL, err := signInWithPasskey(button.GetAttribute("data-return"))
+		if err != nil {
+			dom.GetWindow().Alert("Signing in with a passkey failed: " + err.Error())
+			return
+		}
+		dom.GetWindow().Location().Href = returnURL
+	}()
+}
+
+func registerPasskey(name string) (returnURL string, err error) {
+	var opts webauthn.CreationOptions
+	err = post("/settings/passkeys/register/begin", nil, &opts)
+	if err != nil {
+		return "", err
+	}
+	var params, exclude []js.M
+	for _, alg := range opts.Algorithms {
+		params = append(params, js.M{"type": "public-key", "alg": alg})
+	}
+	for _, id := range opts.ExcludeCredentials {
+		exclude = append(exclude, js.M{"type": "public-key", "id": id})
+	}
+	cred, err := await(js.Global.Get("navigator").Get("credentials").Call("create", js.M{"publicKey": js.M{
+		"challenge":          opts.Challenge,
+		"rp":                 js.M{"id": opts.RPID, "name": opts.RPName},
+		"user":               js.M{"id": opts.UserID, "name": opts.UserName, "displayName": opts.UserDisplayName},
+		"pubKeyCredParams":   params,
+		"excludeCredentials": exclude,
+		"authenticatorSelection": js.M{
+			"residentKey":      "required",
+			"userVerification": "required",
+		},
+		"attestation": "none",
+		"timeout":     opts.TimeoutMillis,
+	}}))
+	if err != nil {
+		return "", err
+	}
+	response := cred.Get("response")
+	var resp struct{ ReturnURL string }
+	err = post("/settings/passkeys/register/finish", struct {
+		webauthn.AttestationResponse
+		Name string
+	}{
+		AttestationResponse: webauthn.AttestationResponse{
+			ID:                bytesOf(cred.Get("rawId")),
+			ClientDataJSON:    bytesOf(response.Get("clientDataJSON")),
+			AttestationObject: bytesOf(response.Get("attestationObject")),
+		},
+		Name: name,
+	}, &resp)
+	return resp.ReturnURL, err
+}
+
+func signInWithPasskey(returnURL string) (string, error) {
+	var opts webauthn.RequestOptions
+	err := post("/login/passkey/begin", nil, &opts)
+	if err != nil {
+		return "", err
+	}
+	var allow []js.M
+	for _, id := range opts.AllowCredentials {
+		allow = append(allow, js.M{"type": "public-key", "id": id})
+	}
+	cred, err := await(js.Global.Get("navigator").Get("credentials").Call("get", js.M{"publicKey": js.M{
+		"challenge":        opts.Challenge,
+		"rpId":             opts.RPID,
+		"allowCredentials": allow,
+		"userVerification": "required",
+		"timeout":          opts.TimeoutMillis,
+	}}))
+	if err != nil {
+		return "", err
+	}
+	response := cred.Get("response")
+	var resp struct{ ReturnURL string }
+	err = post("/login/passkey/finish", struct {
+		webauthn.AssertionResponse
+		ReturnURL string
+	}{
+		AssertionResponse: webauthn.AssertionResponse{
+			ID:                bytesOf(cred.Get("rawId")),
+			ClientDataJSON:    bytesOf(response.Get("clientDataJSON")),
+			AuthenticatorData: bytesOf(response.Get("authenticatorData")),
+			Signature:         bytesOf(response.Get("signature")),
+			UserHandle:        bytesOf(response.Get("userHandle")),
+		},
+		ReturnURL: returnURL,
+	}, &resp)
+	return resp.ReturnURL, err
+}
+
+// post makes a POST request to url with in as the JSON request body,
+// and decodes the JSON response body into out.
+func post(url string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		err := json.NewEncoder(&body).Encode(in)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := http.DefaultClient
+	cookies := &http.Request{Header: http.Header{"Cookie": {document.Cookie()}}}
+	if csrfToken, err := cookies.Cookie("csrfToken"); err == nil {
+		client = &http.Client{Transport: &homehttp.CSRFTransport{Token: csrfToken.Value}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("did not get acceptable status code: %v body: %q", resp.Status, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// await waits for promise to settle, and returns its value or reason.
+func await(promise *js.Object) (*js.Object, error) {
+	value, reason := make(chan *js.Object, 1), make(chan *js.Object, 1)
+	promise.Call("then",
+		func(v *js.Object) { value <- v },
+		func(r *js.Object) { reason <- r },
+	)
+	select {
+	case v := <-value:
+		if v == nil {
+			return nil, errors.New("no credential")
+		}
+		return v, nil
+	case r := <-reason:
+		return nil, errors.New(r.Call("toString").String())
+	}
+}
+
+// bytesOf returns the contents of ArrayBuffer buf, or nil if buf is null.
+func bytesOf(buf *js.Object) []byte {
+	if buf == nil || buf == js.Undefined {
+		return nil
+	}
+	return js.Global.Get("Uint8Array").New(buf).Interface().([]byte)
+}
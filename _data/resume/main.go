@@ -38,7 +38,7 @@ func main() {
 }
 
 func setup(ctx context.Context) {
-	reactionsService := homehttp.Reactions{}
+	reactionsService := homehttp.Reactions{HTTPClient: httpClient()}
 	usersService := homehttp.Users{}
 	authenticatedUser, err := usersService.GetAuthenticated(ctx)
 	if err != nil {
@@ -52,9 +52,14 @@ func setup(ctx context.Context) {
 		httpClient := httpClient()
 
 		notificationsService := httpclient.NewNotifications(httpClient, "", "")
+		var csrfToken string
+		cookies := &http.Request{Header: http.Header{"Cookie": {document.Cookie()}}}
+		if cookie, err := cookies.Cookie("csrfToken"); err == nil {
+			csrfToken = cookie.Value
+		}
 		returnURL := dom.GetWindow().Location().Pathname + dom.GetWindow().Location().Search
 		var buf bytes.Buffer
-		err = resume.RenderBodyInnerHTML(ctx, &buf, reactionsService, notificationsService, usersService, authenticatedUser, returnURL)
+		err = resume.RenderBodyInnerHTML(ctx, &buf, reactionsService, notificationsService, usersService, authenticatedUser, csrfToken, returnURL)
 		if err != nil {
 			log.Println(err)
 			return
@@ -68,12 +73,13 @@ func setup(ctx context.Context) {
 // httpClient gives an *http.Client for making API requests.
 func httpClient() *http.Client {
 	cookies := &http.Request{Header: http.Header{"Cookie": {document.Cookie()}}}
-	if accessToken, err := cookies.Cookie("accessToken"); err == nil {
-		// Authenticated client.
-		src := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: accessToken.Value},
-		)
-		return oauth2.NewClient(context.Background(), src)
+	if csrfToken, err := cookies.Cookie("csrfToken"); err == nil {
+		// Authenticated client. The session cookie is HttpOnly,
+		// so use it to get short-lived API tokens instead.
+		src := oauth2.ReuseTokenSource(nil, homehttp.TokenSource{CSRFToken: csrfToken.Value})
+		// Send CSRF token with state-changing requests.
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: &homehttp.CSRFTransport{Token: csrfToken.Value}})
+		return oauth2.NewClient(ctx, src)
 	}
 	// Not authenticated client.
 	return http.DefaultClient
@@ -62,6 +62,7 @@ func initAbout(notifications notifications.Service, users users.Service) {
 		header := component.Header{
 			CurrentUser:       authenticatedUser,
 			NotificationCount: nc,
+			CSRFToken:         csrfTokenFromContext(req),
 			ReturnURL:         returnURL,
 		}
 		err = htmlg.RenderComponents(w, header)
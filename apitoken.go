@@ -0,0 +1,110 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+)
+
+// apiTokenLifetime is how long a frontend API token is valid for.
+const apiTokenLifetime = time.Hour
+
+// apiToken is a short-lived access token that frontends use to make
+// API requests, since they can't read the HttpOnly session cookie.
+// It is only accepted via the Authorization header, is limited
+// to the frontend scope, and stops working when its session ends.
+type apiToken struct {
+	SessionID string
+	UserSpec  users.UserSpec
+	Expiry    time.Time
+}
+
+// apiTokens is the in-memory store of frontend API tokens.
+var apiTokens = apiTokenStore{tokens: make(map[string]apiToken)}
+
+type apiTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]apiToken // Access Token Digest -> API Token.
+}
+
+// Create creates a new API token for session s,
+// and returns the access token itself.
+func (ts *apiTokenStore) Create(s *session) (string, apiToken, error) {
+	accessToken := make([]byte, 32)
+	_, err := cryptorand.Read(accessToken)
+	if err != nil {
+		return "", apiToken{}, err
+	}
+	t := apiToken{
+		SessionID: s.ID,
+		UserSpec:  s.UserSpec,
+		Expiry:    time.Now().Add(apiTokenLifetime),
+	}
+	if s.Expiry.Before(t.Expiry) {
+		t.Expiry = s.Expiry
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	// Forget expired tokens, so they don't accumulate.
+	for digest, t := range ts.tokens {
+		if !time.Now().Before(t.Expiry) {
+			delete(ts.tokens, digest)
+		}
+	}
+	ts.tokens[tokenDigest(string(accessToken))] = t
+	return string(accessToken), t, nil
+}
+
+// lookUp returns the unexpired token that matches accessToken, if any,
+// as long as the session it was created for still exists.
+func (ts *apiTokenStore) lookUp(accessToken string) (apiToken, bool) {
+	digest := tokenDigest(accessToken)
+	ts.mu.Lock()
+	t, ok := ts.tokens[digest]
+	if ok && !time.Now().Before(t.Expiry) {
+		delete(ts.tokens, digest)
+		ok = false
+	}
+	ts.mu.Unlock()
+	if !ok {
+		return apiToken{}, false
+	}
+	global.mu.Lock()
+	_, ok = global.sessions[t.SessionID]
+	global.mu.Unlock()
+	return t, ok
+}
+
+// serveAPIToken creates a new API token for the session of the
+// frontend that POSTs to it, authenticated via the session cookie.
+func serveAPIToken(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return httperror.Method{Allowed: []string{http.MethodPost}}
+	}
+	// Authorization check. API tokens can only be created from a browser session.
+	s := req.Context().Value(sessionContextKey).(*session)
+	if s == nil || s.Scopes != nil {
+		return os.ErrPermission
+	}
+	accessToken, t, err := apiTokens.Create(s)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return httperror.JSONResponse{V: apiTokenResponse{
+		AccessToken: base64.RawURLEncoding.EncodeToString([]byte(accessToken)),
+		Expiry:      t.Expiry,
+	}}
+}
+
+// apiTokenResponse is the response of the /api/token endpoint.
+type apiTokenResponse struct {
+	AccessToken string // Base64-encoded access token, for use as a Bearer token.
+	Expiry      time.Time
+}
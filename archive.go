@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shurcooL/httperror"
+)
+
+// archiveFormat is a format of source archives.
+type archiveFormat struct {
+	Ext         string // File extension. E.g., ".tar.gz".
+	GitFormat   string // Format name for git archive. E.g., "tar.gz".
+	ContentType string
+}
+
+// archiveFormats are the supported formats of source archives.
+var archiveFormats = []archiveFormat{
+	{Ext: ".tar.gz", GitFormat: "tar.gz", ContentType: "application/gzip"},
+	{Ext: ".zip", GitFormat: "zip", ContentType: "application/zip"},
+}
+
+// gitArchiveTimeout is how long generating a source archive may take.
+const gitArchiveTimeout = 5 * time.Minute
+
+// archiveHandler serves source archives of a repository,
+// or of a single directory in it, at any branch, tag or commit.
+// The request path is "/{{.Ref}}{{.Ext}}", e.g., "/master.tar.gz" or "/v1.0.0.zip".
+type archiveHandler struct {
+	Repo repoInfo
+	Dir  string // Directory within repository, relative to repository root. E.g., "image/png". Empty means entire repository.
+	Name string // Base name of archive files and their top-level directory. E.g., "png".
+
+	cache *archiveCache
+}
+
+func (h *archiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return httperror.Method{Allowed: []string{http.MethodGet, http.MethodHead}}
+	}
+	ref, format, ok := parseArchivePath(req.URL.Path)
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), gitArchiveTimeout)
+	defer cancel()
+	commitHash, err := resolveArchiveRef(ctx, h.Repo.Dir, ref)
+	if err != nil {
+		return err
+	}
+	name := h.Name + "-" + commitHash[:12]
+	key := path.Join(h.Repo.Spec, h.Dir, commitHash+format.Ext)
+	f, err := h.cache.Open(key, func(dst string) error {
+		treeish := commitHash
+		if h.Dir != "" {
+			treeish += ":" + h.Dir
+		}
+		_, err := gitOutput(ctx, h.Repo.Dir, nil, "archive", "--format="+format.GitFormat, "--prefix="+name+"/", "--output="+dst, treeish)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+format.Ext))
+	w.Header().Set("ETag", fmt.Sprintf(`"%s%s"`, commitHash, format.Ext))
+	if ref == commitHash {
+		// Archives of a commit never change.
+		setImmutableCacheControl(w, h.Repo.Spec)
+	}
+	http.ServeContent(w, req, "", fi.ModTime(), f)
+	return nil
+}
+
+// parseArchivePath parses an archive request path like "/v1.0.0.tar.gz"
+// into the ref and the archive format.
+func parseArchivePath(p string) (ref string, _ archiveFormat, ok bool) {
+	for _, format := range archiveFormats {
+		if !strings.HasSuffix(p, format.Ext) {
+			continue
+		}
+		ref = strings.TrimPrefix(p[:len(p)-len(format.Ext)], "/")
+		return ref, format, ref != ""
+	}
+	return "", archiveFormat{}, false
+}
+
+// resolveArchiveRef resolves ref, which is a branch, a tag or
+// a full commit hash, to a commit hash in the repository at dir.
+// It returns os.ErrNotExist if there's no such branch, tag or commit.
+func resolveArchiveRef(ctx context.Context, dir, ref string) (commitHash string, _ error) {
+	var candidates []string
+	if _, err := verifyCommitHash(ref); err == nil {
+		candidates = []string{ref}
+	} else {
+		// Only allow plain branch and tag names, not arbitrary revision expressions.
+		if strings.HasPrefix(ref, "-") || strings.HasPrefix(ref, "/") || strings.Contains(ref, "..") || strings.ContainsAny(ref, "~^:@{}\\ ") {
+			return "", os.ErrNotExist
+		}
+		candidates = []string{"refs/heads/" + ref, "refs/tags/" + ref}
+	}
+	for _, rev := range candidates {
+		out, err := gitOutput(ctx, dir, nil, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+		if err != nil {
+			continue
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return "", os.ErrNotExist
+}
+
+// archiveCacheMaxSize is the total size of archives to keep cached, in bytes.
+// When it's exceeded, the least recently used archives are removed.
+const archiveCacheMaxSize = 1 << 30
+
+// archiveCache is an on-disk cache of source archives.
+// Archives of a given commit never change, so they're keyed by commit hash.
+type archiveCache struct {
+	dir string
+}
+
+// newArchiveCache creates an archive cache in a new temporary directory.
+// Archives are cheap to regenerate, so they don't need to outlive the process.
+func newArchiveCache() (*archiveCache, error) {
+	dir, err := ioutil.TempDir("", "home-archives-")
+	if err != nil {
+		return nil, err
+	}
+	return &archiveCache{dir: dir}, nil
+}
+
+// Open opens the cached archive with key. If it's not cached yet,
+// generate is called to write the archive to the file dst first.
+func (c *archiveCache) Open(key string, generate func(dst string) error) (*os.File, error) {
+	name := filepath.Join(c.dir, filepath.FromSlash(key))
+	f, err := os.Open(name)
+	if err == nil {
+		now := time.Now()
+		os.Chtimes(name, now, now) // Mark as recently used.
+		return f, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), 0700)
+	if err != nil {
+		return nil, err
+	}
+	// Generate into a temporary file, so that concurrent requests
+	// never see a partially written archive.
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	err = generate(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	f, err = os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	c.evict() // Evicting the archive just opened is okay, it stays readable via f.
+	return f, nil
+}
+
+// evict removes the least recently used archives
+// until their total size is at most archiveCacheMaxSize.
+func (c *archiveCache) evict() {
+	type entry struct {
+		path string
+		fi   os.FileInfo
+	}
+	var (
+		entries []entry
+		total   int64
+	)
+	filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// E.g., a temporary file was renamed concurrently. Skip it.
+			return nil
+		}
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".tmp-") {
+			entries = append(entries, entry{path, fi})
+			total += fi.Size()
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].fi.ModTime().Before(entries[j].fi.ModTime()) })
+	for _, e := range entries {
+		if total <= archiveCacheMaxSize {
+			break
+		}
+		err := os.Remove(e.path)
+		if err != nil {
+			log.Println("archiveCache.evict:", err)
+			continue
+		}
+		total -= e.fi.Size()
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Test that source archives of a repository and of a directory in it
+// are served for branches, tags and commits.
+func TestArchiveHandler(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-archive-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	git := testGit(t, tempDir)
+
+	repoDir := filepath.Join(tempDir, "repo.git")
+	workDir := filepath.Join(tempDir, "work")
+	for _, dir := range []string{repoDir, filepath.Join(workDir, "image", "png")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(repoDir, "init", "--bare")
+	git(workDir, "init")
+	for name, contents := range map[string]string{
+		"README.md":          "Hello.\n",
+		"image/png/png.go":   "package png\n",
+		"image/png/LICENSE":  "MIT\n",
+		"image/png/.gitkeep": "",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(workDir, filepath.FromSlash(name)), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(workDir, "add", ".")
+	git(workDir, "commit", "-m", "Initial commit.")
+	git(workDir, "tag", "-a", "-m", "Release.", "v1.0.0")
+	head := git(workDir, "rev-parse", "HEAD")
+	git(workDir, "push", repoDir, "HEAD:refs/heads/master", "v1.0.0")
+
+	cache, err := newArchiveCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache.dir)
+	repo := repoInfo{Spec: "dmitri.shuralyov.com/scratch", Path: "/scratch", Dir: repoDir}
+
+	for _, tc := range []struct {
+		dir, name string
+		path      string
+		wantFiles []string
+	}{
+		{
+			name: "scratch", path: "/master.tar.gz",
+			wantFiles: []string{"scratch-" + head[:12] + "/README.md", "scratch-" + head[:12] + "/image/png/.gitkeep", "scratch-" + head[:12] + "/image/png/LICENSE", "scratch-" + head[:12] + "/image/png/png.go"},
+		},
+		{
+			dir: "image/png", name: "png", path: "/v1.0.0.zip",
+			wantFiles: []string{"png-" + head[:12] + "/.gitkeep", "png-" + head[:12] + "/LICENSE", "png-" + head[:12] + "/png.go"},
+		},
+		{
+			dir: "image/png", name: "png", path: "/" + head + ".tar.gz",
+			wantFiles: []string{"png-" + head[:12] + "/.gitkeep", "png-" + head[:12] + "/LICENSE", "png-" + head[:12] + "/png.go"},
+		},
+	} {
+		h := &archiveHandler{Repo: repo, Dir: tc.dir, Name: tc.name, cache: cache}
+		// Request each archive twice, the second time it should come from the cache.
+		for i := 0; i < 2; i++ {
+			rr := httptest.NewRecorder()
+			err := h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if err != nil {
+				t.Fatalf("%s: %v", tc.path, err)
+			}
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s: got status %d, want %d", tc.path, rr.Code, http.StatusOK)
+			}
+			files, err := archiveFiles(rr.Body.Bytes(), strings.HasSuffix(tc.path, ".zip"))
+			if err != nil {
+				t.Fatalf("%s: %v", tc.path, err)
+			}
+			if !reflect.DeepEqual(files, tc.wantFiles) {
+				t.Errorf("%s: got files %q, want %q", tc.path, files, tc.wantFiles)
+			}
+		}
+	}
+
+	for _, path := range []string{"/nope.zip", "/master~1.zip", "/--output=x.zip", "/master.rar", "/.zip"} {
+		h := &archiveHandler{Repo: repo, Name: "scratch", cache: cache}
+		err := h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: got error %v, want not exist", path, err)
+		}
+	}
+}
+
+// archiveFiles returns the sorted names of regular files in a zip or .tar.gz archive.
+func archiveFiles(archive []byte, isZip bool) ([]string, error) {
+	var files []string
+	if isZip {
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if !f.FileInfo().IsDir() {
+				files = append(files, f.Name)
+			}
+		}
+	} else {
+		gr, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(gr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				files = append(files, hdr.Name)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
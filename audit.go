@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// auditAction is a kind of security-relevant action.
+type auditAction string
+
+const (
+	auditLogin            auditAction = "login"              // User signed in.
+	auditLoginFailed      auditAction = "login-failed"       // Sign in attempt failed.
+	auditLogout           auditAction = "logout"             // User signed out.
+	auditSessionRevoke    auditAction = "session-revoke"     // User revoked one or all of own sessions.
+	auditTokenCreate      auditAction = "token-create"       // User created a personal access token.
+	auditTokenRevoke      auditAction = "token-revoke"       // User revoked a personal access token.
+	auditPasskeyAdd       auditAction = "passkey-add"        // User registered a passkey.
+	auditPasskeyRemove    auditAction = "passkey-remove"     // User removed a passkey.
+	auditSSHKeyAdd        auditAction = "ssh-key-add"        // User added an SSH public key.
+	auditSSHKeyRemove     auditAction = "ssh-key-remove"     // User removed an SSH public key.
+	auditTOTPEnable       auditAction = "totp-enable"        // User enabled two-factor authentication.
+	auditTOTPDisable      auditAction = "totp-disable"       // User disabled two-factor authentication.
+	auditStepUp           auditAction = "step-up"            // User confirmed an admin operation with a second factor.
+	auditStepUpFailed     auditAction = "step-up-failed"     // User gave a bad second factor code.
+	auditGitAuthFailed    auditAction = "git-auth-failed"    // Git client sent bad Basic Auth credentials.
+	auditGitPush          auditAction = "git-push"           // User pushed to a repository.
+	auditLockout          auditAction = "auth-lockout"       // Client was locked out after too many failed authentication attempts.
+	auditUnblock          auditAction = "unblock"            // Admin lifted a lockout.
+	auditRoleGrant        auditAction = "role-grant"         // Admin granted a role.
+	auditRoleRevoke       auditAction = "role-revoke"        // Admin revoked a role.
+	auditPushPolicySet    auditAction = "push-policy-set"    // Admin set a push policy.
+	auditPushPolicyRemove auditAction = "push-policy-remove" // Admin removed a push policy.
+	auditPushMirrorAdd    auditAction = "push-mirror-add"    // Admin added a push mirror.
+	auditPushMirrorRemove auditAction = "push-mirror-remove" // Admin removed a push mirror.
+	auditPullMirrorAdd    auditAction = "pull-mirror-add"    // Admin created a pull mirror.
+	auditPullMirrorRemove auditAction = "pull-mirror-remove" // Admin stopped a pull mirror.
+	auditRepoCreate       auditAction = "repo-create"        // Admin created a repository.
+	auditRepoRename       auditAction = "repo-rename"        // Admin renamed a repository.
+	auditRepoDelete       auditAction = "repo-delete"        // Admin deleted a repository.
+	auditRepoVisibility   auditAction = "repo-visibility"    // Admin changed the visibility of a repository.
+	auditAdminView        auditAction = "admin-view"         // Admin viewed an admin page.
+)
+
+// auditActions are all known actions, in display order.
+var auditActions = []auditAction{
+	auditLogin, auditLoginFailed, auditLogout, auditSessionRevoke,
+	auditTokenCreate, auditTokenRevoke,
+	auditPasskeyAdd, auditPasskeyRemove,
+	auditSSHKeyAdd, auditSSHKeyRemove,
+	auditTOTPEnable, auditTOTPDisable, auditStepUp, auditStepUpFailed,
+	auditGitAuthFailed, auditGitPush,
+	auditLockout, auditUnblock,
+	auditRoleGrant, auditRoleRevoke, auditPushPolicySet, auditPushPolicyRemove,
+	auditPushMirrorAdd, auditPushMirrorRemove, auditPullMirrorAdd, auditPullMirrorRemove,
+	auditRepoCreate, auditRepoRename, auditRepoDelete, auditRepoVisibility, auditAdminView,
+}
+
+// auditEntry is an entry in the audit log.
+type auditEntry struct {
+	Time       time.Time
+	Action     auditAction
+	Actor      users.UserSpec // Zero value if unauthenticated.
+	RemoteAddr string
+	UserAgent  string
+	Target     string // What the action was performed on. E.g., "dmitri.shuralyov.com/kebabcase".
+	Details    string `json:",omitempty"`
+}
+
+// auditLog is the security audit log.
+var auditLog auditStore
+
+// auditStore is an append-only store of audit log entries.
+// Entries are stored as JSON lines, one file per UTC day.
+type auditStore struct {
+	mu sync.Mutex
+
+	// store is where entries are persisted. If nil, entries are only logged to stdout.
+	store webdav.FileSystem
+}
+
+// SetStore sets root as the audit log store.
+func (as *auditStore) SetStore(root webdav.FileSystem) {
+	as.mu.Lock()
+	as.store = root
+	as.mu.Unlock()
+}
+
+// Record records an action performed by actor on target during req.
+// Errors are logged rather than returned, so that a broken audit log
+// doesn't take down the site.
+func (as *auditStore) Record(req *http.Request, action auditAction, actor users.UserSpec, target, details string) {
+	as.RecordClient(req.Context(), httpAuditClient(req), action, actor, target, details)
+}
+
+// RecordClient is like Record, but for an action performed by client
+// outside of an HTTP request, such as over SSH.
+func (as *auditStore) RecordClient(ctx context.Context, client auditClient, action auditAction, actor users.UserSpec, target, details string) {
+	e := auditEntry{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		Actor:      actor,
+		RemoteAddr: client.RemoteAddr,
+		UserAgent:  client.UserAgent,
+		Target:     target,
+		Details:    details,
+	}
+	err := as.append(ctx, e)
+	if err != nil {
+		log.Printf("auditStore.Record: %v: %+v\n", err, e)
+	}
+}
+
+// auditClient identifies the client that performed an action.
+type auditClient struct {
+	RemoteAddr string // IP address.
+	UserAgent  string // User agent, or SSH client version.
+}
+
+// httpAuditClient returns the client that sent req.
+func httpAuditClient(req *http.Request) auditClient {
+	return auditClient{RemoteAddr: remoteIP(req), UserAgent: req.UserAgent()}
+}
+
+func (as *auditStore) append(ctx context.Context, e auditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.store == nil {
+		log.Printf("audit: %s", line)
+		return nil
+	}
+	f, err := as.store.OpenFile(ctx, auditPath(e.Time), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = f.Write(line)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// auditPath returns the path of the file that stores entries recorded at t.
+func auditPath(t time.Time) string {
+	return "/" + t.UTC().Format("2006-01-02") + ".jsonl"
+}
+
+// auditFilter selects audit log entries. Zero value fields match all entries.
+type auditFilter struct {
+	Action auditAction
+	Actor  users.UserSpec
+	Target string // Substring of target.
+	Limit  int    // Maximum number of entries. Zero means no limit.
+}
+
+func (f auditFilter) match(e auditEntry) bool {
+	return (f.Action == "" || e.Action == f.Action) &&
+		(f.Actor == users.UserSpec{} || e.Actor == f.Actor) &&
+		strings.Contains(e.Target, f.Target)
+}
+
+// List lists audit log entries that match filter, newest first.
+func (as *auditStore) List(ctx context.Context, filter auditFilter) ([]auditEntry, error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.store == nil {
+		return nil, nil
+	}
+	dir, err := as.store.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".jsonl") {
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names))) // Newest day first.
+
+	var entries []auditEntry
+	for _, name := range names {
+		day, err := as.readFile(ctx, "/"+name)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(day) - 1; i >= 0; i-- {
+			if !filter.match(day[i]) {
+				continue
+			}
+			entries = append(entries, day[i])
+			if filter.Limit != 0 && len(entries) == filter.Limit {
+				return entries, nil
+			}
+		}
+	}
+	return entries, nil
+}
+
+// readFile reads all entries in the file at path, oldest first.
+func (as *auditStore) readFile(ctx context.Context, path string) ([]auditEntry, error) {
+	f, err := as.store.OpenFile(ctx, path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []auditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e auditEntry
+		err := json.Unmarshal(sc.Bytes(), &e)
+		if err != nil {
+			log.Printf("auditStore.readFile: skipping bad entry in %q: %v\n", path, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// serveAudit serves the audit log admin page.
+// If the format query parameter is "json", entries are exported as JSON.
+func (h *sessionsHandler) serveAudit(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. The audit log can only be viewed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return nil, err
+	}
+
+	q := req.URL.Query()
+	filter := auditFilter{
+		Action: auditAction(q.Get("action")),
+		Target: q.Get("target"),
+		Limit:  100,
+	}
+	if user := q.Get("user"); user != "" {
+		var err error
+		filter.Actor, err = parseUserSpec(user)
+		if err != nil {
+			return nil, httperror.BadRequest{Err: err}
+		}
+	}
+	if limit := q.Get("limit"); limit != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 0 {
+			return nil, httperror.BadRequest{Err: fmt.Errorf("bad limit %q", limit)}
+		}
+	}
+	entries, err := auditLog.List(req.Context(), filter)
+	if err != nil {
+		return nil, err
+	}
+	auditLog.Record(req, auditAdminView, s.UserSpec, req.URL.Path, req.URL.RawQuery)
+	if q.Get("format") == "json" {
+		return nil, httperror.JSONResponse{V: entries}
+	}
+
+	nodes := []*html.Node{htmlg.H3(htmlg.Text("Audit log")), auditFilterForm(q)}
+	for _, e := range entries {
+		actor := "-"
+		if e.Actor != (users.UserSpec{}) {
+			actor = formatUserSpec(e.Actor)
+			if user, err := h.users.Get(req.Context(), e.Actor); err == nil {
+				actor = user.Login + " (" + actor + ")"
+			}
+		}
+		text := fmt.Sprintf("%v %s actor: %s IP: %q user agent: %q target: %q", e.Time.Format(time.RFC3339), e.Action, actor, e.RemoteAddr, e.UserAgent, e.Target)
+		if e.Details != "" {
+			text += fmt.Sprintf(" details: %q", e.Details)
+		}
+		nodes = append(nodes, htmlg.Div(htmlg.Text(text)))
+	}
+	if len(entries) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No matching entries.")),
+		)
+	}
+	q.Set("format", "json")
+	nodes = append(nodes, htmlg.Div(htmlg.A("Export as JSON", "/admin/audit?"+q.Encode())))
+	return nodes, nil
+}
+
+// auditFilterForm renders a form for filtering the audit log,
+// populated with the current filter q.
+func auditFilterForm(q url.Values) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "get"},
+			{Key: atom.Action.String(), Val: "/admin/audit"},
+			{Key: atom.Style.String(), Val: `margin-bottom: 20px;`},
+		},
+	}
+	action := &html.Node{
+		Type: html.ElementNode, Data: atom.Select.String(),
+		Attr: []html.Attribute{{Key: atom.Name.String(), Val: "action"}},
+	}
+	for _, a := range append([]auditAction{""}, auditActions...) {
+		option := &html.Node{
+			Type: html.ElementNode, Data: atom.Option.String(),
+			Attr: []html.Attribute{{Key: atom.Value.String(), Val: string(a)}},
+		}
+		if string(a) == q.Get("action") {
+			option.Attr = append(option.Attr, html.Attribute{Key: atom.Selected.String()})
+		}
+		title := string(a)
+		if a == "" {
+			title = "(all actions)"
+		}
+		option.AppendChild(htmlg.Text(title))
+		action.AppendChild(option)
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Action: "), action))
+	form.AppendChild(htmlg.Div(htmlg.Text("User (e.g., 1924134@github.com): "), textInput("user", q.Get("user"))))
+	form.AppendChild(htmlg.Div(htmlg.Text("Target contains: "), textInput("target", q.Get("target"))))
+	form.AppendChild(htmlg.Div(&html.Node{
+		Type: html.ElementNode, Data: atom.Input.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "submit"},
+			{Key: atom.Value.String(), Val: "Filter"},
+		},
+	}))
+	return form
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+func TestAuditStore(t *testing.T) {
+	var (
+		alice = users.UserSpec{ID: 1, Domain: "example.com"}
+		bob   = users.UserSpec{ID: 2, Domain: "example.com"}
+	)
+	req := httptest.NewRequest("POST", "/logout", nil)
+
+	var as auditStore
+	as.SetStore(webdav.NewMemFS())
+	as.Record(req, auditLogin, alice, "github", "")
+	as.Record(req, auditLogin, bob, "github", "")
+	as.Record(req, auditGitPush, alice, "example.com/repo", "refs/heads/master")
+	as.Record(req, auditLogout, alice, "", "")
+
+	tests := []struct {
+		filter auditFilter
+		want   []auditAction
+	}{
+		{auditFilter{}, []auditAction{auditLogout, auditGitPush, auditLogin, auditLogin}},
+		{auditFilter{Limit: 2}, []auditAction{auditLogout, auditGitPush}},
+		{auditFilter{Action: auditLogin}, []auditAction{auditLogin, auditLogin}},
+		{auditFilter{Actor: alice}, []auditAction{auditLogout, auditGitPush, auditLogin}},
+		{auditFilter{Target: "example.com/"}, []auditAction{auditGitPush}},
+	}
+	for _, tc := range tests {
+		entries, err := as.List(context.Background(), tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []auditAction
+		for _, e := range entries {
+			got = append(got, e.Action)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("List(%+v): got %v, want %v", tc.filter, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("List(%+v): got %v, want %v", tc.filter, got, tc.want)
+				break
+			}
+		}
+	}
+}
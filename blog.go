@@ -6,7 +6,6 @@ import (
 	"html/template"
 	"io"
 	"net/http"
-	"os"
 	"strconv"
 
 	"github.com/shurcooL/home/component"
@@ -18,6 +17,8 @@ import (
 	"github.com/shurcooL/issuesapp"
 	"github.com/shurcooL/notifications"
 	"github.com/shurcooL/users"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 var blogHTML = template.Must(template.New("").Parse(`<html>
@@ -109,12 +110,8 @@ func initBlog(mux *http.ServeMux, issuesService issues.Service, blog issues.Repo
 	.markdown-body { font-family: Go; }
 	tt, code, pre  { font-family: "Go Mono"; }
 </style>`,
-		BodyPre: `{{/* Override create issue button to only show up for shurcooL as New Blog Post button. */}}
-{{define "create-issue"}}
-	{{if and (eq .CurrentUser.ID 1924134) (eq .CurrentUser.Domain "github.com")}}
-		<div style="text-align: right;"><button class="btn btn-success btn-small" onclick="window.location = '{{.BaseURI}}/new';">New Blog Post</button></div>
-	{{end}}
-{{end}}
+		BodyPre: `{{/* Override create issue button. A New Blog Post button is included in BodyTop instead, for pushers of the blog. */}}
+{{define "create-issue"}}{{end}}
 
 {{define "issue"}}
 	{{if .ForceIssuesApp}}
@@ -157,6 +154,7 @@ func initBlog(mux *http.ServeMux, issuesService issues.Service, blog issues.Repo
 		header := component.Header{
 			CurrentUser:       authenticatedUser,
 			NotificationCount: nc,
+			CSRFToken:         csrfTokenFromContext(req),
 			ReturnURL:         returnURL,
 		}
 
@@ -181,7 +179,11 @@ func initBlog(mux *http.ServeMux, issuesService issues.Service, blog issues.Repo
 			return []htmlg.Component{header, post}, nil
 		}
 
-		// If this is not an issue page, that's okay, only include the header.
+		// If this is not an issue page, that's okay, only include the header,
+		// and a New Blog Post button on the list page for pushers of the blog.
+		if req.URL.Path == "/" && policy.Allowed(authenticatedUser.UserSpec, blog.URI, rolePusher) {
+			return []htmlg.Component{header, newBlogPostButton{}}, nil
+		}
 		return []htmlg.Component{header}, nil
 	}
 	issuesApp := issuesapp.New(shurcoolBlogService, users, opt)
@@ -219,7 +221,8 @@ func initBlog(mux *http.ServeMux, issuesService issues.Service, blog issues.Repo
 				return err // THINK: Should it be a fatal error or not? What about on frontend vs backend?
 			}
 			returnURL := req.RequestURI
-			err = blogpkg.RenderBodyInnerHTML(req.Context(), w, issuesService, blog, notifications, authenticatedUser, returnURL)
+			canCreatePost := policy.Allowed(authenticatedUser.UserSpec, blog.URI, rolePusher)
+			err = blogpkg.RenderBodyInnerHTML(req.Context(), w, issuesService, blog, notifications, authenticatedUser, canCreatePost, csrfTokenFromContext(req), returnURL)
 			if err != nil {
 				return err
 			}
@@ -245,7 +248,7 @@ func initBlog(mux *http.ServeMux, issuesService issues.Service, blog issues.Repo
 // shurcoolBlogService skips first comment (the issue body), because we're
 // taking on responsibility to render it ourselves (unless forceIssuesApp
 // is set). It also limits an issues.Service's Create method to allow only
-// shurcooL to create new blog posts.
+// pushers of the blog to create new blog posts.
 type shurcoolBlogService struct {
 	issues.Service
 	users users.Service
@@ -263,13 +266,9 @@ func (s shurcoolBlogService) ListComments(ctx context.Context, repo issues.RepoS
 }
 
 func (s shurcoolBlogService) Create(ctx context.Context, repo issues.RepoSpec, issue issues.Issue) (issues.Issue, error) {
-	currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-	if err != nil {
+	if err := policy.Authorize(ctx, s.users, repo.URI, rolePusher); err != nil {
 		return issues.Issue{}, err
 	}
-	if currentUser != shurcool {
-		return issues.Issue{}, os.ErrPermission
-	}
 	return s.Service.Create(ctx, repo, issue)
 }
 
@@ -279,6 +278,26 @@ func (s shurcoolBlogService) ThreadType(repo issues.RepoSpec) string {
 	}).ThreadType(repo)
 }
 
+// newBlogPostButton is a New Blog Post button for the issuesapp list page.
+type newBlogPostButton struct{}
+
+func (newBlogPostButton) Render() []*html.Node {
+	button := &html.Node{
+		Type: html.ElementNode, Data: atom.Button.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Class.String(), Val: "btn btn-success btn-small"},
+			{Key: atom.Onclick.String(), Val: "window.location = '/blog/new';"},
+		},
+	}
+	button.AppendChild(htmlg.Text("New Blog Post"))
+	div := &html.Node{
+		Type: html.ElementNode, Data: atom.Div.String(),
+		Attr: []html.Attribute{{Key: atom.Style.String(), Val: "text-align: right;"}},
+	}
+	div.AppendChild(button)
+	return []*html.Node{div}
+}
+
 // forceIssuesAppContextKey is a context key. It can be used to check whether
 // issuesapp is being forced upon the blog. The associated value will be of type struct{}.
 // Eventually, a better solution should be found, and this removed.
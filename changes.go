@@ -139,6 +139,7 @@ func initChanges(mux *http.ServeMux, changeService change.Service, issueCounter
 		header := component.Header{
 			CurrentUser:       authenticatedUser,
 			NotificationCount: nc,
+			CSRFToken:         csrfTokenFromContext(req),
 			ReturnURL:         returnURL,
 		}
 
@@ -276,11 +277,12 @@ func initChanges(mux *http.ServeMux, changeService change.Service, issueCounter
 		if len(elems) < 2 || elems[0] == "" || elems[1] == "" {
 			return os.ErrNotExist
 		}
+		specURL := "github.com/" + elems[0] + "/" + elems[1]
 		currentUser, err := users.GetAuthenticatedSpec(req.Context())
 		if err != nil {
 			return err
 		}
-		if currentUser != shurcool {
+		if !policy.Allowed(currentUser, specURL, roleTriager) {
 			// Redirect to GitHub.
 			switch len(elems) {
 			case 2:
@@ -289,7 +291,6 @@ func initChanges(mux *http.ServeMux, changeService change.Service, issueCounter
 				return httperror.Redirect{URL: "https://github.com/" + elems[0] + "/" + elems[1] + "/pull/" + elems[2]}
 			}
 		}
-		specURL := "github.com/" + elems[0] + "/" + elems[1]
 		baseURL := "/changes/" + specURL
 
 		prefixLen := len(baseURL)
@@ -318,11 +319,12 @@ func initChanges(mux *http.ServeMux, changeService change.Service, issueCounter
 		if len(elems) < 1 || elems[0] == "" {
 			return os.ErrNotExist
 		}
+		specURL := "go.googlesource.com/" + elems[0]
 		currentUser, err := users.GetAuthenticatedSpec(req.Context())
 		if err != nil {
 			return err
 		}
-		if currentUser != shurcool {
+		if !policy.Allowed(currentUser, specURL, roleTriager) {
 			// Redirect to Gerrit.
 			switch len(elems) {
 			case 1:
@@ -331,7 +333,6 @@ func initChanges(mux *http.ServeMux, changeService change.Service, issueCounter
 				return httperror.Redirect{URL: fmt.Sprintf("https://go-review.googlesource.com/c/%s/+/%s", elems[0], elems[1])}
 			}
 		}
-		specURL := "go.googlesource.com/" + elems[0]
 		baseURL := "/changes/" + specURL
 
 		prefixLen := len(baseURL)
@@ -399,8 +400,8 @@ func (h changesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) erro
 	return err
 }
 
-// shurcoolSeesOwnChanges lets shurcooL see own changes on GitHub and Gerrit,
-// in addition to local ones.
+// shurcoolSeesOwnChanges lets shurcooL, and others who are triagers
+// of the repository, see changes on GitHub and Gerrit in addition to local ones.
 type shurcoolSeesOwnChanges struct {
 	service              change.Service
 	shurcoolGitHubChange change.Service
@@ -411,22 +412,14 @@ type shurcoolSeesOwnChanges struct {
 func (s shurcoolSeesOwnChanges) List(ctx context.Context, repo string, opt change.ListOptions) ([]change.Change, error) {
 	switch {
 	case strings.HasPrefix(repo, "github.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGitHubChange.List(ctx, repo, opt)
 	case strings.HasPrefix(repo, "go.googlesource.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGerritChange.List(ctx, repo, opt)
 	}
 
@@ -436,31 +429,23 @@ func (s shurcoolSeesOwnChanges) List(ctx context.Context, repo string, opt chang
 func (s shurcoolSeesOwnChanges) Count(ctx context.Context, repo string, opt change.ListOptions) (uint64, error) {
 	switch {
 	case strings.HasPrefix(repo, "github.com/"):
-		shurcoolRequired := true
+		authorizationRequired := true
 		if repo == "github.com/shurcooL/issuesapp" || repo == "github.com/shurcooL/notificationsapp" {
 			// Let everyone count changes in the gh+ds hybrid packages
 			// using the shurcooL-authenticated GitHub change service.
 			// This is needed to show the number of open changes in the tabnav.
-			shurcoolRequired = false
+			authorizationRequired = false
 		}
-		if shurcoolRequired {
-			currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-			if err != nil {
+		if authorizationRequired {
+			if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 				return 0, err
 			}
-			if currentUser != shurcool {
-				return 0, os.ErrPermission
-			}
 		}
 		return s.shurcoolGitHubChange.Count(ctx, repo, opt)
 	case strings.HasPrefix(repo, "go.googlesource.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return 0, err
 		}
-		if currentUser != shurcool {
-			return 0, os.ErrPermission
-		}
 		return s.shurcoolGerritChange.Count(ctx, repo, opt)
 	}
 
@@ -470,22 +455,14 @@ func (s shurcoolSeesOwnChanges) Count(ctx context.Context, repo string, opt chan
 func (s shurcoolSeesOwnChanges) Get(ctx context.Context, repo string, id uint64) (change.Change, error) {
 	switch {
 	case strings.HasPrefix(repo, "github.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return change.Change{}, err
 		}
-		if currentUser != shurcool {
-			return change.Change{}, os.ErrPermission
-		}
 		return s.shurcoolGitHubChange.Get(ctx, repo, id)
 	case strings.HasPrefix(repo, "go.googlesource.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return change.Change{}, err
 		}
-		if currentUser != shurcool {
-			return change.Change{}, os.ErrPermission
-		}
 		return s.shurcoolGerritChange.Get(ctx, repo, id)
 	}
 
@@ -495,22 +472,14 @@ func (s shurcoolSeesOwnChanges) Get(ctx context.Context, repo string, id uint64)
 func (s shurcoolSeesOwnChanges) ListTimeline(ctx context.Context, repo string, id uint64, opt *change.ListTimelineOptions) ([]interface{}, error) {
 	switch {
 	case strings.HasPrefix(repo, "github.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGitHubChange.ListTimeline(ctx, repo, id, opt)
 	case strings.HasPrefix(repo, "go.googlesource.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGerritChange.ListTimeline(ctx, repo, id, opt)
 	}
 
@@ -520,22 +489,14 @@ func (s shurcoolSeesOwnChanges) ListTimeline(ctx context.Context, repo string, i
 func (s shurcoolSeesOwnChanges) ListCommits(ctx context.Context, repo string, id uint64) ([]change.Commit, error) {
 	switch {
 	case strings.HasPrefix(repo, "github.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGitHubChange.ListCommits(ctx, repo, id)
 	case strings.HasPrefix(repo, "go.googlesource.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGerritChange.ListCommits(ctx, repo, id)
 	}
 
@@ -545,22 +506,14 @@ func (s shurcoolSeesOwnChanges) ListCommits(ctx context.Context, repo string, id
 func (s shurcoolSeesOwnChanges) GetDiff(ctx context.Context, repo string, id uint64, opt *change.GetDiffOptions) ([]byte, error) {
 	switch {
 	case strings.HasPrefix(repo, "github.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGitHubChange.GetDiff(ctx, repo, id, opt)
 	case strings.HasPrefix(repo, "go.googlesource.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGerritChange.GetDiff(ctx, repo, id, opt)
 	}
 
@@ -570,22 +523,14 @@ func (s shurcoolSeesOwnChanges) GetDiff(ctx context.Context, repo string, id uin
 func (s shurcoolSeesOwnChanges) EditComment(ctx context.Context, repo string, id uint64, cr change.CommentRequest) (change.Comment, error) {
 	switch {
 	case strings.HasPrefix(repo, "github.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return change.Comment{}, err
 		}
-		if currentUser != shurcool {
-			return change.Comment{}, os.ErrPermission
-		}
 		return s.shurcoolGitHubChange.EditComment(ctx, repo, id, cr)
 	case strings.HasPrefix(repo, "go.googlesource.com/"):
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo, roleTriager); err != nil {
 			return change.Comment{}, err
 		}
-		if currentUser != shurcool {
-			return change.Comment{}, os.ErrPermission
-		}
 		return s.shurcoolGerritChange.EditComment(ctx, repo, id, cr)
 	}
 
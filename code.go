@@ -21,7 +21,7 @@ import (
 )
 
 type codeHandler struct {
-	code          code.Code
+	code          *code.Store
 	reposDir      string
 	issuesApp     http.Handler
 	changesApp    http.Handler
@@ -30,6 +30,7 @@ type codeHandler struct {
 	notifications notifications.Service
 	users         users.Service
 	gitUsers      map[string]users.User // Key is lower git author email.
+	archives      *archiveCache
 }
 
 func (h *codeHandler) ServeCodeMaybe(w http.ResponseWriter, req *http.Request) (ok bool) {
@@ -50,10 +51,15 @@ func (h *codeHandler) ServeCodeMaybe(w http.ResponseWriter, req *http.Request) (
 	}
 
 	// Look up code directory by import path.
-	d, ok := h.code.ByImportPath[importPath]
+	d, ok := h.code.Code().ByImportPath[importPath]
 	if !ok || !d.WithinRepo() || (wantRepoRoot && !d.IsRepoRoot()) {
 		return false
 	}
+	// Private repositories are treated as nonexistent by clients who can't read them,
+	// including go-import meta tag pages for the go command.
+	if !canReadViaRequest(w, req, h.users, d.RepoRoot) {
+		return false
+	}
 
 	repo := repoInfo{
 		Spec:     d.RepoRoot,
@@ -122,7 +128,7 @@ func (h *codeHandler) ServeCodeMaybe(w http.ResponseWriter, req *http.Request) (
 	case req.URL.Path == route.RepoIndex(repo.Path):
 		h := cookieAuth{httputil.ErrorHandler(h.users, (&repositoryHandler{
 			Repo:          repo,
-			code:          h.code,
+			code:          h.code.Code(),
 			issues:        h.issues,
 			change:        h.change,
 			notifications: h.notifications,
@@ -153,6 +159,25 @@ func (h *codeHandler) ServeCodeMaybe(w http.ResponseWriter, req *http.Request) (
 		}).ServeHTTP)}
 		h.ServeHTTP(w, req)
 		return true
+	case strings.HasPrefix(req.URL.Path, route.RepoArchive(repo.Path)+"/"):
+		req = stripPrefix(req, len(route.RepoArchive(repo.Path)))
+		h := cookieAuth{httputil.ErrorHandler(h.users, (&archiveHandler{
+			Repo:  repo,
+			Name:  path.Base(repo.Spec),
+			cache: h.archives,
+		}).ServeHTTP)}
+		h.ServeHTTP(w, req)
+		return true
+	case strings.HasPrefix(req.URL.Path, route.PkgArchive(pkgPath)+"/"):
+		req = stripPrefix(req, len(route.PkgArchive(pkgPath)))
+		h := cookieAuth{httputil.ErrorHandler(h.users, (&archiveHandler{
+			Repo:  repo,
+			Dir:   strings.TrimPrefix(d.ImportPath[len(d.RepoRoot):], "/"),
+			Name:  path.Base(d.ImportPath),
+			cache: h.archives,
+		}).ServeHTTP)}
+		h.ServeHTTP(w, req)
+		return true
 	case req.URL.Path == route.RepoIssues(repo.Path) ||
 		strings.HasPrefix(req.URL.Path, route.RepoIssues(repo.Path)+"/"):
 
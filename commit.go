@@ -148,6 +148,7 @@ func (h *commitHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) erro
 	header := homecomponent.Header{
 		CurrentUser:       authenticatedUser,
 		NotificationCount: nc,
+		CSRFToken:         csrfTokenFromContext(req),
 		ReturnURL:         req.RequestURI,
 	}
 	err = htmlg.RenderComponents(w, header)
@@ -106,6 +106,7 @@ func (h *commitsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) err
 	header := homecomponent.Header{
 		CurrentUser:       authenticatedUser,
 		NotificationCount: nc,
+		CSRFToken:         csrfTokenFromContext(req),
 		ReturnURL:         req.RequestURI,
 	}
 	err = htmlg.RenderComponents(w, header)
@@ -11,6 +11,10 @@ type PostButton struct {
 	Action    string
 	Text      string
 	ReturnURL string
+
+	// CSRFToken is submitted along with the form, if not empty.
+	// It's needed for actions that require the user to be signed in.
+	CSRFToken string
 }
 
 func (b PostButton) Render() []*html.Node {
@@ -19,6 +23,7 @@ func (b PostButton) Render() []*html.Node {
 		<form method="post" action="{{.Action}}" style="display: inline-block; margin-bottom: 0;">
 			<input type="submit" value="{{.Text}}" style=...>
 			<input type="hidden" name="return" value="{{.ReturnURL}}">
+			{{if .CSRFToken}}<input type="hidden" name="csrf" value="{{.CSRFToken}}">{{end}}
 		</form>
 	*/
 	form := &html.Node{
@@ -53,6 +58,16 @@ box-shadow: 0 1px 1px rgba(0, 0, 0, .05);`},
 			{Key: atom.Value.String(), Val: b.ReturnURL},
 		},
 	})
+	if b.CSRFToken != "" {
+		form.AppendChild(&html.Node{
+			Type: html.ElementNode, Data: atom.Input.String(),
+			Attr: []html.Attribute{
+				{Key: atom.Type.String(), Val: "hidden"},
+				{Key: atom.Name.String(), Val: "csrf"},
+				{Key: atom.Value.String(), Val: b.CSRFToken},
+			},
+		})
+	}
 	return []*html.Node{form}
 }
 
@@ -14,6 +14,7 @@ import (
 type Header struct {
 	CurrentUser       users.User
 	NotificationCount uint64 // Only needed if CurrentUser.ID != 0.
+	CSRFToken         string // CSRF token for the sign out button. Only needed if CurrentUser.ID != 0.
 	ReturnURL         string
 }
 
@@ -41,7 +42,7 @@ func (h Header) Render() []*html.Node {
 				<a class="topbar-avatar" href="{{h.CurrentUser.HTMLURL}}">
 					<img class="topbar-avatar" src="{{h.CurrentUser.AvatarURL}}" title="Signed in as {{h.CurrentUser.Login}}.">
 				</a>
-				PostButton{Action: "/logout", Text: "Sign out", ReturnURL: h.ReturnURL}
+				PostButton{Action: "/logout", Text: "Sign out", ReturnURL: h.ReturnURL, CSRFToken: h.CSRFToken}
 			{{else}}
 				PostButton{Action: "/login/github", Text: "Sign in via GitHub", ReturnURL: h.ReturnURL}
 			{{end}}
@@ -140,7 +141,7 @@ vertical-align: top;`},
 			userSpan.AppendChild(a)
 		}
 
-		signOut := PostButton{Action: "/logout", Text: "Sign out", ReturnURL: h.ReturnURL}
+		signOut := PostButton{Action: "/logout", Text: "Sign out", ReturnURL: h.ReturnURL, CSRFToken: h.CSRFToken}
 		htmlg.AppendChildren(userSpan, signOut.Render()...)
 	} else {
 		signInViaGitHub := PostButton{Action: "/login/github", Text: "Sign in via GitHub", ReturnURL: h.ReturnURL}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/shurcooL/home/httputil"
+)
+
+const (
+	csrfTokenCookieName = "csrfToken"    // Readable by frontend code, so it can set csrfTokenHeaderName.
+	csrfTokenHeaderName = "X-CSRF-Token" // Used by frontend HTTP clients.
+	csrfTokenFormName   = "csrf"         // Used by HTML forms, e.g., component.PostButton.
+)
+
+// csrfToken returns the CSRF token for the session with accessToken.
+// It's derived from the access token, so it doesn't need to be stored,
+// and it can't be computed by anyone who doesn't know the access token.
+func csrfToken(accessToken string) string {
+	mac := hmac.New(sha256.New, []byte(accessToken))
+	mac.Write([]byte("csrf"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfTokenFromContext returns the CSRF token for the session of req.
+// It's meant to be used when rendering forms. It returns the empty string
+// if there's no session.
+func csrfTokenFromContext(req *http.Request) string {
+	s, _ := req.Context().Value(sessionContextKey).(*session)
+	if s == nil {
+		return ""
+	}
+	return csrfToken(s.rawAccessToken)
+}
+
+var errBadCSRFToken = errors.New("missing or bad CSRF token")
+
+// checkCSRF checks that a state-changing req made with cookie-authenticated
+// session s did not come from another site. It passes if req uses a safe method,
+// or if there's no session to abuse.
+//
+// Otherwise, req must carry the CSRF token of s, either in the csrfTokenHeaderName header
+// or in the csrfTokenFormName field of a URL-encoded form. Requests without a token are
+// only accepted if their Origin header shows they're same-origin, for the sake of
+// clients that aren't able to include it. Requests from other origins are always rejected.
+func checkCSRF(req *http.Request, s *session) error {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	if s == nil {
+		return nil
+	}
+	origin := req.Header.Get("Origin")
+	sameOrigin := false
+	if origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != req.Host {
+			return errBadCSRFToken
+		}
+		sameOrigin = true
+	}
+	token := req.Header.Get(csrfTokenHeaderName)
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); token == "" && mediaType == "application/x-www-form-urlencoded" {
+		token = req.PostFormValue(csrfTokenFormName)
+	}
+	switch {
+	case token != "":
+		if subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken(s.rawAccessToken))) != 1 {
+			return errBadCSRFToken
+		}
+		return nil
+	case sameOrigin:
+		return nil
+	default:
+		return errBadCSRFToken
+	}
+}
+
+// hasCSRFTokenCookie reports whether req has an up to date CSRF token cookie for session s.
+func hasCSRFTokenCookie(req *http.Request, s *session) bool {
+	cookie, err := req.Cookie(csrfTokenCookieName)
+	return err == nil && cookie.Value == csrfToken(s.rawAccessToken)
+}
+
+func setCSRFTokenCookie(w httputil.HeaderWriter, accessToken string, expiry time.Time) {
+	httputil.SetCookie(w, &http.Cookie{Path: "/", Name: csrfTokenCookieName, Value: csrfToken(accessToken), Expires: expiry, HttpOnly: false, Secure: *productionFlag})
+}
+func clearCSRFTokenCookie(w httputil.HeaderWriter) {
+	httputil.SetCookie(w, &http.Cookie{Path: "/", Name: csrfTokenCookieName, MaxAge: -1})
+}
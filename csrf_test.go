@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	s := &session{rawAccessToken: "aaa"}
+	token := csrfToken(s.rawAccessToken)
+
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		session *session
+		wantErr bool
+	}{
+		{
+			name:    "safe method",
+			req:     func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/react", nil) },
+			session: s,
+		},
+		{
+			name:    "no session",
+			req:     func() *http.Request { return httptest.NewRequest(http.MethodPost, "/logout", nil) },
+			session: nil,
+		},
+		{
+			name: "token in header",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/api/react", nil)
+				req.Header.Set("X-CSRF-Token", token)
+				return req
+			},
+			session: s,
+		},
+		{
+			name: "token in form",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader("return=%2F&csrf="+token))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return req
+			},
+			session: s,
+		},
+		{
+			name: "bad token",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/api/react", nil)
+				req.Header.Set("X-CSRF-Token", csrfToken("bbb"))
+				return req
+			},
+			session: s,
+			wantErr: true,
+		},
+		{
+			name:    "no token",
+			req:     func() *http.Request { return httptest.NewRequest(http.MethodPost, "/logout", nil) },
+			session: s,
+			wantErr: true,
+		},
+		{
+			name: "no token, same origin",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "http://example.com/api/usercontent", nil)
+				req.Header.Set("Origin", "http://example.com")
+				return req
+			},
+			session: s,
+		},
+		{
+			name: "token, cross origin",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "http://example.com/api/react", nil)
+				req.Header.Set("Origin", "https://evil.example.org")
+				req.Header.Set("X-CSRF-Token", token)
+				return req
+			},
+			session: s,
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		err := checkCSRF(tc.req(), tc.session)
+		if got := err != nil; got != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
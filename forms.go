@@ -0,0 +1,53 @@
+package main
+
+import (
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// hiddenInput returns a hidden form input with name and value.
+func hiddenInput(name, value string) *html.Node {
+	return &html.Node{
+		Type: html.ElementNode, Data: atom.Input.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "hidden"},
+			{Key: atom.Name.String(), Val: name},
+			{Key: atom.Value.String(), Val: value},
+		},
+	}
+}
+
+// textInput returns a text form input with name and initial value.
+func textInput(name, value string) *html.Node {
+	return &html.Node{
+		Type: html.ElementNode, Data: atom.Input.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "text"},
+			{Key: atom.Name.String(), Val: name},
+			{Key: atom.Value.String(), Val: value},
+		},
+	}
+}
+
+// submitInput returns a form submit button labeled value.
+func submitInput(value string) *html.Node {
+	return &html.Node{
+		Type: html.ElementNode, Data: atom.Input.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "submit"},
+			{Key: atom.Value.String(), Val: value},
+		},
+	}
+}
+
+// checkboxInput returns a form checkbox named name, which is submitted as "on" when checked.
+func checkboxInput(name string) *html.Node {
+	return &html.Node{
+		Type: html.ElementNode, Data: atom.Input.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "checkbox"},
+			{Key: atom.Name.String(), Val: name},
+			{Key: atom.Value.String(), Val: "on"},
+		},
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -21,8 +23,6 @@ import (
 	"github.com/shurcooL/home/internal/route"
 	"github.com/shurcooL/httperror"
 	"github.com/shurcooL/users"
-	"sourcegraph.com/sourcegraph/go-vcs/vcs"
-	"sourcegraph.com/sourcegraph/go-vcs/vcs/gitcmd"
 )
 
 func initGitUsers(usersService users.Service) (gitUsers map[string]users.User, err error) {
@@ -40,7 +40,7 @@ func initGitUsers(usersService users.Service) (gitUsers map[string]users.User, e
 	return gitUsers, nil
 }
 
-func initGitHandler(code code.Code, reposDir string, events events.Service, users users.Service, gitUsers map[string]users.User) (*gitHandler, error) {
+func initGitHandler(code *code.Store, reposDir string, events events.Service, users users.Service, gitUsers map[string]users.User) (*gitHandler, error) {
 	gitUploadPack, err := exec.LookPath("git-upload-pack")
 	if err != nil {
 		return nil, err
@@ -49,6 +49,10 @@ func initGitHandler(code code.Code, reposDir string, events events.Service, user
 	if err != nil {
 		return nil, err
 	}
+	hooksDir, err := installGitHooks()
+	if err != nil {
+		return nil, fmt.Errorf("installGitHooks: %v", err)
+	}
 	return &gitHandler{
 		code:           code,
 		reposDir:       reposDir,
@@ -57,11 +61,12 @@ func initGitHandler(code code.Code, reposDir string, events events.Service, user
 		gitUsers:       gitUsers,
 		gitUploadPack:  gitUploadPack,
 		gitReceivePack: gitReceivePack,
+		hooksDir:       hooksDir,
 	}, nil
 }
 
 type gitHandler struct {
-	code     code.Code
+	code     *code.Store
 	reposDir string
 	events   events.Service
 	users    users.Service
@@ -69,13 +74,19 @@ type gitHandler struct {
 
 	gitUploadPack  string // Path to git-upload-pack binary.
 	gitReceivePack string // Path to git-receive-pack binary.
+	hooksDir       string // Path to git hooks directory with the pre-receive hook that enforces push policies.
+}
+
+// Close removes the git hooks directory installed by initGitHandler.
+func (h *gitHandler) Close() error {
+	return os.RemoveAll(h.hooksDir)
 }
 
 func (h *gitHandler) ServeGitMaybe(w http.ResponseWriter, req *http.Request) (ok bool) {
 	switch url := req.URL.String(); {
 	case strings.HasSuffix(url, "/info/refs?service=git-upload-pack"):
 		repoRoot := "dmitri.shuralyov.com" + url[:len(url)-len("/info/refs?service=git-upload-pack")]
-		if dir, ok := h.code.ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() {
+		if dir, ok := h.code.Code().ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() {
 			return false
 		}
 		h.serveGitInfoRefsUploadPack(w, req, repoInfo{
@@ -86,7 +97,7 @@ func (h *gitHandler) ServeGitMaybe(w http.ResponseWriter, req *http.Request) (ok
 		return true
 	case strings.HasSuffix(url, "/git-upload-pack"):
 		repoRoot := "dmitri.shuralyov.com" + url[:len(url)-len("/git-upload-pack")]
-		if dir, ok := h.code.ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() {
+		if dir, ok := h.code.Code().ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() {
 			return false
 		}
 		h.serveGitUploadPack(w, req, repoInfo{
@@ -97,7 +108,7 @@ func (h *gitHandler) ServeGitMaybe(w http.ResponseWriter, req *http.Request) (ok
 		return true
 	case strings.HasSuffix(url, "/info/refs?service=git-receive-pack"):
 		repoRoot := "dmitri.shuralyov.com" + url[:len(url)-len("/info/refs?service=git-receive-pack")]
-		if dir, ok := h.code.ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() {
+		if dir, ok := h.code.Code().ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() {
 			return false
 		}
 		h.serveGitInfoRefsReceivePack(w, req, repoInfo{
@@ -108,7 +119,7 @@ func (h *gitHandler) ServeGitMaybe(w http.ResponseWriter, req *http.Request) (ok
 		return true
 	case strings.HasSuffix(url, "/git-receive-pack"):
 		repoRoot := "dmitri.shuralyov.com" + url[:len(url)-len("/git-receive-pack")]
-		if dir, ok := h.code.ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() {
+		if dir, ok := h.code.Code().ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() {
 			return false
 		}
 		h.serveGitReceivePack(w, req, repoInfo{
@@ -117,45 +128,59 @@ func (h *gitHandler) ServeGitMaybe(w http.ResponseWriter, req *http.Request) (ok
 			Dir:  filepath.Join(h.reposDir, filepath.FromSlash(repoRoot)),
 		})
 		return true
+	case strings.Contains(req.URL.Path, "/info/lfs/"):
+		i := strings.Index(req.URL.Path, "/info/lfs/")
+		repoRoot := "dmitri.shuralyov.com" + strings.TrimSuffix(req.URL.Path[:i], ".git")
+		if dir, ok := h.code.Code().ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() {
+			return false
+		}
+		h.serveLFS(w, req, repoInfo{
+			Spec: repoRoot,
+			Path: repoRoot[len("dmitri.shuralyov.com"):],
+			Dir:  filepath.Join(h.reposDir, filepath.FromSlash(repoRoot)),
+		}, req.URL.Path[i+len("/info/lfs"):])
+		return true
 	default:
 		return false
 	}
 }
 
+// isGitRequest reports whether req is a git smart HTTP or Git LFS request,
+// as served by ServeGitMaybe for existing repositories.
+func isGitRequest(req *http.Request) bool {
+	url := req.URL.String()
+	return strings.HasSuffix(url, "/info/refs?service=git-upload-pack") ||
+		strings.HasSuffix(url, "/git-upload-pack") ||
+		strings.HasSuffix(url, "/info/refs?service=git-receive-pack") ||
+		strings.HasSuffix(url, "/git-receive-pack") ||
+		strings.Contains(req.URL.Path, "/info/lfs/")
+}
+
 func (h *gitHandler) serveGitInfoRefsUploadPack(w http.ResponseWriter, req *http.Request, repo repoInfo) {
 	if req.Method != http.MethodGet {
 		httperror.HandleMethod(w, httperror.Method{Allowed: []string{http.MethodGet}})
 		return
 	}
-	cmd := exec.CommandContext(req.Context(), h.gitUploadPack, "--strict", "--advertise-refs", ".")
-	cmd.Dir = repo.Dir
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	err := cmd.Start()
-	if os.IsNotExist(err) {
-		http.Error(w, "404 Not Found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		http.Error(w, fmt.Errorf("could not start command: %v", err).Error(), http.StatusInternalServerError)
-		return
-	}
-	err = cmd.Wait()
-	if err != nil {
-		log.Printf("git-upload-pack command failed: %v\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
-	_, err = io.WriteString(w, "001e# service=git-upload-pack\n0000")
-	if err != nil {
-		log.Println(err)
+
+	// Authorization check.
+	if !h.authorizeGitFetch(w, req, repo) {
 		return
 	}
-	_, err = io.Copy(w, &buf)
-	if err != nil {
-		log.Println(err)
+
+	ctx, cancel := context.WithTimeout(req.Context(), gitAdvertiseTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.gitUploadPack, "--strict", "--advertise-refs", ".")
+	cmd.Dir = repo.Dir
+	cmd.Env = gitProtocolEnv(req)
+	prefix := "001e# service=git-upload-pack\n0000"
+	if gitProtocolV2(req) {
+		// Protocol v2 responses start with the capability advertisement
+		// directly, without the service line.
+		prefix = ""
 	}
+	runGit(w, cmd, "application/x-git-upload-pack-advertisement", prefix)
 }
+
 func (h *gitHandler) serveGitUploadPack(w http.ResponseWriter, req *http.Request, repo repoInfo) {
 	if req.Method != http.MethodPost {
 		httperror.HandleMethod(w, httperror.Method{Allowed: []string{http.MethodPost}})
@@ -166,33 +191,24 @@ func (h *gitHandler) serveGitUploadPack(w http.ResponseWriter, req *http.Request
 		httperror.HandleBadRequest(w, httperror.BadRequest{Err: err})
 		return
 	}
-	cmd := exec.CommandContext(req.Context(), h.gitUploadPack, "--strict", "--stateless-rpc", ".")
-	cmd.Dir = repo.Dir
-	cmd.Stdin = req.Body
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	err := cmd.Start()
-	if os.IsNotExist(err) {
-		http.Error(w, "404 Not Found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		http.Error(w, fmt.Errorf("could not start command: %v", err).Error(), http.StatusInternalServerError)
-		return
-	}
-	err = cmd.Wait()
-	if ee, _ := err.(*exec.ExitError); ee != nil && ee.Sys().(syscall.WaitStatus).ExitStatus() == 128 {
-		// Supposedly this is "fatal: The remote end hung up unexpectedly"
-		// due to git clone --depth=1 or so. Ignore this error.
-	} else if err != nil {
-		log.Printf("git-upload-pack command failed: %v\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	// Authorization check.
+	if !h.authorizeGitFetch(w, req, repo) {
 		return
 	}
-	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
-	_, err = io.Copy(w, &buf)
+
+	body, err := gitRequestBody(w, req, gitUploadPackMaxRequest)
 	if err != nil {
-		log.Println(err)
+		httperror.HandleBadRequest(w, httperror.BadRequest{Err: err})
+		return
 	}
+	ctx, cancel := context.WithTimeout(req.Context(), gitUploadPackTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.gitUploadPack, "--strict", "--stateless-rpc", ".")
+	cmd.Dir = repo.Dir
+	cmd.Env = gitProtocolEnv(req)
+	cmd.Stdin = body
+	runGit(w, cmd, "application/x-git-upload-pack-result", "")
 }
 
 func (h *gitHandler) serveGitInfoRefsReceivePack(w http.ResponseWriter, req *http.Request, repo repoInfo) {
@@ -202,46 +218,57 @@ func (h *gitHandler) serveGitInfoRefsReceivePack(w http.ResponseWriter, req *htt
 	}
 
 	// Authorization check.
-	session, user, _ := lookUpSessionUserViaBasicAuth(req, h.users)
-	if user == nil {
-		w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
-		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
-		return
-	} else if !user.SiteAdmin {
-		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	_, req, ok := h.authorizeGitPush(w, req, repo)
+	if !ok {
 		return
 	}
-	req = withSession(req, session)
 
-	cmd := exec.CommandContext(req.Context(), h.gitReceivePack, "--advertise-refs", ".")
+	ctx, cancel := context.WithTimeout(req.Context(), gitAdvertiseTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.gitReceivePack, "--advertise-refs", ".")
 	cmd.Dir = repo.Dir
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	err := cmd.Start()
-	if os.IsNotExist(err) {
-		http.Error(w, "404 Not Found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		http.Error(w, fmt.Errorf("could not start command: %v", err).Error(), http.StatusInternalServerError)
-		return
+	runGit(w, cmd, "application/x-git-receive-pack-advertisement", "001f# service=git-receive-pack\n0000")
+}
+
+// authorizeGitPush checks that the client of req is allowed to push to repo,
+// using the same Basic Auth scheme for all git clients. If not, it responds
+// with an error and reports false. Otherwise it returns the pushing user,
+// and req with their session.
+func (h *gitHandler) authorizeGitPush(w http.ResponseWriter, req *http.Request, repo repoInfo) (*users.User, *http.Request, bool) {
+	session, user, err := lookUpSessionUserViaBasicAuth(req, h.users)
+	if err, ok := err.(rateLimitedError); ok {
+		handleRateLimited(w, err)
+		return nil, nil, false
 	}
-	err = cmd.Wait()
-	if err != nil {
-		log.Printf("git-receive-pack command failed: %v\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err == errBadAccessToken {
+		username, _, _ := req.BasicAuth()
+		auditLog.Record(req, auditGitAuthFailed, users.UserSpec{}, repo.Spec, "username: "+username)
 	}
-	w.Header().Set("Content-Type", "application/x-git-receive-pack-advertisement")
-	_, err = io.WriteString(w, "001f# service=git-receive-pack\n0000")
-	if err != nil {
-		log.Println(err)
-		return
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return nil, nil, false
+	} else if !canRead(user.UserSpec, repo.Spec) {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return nil, nil, false
+	} else if !policy.Allowed(user.UserSpec, repo.Spec, rolePusher) || !session.HasScope(scopeGitPush) {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return nil, nil, false
 	}
-	_, err = io.Copy(w, &buf)
-	if err != nil {
-		log.Println(err)
+	if policy.Allowed(user.UserSpec, "", roleAdmin) {
+		// Site admins can push to every repository, so require step-up authentication.
+		if err := checkGitStepUp(req, user.UserSpec); err != nil {
+			handleGitStepUpError(w, err)
+			return nil, nil, false
+		}
+	}
+	if err := checkPushable(repo.Spec); err != nil {
+		http.Error(w, "403 Forbidden: "+err.Error(), http.StatusForbidden)
+		return nil, nil, false
 	}
+	return user, withSession(req, session), true
 }
+
 func (h *gitHandler) serveGitReceivePack(w http.ResponseWriter, req *http.Request, repo repoInfo) {
 	if req.Method != http.MethodPost {
 		httperror.HandleMethod(w, httperror.Method{Allowed: []string{http.MethodPost}})
@@ -254,126 +281,450 @@ func (h *gitHandler) serveGitReceivePack(w http.ResponseWriter, req *http.Reques
 	}
 
 	// Authorization check.
-	session, user, _ := lookUpSessionUserViaBasicAuth(req, h.users)
-	if user == nil {
-		w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
-		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
-		return
-	} else if !user.SiteAdmin {
-		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	user, req, ok := h.authorizeGitPush(w, req, repo)
+	if !ok {
 		return
 	}
-	req = withSession(req, session)
 
-	cmd := exec.CommandContext(req.Context(), h.gitReceivePack, "--stateless-rpc", ".")
+	body, err := gitRequestBody(w, req, gitReceivePackMaxRequest)
+	if err != nil {
+		httperror.HandleBadRequest(w, httperror.BadRequest{Err: err})
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), gitReceivePackTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.gitReceivePack, "--stateless-rpc", ".")
 	cmd.Dir = repo.Dir
+	cmd.Env = pushPolicyHookEnv(h.hooksDir, pushPolicies.Get(repo.Spec))
 	rpc := &githttp.RpcReader{
-		Reader: req.Body,
+		Reader: body,
 		Rpc:    "receive-pack",
 	}
 	cmd.Stdin = rpc
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	err := cmd.Start()
-	if os.IsNotExist(err) {
-		http.Error(w, "404 Not Found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		http.Error(w, fmt.Errorf("could not start command: %v", err).Error(), http.StatusInternalServerError)
+	if !runGit(w, cmd, "application/x-git-receive-pack-result", "") {
 		return
 	}
-	err = cmd.Wait()
+
+	h.logPush(req.Context(), httpAuditClient(req), *user, repo, rpc.Events)
+	h.updateCode(repo, rpc.Events)
+	h.mirrorPush(req.Context(), repo, rpc.Events)
+}
+
+// updateCode discovers the code in repo again if the push with events
+// updated its default branch, so that package pages, the package listing,
+// and the repository index reflect the new code.
+func (h *gitHandler) updateCode(repo repoInfo, events []githttp.Event) {
+	branch, err := code.DefaultBranch(repo.Dir)
 	if err != nil {
-		log.Printf("git-receive-pack command failed: %v\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println("updateCode: DefaultBranch:", err)
+		return
+	}
+	for _, e := range events {
+		if e.Type == githttp.TAG || e.Branch != branch {
+			continue
+		}
+		err := h.code.UpdateRepository(repo.Spec)
+		if err != nil {
+			log.Println("updateCode: UpdateRepository:", err)
+		}
+		return
+	}
+}
+
+// mirrorPush queues syncs of the push mirrors of repo
+// if the push with events updated any refs.
+func (h *gitHandler) mirrorPush(ctx context.Context, repo repoInfo, events []githttp.Event) {
+	if len(events) == 0 {
 		return
 	}
-	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
-	_, err = io.Copy(w, &buf)
+	err := pushMirrors.Enqueue(ctx, repo.Spec)
 	if err != nil {
-		log.Println(err)
+		log.Println("mirrorPush: Enqueue:", err)
+	}
+}
+
+// logPush records the ref updates in a push by user to repo
+// in the audit log, and logs the corresponding events.
+// Ref updates that didn't happen, e.g., because the push policy rejected them, are skipped.
+// Events aren't logged for repositories that aren't public, since the activity feed is.
+func (h *gitHandler) logPush(ctx context.Context, client auditClient, user users.User, repo repoInfo, events []githttp.Event) {
+	refs, err := listRefs(ctx, repo.Dir)
+	if err != nil {
+		log.Println("logPush: listRefs:", err)
+		return
+	}
+	var updates []githttp.Event
+	before := make(map[string]string, len(refs)) // Refs before the push.
+	for ref, id := range refs {
+		before[ref] = id
+	}
+	for _, e := range events {
+		ref := gitEventRef(e)
+		if got := refs[ref]; got != e.Commit && !(got == "" && isZeroID(e.Commit)) {
+			continue
+		}
+		updates = append(updates, e)
+		if isZeroID(e.Last) {
+			delete(before, ref)
+		} else {
+			before[ref] = e.Last
+		}
 	}
 
-	// Log events.
 	now := time.Now().UTC()
-	for _, e := range rpc.Events {
-		evt := event.Event{
-			Time:      now,
-			Actor:     *user,
-			Container: repo.Spec,
+	for _, e := range updates {
+		payloads, details := h.pushPayloads(ctx, repo, e, before)
+		auditLog.RecordClient(ctx, client, auditGitPush, user.UserSpec, repo.Spec, fmt.Sprintf("%s %s..%s%s", gitEventRef(e), e.Last, e.Commit, details))
+
+		if repoVisibilities.Get(repo.Spec) != visibilityPublic {
+			continue
 		}
-		const zero = "0000000000000000000000000000000000000000"
-		switch {
-		case e.Type == githttp.PUSH && e.Last != zero && e.Commit != zero:
-			commits, err := listCommitsBetween(repo, vcs.CommitID(e.Last), vcs.CommitID(e.Commit), h.gitUsers)
+		for _, payload := range payloads {
+			err := h.events.Log(ctx, event.Event{
+				Time:      now,
+				Actor:     user,
+				Container: repo.Spec,
+				Payload:   payload,
+			})
 			if err != nil {
-				log.Println("listCommitsBetween:", err)
-				commits = nil
+				log.Println("h.events.Log:", err)
 			}
-			evt.Payload = event.Push{
+		}
+	}
+}
+
+// pushMaxCommits is the maximum number of commits listed in a push event.
+// Pushes with more commits list the most recent ones.
+const pushMaxCommits = 20
+
+// pushPayloads returns the event payloads for ref update e in a push to repo,
+// and details about it for the audit log, if any. before are the refs of repo
+// before the push, used to find the commits that a new branch introduces.
+//
+// Force pushes and moved tags are logged as deleting the ref and creating
+// it again, with a description of what was overwritten. The commits that
+// force pushes drop from the branch are included in it and in the details.
+func (h *gitHandler) pushPayloads(ctx context.Context, repo repoInfo, e githttp.Event, before map[string]string) (payloads []interface{}, details string) {
+	switch {
+	case e.Type == githttp.PUSH && isZeroID(e.Last):
+		// A new branch. Its commits are the ones not reachable from any other ref.
+		var others []string
+		for _, id := range before {
+			others = append(others, id)
+		}
+		payloads = append(payloads, event.Create{Type: "branch", Name: e.Branch})
+		commits, err := listCommits(ctx, repo, e.Commit, others, h.gitUsers)
+		if err != nil {
+			log.Println("pushPayloads: listCommits:", err)
+		}
+		if len(commits) > 0 {
+			payloads = append(payloads, event.Push{
 				Branch:  e.Branch,
 				Head:    e.Commit,
 				Before:  e.Last,
 				Commits: commits,
+			})
+		}
+	case e.Type == githttp.PUSH && isZeroID(e.Commit):
+		payloads = append(payloads, event.Delete{Type: "branch", Name: e.Branch})
+	case e.Type == githttp.PUSH:
+		fastForward, err := isAncestor(ctx, repo.Dir, e.Last, e.Commit)
+		if err != nil {
+			log.Println("pushPayloads: isAncestor:", err)
+			fastForward = true
+		}
+		if !fastForward {
+			dropped, err := listCommitIDs(ctx, repo.Dir, e.Last, e.Commit)
+			if err != nil {
+				log.Println("pushPayloads: listCommitIDs:", err)
 			}
-		case e.Type == githttp.PUSH && e.Last == zero && e.Commit != zero:
-			evt.Payload = event.Create{
-				Type: "branch", Name: e.Branch,
-			}
-		case e.Type == githttp.PUSH && e.Last != zero && e.Commit == zero:
-			evt.Payload = event.Delete{
-				Type: "branch", Name: e.Branch,
-			}
-		case e.Type == githttp.TAG && e.Last == zero && e.Commit != zero:
-			evt.Payload = event.Create{
-				Type: "tag", Name: e.Tag,
+			description := "Force-pushed over " + e.Last + "."
+			details = " (forced)"
+			if len(dropped) > 0 {
+				list := strings.Join(dropped, " ")
+				if len(dropped) > pushMaxCommits {
+					list = fmt.Sprintf("%s and %d more", strings.Join(dropped[:pushMaxCommits], " "), len(dropped)-pushMaxCommits)
+				}
+				description = "Force-pushed, dropping " + list + "."
+				details = " (forced, dropped " + list + ")"
 			}
-		case e.Type == githttp.TAG && e.Last != zero && e.Commit == zero:
-			evt.Payload = event.Delete{
-				Type: "tag", Name: e.Tag,
+			payloads = append(payloads,
+				event.Delete{Type: "branch", Name: e.Branch},
+				event.Create{Type: "branch", Name: e.Branch, Description: description},
+			)
+		}
+		commits, err := listCommits(ctx, repo, e.Commit, []string{e.Last}, h.gitUsers)
+		if err != nil {
+			log.Println("pushPayloads: listCommits:", err)
+		}
+		payloads = append(payloads, event.Push{
+			Branch:  e.Branch,
+			Head:    e.Commit,
+			Before:  e.Last,
+			Commits: commits,
+		})
+	case e.Type == githttp.TAG && isZeroID(e.Commit):
+		payloads = append(payloads, event.Delete{Type: "tag", Name: e.Tag})
+	case e.Type == githttp.TAG:
+		description, err := tagAnnotation(ctx, repo.Dir, e.Commit)
+		if err != nil {
+			log.Println("pushPayloads: tagAnnotation:", err)
+		}
+		if !isZeroID(e.Last) {
+			// A moved tag. It's the same as deleting it and creating it again.
+			payloads = append(payloads, event.Delete{Type: "tag", Name: e.Tag})
+			if description != "" {
+				description = "\n\n" + description
 			}
-		default:
-			log.Printf("unsupported git event: %+v\n", e)
-			continue
+			description = "Moved from " + e.Last + "." + description
+			details = " (forced)"
 		}
-		err := h.events.Log(req.Context(), evt)
+		payloads = append(payloads, event.Create{Type: "tag", Name: e.Tag, Description: description})
+	}
+	return payloads, details
+}
+
+// gitEventRef returns the full name of the ref updated by e.
+func gitEventRef(e githttp.Event) string {
+	if e.Type == githttp.TAG {
+		return "refs/tags/" + e.Tag
+	}
+	return "refs/heads/" + e.Branch
+}
+
+// Limits on git operations.
+const (
+	gitAdvertiseTimeout   = time.Minute      // Ref advertisement.
+	gitUploadPackTimeout  = 30 * time.Minute // Fetch, including sending the pack.
+	gitReceivePackTimeout = 30 * time.Minute // Push, including receiving the pack.
+
+	gitUploadPackMaxRequest  = 10 << 20 // Max size of a fetch request (wants and haves), after decompression.
+	gitReceivePackMaxRequest = 1 << 30  // Max size of a push request, including the pack, after decompression.
+)
+
+// gitRequestBody returns the body of req, decompressed if the git client
+// gzipped it, and limited to at most n bytes after decompression.
+func gitRequestBody(w http.ResponseWriter, req *http.Request, n int64) (io.Reader, error) {
+	var body io.ReadCloser = req.Body
+	switch enc := req.Header.Get("Content-Encoding"); enc {
+	case "":
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(req.Body)
 		if err != nil {
-			log.Println("h.events.Log:", err)
+			return nil, fmt.Errorf("bad gzip request body: %v", err)
+		}
+		body = zr
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding: %v", enc)
+	}
+	return http.MaxBytesReader(w, body, n), nil
+}
+
+// runGit runs cmd, streaming its output to w as the response body
+// with the given content type, preceded by prefix.
+// It reports whether cmd succeeded.
+//
+// If cmd fails before producing any output, the failure is reported to the client
+// with an appropriate status code. Otherwise it's too late for that, so the failure
+// is only logged, and the client sees the response end early.
+func runGit(w http.ResponseWriter, cmd *exec.Cmd, contentType, prefix string) (ok bool) {
+	name := filepath.Base(cmd.Path)
+	resp := &gitResponse{w: w, prefix: prefix}
+	var stderr bytes.Buffer
+	cmd.Stdout = resp
+	cmd.Stderr = &stderr
+	w.Header().Set("Content-Type", contentType)
+	err := cmd.Start()
+	if os.IsNotExist(err) {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		http.Error(w, fmt.Errorf("could not start command: %v", err).Error(), http.StatusInternalServerError)
+		return false
+	}
+	err = cmd.Wait()
+	if ee, _ := err.(*exec.ExitError); ee != nil && ee.Sys().(syscall.WaitStatus).ExitStatus() == 128 && name == "git-upload-pack" {
+		// Supposedly this is "fatal: The remote end hung up unexpectedly"
+		// due to git clone --depth=1 or so. Ignore this error.
+	} else if err != nil {
+		log.Printf("%s command failed: %v: %s\n", name, err, bytes.TrimSpace(stderr.Bytes()))
+		if !resp.started {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
+		return false
+	}
+	if !resp.started {
+		resp.start()
+	}
+	if resp.err != nil {
+		log.Printf("%s: error writing response: %v\n", name, resp.err)
+	}
+	return true
+}
+
+// gitResponse streams the output of a git command as an HTTP response.
+// It flushes after every write, so the client sees progress right away.
+type gitResponse struct {
+	w       http.ResponseWriter
+	prefix  string // Written before the first output.
+	started bool   // Whether the response body has been started.
+	err     error  // First error writing to w, if any.
+}
+
+func (r *gitResponse) Write(p []byte) (int, error) {
+	if !r.started {
+		r.start()
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.w.Write(p)
+	if err != nil {
+		r.err = err
+		return n, err
+	}
+	if f, ok := r.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, nil
+}
+
+// start starts the response body by writing the prefix.
+func (r *gitResponse) start() {
+	r.started = true
+	_, r.err = io.WriteString(r.w, r.prefix)
+}
+
+// gitProtocolEnv returns the environment for running git-upload-pack for req.
+// Like git-http-backend, it passes the Git-Protocol header of the git client
+// through as GIT_PROTOCOL, so that clients can negotiate protocol v2.
+func gitProtocolEnv(req *http.Request) []string {
+	env := os.Environ()
+	if p := req.Header.Get("Git-Protocol"); p != "" && validGitProtocol(p) {
+		env = append(env, "GIT_PROTOCOL="+p)
+	}
+	return env
+}
+
+// gitProtocolV2 reports whether the git client of req requested protocol v2.
+func gitProtocolV2(req *http.Request) bool {
+	p := req.Header.Get("Git-Protocol")
+	if !validGitProtocol(p) {
+		return false
+	}
+	for _, param := range strings.Split(p, ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// validGitProtocol reports whether p is a well-formed Git-Protocol header value,
+// a colon-separated list of key=value parameters.
+func validGitProtocol(p string) bool {
+	for _, r := range p {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9',
+			r == '=', r == ':', r == '.', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// listRefs returns the refs of the git repository in dir, mapped to their object IDs.
+func listRefs(ctx context.Context, dir string) (map[string]string, error) {
+	out, err := gitOutput(ctx, dir, nil, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, err
 	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		i := strings.Index(line, " ")
+		if i == -1 {
+			continue
+		}
+		refs[line[i+1:]] = line[:i]
+	}
+	return refs, nil
 }
 
-// listCommitsBetween returns a list of commits in git repo from base to head.
-func listCommitsBetween(repo repoInfo, base, head vcs.CommitID, gitUsers map[string]users.User) ([]event.Commit, error) {
-	r := &gitcmd.Repository{Dir: repo.Dir}
-	defer r.Close()
-	cs, _, err := r.Commits(vcs.CommitsOptions{
-		Head:    head,
-		Base:    base,
-		NoTotal: true,
-	})
+// listCommits returns commits in git repo that are reachable from head
+// but not from any of exclude, ordered from earliest to most recent.
+// At most pushMaxCommits of the most recent commits are returned.
+func listCommits(ctx context.Context, repo repoInfo, head string, exclude []string, gitUsers map[string]users.User) ([]event.Commit, error) {
+	revs := head + "\n"
+	for _, id := range exclude {
+		revs += "^" + id + "\n"
+	}
+	out, err := gitOutput(ctx, repo.Dir, strings.NewReader(revs), "log", "--stdin", "--reverse",
+		"--max-count="+strconv.Itoa(pushMaxCommits), "--format=%H%x00%an%x00%ae%x00%B%x00")
 	if err != nil {
 		return nil, err
 	}
 	var commits []event.Commit
-	for i := len(cs) - 1; i >= 0; i-- {
-		c := cs[i]
+	for _, record := range strings.Split(string(out), "\x00\n") {
+		fields := strings.Split(record, "\x00")
+		if len(fields) != 4 {
+			continue
+		}
+		id, name, email, message := fields[0], fields[1], fields[2], strings.TrimRight(fields[3], "\n")
 
-		user, ok := gitUsers[strings.ToLower(c.Author.Email)]
+		user, ok := gitUsers[strings.ToLower(email)]
 		if !ok {
 			user = users.User{
-				Name:      c.Author.Name,
-				Email:     c.Author.Email,
+				Name:      name,
+				Email:     email,
 				AvatarURL: "https://secure.gravatar.com/avatar?d=mm&f=y&s=96", // TODO: Use email.
 			}
 		}
 
 		commits = append(commits, event.Commit{
-			SHA:             string(c.ID),
-			Message:         c.Message,
+			SHA:             id,
+			Message:         message,
 			AuthorAvatarURL: user.AvatarURL,
-			HTMLURL:         route.RepoCommit(repo.Path) + "/" + string(c.ID),
+			HTMLURL:         route.RepoCommit(repo.Path) + "/" + id,
 		})
 	}
 	return commits, nil
 }
+
+// listCommitIDs returns IDs of all commits in the git repository in dir
+// that are reachable from head but not from base, most recent first.
+func listCommitIDs(ctx context.Context, dir, head, base string) ([]string, error) {
+	out, err := gitOutput(ctx, dir, nil, "rev-list", head, "^"+base)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// tagAnnotation returns the message of the annotated tag object id
+// in the git repository in dir, without a signature, if any.
+// It returns the empty string if id is a commit, i.e., a lightweight tag.
+func tagAnnotation(ctx context.Context, dir, id string) (string, error) {
+	typ, err := gitOutput(ctx, dir, nil, "cat-file", "-t", id)
+	if err != nil {
+		return "", err
+	}
+	if string(bytes.TrimSpace(typ)) != "tag" {
+		return "", nil
+	}
+	out, err := gitOutput(ctx, dir, nil, "cat-file", "tag", id)
+	if err != nil {
+		return "", err
+	}
+	i := bytes.Index(out, []byte("\n\n")) // The message follows the header.
+	if i == -1 {
+		return "", nil
+	}
+	message := string(out[i+len("\n\n"):])
+	for _, sig := range []string{"-----BEGIN PGP SIGNATURE-----", "-----BEGIN SSH SIGNATURE-----", "-----BEGIN SIGNED MESSAGE-----"} {
+		if j := strings.Index(message, sig); j != -1 {
+			message = message[:j]
+		}
+	}
+	return strings.TrimSpace(message), nil
+}
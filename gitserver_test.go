@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AaronO/go-git-http"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/home/internal/code"
+	"github.com/shurcooL/users"
+)
+
+// Test fetching via the git smart HTTP protocol, versions 0 and 2,
+// using a local git client.
+func TestGitUploadPack(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-gitserver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	git := testGit(t, tempDir)
+
+	// Create a repository with a commit in the repository store.
+	const repoRoot = "dmitri.shuralyov.com/test/repo"
+	reposDir := filepath.Join(tempDir, "repositories")
+	repoDir := filepath.Join(reposDir, filepath.FromSlash(repoRoot))
+	workDir := filepath.Join(tempDir, "work")
+	for _, dir := range []string{repoDir, workDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(repoDir, "init", "--bare")
+	git(repoDir, "symbolic-ref", "HEAD", "refs/heads/master")
+	git(workDir, "init")
+	if err := ioutil.WriteFile(filepath.Join(workDir, "README.md"), []byte("Hello.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(workDir, "add", "README.md")
+	git(workDir, "commit", "-m", "Initial commit.")
+	git(workDir, "push", repoDir, "HEAD:refs/heads/master")
+	head := git(workDir, "rev-parse", "HEAD")
+
+	codeStore, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := initGitHandler(codeStore, reposDir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu            sync.Mutex
+		gitProtocols  []string // Git-Protocol headers of requests.
+		advertisement string   // Body of the last ref advertisement response.
+		unflushable   bool     // Whether any response writer didn't support flushing.
+	)
+	// Serve via the same top-level handler as in production,
+	// to check that responses are streamed through it.
+	ts := httptest.NewServer(serverHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		gitProtocols = append(gitProtocols, req.Header.Get("Git-Protocol"))
+		if _, ok := w.(http.Flusher); !ok {
+			unflushable = true
+		}
+		mu.Unlock()
+		if strings.HasSuffix(req.URL.Path, "/info/refs") {
+			rr := httptest.NewRecorder()
+			if !h.ServeGitMaybe(rr, req) {
+				http.NotFound(w, req)
+				return
+			}
+			mu.Lock()
+			advertisement = rr.Body.String()
+			mu.Unlock()
+			for k, v := range rr.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rr.Code)
+			rr.Body.WriteTo(w)
+			return
+		}
+		if !h.ServeGitMaybe(w, req) {
+			http.NotFound(w, req)
+		}
+	})))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		version         string
+		wantGitProtocol string
+		wantVersionLine bool // Whether the ref advertisement starts with "version 2".
+		wantServiceLine bool // Whether the ref advertisement starts with "# service=git-upload-pack".
+	}{
+		{version: "0", wantGitProtocol: "", wantServiceLine: true},
+		{version: "2", wantGitProtocol: "version=2", wantVersionLine: true},
+	} {
+		mu.Lock()
+		gitProtocols = nil
+		mu.Unlock()
+
+		// List refs and clone.
+		lsRemote := git(tempDir, "-c", "protocol.version="+tc.version, "ls-remote", ts.URL+"/test/repo", "refs/heads/master")
+		if got, want := lsRemote, head+"\trefs/heads/master"; got != want {
+			t.Errorf("protocol v%s: got ls-remote output %q, want %q", tc.version, got, want)
+		}
+		cloneDir := filepath.Join(tempDir, "clone-v"+tc.version)
+		git(tempDir, "-c", "protocol.version="+tc.version, "clone", ts.URL+"/test/repo", cloneDir)
+		if got, want := git(cloneDir, "rev-parse", "HEAD"), head; got != want {
+			t.Errorf("protocol v%s: got cloned HEAD %q, want %q", tc.version, got, want)
+		}
+
+		mu.Lock()
+		for _, p := range gitProtocols {
+			if p != tc.wantGitProtocol {
+				t.Errorf("protocol v%s: got Git-Protocol header %q, want %q", tc.version, p, tc.wantGitProtocol)
+			}
+		}
+		if got := strings.HasPrefix(advertisement, "000eversion 2\n"); got != tc.wantVersionLine {
+			t.Errorf("protocol v%s: got version 2 advertisement %v, want %v", tc.version, got, tc.wantVersionLine)
+		}
+		if got := strings.HasPrefix(advertisement, "001e# service=git-upload-pack\n0000"); got != tc.wantServiceLine {
+			t.Errorf("protocol v%s: got service line %v, want %v", tc.version, got, tc.wantServiceLine)
+		}
+		mu.Unlock()
+	}
+	if unflushable {
+		t.Error("got response writer that doesn't support flushing, want streamed responses")
+	}
+
+	// Git clients may gzip large requests, so check that's supported.
+	// Use a protocol v2 ls-refs request, since it's short.
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	io.WriteString(zw, "0014command=ls-refs\n"+"0001"+"0000")
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/test/repo/git-upload-pack", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("Accept-Encoding", "gzip") // As sent by git clients.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("gzipped ls-refs: got Content-Encoding %q, want response not to be compressed, so that it's streamed", got)
+	}
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("gzipped ls-refs: got status code %d %s, want %d %s: %s", got, http.StatusText(got), want, http.StatusText(want), result)
+	}
+	if want := head + " refs/heads/master"; !strings.Contains(string(result), want) {
+		t.Errorf("gzipped ls-refs: got response %q, want it to contain %q", result, want)
+	}
+}
+
+// Test that pushes are logged as events that reflect what happened:
+// commits of new branches, force pushes, and tag annotations.
+func TestLogPush(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-gitserver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	git := testGit(t, tempDir)
+	const repoRoot = "dmitri.shuralyov.com/test/repo"
+	repo := repoInfo{
+		Spec: repoRoot,
+		Path: repoRoot[len("dmitri.shuralyov.com"):],
+		Dir:  filepath.Join(tempDir, "repositories", filepath.FromSlash(repoRoot)),
+	}
+	workDir := filepath.Join(tempDir, "work")
+	for _, dir := range []string{repo.Dir, workDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(repo.Dir, "init", "--bare")
+	git(workDir, "init")
+	commit := func(message string) string {
+		t.Helper()
+		git(workDir, "commit", "--allow-empty", "-m", message)
+		return git(workDir, "rev-parse", "HEAD")
+	}
+	const zero = "0000000000000000000000000000000000000000"
+	events := &recordedEvents{}
+	h := &gitHandler{events: events}
+	// push pushes refspecs to repo, and logs the push with events.
+	push := func(refspecs []string, es ...githttp.Event) []interface{} {
+		t.Helper()
+		git(workDir, append([]string{"push", "--force", repo.Dir}, refspecs...)...)
+		before := len(events.Payloads())
+		h.logPush(context.Background(), auditClient{}, users.User{Login: "gopher"}, repo, es)
+		var payloads []interface{}
+		for _, p := range events.Payloads()[before:] {
+			if push, ok := p.(event.Push); ok {
+				// Only check commit IDs and messages.
+				for i, c := range push.Commits {
+					push.Commits[i] = event.Commit{SHA: c.SHA, Message: c.Message}
+				}
+				p = push
+			}
+			payloads = append(payloads, p)
+		}
+		return payloads
+	}
+	check := func(got, want []interface{}) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got events:\n%+v\nwant:\n%+v", got, want)
+		}
+	}
+
+	// A new branch lists all its commits.
+	a, b := commit("A."), commit("B.")
+	check(push([]string{"HEAD:refs/heads/master"},
+		githttp.Event{Type: githttp.PUSH, Branch: "master", Last: zero, Commit: b},
+	), []interface{}{
+		event.Create{Type: "branch", Name: "master"},
+		event.Push{Branch: "master", Head: b, Before: zero, Commits: []event.Commit{{SHA: a, Message: "A."}, {SHA: b, Message: "B."}}},
+	})
+
+	// New branches list commits that weren't reachable from other refs
+	// before the push, even if they're pushed together.
+	c := commit("C.")
+	check(push([]string{"HEAD:refs/heads/feature", "HEAD:refs/heads/feature2"},
+		githttp.Event{Type: githttp.PUSH, Branch: "feature", Last: zero, Commit: c},
+		githttp.Event{Type: githttp.PUSH, Branch: "feature2", Last: zero, Commit: c},
+	), []interface{}{
+		event.Create{Type: "branch", Name: "feature"},
+		event.Push{Branch: "feature", Head: c, Before: zero, Commits: []event.Commit{{SHA: c, Message: "C."}}},
+		event.Create{Type: "branch", Name: "feature2"},
+		event.Push{Branch: "feature2", Head: c, Before: zero, Commits: []event.Commit{{SHA: c, Message: "C."}}},
+	})
+
+	// A new branch without new commits only creates it.
+	check(push([]string{"HEAD:refs/heads/feature3"},
+		githttp.Event{Type: githttp.PUSH, Branch: "feature3", Last: zero, Commit: c},
+	), []interface{}{
+		event.Create{Type: "branch", Name: "feature3"},
+	})
+
+	// A force push recreates the branch noting the dropped commits,
+	// and lists the new commits.
+	git(workDir, "reset", "--hard", a)
+	d := commit("D.")
+	e := githttp.Event{Type: githttp.PUSH, Branch: "master", Last: b, Commit: d}
+	check(push([]string{"HEAD:refs/heads/master"}, e), []interface{}{
+		event.Delete{Type: "branch", Name: "master"},
+		event.Create{Type: "branch", Name: "master", Description: "Force-pushed, dropping " + b + "."},
+		event.Push{Branch: "master", Head: d, Before: b, Commits: []event.Commit{{SHA: d, Message: "D."}}},
+	})
+	if _, details := h.pushPayloads(context.Background(), repo, e, nil); details != " (forced, dropped "+b+")" {
+		t.Errorf("got force push details %q, want dropped commit %s", details, b)
+	}
+	e = githttp.Event{Type: githttp.PUSH, Branch: "master", Last: a, Commit: d}
+	if _, details := h.pushPayloads(context.Background(), repo, e, nil); details != "" {
+		t.Errorf("got fast-forward push details %q, want none", details)
+	}
+
+	// Annotated tags include their message, and moved tags are recreated
+	// noting where they were moved from.
+	git(workDir, "tag", "-a", "-m", "Release v1.\n\nThe first release.", "v1")
+	tag := git(workDir, "rev-parse", "v1")
+	check(push([]string{"refs/tags/v1"},
+		githttp.Event{Type: githttp.TAG, Tag: "v1", Last: zero, Commit: tag},
+	), []interface{}{
+		event.Create{Type: "tag", Name: "v1", Description: "Release v1.\n\nThe first release."},
+	})
+	git(workDir, "tag", "--force", "v1", a)
+	check(push([]string{"refs/tags/v1"},
+		githttp.Event{Type: githttp.TAG, Tag: "v1", Last: tag, Commit: a},
+	), []interface{}{
+		event.Delete{Type: "tag", Name: "v1"},
+		event.Create{Type: "tag", Name: "v1", Description: "Moved from " + tag + "."},
+	})
+}
+
+// testGit returns a function that runs git with args in dir, and returns
+// its output without surrounding space. It fails t if git fails.
+// git is run like testGitCommand does, with home as its home directory.
+func testGit(t *testing.T, home string) func(dir string, args ...string) string {
+	return func(dir string, args ...string) string {
+		t.Helper()
+		out, err := testGitCommand(home, dir, args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+}
+
+// testGitCommand returns a command that runs git with args in dir,
+// for git commands that are expected to fail. git uses home as its home
+// directory and ignores the system config, so that git config of the developer,
+// such as init.defaultBranch or commit.gpgsign, doesn't affect tests.
+func testGitCommand(home, dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"HOME="+home, "XDG_CONFIG_HOME="+filepath.Join(home, ".config"), "GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=Gopher", "GIT_AUTHOR_EMAIL=gopher@example.com",
+		"GIT_COMMITTER_NAME=Gopher", "GIT_COMMITTER_EMAIL=gopher@example.com",
+	)
+	return cmd
+}
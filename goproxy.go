@@ -0,0 +1,529 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shurcooL/home/internal/code"
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// goProxyHandler serves the Go module proxy protocol
+// for modules in repositories in the repository store.
+// Versions are the semantic version tags of the repositories,
+// and pseudo-versions of their commits.
+//
+// The request paths are:
+//
+//	/{{.Module}}/@v/list
+//	/{{.Module}}/@v/{{.Version}}.info
+//	/{{.Module}}/@v/{{.Version}}.mod
+//	/{{.Module}}/@v/{{.Version}}.zip
+//	/{{.Module}}/@latest
+//
+// Module paths and versions are escaped as described at
+// https://golang.org/cmd/go/#hdr-Module_proxy_protocol.
+type goProxyHandler struct {
+	code     *code.Store
+	reposDir string
+	cache    *archiveCache
+	users    users.Service
+}
+
+func (h *goProxyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return httperror.Method{Allowed: []string{http.MethodGet, http.MethodHead}}
+	}
+	escapedPath, query, ok := parseGoProxyPath(req.URL.Path)
+	if !ok {
+		return os.ErrNotExist
+	}
+	modulePath, err := module.UnescapePath(escapedPath)
+	if err != nil {
+		return os.ErrNotExist
+	}
+	m, ok := h.lookupModule(modulePath)
+	if !ok {
+		return os.ErrNotExist
+	}
+	// Private modules are served only to users who can read them,
+	// authenticated like git fetches (the go command uses .netrc),
+	// and are treated as nonexistent by everyone else.
+	if !canReadViaRequest(w, req, h.users, m.Repo) {
+		return os.ErrNotExist
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), gitArchiveTimeout)
+	defer cancel()
+	switch {
+	case query == "@latest":
+		info, err := m.Latest(ctx)
+		if err != nil {
+			return err
+		}
+		return serveGoProxyJSON(w, info)
+	case query == "@v/list":
+		versions, err := m.Versions(ctx)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, v := range versions {
+			fmt.Fprintln(w, v)
+		}
+		return nil
+	}
+
+	// The remaining queries are "@v/{{.Version}}{{.Ext}}".
+	ext := path.Ext(query)
+	version, err := module.UnescapeVersion(strings.TrimPrefix(query[:len(query)-len(ext)], "@v/"))
+	if err != nil {
+		return os.ErrNotExist
+	}
+	if ext == ".info" {
+		// Info queries may be for any branch or commit too, not only for canonical versions.
+		info, err := m.Query(ctx, version)
+		if err != nil {
+			return err
+		}
+		return serveGoProxyJSON(w, info)
+	}
+	commitHash, err := m.Resolve(ctx, version)
+	if err != nil {
+		return err
+	}
+	switch ext {
+	case ".mod":
+		_, goMod, err := m.CodeDir(ctx, commitHash)
+		if err != nil {
+			return err
+		}
+		if goMod == nil {
+			// Synthesize a go.mod file for code that doesn't have one.
+			goMod = []byte(fmt.Sprintf("module %s\n", modfile.AutoQuote(m.Path)))
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		setImmutableCacheControl(w, m.Repo)
+		_, err = w.Write(goMod)
+		return err
+	case ".zip":
+		key := path.Join("goproxy", escapedPath, "@v", commitHash+"-"+version+".zip")
+		f, err := h.cache.Open(key, func(dst string) error {
+			return m.CreateZip(ctx, dst, version, commitHash)
+		})
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		setImmutableCacheControl(w, m.Repo)
+		http.ServeContent(w, req, "", fi.ModTime(), f)
+		return nil
+	default:
+		return os.ErrNotExist
+	}
+}
+
+// parseGoProxyPath parses a module proxy request path like "/example.com/foo/@v/list"
+// into the escaped module path and the query, e.g., "example.com/foo" and "@v/list".
+func parseGoProxyPath(p string) (escapedPath, query string, ok bool) {
+	p = strings.TrimPrefix(p, "/")
+	if strings.HasSuffix(p, "/@latest") {
+		return strings.TrimSuffix(p, "/@latest"), "@latest", true
+	}
+	i := strings.LastIndex(p, "/@v/")
+	if i == -1 {
+		return "", "", false
+	}
+	escapedPath, query = p[:i], p[i+1:]
+	switch {
+	case query == "@v/list",
+		strings.HasSuffix(query, ".info"),
+		strings.HasSuffix(query, ".mod"),
+		strings.HasSuffix(query, ".zip"):
+		return escapedPath, query, !strings.Contains(query[len("@v/"):], "/")
+	default:
+		return "", "", false
+	}
+}
+
+// serveGoProxyJSON serves info as the JSON response to an info or latest query.
+func serveGoProxyJSON(w http.ResponseWriter, info goModuleInfo) error {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(info)
+}
+
+// lookupModule finds the repository that module with modulePath would be in.
+// It reports false if there's no such repository, or if modulePath isn't a valid module path.
+func (h *goProxyHandler) lookupModule(modulePath string) (goModule, bool) {
+	if module.CheckPath(modulePath) != nil {
+		return goModule{}, false
+	}
+	pathPrefix, pathMajor, ok := module.SplitPathVersion(modulePath)
+	if !ok {
+		return goModule{}, false
+	}
+	c := h.code.Code()
+	for repoRoot := modulePath; repoRoot != "." && repoRoot != "/"; repoRoot = path.Dir(repoRoot) {
+		d, ok := c.ByImportPath[repoRoot]
+		if !ok || !d.IsRepoRoot() {
+			continue
+		}
+		if len(pathPrefix) < len(repoRoot) {
+			// The major version suffix can't be the repository root itself.
+			return goModule{}, false
+		}
+		m := goModule{
+			Path:      modulePath,
+			PathMajor: pathMajor,
+			Repo:      repoRoot,
+			RepoDir:   filepath.Join(h.reposDir, filepath.FromSlash(repoRoot)),
+			Dir:       strings.TrimPrefix(modulePath[len(repoRoot):], "/"),
+			TagPrefix: strings.TrimPrefix(pathPrefix[len(repoRoot):], "/"),
+		}
+		if m.TagPrefix != "" {
+			m.TagPrefix += "/"
+		}
+		return m, true
+	}
+	return goModule{}, false
+}
+
+// goModule is a module in a repository in the repository store.
+type goModule struct {
+	Path      string // Module path. E.g., "dmitri.shuralyov.com/gpu/mtl/v2".
+	PathMajor string // Major version suffix of module path. E.g., "/v2". Empty for v0 and v1.
+	Repo      string // Repository spec. E.g., "dmitri.shuralyov.com/gpu".
+	RepoDir   string // Path to repository directory on disk.
+
+	// Dir is the directory of the module within the repository,
+	// relative to repository root, when it's in a major version subdirectory.
+	// E.g., "mtl/v2". Otherwise, the module is in directory
+	// TagPrefix without the trailing slash. E.g., "mtl".
+	Dir string
+
+	// TagPrefix is the prefix of tags for versions of the module.
+	// E.g., "mtl/" for tags like "mtl/v2.0.0". Empty at repository root.
+	TagPrefix string
+}
+
+// goModuleInfo is the JSON response to info and latest queries.
+type goModuleInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// Versions returns the versions of module m, sorted by semantic version.
+// They're the semantic version tags that are valid for the module path.
+// Pseudo-versions aren't listed.
+func (m goModule) Versions(ctx context.Context) ([]string, error) {
+	tags, err := m.versionTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for v := range tags {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return semver.Compare(versions[i], versions[j]) < 0 })
+	return versions, nil
+}
+
+// versionTags returns a map of versions of module m to their commit hashes.
+func (m goModule) versionTags(ctx context.Context) (map[string]string, error) {
+	out, err := gitOutput(ctx, m.RepoDir, nil, "for-each-ref", "--format=%(refname:strip=2) %(*objectname) %(objectname)", "refs/tags/"+m.TagPrefix)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		// Annotated tags have the commit hash in %(*objectname),
+		// lightweight tags have it in %(objectname).
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], m.TagPrefix) {
+			continue
+		}
+		v := fields[0][len(m.TagPrefix):]
+		if !semver.IsValid(v) || semver.Canonical(v) != v || module.IsPseudoVersion(v) ||
+			module.CheckPathMajor(v, m.PathMajor) != nil {
+			continue
+		}
+		tags[v] = fields[1]
+	}
+	return tags, nil
+}
+
+// Latest returns the latest version of module m. It's the highest release version,
+// or the highest pre-release version if there are no releases.
+// If there are no versions at all, it's a pseudo-version of the default branch.
+func (m goModule) Latest(ctx context.Context) (goModuleInfo, error) {
+	versions, err := m.Versions(ctx)
+	if err != nil {
+		return goModuleInfo{}, err
+	}
+	var latest string
+	for _, v := range versions {
+		if latest == "" || semver.Prerelease(latest) != "" || semver.Prerelease(v) == "" {
+			latest = v
+		}
+	}
+	if latest == "" {
+		return m.Query(ctx, "HEAD")
+	}
+	return m.Query(ctx, latest)
+}
+
+// Query resolves query to a version of module m. The query is a version,
+// a branch, a tag, a commit hash, or "HEAD" for the default branch.
+// Queries that aren't versions resolve to a pseudo-version.
+func (m goModule) Query(ctx context.Context, query string) (goModuleInfo, error) {
+	if semver.IsValid(query) {
+		commitHash, err := m.Resolve(ctx, query)
+		if err != nil {
+			return goModuleInfo{}, err
+		}
+		t, err := commitTime(ctx, m.RepoDir, commitHash)
+		return goModuleInfo{Version: query, Time: t}, err
+	}
+
+	var commitHash string
+	if query == "HEAD" {
+		out, err := gitOutput(ctx, m.RepoDir, nil, "rev-parse", "--verify", "--quiet", "HEAD^{commit}")
+		if err != nil {
+			return goModuleInfo{}, os.ErrNotExist
+		}
+		commitHash = strings.TrimSpace(string(out))
+	} else {
+		var err error
+		commitHash, err = resolveArchiveRef(ctx, m.RepoDir, query)
+		if err != nil {
+			return goModuleInfo{}, err
+		}
+	}
+	if _, _, err := m.CodeDir(ctx, commitHash); err != nil {
+		return goModuleInfo{}, err
+	}
+	t, err := commitTime(ctx, m.RepoDir, commitHash)
+	if err != nil {
+		return goModuleInfo{}, err
+	}
+
+	tags, err := m.versionTags(ctx)
+	if err != nil {
+		return goModuleInfo{}, err
+	}
+	var tagged, older string
+	for v, tagCommit := range tags {
+		if tagCommit == commitHash && semver.Compare(v, tagged) > 0 {
+			tagged = v
+		}
+	}
+	if tagged != "" {
+		// The commit has a version, so use it.
+		return goModuleInfo{Version: tagged, Time: t}, nil
+	}
+	// Otherwise, the pseudo-version is based on
+	// the highest version that is an ancestor of the commit.
+	for v, tagCommit := range tags {
+		if semver.Compare(v, older) <= 0 {
+			continue
+		}
+		if ok, err := isAncestor(ctx, m.RepoDir, tagCommit, commitHash); err != nil {
+			return goModuleInfo{}, err
+		} else if ok {
+			older = v
+		}
+	}
+	major := strings.TrimPrefix(m.PathMajor, "/")
+	return goModuleInfo{Version: module.PseudoVersion(major, older, t, commitHash[:12]), Time: t}, nil
+}
+
+// Resolve resolves version, which is a canonical semantic version or a pseudo-version,
+// to a commit hash. It returns os.ErrNotExist if module m doesn't have that version.
+func (m goModule) Resolve(ctx context.Context, version string) (commitHash string, _ error) {
+	if !semver.IsValid(version) || semver.Canonical(version) != version ||
+		module.CheckPathMajor(version, m.PathMajor) != nil {
+		return "", os.ErrNotExist
+	}
+	if !module.IsPseudoVersion(version) {
+		tags, err := m.versionTags(ctx)
+		if err != nil {
+			return "", err
+		}
+		commitHash, ok := tags[version]
+		if !ok {
+			return "", os.ErrNotExist
+		}
+		return commitHash, nil
+	}
+
+	rev, err := module.PseudoVersionRev(version)
+	if err != nil {
+		return "", os.ErrNotExist
+	}
+	out, err := gitOutput(ctx, m.RepoDir, nil, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		return "", os.ErrNotExist
+	}
+	commitHash = strings.TrimSpace(string(out))
+	// The pseudo-version must match the commit time exactly,
+	// so that there's only one pseudo-version per commit.
+	wantTime, err := module.PseudoVersionTime(version)
+	if err != nil {
+		return "", os.ErrNotExist
+	}
+	if t, err := commitTime(ctx, m.RepoDir, commitHash); err != nil {
+		return "", err
+	} else if !t.Equal(wantTime) {
+		return "", os.ErrNotExist
+	}
+	return commitHash, nil
+}
+
+// CodeDir finds the directory of module m at commitHash, relative to repository root,
+// and returns its go.mod file. goMod is nil if the module doesn't have a go.mod file,
+// which is only possible at repository root. It returns os.ErrNotExist if the module
+// doesn't exist at commitHash.
+func (m goModule) CodeDir(ctx context.Context, commitHash string) (dir string, goMod []byte, _ error) {
+	candidates := []string{m.Dir}
+	if m.PathMajor != "" {
+		// A major version can also be in its own subdirectory,
+		// or at the same directory as other major versions.
+		candidates = append(candidates, strings.TrimSuffix(m.TagPrefix, "/"))
+	}
+	for _, dir := range candidates {
+		goMod, err := gitOutput(ctx, m.RepoDir, nil, "cat-file", "blob", commitHash+":"+path.Join(dir, "go.mod"))
+		if err != nil {
+			continue
+		}
+		if modfile.ModulePath(goMod) != m.Path {
+			continue
+		}
+		return dir, goMod, nil
+	}
+	if m.PathMajor != "" || m.Dir != "" {
+		// Major versions 2 and higher need a go.mod file. So do modules
+		// in subdirectories, otherwise the directory is a part of the module
+		// at repository root, and the go command would report an ambiguous import.
+		return "", nil, os.ErrNotExist
+	}
+	return "", nil, nil
+}
+
+// CreateZip writes the module zip file of module m at version,
+// which is at commitHash, to the file dst. Module zips are reproducible:
+// the same commit always results in the same zip file.
+func (m goModule) CreateZip(ctx context.Context, dst, version, commitHash string) error {
+	dir, _, err := m.CodeDir(ctx, commitHash)
+	if err != nil {
+		return err
+	}
+	// Use git archive to get the files, like the go command does.
+	args := []string{"-c", "core.autocrlf=input", "-c", "core.eol=lf", "archive", "--format=zip", commitHash}
+	if dir != "" {
+		args = append(args, dir)
+	}
+	archive, err := gitOutput(ctx, m.RepoDir, nil, args...)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return err
+	}
+	var (
+		files       []modzip.File
+		haveLICENSE bool
+	)
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		name := f.Name
+		if dir != "" {
+			name = strings.TrimPrefix(name, dir+"/")
+		}
+		files = append(files, gitZipFile{name: name, f: f})
+		haveLICENSE = haveLICENSE || name == "LICENSE"
+	}
+	if !haveLICENSE && dir != "" {
+		// Modules in subdirectories get the LICENSE file at repository root, like with the go command.
+		if license, err := gitOutput(ctx, m.RepoDir, nil, "cat-file", "blob", commitHash+":LICENSE"); err == nil {
+			files = append(files, licenseZipFile(license))
+		}
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	err = modzip.Create(f, module.Version{Path: m.Path, Version: version}, files)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// gitZipFile is a file in a git archive, to be included in a module zip.
+type gitZipFile struct {
+	name string // Path relative to module root.
+	f    *zip.File
+}
+
+func (f gitZipFile) Path() string                 { return f.name }
+func (f gitZipFile) Lstat() (os.FileInfo, error)  { return f.f.FileInfo(), nil }
+func (f gitZipFile) Open() (io.ReadCloser, error) { return f.f.Open() }
+
+// licenseZipFile is the LICENSE file of a repository, to be included in a module zip.
+type licenseZipFile []byte
+
+func (f licenseZipFile) Path() string                { return "LICENSE" }
+func (f licenseZipFile) Lstat() (os.FileInfo, error) { return f, nil }
+func (f licenseZipFile) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(f)), nil
+}
+
+func (f licenseZipFile) Name() string       { return "LICENSE" }
+func (f licenseZipFile) Size() int64        { return int64(len(f)) }
+func (f licenseZipFile) Mode() os.FileMode  { return 0644 }
+func (f licenseZipFile) ModTime() time.Time { return time.Time{} }
+func (f licenseZipFile) IsDir() bool        { return false }
+func (f licenseZipFile) Sys() interface{}   { return nil }
+
+// commitTime returns the committer time of commit commitHash in the repository at dir.
+func commitTime(ctx context.Context, dir, commitHash string) (time.Time, error) {
+	out, err := gitOutput(ctx, dir, nil, "show", "--no-patch", "--format=%ct", commitHash)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
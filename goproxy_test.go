@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shurcooL/home/internal/code"
+)
+
+// Test that modules in a repository, including one in a subdirectory,
+// are served via the module proxy protocol for tags and commits,
+// and that subdirectories without a go.mod file aren't served as modules.
+func TestGoProxyHandler(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-goproxy-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	git := testGit(t, tempDir)
+	writeFiles := func(dir string, files map[string]string) {
+		t.Helper()
+		for name, contents := range files {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	reposDir := filepath.Join(tempDir, "repositories")
+	if err := os.Mkdir(reposDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	codeStore, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codeStore.Create("dmitri.shuralyov.com/gpu"); err != nil {
+		t.Fatal(err)
+	}
+	repoDir := filepath.Join(reposDir, "dmitri.shuralyov.com", "gpu")
+	workDir := filepath.Join(tempDir, "work")
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git(workDir, "init")
+	writeFiles(workDir, map[string]string{
+		"LICENSE":             "MIT\n",
+		"go.mod":              "module dmitri.shuralyov.com/gpu\n",
+		"gpu.go":              "package gpu\n",
+		"cmd/gpuinfo/main.go": "package main\n",
+		"mtl/go.mod":          "module dmitri.shuralyov.com/gpu/mtl\n",
+		"mtl/mtl.go":          "package mtl\n",
+	})
+	git(workDir, "add", ".")
+	git(workDir, "commit", "-m", "Initial commit.")
+	git(workDir, "tag", "-a", "-m", "Release.", "v1.0.0")
+	git(workDir, "tag", "mtl/v0.1.0")
+	git(workDir, "tag", "cmd/gpuinfo/v0.1.0")
+	writeFiles(workDir, map[string]string{"gpu.go": "package gpu // import \"dmitri.shuralyov.com/gpu\"\n"})
+	git(workDir, "commit", "-a", "-m", "Add import comment.")
+	git(workDir, "tag", "v1.1.0-pre")
+	writeFiles(workDir, map[string]string{"doc.go": "// Package gpu does things.\npackage gpu\n"})
+	git(workDir, "add", ".")
+	git(workDir, "commit", "-m", "Add documentation.")
+	head := git(workDir, "rev-parse", "HEAD")
+	git(workDir, "push", repoDir, "HEAD:refs/heads/master", "--tags")
+
+	cache, err := newArchiveCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache.dir)
+	h := &goProxyHandler{code: codeStore, reposDir: reposDir, cache: cache}
+	get := func(path string) (string, error) {
+		rr := httptest.NewRecorder()
+		err := h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr.Body.String(), err
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/dmitri.shuralyov.com/gpu/@v/list", "v1.0.0\nv1.1.0-pre\n"},
+		{"/dmitri.shuralyov.com/gpu/@v/v1.0.0.mod", "module dmitri.shuralyov.com/gpu\n"},
+		{"/dmitri.shuralyov.com/gpu/mtl/@v/list", "v0.1.0\n"},
+		{"/dmitri.shuralyov.com/gpu/mtl/@v/v0.1.0.mod", "module dmitri.shuralyov.com/gpu/mtl\n"},
+	} {
+		got, err := get(tc.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.path, got, tc.want)
+		}
+	}
+
+	// The latest version is the highest release, not a pre-release.
+	body, err := get("/dmitri.shuralyov.com/gpu/@latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info goModuleInfo
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "v1.0.0" {
+		t.Errorf("got latest version %q, want %q", info.Version, "v1.0.0")
+	}
+
+	// A branch resolves to a pseudo-version based on the highest version before it.
+	body, err = get("/dmitri.shuralyov.com/gpu/@v/master.info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(info.Version, "v1.1.0-pre.0.") || !strings.HasSuffix(info.Version, "-"+head[:12]) {
+		t.Errorf("got pseudo-version %q, want v1.1.0-pre.0.{{.Time}}-%s", info.Version, head[:12])
+	}
+	pseudoVersion := info.Version
+
+	for _, tc := range []struct {
+		path      string
+		wantFiles []string
+	}{
+		{
+			path:      "/dmitri.shuralyov.com/gpu/@v/v1.0.0.zip",
+			wantFiles: []string{"dmitri.shuralyov.com/gpu@v1.0.0/LICENSE", "dmitri.shuralyov.com/gpu@v1.0.0/cmd/gpuinfo/main.go", "dmitri.shuralyov.com/gpu@v1.0.0/go.mod", "dmitri.shuralyov.com/gpu@v1.0.0/gpu.go"},
+		},
+		{
+			path:      "/dmitri.shuralyov.com/gpu/@v/" + pseudoVersion + ".zip",
+			wantFiles: []string{"dmitri.shuralyov.com/gpu@" + pseudoVersion + "/LICENSE", "dmitri.shuralyov.com/gpu@" + pseudoVersion + "/cmd/gpuinfo/main.go", "dmitri.shuralyov.com/gpu@" + pseudoVersion + "/doc.go", "dmitri.shuralyov.com/gpu@" + pseudoVersion + "/go.mod", "dmitri.shuralyov.com/gpu@" + pseudoVersion + "/gpu.go"},
+		},
+		{
+			path:      "/dmitri.shuralyov.com/gpu/mtl/@v/v0.1.0.zip",
+			wantFiles: []string{"dmitri.shuralyov.com/gpu/mtl@v0.1.0/LICENSE", "dmitri.shuralyov.com/gpu/mtl@v0.1.0/go.mod", "dmitri.shuralyov.com/gpu/mtl@v0.1.0/mtl.go"},
+		},
+	} {
+		// Request each zip twice, the second time it should come from the cache.
+		var first string
+		for i := 0; i < 2; i++ {
+			body, err := get(tc.path)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.path, err)
+			}
+			files, err := archiveFiles([]byte(body), true)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.path, err)
+			}
+			if !reflect.DeepEqual(files, tc.wantFiles) {
+				t.Errorf("%s: got files %q, want %q", tc.path, files, tc.wantFiles)
+			}
+			if i == 0 {
+				first = body
+			} else if body != first {
+				t.Errorf("%s: got a different zip the second time", tc.path)
+			}
+		}
+	}
+
+	for _, path := range []string{
+		"/dmitri.shuralyov.com/gpu/@v/v1.2.0.info",
+		"/dmitri.shuralyov.com/gpu/@v/v2.0.0.mod",
+		"/dmitri.shuralyov.com/gpu/@v/v1.1.0-pre.0.20060102150405-" + head[:12] + ".zip",
+		"/dmitri.shuralyov.com/gpu/@v/master~1.info",
+		"/dmitri.shuralyov.com/gpu/v2/@latest",
+		"/dmitri.shuralyov.com/gpu/cmd/gpuinfo/@v/v0.1.0.mod",
+		"/dmitri.shuralyov.com/gpu/cmd/gpuinfo/@v/v0.1.0.zip",
+		"/dmitri.shuralyov.com/nope/@v/list",
+		"/dmitri.shuralyov.com/gpu/@v/v1.0.0.rar",
+	} {
+		if _, err := get(path); !os.IsNotExist(err) {
+			t.Errorf("%s: got error %v, want not exist", path, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package http
+
+import "net/http"
+
+// CSRFTransport is an http.RoundTripper that sets the X-CSRF-Token header
+// on state-changing requests. Cookie-authenticated endpoints reject such
+// requests if they don't carry the CSRF token of the session.
+type CSRFTransport struct {
+	Token string // CSRF token of the session.
+
+	// Base is the base RoundTripper used to make HTTP requests.
+	// If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *CSRFTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return base.RoundTrip(req)
+	}
+	// RoundTrippers must not modify the request, so modify a copy.
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		req2.Header[k] = append([]string(nil), v...)
+	}
+	req2.Header.Set("X-CSRF-Token", t.Token)
+	return base.RoundTrip(req2)
+}
@@ -4,9 +4,11 @@ import (
 	"github.com/shurcooL/home/http"
 	"github.com/shurcooL/reactions"
 	"github.com/shurcooL/users"
+	"golang.org/x/oauth2"
 )
 
 var (
-	_ reactions.Service = http.Reactions{}
-	_ users.Service     = http.Users{}
+	_ reactions.Service  = http.Reactions{}
+	_ users.Service      = http.Users{}
+	_ oauth2.TokenSource = http.TokenSource{}
 )
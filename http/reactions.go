@@ -13,11 +13,15 @@ import (
 )
 
 // Reactions implements reactions.Service remotely over HTTP.
-type Reactions struct{}
+type Reactions struct {
+	// HTTPClient is used for API requests. If nil, http.DefaultClient is used.
+	// Toggle requires it to send the CSRF token, e.g., via CSRFTransport.
+	HTTPClient *http.Client
+}
 
-func (Reactions) List(ctx context.Context, uri string) (map[string][]reactions.Reaction, error) {
+func (r Reactions) List(ctx context.Context, uri string) (map[string][]reactions.Reaction, error) {
 	u := url.URL{Path: "/api/react/list", RawQuery: url.Values{"ReactableURL": {uri}}.Encode()}
-	resp, err := ctxhttp.Get(ctx, nil, u.String())
+	resp, err := ctxhttp.Get(ctx, r.HTTPClient, u.String())
 	if err != nil {
 		return nil, err
 	}
@@ -31,9 +35,9 @@ func (Reactions) List(ctx context.Context, uri string) (map[string][]reactions.R
 	return rm, err
 }
 
-func (Reactions) Get(ctx context.Context, uri string, id string) ([]reactions.Reaction, error) {
+func (r Reactions) Get(ctx context.Context, uri string, id string) ([]reactions.Reaction, error) {
 	u := url.URL{Path: "/api/react", RawQuery: url.Values{"reactableURL": {uri}, "reactableID": {id}}.Encode()}
-	resp, err := ctxhttp.Get(ctx, nil, u.String())
+	resp, err := ctxhttp.Get(ctx, r.HTTPClient, u.String())
 	if err != nil {
 		return nil, err
 	}
@@ -47,8 +51,8 @@ func (Reactions) Get(ctx context.Context, uri string, id string) ([]reactions.Re
 	return rs, err
 }
 
-func (Reactions) Toggle(ctx context.Context, uri string, id string, tr reactions.ToggleRequest) ([]reactions.Reaction, error) {
-	resp, err := ctxhttp.PostForm(ctx, nil, "/api/react", url.Values{"reactableURL": {uri}, "reactableID": {id}, "reaction": {string(tr.Reaction)}})
+func (r Reactions) Toggle(ctx context.Context, uri string, id string, tr reactions.ToggleRequest) ([]reactions.Reaction, error) {
+	resp, err := ctxhttp.PostForm(ctx, r.HTTPClient, "/api/react", url.Values{"reactableURL": {uri}, "reactableID": {id}, "reaction": {string(tr.Reaction)}})
 	if err != nil {
 		return nil, err
 	}
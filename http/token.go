@@ -0,0 +1,54 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenSource is an oauth2.TokenSource that gets short-lived API tokens
+// for the signed in user from the /api/token endpoint. It's meant for
+// frontends, which can't read the HttpOnly session cookie themselves.
+// Wrap it with oauth2.ReuseTokenSource to reuse tokens until they expire.
+type TokenSource struct {
+	CSRFToken string // CSRF token of the session.
+
+	// HTTPClient is used to make the request. It must send the session cookie.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// Token implements oauth2.TokenSource.
+func (ts TokenSource) Token() (*oauth2.Token, error) {
+	client := ts.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest(http.MethodPost, "/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-CSRF-Token", ts.CSRFToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("did not get acceptable status code: %v body: %q", resp.Status, body)
+	}
+	var t struct {
+		AccessToken string
+		Expiry      time.Time
+	}
+	err = json.NewDecoder(resp.Body).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: t.AccessToken, Expiry: t.Expiry}, nil
+}
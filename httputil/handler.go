@@ -165,6 +165,24 @@ func (rw *gzipResponseWriter) Write(p []byte) (n int, err error) {
 	return rw.w.Write(p)
 }
 
+// Flush flushes data buffered by gzip compression, if any,
+// and then flushes the underlying http.ResponseWriter, if it supports it.
+func (rw *gzipResponseWriter) Flush() {
+	if rw.w == nil {
+		rw.setWriterAndCloser()
+	}
+	if gw, ok := rw.w.(*gzip.Writer); ok {
+		err := gw.Flush()
+		if err != nil {
+			log.Printf("gzipResponseWriter.Flush: error flushing *gzip.Writer: %v", err)
+			return
+		}
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (rw *gzipResponseWriter) setWriterAndCloser() {
 	if _, ok := rw.Header()["Content-Encoding"]; ok {
 		// Compression already handled by the handler.
@@ -51,7 +51,7 @@ func initIdiomaticGo(issues issues.Service, notifications notifications.Service,
 			authenticatedUser = users.User{} // THINK: Should it be a fatal error or not? What about on frontend vs backend?
 		}
 		returnURL := req.RequestURI
-		err = idiomaticgo.RenderBodyInnerHTML(req.Context(), w, issues, notifications, authenticatedUser, returnURL)
+		err = idiomaticgo.RenderBodyInnerHTML(req.Context(), w, issues, notifications, authenticatedUser, csrfTokenFromContext(req), returnURL)
 		if err != nil {
 			return err
 		}
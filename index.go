@@ -88,6 +88,7 @@ func (h *indexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) error
 	header := homecomponent.Header{
 		CurrentUser:       authenticatedUser,
 		NotificationCount: nc,
+		CSRFToken:         csrfTokenFromContext(req),
 		ReturnURL:         returnURL,
 	}
 	err = htmlg.RenderComponents(w, header)
@@ -99,7 +100,7 @@ func (h *indexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) error
 	var error string
 	if eventsError != nil {
 		error = "There was a problem getting latest activity."
-		if authenticatedUser.SiteAdmin {
+		if policy.Allowed(authenticatedUser.UserSpec, "", roleAdmin) {
 			error += "\n\n" + eventsError.Error()
 		}
 	}
@@ -322,10 +323,18 @@ func (a activity) Render() []*html.Node {
 				e.Icon = octicon.GitBranch
 				e.Action = component.Text("created branch in")
 				e.Details = belt.Reference{Name: p.Name}
+				if p.Description != "" {
+					// What a force push overwrote.
+					e.Details = component.Join(belt.Reference{Name: p.Name}, " ", plainText{Text: shortBody(p.Description)})
+				}
 			case "tag":
 				e.Icon = octicon.Tag
 				e.Action = component.Text("created tag in")
 				e.Details = belt.Reference{Name: p.Name}
+				if p.Description != "" {
+					// Annotation of an annotated tag, and what a moved tag overwrote.
+					e.Details = component.Join(belt.Reference{Name: p.Name}, " ", plainText{Text: shortBody(p.Description)})
+				}
 
 				//default:
 				//basicEvent.WIP = true
@@ -3,9 +3,11 @@ package code
 
 import (
 	"bytes"
+	"fmt"
 	"go/build"
 	"go/doc"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
@@ -65,9 +67,17 @@ func Discover(reposDir string) (Code, error) {
 	for _, d := range dirs {
 		byImportPath[d.ImportPath] = d
 	}
+	populateLicenseRoots(dirs, byImportPath)
 
-	// Populate LicenseRoot values for all remaining directories
-	// that don't directly contain a LICENSE file.
+	return Code{
+		Sorted:       dirs,
+		ByImportPath: byImportPath,
+	}, nil
+}
+
+// populateLicenseRoots populates LicenseRoot values for all directories in dirs
+// that don't directly contain a LICENSE file. byImportPath must include dirs.
+func populateLicenseRoots(dirs []*Directory, byImportPath map[string]*Directory) {
 	for _, dir := range dirs {
 		if dir.HasLicenseFile() {
 			continue
@@ -81,11 +91,6 @@ func Discover(reposDir string) (Code, error) {
 			}
 		}
 	}
-
-	return Code{
-		Sorted:       dirs,
-		ByImportPath: byImportPath,
-	}, nil
 }
 
 // walkRepositoryStore walks the repository store at reposDir,
@@ -132,6 +137,20 @@ func isBareGitRepository(dir string) (bool, error) {
 	return !head.IsDir(), nil
 }
 
+// DefaultBranch returns the default branch of the bare git repository at gitDir,
+// which is the branch that its HEAD points to. E.g., "master".
+func DefaultBranch(gitDir string) (string, error) {
+	head, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	ref := strings.TrimSpace(string(head))
+	if !strings.HasPrefix(ref, "ref: refs/heads/") {
+		return "", fmt.Errorf("HEAD of %s isn't a branch", gitDir)
+	}
+	return ref[len("ref: refs/heads/"):], nil
+}
+
 func walkRepository(gitDir, repoRoot string) ([]*Directory, error) {
 	r, err := git.Open(gitDir)
 	if err != nil {
@@ -143,7 +162,11 @@ func walkRepository(gitDir, repoRoot string) ([]*Directory, error) {
 			log.Println("walkRepository: r.Close:", err)
 		}
 	}()
-	master, err := r.ResolveBranch("master")
+	branch, err := DefaultBranch(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	head, err := r.ResolveBranch(branch)
 	if err == vcs.ErrBranchNotFound {
 		// Empty repository.
 		return []*Directory{{
@@ -153,7 +176,7 @@ func walkRepository(gitDir, repoRoot string) ([]*Directory, error) {
 	} else if err != nil {
 		return nil, err
 	}
-	fs, err := r.FileSystem(master)
+	fs, err := r.FileSystem(head)
 	if err != nil {
 		return nil, err
 	}
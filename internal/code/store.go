@@ -0,0 +1,225 @@
+package code
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Store is a repository store that can be changed while it's in use.
+// The code discovered inside it is kept up to date with the changes.
+type Store struct {
+	reposDir string
+
+	mu sync.Mutex // Serializes changes to the repository store.
+
+	cmu  sync.RWMutex // Guards code.
+	code Code
+}
+
+// NewStore discovers all Go code inside the repository store at reposDir,
+// and returns a Store for it.
+func NewStore(reposDir string) (*Store, error) {
+	code, err := Discover(reposDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{reposDir: reposDir, code: code}, nil
+}
+
+// Code returns the code currently in the repository store.
+// The returned Code is a snapshot that must not be modified.
+func (s *Store) Code() Code {
+	s.cmu.RLock()
+	defer s.cmu.RUnlock()
+	return s.code
+}
+
+// Create creates an empty bare git repository with repository root repoRoot.
+// It returns os.ErrExist if repoRoot is taken, or if it would be nested
+// inside another repository, or contain one.
+func (s *Store) Create(repoRoot string) error {
+	if err := CheckRepoRoot(repoRoot); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkAvailable(repoRoot); err != nil {
+		return err
+	}
+	dir := filepath.Join(s.reposDir, filepath.FromSlash(repoRoot))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("git", "init", "--bare", "--quiet", ".")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("git init: %v: %s", err, out)
+	}
+	cmd = exec.Command("git", "symbolic-ref", "HEAD", "refs/heads/master")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("git symbolic-ref: %v: %s", err, out)
+	}
+	return s.rediscover()
+}
+
+// Rename renames the repository with repository root from to have repository root to.
+// It returns os.ErrNotExist if there's no repository at from,
+// and os.ErrExist if to isn't available, like Create.
+func (s *Store) Rename(from, to string) error {
+	if err := CheckRepoRoot(to); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.Code().ByImportPath[from]; !ok || !d.IsRepoRoot() {
+		return os.ErrNotExist
+	}
+	if strings.HasPrefix(to+"/", from+"/") {
+		return os.ErrExist
+	}
+	if err := s.checkAvailable(to); err != nil {
+		return err
+	}
+	newDir := filepath.Join(s.reposDir, filepath.FromSlash(to))
+	err := os.MkdirAll(filepath.Dir(newDir), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(filepath.Join(s.reposDir, filepath.FromSlash(from)), newDir)
+	if err != nil {
+		return err
+	}
+	s.removeEmptyParents(from)
+	return s.rediscover()
+}
+
+// Delete deletes the repository with repository root repoRoot.
+// It returns os.ErrNotExist if there's no repository at repoRoot.
+func (s *Store) Delete(repoRoot string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.Code().ByImportPath[repoRoot]; !ok || !d.IsRepoRoot() {
+		return os.ErrNotExist
+	}
+	err := os.RemoveAll(filepath.Join(s.reposDir, filepath.FromSlash(repoRoot)))
+	if err != nil {
+		return err
+	}
+	s.removeEmptyParents(repoRoot)
+	return s.rediscover()
+}
+
+// UpdateRepository discovers the code in the repository with repository root
+// repoRoot again, e.g., after a push to it. The code in other repositories
+// is kept as is. It returns os.ErrNotExist if there's no repository at repoRoot.
+func (s *Store) UpdateRepository(repoRoot string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.Code()
+	if d, ok := old.ByImportPath[repoRoot]; !ok || !d.IsRepoRoot() {
+		return os.ErrNotExist
+	}
+	repoDirs, err := walkRepository(filepath.Join(s.reposDir, filepath.FromSlash(repoRoot)), repoRoot)
+	if err != nil {
+		return err
+	}
+
+	// Replace the directories of the repository in place,
+	// so that the rest stay in the same order.
+	var (
+		dirs         = make([]*Directory, 0, len(old.Sorted)+len(repoDirs))
+		byImportPath = make(map[string]*Directory, len(old.Sorted)+len(repoDirs))
+	)
+	for _, d := range old.Sorted {
+		if d.RepoRoot == repoRoot {
+			if d.IsRepoRoot() {
+				dirs = append(dirs, repoDirs...)
+			}
+			continue
+		}
+		dirs = append(dirs, d)
+	}
+	for _, d := range dirs {
+		byImportPath[d.ImportPath] = d
+	}
+	populateLicenseRoots(repoDirs, byImportPath)
+
+	s.cmu.Lock()
+	s.code = Code{Sorted: dirs, ByImportPath: byImportPath}
+	s.cmu.Unlock()
+	return nil
+}
+
+// checkAvailable returns os.ErrExist if a repository can't be added
+// at repoRoot, because something already exists at that path,
+// or a parent directory is a repository. s.mu must be held.
+func (s *Store) checkAvailable(repoRoot string) error {
+	dir := filepath.Join(s.reposDir, filepath.FromSlash(repoRoot))
+	if _, err := os.Stat(dir); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for parent := filepath.Dir(dir); len(parent) > len(s.reposDir); parent = filepath.Dir(parent) {
+		if ok, err := isBareGitRepository(parent); err != nil {
+			return err
+		} else if ok {
+			return os.ErrExist
+		}
+	}
+	return nil
+}
+
+// removeEmptyParents removes the parent directories of the repository
+// that was at repoRoot, as long as they're empty. s.mu must be held.
+func (s *Store) removeEmptyParents(repoRoot string) {
+	dir := filepath.Join(s.reposDir, filepath.FromSlash(repoRoot))
+	for parent := filepath.Dir(dir); len(parent) > len(s.reposDir); parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			// Not empty, or already gone.
+			return
+		}
+	}
+}
+
+// rediscover discovers all code in the repository store again,
+// and makes it the current code. s.mu must be held.
+func (s *Store) rediscover() error {
+	code, err := Discover(s.reposDir)
+	if err != nil {
+		return err
+	}
+	s.cmu.Lock()
+	s.code = code
+	s.cmu.Unlock()
+	return nil
+}
+
+// CheckRepoRoot checks that repoRoot is a valid repository root for a new repository.
+// Each path element must be made of letters, digits, '-', '.' and '_',
+// and not be skipped by code discovery.
+func CheckRepoRoot(repoRoot string) error {
+	elems := strings.Split(repoRoot, "/")
+	if len(elems) < 2 {
+		return fmt.Errorf("repository root %q must have a domain and a path", repoRoot)
+	}
+	for _, e := range elems {
+		if e == "" || strings.HasPrefix(e, ".") || strings.HasPrefix(e, "_") || e == "testdata" || strings.HasSuffix(e, ".git") {
+			return fmt.Errorf("repository root %q has bad path element %q", repoRoot, e)
+		}
+		for _, r := range e {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '.' || r == '_') {
+				return fmt.Errorf("repository root %q has bad character %q", repoRoot, r)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package code_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shurcooL/home/internal/code"
+)
+
+func TestStore(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	reposDir, err := ioutil.TempDir("", "home-code-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(reposDir)
+	s, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isRepoRoot := func(repoRoot string) bool {
+		d, ok := s.Code().ByImportPath[repoRoot]
+		return ok && d.IsRepoRoot()
+	}
+
+	err = s.Create("example.com/foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isRepoRoot("example.com/foo/bar") {
+		t.Error("created repository wasn't discovered")
+	}
+	for _, repoRoot := range []string{"example.com/foo/bar", "example.com/foo/bar/baz", "example.com/foo"} {
+		if err := s.Create(repoRoot); !os.IsExist(err) {
+			t.Errorf("Create(%q): got error %v, want os.ErrExist", repoRoot, err)
+		}
+	}
+	for _, repoRoot := range []string{"example.com", "example.com/.foo", "example.com/foo.git", "example.com/fo o", "example.com//foo"} {
+		if err := s.Create(repoRoot); err == nil || os.IsExist(err) {
+			t.Errorf("Create(%q): got error %v, want bad repository root error", repoRoot, err)
+		}
+	}
+
+	err = s.Rename("example.com/foo/bar", "example.com/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isRepoRoot("example.com/foo/bar") || !isRepoRoot("example.com/baz") {
+		t.Error("renamed repository wasn't rediscovered")
+	}
+	if _, err := os.Stat(filepath.Join(reposDir, "example.com", "foo")); !os.IsNotExist(err) {
+		t.Errorf("empty parent directory wasn't removed: %v", err)
+	}
+	if err := s.Rename("example.com/foo/bar", "example.com/qux"); !os.IsNotExist(err) {
+		t.Errorf("Rename of missing repository: got error %v, want os.ErrNotExist", err)
+	}
+
+	err = s.Delete("example.com/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isRepoRoot("example.com/baz") {
+		t.Error("deleted repository is still discovered")
+	}
+	if err := s.Delete("example.com/baz"); !os.IsNotExist(err) {
+		t.Errorf("Delete of missing repository: got error %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestStoreUpdateRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-code-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	reposDir := filepath.Join(tempDir, "repositories")
+	workDir := filepath.Join(tempDir, "work")
+	for _, dir := range []string{reposDir, workDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repoRoot := range []string{"example.com/a", "example.com/b", "example.com/c"} {
+		if err := s.Create(repoRoot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Push a package to the master branch of example.com/b.
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = workDir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=Gopher", "GIT_AUTHOR_EMAIL=gopher@example.com",
+			"GIT_COMMITTER_NAME=Gopher", "GIT_COMMITTER_EMAIL=gopher@example.com",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init")
+	if err := os.MkdirAll(filepath.Join(workDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workDir, "sub", "sub.go"), []byte("// Package sub is new.\npackage sub\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", ".")
+	git("commit", "-m", "Add package sub.")
+	git("push", filepath.Join(reposDir, "example.com", "b"), "HEAD:refs/heads/master")
+
+	if _, ok := s.Code().ByImportPath["example.com/b/sub"]; ok {
+		t.Fatal("package was discovered before UpdateRepository")
+	}
+	err = s.UpdateRepository("example.com/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.Code()
+	var got []string
+	for _, d := range c.Sorted {
+		got = append(got, d.ImportPath)
+	}
+	if want := []string{"example.com/a", "example.com/b", "example.com/b/sub", "example.com/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got directories %q, want %q", got, want)
+	}
+	if d, ok := c.ByImportPath["example.com/b/sub"]; !ok || d.Package == nil || d.Package.Synopsis != "Package sub is new." || d.RepoRoot != "example.com/b" {
+		t.Errorf("package wasn't discovered after UpdateRepository: %+v", d)
+	}
+	if err := s.UpdateRepository("example.com/d"); !os.IsNotExist(err) {
+		t.Errorf("UpdateRepository of missing repository: got error %v, want os.ErrNotExist", err)
+	}
+}
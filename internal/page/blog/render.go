@@ -22,11 +22,11 @@ import (
 	"golang.org/x/net/html/atom"
 )
 
-var shurcool = users.UserSpec{ID: 1924134, Domain: "github.com"}
-
 // RenderBodyInnerHTML renders the inner HTML of the <body> element of the Blog page.
+// canCreatePost controls whether the New Blog Post button is displayed.
+// csrfToken is the CSRF token of the authenticated user's session, if any.
 // It's safe for concurrent use.
-func RenderBodyInnerHTML(ctx context.Context, w io.Writer, issuesService issues.Service, blogURI issues.RepoSpec, notifications notifications.Service, authenticatedUser users.User, returnURL string) error {
+func RenderBodyInnerHTML(ctx context.Context, w io.Writer, issuesService issues.Service, blogURI issues.RepoSpec, notifications notifications.Service, authenticatedUser users.User, canCreatePost bool, csrfToken, returnURL string) error {
 	var nc uint64
 	if authenticatedUser.ID != 0 {
 		var err error
@@ -45,6 +45,7 @@ func RenderBodyInnerHTML(ctx context.Context, w io.Writer, issuesService issues.
 	header := component.Header{
 		CurrentUser:       authenticatedUser,
 		NotificationCount: nc,
+		CSRFToken:         csrfToken,
 		ReturnURL:         returnURL,
 	}
 	err = htmlg.RenderComponents(w, header)
@@ -52,8 +53,8 @@ func RenderBodyInnerHTML(ctx context.Context, w io.Writer, issuesService issues.
 		return err
 	}
 
-	// New Blog Post button for shurcooL.
-	if authenticatedUser.UserSpec == shurcool {
+	// New Blog Post button.
+	if canCreatePost {
 		// TODO: Reuse a subset of component.PostButton (to reduce duplication of common button properties).
 		io.WriteString(w, `<div style="text-align: right;"><button style="font-family: inherit; font-size: 11px; line-height: 11px; height: 18px; border-radius: 4px; border: solid #d2d2d2 1px; background-color: #fff; box-shadow: 0 1px 1px rgba(0, 0, 0, .05);" onclick="window.location = '/blog/new';">New Blog Post</button></div>`)
 	}
@@ -26,8 +26,9 @@ const idiomaticGoURI = "dmitri.shuralyov.com/idiomatic-go"
 const ReactableURL = idiomaticGoURI
 
 // RenderBodyInnerHTML renders the inner HTML of the <body> element of the Idiomatic Go page.
+// csrfToken is the CSRF token of the authenticated user's session, if any.
 // It's safe for concurrent use.
-func RenderBodyInnerHTML(ctx context.Context, w io.Writer, issuesService issues.Service, notifications notifications.Service, authenticatedUser users.User, returnURL string) error {
+func RenderBodyInnerHTML(ctx context.Context, w io.Writer, issuesService issues.Service, notifications notifications.Service, authenticatedUser users.User, csrfToken, returnURL string) error {
 	var nc uint64
 	if authenticatedUser.ID != 0 {
 		var err error
@@ -46,6 +47,7 @@ func RenderBodyInnerHTML(ctx context.Context, w io.Writer, issuesService issues.
 	header := component.Header{
 		CurrentUser:       authenticatedUser,
 		NotificationCount: nc,
+		CSRFToken:         csrfToken,
 		ReturnURL:         returnURL,
 	}
 	err = htmlg.RenderComponents(w, header)
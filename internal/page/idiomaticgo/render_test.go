@@ -41,7 +41,7 @@ func TestBodyInnerHTML(t *testing.T) {
 	returnURL := "http://localhost:8080/idiomatic-go"
 
 	var buf bytes.Buffer
-	err = idiomaticgo.RenderBodyInnerHTML(context.Background(), &buf, issues, notifications, authenticatedUser, returnURL)
+	err = idiomaticgo.RenderBodyInnerHTML(context.Background(), &buf, issues, notifications, authenticatedUser, "", returnURL)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -81,7 +81,7 @@ func BenchmarkRenderBodyInnerHTML(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		err := idiomaticgo.RenderBodyInnerHTML(context.Background(), ioutil.Discard, issues, notifications, authenticatedUser, returnURL)
+		err := idiomaticgo.RenderBodyInnerHTML(context.Background(), ioutil.Discard, issues, notifications, authenticatedUser, "", returnURL)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -20,8 +20,9 @@ var shurcool = users.UserSpec{ID: 1924134, Domain: "github.com"}
 const ReactableURL = "dmitri.shuralyov.com/resume"
 
 // RenderBodyInnerHTML renders the inner HTML of the <body> element of the page that displays the resume.
+// csrfToken is the CSRF token of the authenticated user's session, if any.
 // It's safe for concurrent use.
-func RenderBodyInnerHTML(ctx context.Context, w io.Writer, reactionsService reactions.Service, notifications notifications.Service, users users.Service, authenticatedUser users.User, returnURL string) error {
+func RenderBodyInnerHTML(ctx context.Context, w io.Writer, reactionsService reactions.Service, notifications notifications.Service, users users.Service, authenticatedUser users.User, csrfToken, returnURL string) error {
 	var nc uint64
 	if authenticatedUser.ID != 0 {
 		var err error
@@ -51,6 +52,7 @@ func RenderBodyInnerHTML(ctx context.Context, w io.Writer, reactionsService reac
 	header := homecomponent.Header{
 		CurrentUser:       authenticatedUser,
 		NotificationCount: nc,
+		CSRFToken:         csrfToken,
 		ReturnURL:         returnURL,
 	}
 	err = htmlg.RenderComponents(w, header)
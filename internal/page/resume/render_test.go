@@ -23,7 +23,7 @@ var updateFlag = flag.Bool("update", false, "Update golden files.")
 // TestBodyInnerHTML validates that resume.RenderBodyInnerHTML renders the body inner HTML as expected.
 func TestBodyInnerHTML(t *testing.T) {
 	var buf bytes.Buffer
-	err := resume.RenderBodyInnerHTML(context.TODO(), &buf, mockReactions{}, mockNotifications{}, mockUsers{}, alice, "/")
+	err := resume.RenderBodyInnerHTML(context.TODO(), &buf, mockReactions{}, mockNotifications{}, mockUsers{}, alice, "", "/")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,7 +63,7 @@ func BenchmarkRenderBodyInnerHTML(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		err := resume.RenderBodyInnerHTML(context.Background(), ioutil.Discard, reactions, notifications, users, authenticatedUser, returnURL)
+		err := resume.RenderBodyInnerHTML(context.Background(), ioutil.Discard, reactions, notifications, users, authenticatedUser, "", returnURL)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -22,8 +22,10 @@ func HasImportPathSeparator(path string) bool {
 
 func PkgIndex(pkgPath string) string     { return pkgPath }
 func PkgLicense(pkgPath string) string   { return pkgPath + "$file/LICENSE" }
+func PkgArchive(pkgPath string) string   { return pkgPath + "$archive" }
 func RepoIndex(repoPath string) string   { return repoPath + "/..." }
 func RepoHistory(repoPath string) string { return repoPath + "/...$history" }
 func RepoCommit(repoPath string) string  { return repoPath + "/...$commit" }
+func RepoArchive(repoPath string) string { return repoPath + "/...$archive" }
 func RepoIssues(repoPath string) string  { return repoPath + "/...$issues" }
 func RepoChanges(repoPath string) string { return repoPath + "/...$changes" }
@@ -0,0 +1,120 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// decodeCBOR decodes a single CBOR data item from the start of b,
+// and returns it along with the remaining bytes.
+// It supports only the subset of CBOR that WebAuthn uses:
+// integers, byte and text strings, arrays, maps and simple values.
+// Integers are decoded as int64, byte strings as []byte, text strings
+// as string, arrays as []interface{}, and maps as map[interface{}]interface{}.
+func decodeCBOR(b []byte) (v interface{}, rest []byte, err error) {
+	return decodeCBORDepth(b, 0)
+}
+
+const maxCBORDepth = 16
+
+func decodeCBORDepth(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+	if len(b) == 0 {
+		return nil, nil, errors.New("cbor: unexpected end of data")
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22, 23:
+			return nil, b, nil
+		default:
+			return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(b) >= 1:
+		arg, b = uint64(b[0]), b[1:]
+	case info == 25 && len(b) >= 2:
+		arg, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26 && len(b) >= 4:
+		arg, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27 && len(b) >= 8:
+		arg, b = binary.BigEndian.Uint64(b), b[8:]
+	case info >= 28:
+		return nil, nil, fmt.Errorf("cbor: unsupported additional information %d", info)
+	default:
+		return nil, nil, errors.New("cbor: unexpected end of data")
+	}
+
+	switch major {
+	case 0: // Unsigned integer.
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return int64(arg), b, nil
+	case 1: // Negative integer.
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3: // Byte string, text string.
+		if arg > uint64(len(b)) {
+			return nil, nil, errors.New("cbor: unexpected end of data")
+		}
+		s, b := b[:arg], b[arg:]
+		if major == 3 {
+			return string(s), b, nil
+		}
+		return append([]byte(nil), s...), b, nil
+	case 4: // Array.
+		if arg > uint64(len(b)) {
+			return nil, nil, errors.New("cbor: unexpected end of data")
+		}
+		a := make([]interface{}, arg)
+		for i := range a {
+			var err error
+			a[i], b, err = decodeCBORDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return a, b, nil
+	case 5: // Map.
+		if arg > uint64(len(b)) {
+			return nil, nil, errors.New("cbor: unexpected end of data")
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, rest, err := decodeCBORDepth(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", k)
+			}
+			v, rest, err := decodeCBORDepth(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k], b = v, rest
+		}
+		return m, b, nil
+	default: // Tags.
+		return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+	}
+}
@@ -0,0 +1,285 @@
+// Package webauthn implements the relying party side of Web Authentication
+// registration and authentication ceremonies, as used by passkeys.
+//
+// Only "none" attestation conveyance is used, so attestation statements
+// are not verified. Supported public key algorithms are ES256 and RS256.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers of supported public key algorithms.
+const (
+	AlgES256 = -7   // ECDSA with P-256 and SHA-256.
+	AlgRS256 = -257 // RSASSA-PKCS1-v1_5 with SHA-256.
+)
+
+// RelyingParty is a WebAuthn relying party, i.e., a website.
+type RelyingParty struct {
+	ID     string // Relying party ID. E.g., "dmitri.shuralyov.com".
+	Name   string // Human-palatable name. E.g., "Dmitri Shuralyov".
+	Origin string // Expected origin of requests. E.g., "https://dmitri.shuralyov.com".
+}
+
+// CreationOptions are options for navigator.credentials.create.
+type CreationOptions struct {
+	Challenge          []byte
+	RPID               string
+	RPName             string
+	UserID             []byte // User handle.
+	UserName           string
+	UserDisplayName    string
+	Algorithms         []int    // COSE algorithm identifiers, in order of preference.
+	ExcludeCredentials [][]byte // IDs of credentials the user already has.
+	TimeoutMillis      int
+}
+
+// RequestOptions are options for navigator.credentials.get.
+type RequestOptions struct {
+	Challenge        []byte
+	RPID             string
+	AllowCredentials [][]byte // Empty means any discoverable credential.
+	TimeoutMillis    int
+}
+
+// AttestationResponse is the result of navigator.credentials.create.
+type AttestationResponse struct {
+	ID                []byte // Raw credential ID.
+	ClientDataJSON    []byte
+	AttestationObject []byte
+}
+
+// AssertionResponse is the result of navigator.credentials.get.
+type AssertionResponse struct {
+	ID                []byte // Raw credential ID.
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+	UserHandle        []byte // May be empty.
+}
+
+// Credential is a public key credential registered with a relying party.
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key encoded public key.
+	SignCount uint32
+}
+
+// VerifyRegistration verifies the response of a registration ceremony
+// that was started with challenge, and returns the new credential.
+func (rp RelyingParty) VerifyRegistration(challenge []byte, r AttestationResponse) (Credential, error) {
+	err := rp.verifyClientData(r.ClientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return Credential{}, err
+	}
+	v, _, err := decodeCBOR(r.AttestationObject)
+	if err != nil {
+		return Credential{}, fmt.Errorf("bad attestation object: %v", err)
+	}
+	attestation, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return Credential{}, errors.New("bad attestation object: not a map")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return Credential{}, errors.New("bad attestation object: missing authData")
+	}
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if authData.CredentialID == nil {
+		return Credential{}, errors.New("authenticator data has no attested credential data")
+	}
+	if !bytes.Equal(authData.CredentialID, r.ID) {
+		return Credential{}, errors.New("credential ID doesn't match authenticator data")
+	}
+	if _, err := parsePublicKey(authData.PublicKey); err != nil {
+		return Credential{}, err
+	}
+	return Credential{
+		ID:        authData.CredentialID,
+		PublicKey: authData.PublicKey,
+		SignCount: authData.SignCount,
+	}, nil
+}
+
+// VerifyAssertion verifies the response of an authentication ceremony
+// that was started with challenge, and was performed using cred.
+// It returns the new signature counter of cred.
+func (rp RelyingParty) VerifyAssertion(challenge []byte, cred Credential, r AssertionResponse) (signCount uint32, err error) {
+	if !bytes.Equal(r.ID, cred.ID) {
+		return 0, errors.New("credential ID doesn't match")
+	}
+	err = rp.verifyClientData(r.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	authData, err := rp.parseAuthenticatorData(r.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	pub, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(r.ClientDataJSON)
+	signed := sha256.Sum256(append(append([]byte(nil), r.AuthenticatorData...), clientDataHash[:]...))
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(r.Signature, &sig); err != nil || len(rest) != 0 {
+			return 0, errors.New("bad ECDSA signature encoding")
+		}
+		if !ecdsa.Verify(pub, signed[:], sig.R, sig.S) {
+			return 0, errors.New("bad signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, signed[:], r.Signature); err != nil {
+			return 0, errors.New("bad signature")
+		}
+	}
+	// A signature counter that doesn't increase is a sign
+	// that the authenticator may have been cloned.
+	if (authData.SignCount != 0 || cred.SignCount != 0) && authData.SignCount <= cred.SignCount {
+		return 0, fmt.Errorf("signature counter %d didn't increase past %d", authData.SignCount, cred.SignCount)
+	}
+	return authData.SignCount, nil
+}
+
+// verifyClientData verifies that clientDataJSON is of type typ,
+// has the expected challenge and comes from the expected origin.
+func (rp RelyingParty) verifyClientData(clientDataJSON []byte, typ string, challenge []byte) error {
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return fmt.Errorf("bad client data: %v", err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("client data type is %q, want %q", cd.Type, typ)
+	}
+	if subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(base64.RawURLEncoding.EncodeToString(challenge))) != 1 {
+		return errors.New("client data challenge doesn't match")
+	}
+	if cd.Origin != rp.Origin {
+		return fmt.Errorf("client data origin is %q, want %q", cd.Origin, rp.Origin)
+	}
+	return nil
+}
+
+// authenticatorData is parsed authenticator data.
+type authenticatorData struct {
+	Flags     byte
+	SignCount uint32
+
+	// Attested credential data. Nil if not present.
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key encoded public key.
+}
+
+// Authenticator data flags.
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+// parseAuthenticatorData parses b, and verifies that it's scoped
+// to the relying party and that the user was present and verified.
+// User verification is required because a passkey is used on its own
+// to sign in, without a password.
+func (rp RelyingParty) parseAuthenticatorData(b []byte) (authenticatorData, error) {
+	if len(b) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(b[:32], rpIDHash[:]) {
+		return authenticatorData{}, errors.New("authenticator data is for another relying party")
+	}
+	ad := authenticatorData{
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return authenticatorData{}, errors.New("user was not present")
+	}
+	if ad.Flags&flagUserVerified == 0 {
+		return authenticatorData{}, errors.New("user was not verified")
+	}
+	if ad.Flags&flagAttestedCredentialData == 0 {
+		return ad, nil
+	}
+	b = b[37:]
+	if len(b) < 18 {
+		return authenticatorData{}, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(b[16:18])) // Skip 16 byte AAGUID.
+	b = b[18:]
+	if len(b) < idLen {
+		return authenticatorData{}, errors.New("attested credential data too short")
+	}
+	ad.CredentialID, b = append([]byte(nil), b[:idLen]...), b[idLen:]
+	_, rest, err := decodeCBOR(b)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("bad credential public key: %v", err)
+	}
+	ad.PublicKey = append([]byte(nil), b[:len(b)-len(rest)]...)
+	return ad, nil
+}
+
+// parsePublicKey parses a COSE_Key encoded public key.
+func parsePublicKey(coseKey []byte) (crypto.PublicKey, error) {
+	v, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return nil, fmt.Errorf("bad public key: %v", err)
+	}
+	key, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("bad public key: not a map")
+	}
+	// COSE_Key map labels.
+	const (
+		labelKty = int64(1)
+		labelAlg = int64(3)
+	)
+	switch kty, alg := key[labelKty], key[labelAlg]; {
+	case kty == int64(2) && alg == int64(AlgES256):
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if key[int64(-1)] != int64(1) || len(x) != 32 || len(y) != 32 { // Curve must be P-256.
+			return nil, errors.New("bad ES256 public key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("bad ES256 public key: point is not on curve")
+		}
+		return pub, nil
+	case kty == int64(3) && alg == int64(AlgRS256):
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("bad RS256 public key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %v with algorithm %v", kty, alg)
+	}
+}
@@ -134,6 +134,7 @@ func initIssues(mux *http.ServeMux, issuesService issues.Service, changeCounter
 		header := homecomponent.Header{
 			CurrentUser:       authenticatedUser,
 			NotificationCount: nc,
+			CSRFToken:         csrfTokenFromContext(req),
 			ReturnURL:         returnURL,
 		}
 
@@ -244,11 +245,12 @@ func initIssues(mux *http.ServeMux, issuesService issues.Service, changeCounter
 		if len(elems) < 2 || elems[0] == "" || elems[1] == "" {
 			return os.ErrNotExist
 		}
+		specURL := "github.com/" + elems[0] + "/" + elems[1]
 		currentUser, err := users.GetAuthenticatedSpec(req.Context())
 		if err != nil {
 			return err
 		}
-		if currentUser != shurcool {
+		if !policy.Allowed(currentUser, specURL, roleTriager) {
 			// Redirect to GitHub.
 			switch len(elems) {
 			case 2:
@@ -257,7 +259,6 @@ func initIssues(mux *http.ServeMux, issuesService issues.Service, changeCounter
 				return httperror.Redirect{URL: "https://github.com/" + elems[0] + "/" + elems[1] + "/issues/" + elems[2]}
 			}
 		}
-		specURL := "github.com/" + elems[0] + "/" + elems[1]
 		baseURL := "/issues/" + specURL
 
 		prefixLen := len(baseURL)
@@ -325,8 +326,8 @@ func (h issuesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) error
 	return err
 }
 
-// shurcoolSeesGitHubIssues lets shurcooL also see issues on GitHub,
-// in addition to local ones.
+// shurcoolSeesGitHubIssues lets shurcooL, and others who are triagers
+// of the repository, also see issues on GitHub in addition to local ones.
 type shurcoolSeesGitHubIssues struct {
 	service              issues.Service
 	shurcoolGitHubIssues issues.Service
@@ -336,13 +337,9 @@ type shurcoolSeesGitHubIssues struct {
 func (s shurcoolSeesGitHubIssues) List(ctx context.Context, repo issues.RepoSpec, opt issues.IssueListOptions) ([]issues.Issue, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGitHubIssues.List(ctx, repo, opt)
 	}
 
@@ -352,13 +349,9 @@ func (s shurcoolSeesGitHubIssues) List(ctx context.Context, repo issues.RepoSpec
 func (s shurcoolSeesGitHubIssues) Count(ctx context.Context, repo issues.RepoSpec, opt issues.IssueListOptions) (uint64, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return 0, err
 		}
-		if currentUser != shurcool {
-			return 0, os.ErrPermission
-		}
 		return s.shurcoolGitHubIssues.Count(ctx, repo, opt)
 	}
 
@@ -368,13 +361,9 @@ func (s shurcoolSeesGitHubIssues) Count(ctx context.Context, repo issues.RepoSpe
 func (s shurcoolSeesGitHubIssues) Get(ctx context.Context, repo issues.RepoSpec, id uint64) (issues.Issue, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return issues.Issue{}, err
 		}
-		if currentUser != shurcool {
-			return issues.Issue{}, os.ErrPermission
-		}
 		return s.shurcoolGitHubIssues.Get(ctx, repo, id)
 	}
 
@@ -384,13 +373,9 @@ func (s shurcoolSeesGitHubIssues) Get(ctx context.Context, repo issues.RepoSpec,
 func (s shurcoolSeesGitHubIssues) ListComments(ctx context.Context, repo issues.RepoSpec, id uint64, opt *issues.ListOptions) ([]issues.Comment, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGitHubIssues.ListComments(ctx, repo, id, opt)
 	}
 
@@ -400,13 +385,9 @@ func (s shurcoolSeesGitHubIssues) ListComments(ctx context.Context, repo issues.
 func (s shurcoolSeesGitHubIssues) ListEvents(ctx context.Context, repo issues.RepoSpec, id uint64, opt *issues.ListOptions) ([]issues.Event, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		return s.shurcoolGitHubIssues.ListEvents(ctx, repo, id, opt)
 	}
 
@@ -427,13 +408,9 @@ func (s shurcoolSeesGitHubIssues) IsTimelineLister(repo issues.RepoSpec) bool {
 func (s shurcoolSeesGitHubIssues) ListTimeline(ctx context.Context, repo issues.RepoSpec, id uint64, opt *issues.ListOptions) ([]interface{}, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return nil, err
 		}
-		if currentUser != shurcool {
-			return nil, os.ErrPermission
-		}
 		tl, ok := s.shurcoolGitHubIssues.(issues.TimelineLister)
 		if !ok {
 			return nil, fmt.Errorf("s.shurcoolGitHubIssues doesn't implement issues.TimelineLister")
@@ -451,13 +428,9 @@ func (s shurcoolSeesGitHubIssues) ListTimeline(ctx context.Context, repo issues.
 func (s shurcoolSeesGitHubIssues) Create(ctx context.Context, repo issues.RepoSpec, issue issues.Issue) (issues.Issue, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return issues.Issue{}, err
 		}
-		if currentUser != shurcool {
-			return issues.Issue{}, os.ErrPermission
-		}
 		return s.shurcoolGitHubIssues.Create(ctx, repo, issue)
 	}
 
@@ -467,13 +440,9 @@ func (s shurcoolSeesGitHubIssues) Create(ctx context.Context, repo issues.RepoSp
 func (s shurcoolSeesGitHubIssues) CreateComment(ctx context.Context, repo issues.RepoSpec, id uint64, comment issues.Comment) (issues.Comment, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return issues.Comment{}, err
 		}
-		if currentUser != shurcool {
-			return issues.Comment{}, os.ErrPermission
-		}
 		return s.shurcoolGitHubIssues.CreateComment(ctx, repo, id, comment)
 	}
 
@@ -483,13 +452,9 @@ func (s shurcoolSeesGitHubIssues) CreateComment(ctx context.Context, repo issues
 func (s shurcoolSeesGitHubIssues) Edit(ctx context.Context, repo issues.RepoSpec, id uint64, ir issues.IssueRequest) (issues.Issue, []issues.Event, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return issues.Issue{}, nil, err
 		}
-		if currentUser != shurcool {
-			return issues.Issue{}, nil, os.ErrPermission
-		}
 		return s.shurcoolGitHubIssues.Edit(ctx, repo, id, ir)
 	}
 
@@ -499,13 +464,9 @@ func (s shurcoolSeesGitHubIssues) Edit(ctx context.Context, repo issues.RepoSpec
 func (s shurcoolSeesGitHubIssues) EditComment(ctx context.Context, repo issues.RepoSpec, id uint64, cr issues.CommentRequest) (issues.Comment, error) {
 	if strings.HasPrefix(repo.URI, "github.com/") &&
 		repo.URI != "github.com/shurcooL/issuesapp" && repo.URI != "github.com/shurcooL/notificationsapp" {
-		currentUser, err := s.users.GetAuthenticatedSpec(ctx)
-		if err != nil {
+		if err := policy.Authorize(ctx, s.users, repo.URI, roleTriager); err != nil {
 			return issues.Comment{}, err
 		}
-		if currentUser != shurcool {
-			return issues.Comment{}, os.ErrPermission
-		}
 		return s.shurcoolGitHubIssues.EditComment(ctx, repo, id, cr)
 	}
 
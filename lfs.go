@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/httperror"
+	"golang.org/x/net/webdav"
+)
+
+// Git LFS support, via the batch API and the basic transfer adapter.
+// See https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md
+// and https://github.com/git-lfs/git-lfs/blob/main/docs/api/basic-transfers.md.
+//
+// The LFS endpoint of a repository is at {repo}.git/info/lfs, which is
+// where LFS clients look for it given the repository's clone URL.
+// {repo}/info/lfs is accepted too.
+
+const (
+	lfsMediaType     = "application/vnd.git-lfs+json"
+	lfsMaxBatch      = 1 << 20  // Max size of a batch request.
+	lfsMaxObjectSize = 10 << 30 // Max size of an object.
+)
+
+// lfsObjects is the store of Git LFS objects.
+var lfsObjects lfsStore
+
+// lfsStore stores Git LFS objects of repositories. Objects are content-addressed:
+// each one is stored once, named by its OID (its SHA-256 hash), and shared by all
+// repositories that have it. An index of which objects each repository has,
+// along with its usage stats, is kept so that repositories can only download
+// objects that were uploaded to them.
+//
+// The index entry of each repository is persisted in its own file,
+// when its objects change. Downloads are only counted in memory,
+// and persisted by SaveUsage.
+type lfsStore struct {
+	dir string // Directory where object files are stored. Set by Load.
+
+	mu      sync.Mutex
+	repos   []lfsRepo       // Sorted by Repo.
+	unsaved map[string]bool // Repositories with downloads that aren't persisted yet.
+
+	// store is where the index is persisted. If nil, the index is only kept in memory.
+	store webdav.FileSystem
+}
+
+// lfsRepo is the index entry of a repository in the LFS store.
+type lfsRepo struct {
+	Repo    string           // Repository spec. E.g., "dmitri.shuralyov.com/kebabcase".
+	Objects map[string]int64 // Objects of the repository. Key is OID, value is size in bytes.
+
+	// Usage stats.
+	Uploads         int   // Number of uploaded objects.
+	UploadedBytes   int64 // Total size of uploaded objects.
+	Downloads       int   // Number of downloaded objects.
+	DownloadedBytes int64 // Total size of downloaded objects.
+}
+
+// Size returns the total size of the objects of r, in bytes.
+func (r lfsRepo) Size() int64 {
+	var size int64
+	for _, s := range r.Objects {
+		size += s
+	}
+	return size
+}
+
+// lfsIndexDir is the directory in the LFS store
+// where index entries of repositories are persisted.
+const lfsIndexDir = "/index"
+
+// lfsIndexPath returns the path of the file in the LFS store
+// where the index entry of repo is persisted.
+func lfsIndexPath(repo string) string {
+	return lfsIndexDir + "/" + url.PathEscape(repo)
+}
+
+// Load sets root as the store of the index and dir as the directory
+// of object files, and loads the index.
+func (ls *lfsStore) Load(ctx context.Context, root webdav.FileSystem, dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	err = root.Mkdir(ctx, lfsIndexDir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	d, err := root.OpenFile(ctx, lfsIndexDir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	fis, err := d.Readdir(0)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	var repos []lfsRepo
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		var r lfsRepo
+		err := gobDecodeFile(ctx, root, lfsIndexDir+"/"+fi.Name(), &r)
+		if err != nil {
+			return fmt.Errorf("decoding index entry %q: %v", fi.Name(), err)
+		}
+		repos = append(repos, r)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Repo < repos[j].Repo })
+	ls.mu.Lock()
+	ls.dir = dir
+	ls.store = root
+	ls.repos = repos
+	ls.unsaved = nil
+	ls.mu.Unlock()
+	return nil
+}
+
+// Usage returns the LFS objects and usage stats of repo.
+func (ls *lfsStore) Usage(repo string) lfsRepo {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	i := ls.index(repo)
+	if i == -1 {
+		return lfsRepo{Repo: repo}
+	}
+	r := ls.repos[i]
+	r.Objects = make(map[string]int64, len(ls.repos[i].Objects))
+	for oid, size := range ls.repos[i].Objects {
+		r.Objects[oid] = size
+	}
+	return r
+}
+
+// Has reports whether repo has the object oid, and its size if so.
+func (ls *lfsStore) Has(repo, oid string) (size int64, ok bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	i := ls.index(repo)
+	if i == -1 {
+		return 0, false
+	}
+	size, ok = ls.repos[i].Objects[oid]
+	return size, ok
+}
+
+// Open opens the object oid of repo for reading.
+// It returns os.ErrNotExist if repo doesn't have the object.
+func (ls *lfsStore) Open(repo, oid string) (*os.File, error) {
+	if _, ok := ls.Has(repo, oid); !ok {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(ls.path(oid))
+}
+
+// Put stores the object oid of repo with contents read from r.
+// The contents are checked against oid and size before being stored.
+// If the object is already stored because another repository has it,
+// it's still read from r and checked, so that repositories can only
+// get objects whose contents are known.
+func (ls *lfsStore) Put(ctx context.Context, repo, oid string, size int64, r io.Reader) error {
+	if !validLFSOID(oid) {
+		return fmt.Errorf("bad object ID %q", oid)
+	}
+	f, err := ioutil.TempFile(ls.dir, "upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // In case of failure. After success, it's been renamed.
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, size+1))
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("object %s has size %d, want %d", oid, n, size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != oid {
+		return fmt.Errorf("object %s has SHA-256 hash %s", oid, got)
+	}
+	path := ls.path(oid)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return err
+	}
+	lr := lfsRepo{Repo: repo}
+	i := ls.index(repo)
+	if i != -1 {
+		lr = ls.repos[i]
+	}
+	objects := make(map[string]int64, len(lr.Objects)+1)
+	for oid, size := range lr.Objects {
+		objects[oid] = size
+	}
+	objects[oid] = size
+	lr.Objects = objects
+	lr.Uploads++
+	lr.UploadedBytes += size
+	err = ls.save(ctx, lr)
+	if err != nil {
+		return err
+	}
+	if i == -1 {
+		ls.repos = append(ls.repos, lr)
+		sort.Slice(ls.repos, func(i, j int) bool { return ls.repos[i].Repo < ls.repos[j].Repo })
+	} else {
+		ls.repos[i] = lr
+	}
+	return nil
+}
+
+// RecordDownload records that an object of size bytes was downloaded from repo.
+// It's only recorded in memory, until the next SaveUsage.
+func (ls *lfsStore) RecordDownload(repo string, size int64) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	i := ls.index(repo)
+	if i == -1 {
+		return
+	}
+	ls.repos[i].Downloads++
+	ls.repos[i].DownloadedBytes += size
+	if ls.unsaved == nil {
+		ls.unsaved = make(map[string]bool)
+	}
+	ls.unsaved[repo] = true
+}
+
+// SaveUsage persists the index entries of repositories
+// with downloads that aren't persisted yet.
+func (ls *lfsStore) SaveUsage(ctx context.Context) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for repo := range ls.unsaved {
+		if i := ls.index(repo); i != -1 {
+			err := ls.save(ctx, ls.repos[i])
+			if err != nil {
+				return err
+			}
+		}
+		delete(ls.unsaved, repo)
+	}
+	return nil
+}
+
+// saveUsagePeriodically calls SaveUsage every interval until ctx is done,
+// and one last time after that.
+func (ls *lfsStore) saveUsagePeriodically(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			err := ls.SaveUsage(ctx)
+			if err != nil {
+				log.Println("lfsStore.SaveUsage:", err)
+			}
+		case <-ctx.Done():
+			err := ls.SaveUsage(context.Background())
+			if err != nil {
+				log.Println("lfsStore.SaveUsage:", err)
+			}
+			return
+		}
+	}
+}
+
+// RenameRepo moves the LFS objects and usage stats of repository from to repository to.
+func (ls *lfsStore) RenameRepo(ctx context.Context, from, to string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	i := ls.index(from)
+	if i == -1 {
+		return nil
+	}
+	r := ls.repos[i]
+	r.Repo = to
+	err := ls.save(ctx, r)
+	if err != nil {
+		return err
+	}
+	err = ls.remove(ctx, from)
+	if err != nil {
+		return err
+	}
+	var repos []lfsRepo
+	for _, lr := range ls.repos {
+		switch lr.Repo {
+		case from:
+			lr = r
+		case to:
+			continue
+		}
+		repos = append(repos, lr)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Repo < repos[j].Repo })
+	ls.repos = repos
+	delete(ls.unsaved, from)
+	delete(ls.unsaved, to)
+	ls.removeUnused()
+	return nil
+}
+
+// RemoveRepo removes the LFS objects and usage stats of repo.
+// Object files that no other repository has are deleted.
+func (ls *lfsStore) RemoveRepo(ctx context.Context, repo string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	i := ls.index(repo)
+	if i == -1 {
+		return nil
+	}
+	err := ls.remove(ctx, repo)
+	if err != nil {
+		return err
+	}
+	ls.repos = append(ls.repos[:i:i], ls.repos[i+1:]...)
+	delete(ls.unsaved, repo)
+	ls.removeUnused()
+	return nil
+}
+
+// removeUnused deletes object files that no repository has. ls.mu must be held.
+func (ls *lfsStore) removeUnused() {
+	used := make(map[string]bool)
+	for _, r := range ls.repos {
+		for oid := range r.Objects {
+			used[oid] = true
+		}
+	}
+	err := filepath.Walk(ls.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !validLFSOID(fi.Name()) || used[fi.Name()] {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if err != nil {
+		log.Println("lfsStore.removeUnused:", err)
+	}
+}
+
+// path returns the path of the file of object oid.
+func (ls *lfsStore) path(oid string) string {
+	return filepath.Join(ls.dir, oid[:2], oid[2:4], oid)
+}
+
+// index returns the index of repo in ls.repos,
+// or -1 if it has no LFS objects. ls.mu must be held.
+func (ls *lfsStore) index(repo string) int {
+	i := sort.Search(len(ls.repos), func(i int) bool { return ls.repos[i].Repo >= repo })
+	if i == len(ls.repos) || ls.repos[i].Repo != repo {
+		return -1
+	}
+	return i
+}
+
+// save persists the index entry r. ls.mu must be held.
+func (ls *lfsStore) save(ctx context.Context, r lfsRepo) error {
+	if ls.store == nil {
+		return nil
+	}
+	return gobEncodeFile(ctx, ls.store, lfsIndexPath(r.Repo), r)
+}
+
+// remove removes the persisted index entry of repo. ls.mu must be held.
+func (ls *lfsStore) remove(ctx context.Context, repo string) error {
+	if ls.store == nil {
+		return nil
+	}
+	return ls.store.RemoveAll(ctx, lfsIndexPath(repo))
+}
+
+// validLFSOID reports whether oid is a valid LFS object ID,
+// a SHA-256 hash in lowercase hex.
+func validLFSOID(oid string) bool {
+	if len(oid) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range oid {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// serveLFS serves a Git LFS API request for repo.
+// path is the path of the request relative to the LFS endpoint,
+// e.g., "/objects/batch".
+func (h *gitHandler) serveLFS(w http.ResponseWriter, req *http.Request, repo repoInfo, path string) {
+	switch {
+	case path == "/objects/batch":
+		h.serveLFSBatch(w, req, repo)
+	case strings.HasPrefix(path, "/objects/") && validLFSOID(path[len("/objects/"):]):
+		oid := path[len("/objects/"):]
+		switch req.Method {
+		case http.MethodGet:
+			h.serveLFSDownload(w, req, repo, oid)
+		case http.MethodPut:
+			h.serveLFSUpload(w, req, repo, oid)
+		default:
+			httperror.HandleMethod(w, httperror.Method{Allowed: []string{http.MethodGet, http.MethodPut}})
+		}
+	default:
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+	}
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"` // "download" or "upload".
+	Transfers []string    `json:"transfers,omitempty"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string      `json:"transfer"`
+	Objects  []lfsObject `json:"objects"`
+}
+
+type lfsObject struct {
+	OID           string               `json:"oid"`
+	Size          int64                `json:"size"`
+	Authenticated bool                 `json:"authenticated,omitempty"`
+	Actions       map[string]lfsAction `json:"actions,omitempty"` // Key is "download" or "upload".
+	Error         *lfsError            `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href string `json:"href"`
+}
+
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// serveLFSBatch serves a batch API request, which tells the LFS client
+// where to download or upload each of the requested objects.
+// Uploading requires the client to be allowed to push to repo,
+// and downloading to fetch from it.
+func (h *gitHandler) serveLFSBatch(w http.ResponseWriter, req *http.Request, repo repoInfo) {
+	if req.Method != http.MethodPost {
+		httperror.HandleMethod(w, httperror.Method{Allowed: []string{http.MethodPost}})
+		return
+	}
+	var batch lfsBatchRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, lfsMaxBatch)).Decode(&batch)
+	if err != nil {
+		serveLFSError(w, http.StatusBadRequest, fmt.Sprintf("bad batch request: %v", err))
+		return
+	}
+	if !lfsBasicTransfer(batch.Transfers) {
+		serveLFSError(w, http.StatusUnprocessableEntity, "only the basic transfer adapter is supported")
+		return
+	}
+	switch batch.Operation {
+	case "download":
+		// Authorization check.
+		if !h.authorizeGitFetch(w, req, repo) {
+			return
+		}
+	case "upload":
+		// Authorization check.
+		if _, _, ok := h.authorizeGitPush(w, req, repo); !ok {
+			return
+		}
+	default:
+		serveLFSError(w, http.StatusUnprocessableEntity, fmt.Sprintf("unsupported operation %q", batch.Operation))
+		return
+	}
+
+	// Actions are marked as authenticated, so that the client authenticates
+	// transfers with its own credentials, the same way as this request.
+	href := lfsEndpoint(req, repo) + "/objects/"
+	resp := lfsBatchResponse{Transfer: "basic", Objects: []lfsObject{}}
+	for _, o := range batch.Objects {
+		obj := lfsObject{OID: o.OID, Size: o.Size}
+		size, have := lfsObjects.Has(repo.Spec, o.OID)
+		switch {
+		case !validLFSOID(o.OID):
+			obj.Error = &lfsError{Code: http.StatusUnprocessableEntity, Message: "bad object ID"}
+		case batch.Operation == "download" && !have:
+			obj.Error = &lfsError{Code: http.StatusNotFound, Message: "object does not exist"}
+		case batch.Operation == "download":
+			obj.Size = size
+			obj.Authenticated = true
+			obj.Actions = map[string]lfsAction{"download": {Href: href + o.OID}}
+		case o.Size < 0 || o.Size > lfsMaxObjectSize:
+			obj.Error = &lfsError{Code: http.StatusUnprocessableEntity, Message: fmt.Sprintf("object size must be at most %d bytes", int64(lfsMaxObjectSize))}
+		case have && size == o.Size:
+			// Already uploaded, nothing to do.
+		default:
+			obj.Authenticated = true
+			obj.Actions = map[string]lfsAction{"upload": {Href: href + o.OID}}
+		}
+		resp.Objects = append(resp.Objects, obj)
+	}
+	w.Header().Set("Content-Type", lfsMediaType)
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println("serveLFSBatch: Encode:", err)
+	}
+}
+
+// serveLFSDownload serves the contents of object oid of repo.
+// It requires the client to be allowed to fetch from repo.
+func (h *gitHandler) serveLFSDownload(w http.ResponseWriter, req *http.Request, repo repoInfo, oid string) {
+	// Authorization check.
+	if !h.authorizeGitFetch(w, req, repo) {
+		return
+	}
+
+	f, err := lfsObjects.Open(repo.Spec, oid)
+	if os.IsNotExist(err) {
+		serveLFSError(w, http.StatusNotFound, "object does not exist")
+		return
+	} else if err != nil {
+		log.Println("serveLFSDownload: Open:", err)
+		serveLFSError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		log.Println("serveLFSDownload: Stat:", err)
+		serveLFSError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	_, err = io.Copy(w, f)
+	if err != nil {
+		return
+	}
+	lfsObjects.RecordDownload(repo.Spec, fi.Size())
+}
+
+// serveLFSUpload stores the object oid of repo from the request body.
+// It requires the client to be allowed to push to repo.
+func (h *gitHandler) serveLFSUpload(w http.ResponseWriter, req *http.Request, repo repoInfo, oid string) {
+	// Authorization check.
+	if _, _, ok := h.authorizeGitPush(w, req, repo); !ok {
+		return
+	}
+	if req.ContentLength < 0 || req.ContentLength > lfsMaxObjectSize {
+		serveLFSError(w, http.StatusBadRequest, fmt.Sprintf("Content-Length must be set, and be at most %d bytes", int64(lfsMaxObjectSize)))
+		return
+	}
+	err := lfsObjects.Put(req.Context(), repo.Spec, oid, req.ContentLength, req.Body)
+	if err != nil {
+		serveLFSError(w, http.StatusBadRequest, fmt.Sprintf("bad object: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveLFSError serves an error response to an LFS client.
+func serveLFSError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{message})
+	if err != nil {
+		log.Println("serveLFSError: Encode:", err)
+	}
+}
+
+// lfsBasicTransfer reports whether transfers, the transfer adapters
+// an LFS client supports, include the basic one.
+func lfsBasicTransfer(transfers []string) bool {
+	if len(transfers) == 0 {
+		// The basic adapter is implied.
+		return true
+	}
+	for _, t := range transfers {
+		if t == "basic" {
+			return true
+		}
+	}
+	return false
+}
+
+// lfsEndpoint returns the absolute URL of the LFS endpoint of repo
+// on the host that req was made to.
+func lfsEndpoint(req *http.Request, repo repoInfo) string {
+	scheme := "http"
+	if *productionFlag {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + repo.Path + ".git/info/lfs"
+}
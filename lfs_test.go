@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shurcooL/home/internal/code"
+	"golang.org/x/net/webdav"
+)
+
+// Test that LFS objects are stored content-addressed, shared between
+// repositories, checked on upload, and only downloadable from
+// repositories they were uploaded to.
+func TestLFSStore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "home-lfs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	ctx := context.Background()
+	objectsDir := filepath.Join(tempDir, "objects")
+	var ls lfsStore
+	if err := ls.Load(ctx, webdav.Dir(tempDir), objectsDir); err != nil {
+		t.Fatal(err)
+	}
+	const (
+		repoA = "dmitri.shuralyov.com/a"
+		repoB = "dmitri.shuralyov.com/b"
+	)
+	contents := "large file contents\n"
+	oid := lfsTestOID(contents)
+
+	// Bad contents are rejected.
+	for _, tc := range []struct {
+		oid      string
+		size     int64
+		contents string
+	}{
+		{oid, int64(len(contents)), "other contents\n"},        // Wrong hash.
+		{oid, int64(len(contents)) - 1, contents},              // Too long.
+		{oid, int64(len(contents)) + 1, contents},              // Too short.
+		{strings.ToUpper(oid), int64(len(contents)), contents}, // Bad OID.
+		{"../" + oid[3:], int64(len(contents)), contents},      // Bad OID.
+	} {
+		if err := ls.Put(ctx, repoA, tc.oid, tc.size, strings.NewReader(tc.contents)); err == nil {
+			t.Errorf("Put(%q, %d, %q): got no error", tc.oid, tc.size, tc.contents)
+		}
+	}
+	if _, ok := ls.Has(repoA, oid); ok {
+		t.Fatal("got object after bad uploads")
+	}
+
+	// Objects uploaded to both repositories are stored once.
+	for _, repo := range []string{repoA, repoB} {
+		if err := ls.Put(ctx, repo, oid, int64(len(contents)), strings.NewReader(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := ls.Has("dmitri.shuralyov.com/c", oid); ok {
+		t.Error("got object in repository it wasn't uploaded to")
+	}
+	if _, err := ls.Open("dmitri.shuralyov.com/c", oid); !os.IsNotExist(err) {
+		t.Errorf("opening object in repository it wasn't uploaded to: got error %v, want not exist", err)
+	}
+	f, err := ls.Open(repoA, oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != contents {
+		t.Errorf("got object contents %q, want %q", got, contents)
+	}
+	ls.RecordDownload(repoA, int64(len(contents)))
+	usage := ls.Usage(repoA)
+	if len(usage.Objects) != 1 || usage.Size() != int64(len(contents)) || usage.Uploads != 1 || usage.Downloads != 1 || usage.DownloadedBytes != int64(len(contents)) {
+		t.Errorf("got usage %+v", usage)
+	}
+
+	// The index survives a restart. Downloads are persisted by SaveUsage.
+	var loaded lfsStore
+	if err := loaded.Load(ctx, webdav.Dir(tempDir), objectsDir); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Usage(repoA); got.Downloads != 0 || len(got.Objects) != 1 {
+		t.Errorf("got loaded usage before SaveUsage %+v, want objects but no downloads", got)
+	}
+	if err := ls.SaveUsage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Load(ctx, webdav.Dir(tempDir), objectsDir); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Usage(repoA); !reflect.DeepEqual(got, usage) {
+		t.Errorf("got loaded usage %+v, want %+v", got, usage)
+	}
+
+	// Object files are deleted once no repository has them.
+	if err := ls.RemoveRepo(ctx, repoA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ls.path(oid)); err != nil {
+		t.Errorf("object file of a remaining repository: %v", err)
+	}
+	if err := ls.RenameRepo(ctx, repoB, repoA); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ls.Has(repoA, oid); !ok {
+		t.Error("object not moved along with renamed repository")
+	}
+	if err := loaded.Load(ctx, webdav.Dir(tempDir), objectsDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Has(repoA, oid); !ok {
+		t.Error("loaded object not moved along with renamed repository")
+	}
+	if _, ok := loaded.Has(repoB, oid); ok {
+		t.Error("got loaded object in repository that was renamed")
+	}
+	if err := ls.RemoveRepo(ctx, repoA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ls.path(oid)); !os.IsNotExist(err) {
+		t.Errorf("object file of removed repositories: got error %v, want not exist", err)
+	}
+}
+
+// Test the LFS batch API and basic transfers via the git HTTP handler.
+func TestLFSHandler(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-lfs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	const repo = "dmitri.shuralyov.com/assets"
+	reposDir := filepath.Join(tempDir, "repositories")
+	if err := os.Mkdir(reposDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	codeStore, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codeStore.Create(repo); err != nil {
+		t.Fatal(err)
+	}
+	h, err := initGitHandler(codeStore, reposDir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { lfsObjects = lfsStore{} }()
+	if err := lfsObjects.Load(context.Background(), webdav.Dir(tempDir), filepath.Join(tempDir, "lfs")); err != nil {
+		t.Fatal(err)
+	}
+	contents := "large file contents\n"
+	oid := lfsTestOID(contents)
+	missing := lfsTestOID("missing\n")
+	if err := lfsObjects.Put(context.Background(), repo, oid, int64(len(contents)), strings.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !h.ServeGitMaybe(w, req) {
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+	batch := func(operation string) (*http.Response, lfsBatchResponse) {
+		t.Helper()
+		body := `{"operation": "` + operation + `", "transfers": ["basic"], "objects": [{"oid": "` + oid + `", "size": 20}, {"oid": "` + missing + `", "size": 8}]}`
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/assets.git/info/lfs/objects/batch", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", lfsMediaType)
+		req.Header.Set("Content-Type", lfsMediaType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var br lfsBatchResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, br
+	}
+
+	// Downloading.
+	resp, br := batch("download")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("download batch: got status %v, want 200", resp.Status)
+	}
+	if len(br.Objects) != 2 {
+		t.Fatalf("got %d objects, want 2", len(br.Objects))
+	}
+	download, ok := br.Objects[0].Actions["download"]
+	if !ok || download.Href != ts.URL+"/assets.git/info/lfs/objects/"+oid || !br.Objects[0].Authenticated {
+		t.Errorf("got object %+v for existing object, want authenticated download from the repository", br.Objects[0])
+	}
+	if e := br.Objects[1].Error; e == nil || e.Code != http.StatusNotFound {
+		t.Errorf("got error %+v for missing object, want code 404", e)
+	}
+	resp, err = http.Get(download.Href)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(got) != contents {
+		t.Errorf("download: got %v %q, want 200 %q", resp.Status, got, contents)
+	}
+	if usage := lfsObjects.Usage(repo); usage.Downloads != 1 {
+		t.Errorf("got %d downloads, want 1", usage.Downloads)
+	}
+	resp, err = http.Get(ts.URL + "/assets/info/lfs/objects/" + missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("downloading missing object: got status %v, want 404", resp.Status)
+	}
+
+	// Uploading requires authentication.
+	if resp, _ := batch("upload"); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("upload batch without credentials: got status %v, want 401 with WWW-Authenticate", resp.Status)
+	}
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/assets.git/info/lfs/objects/"+missing, strings.NewReader("missing\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("upload without credentials: got status %v, want 401", resp.Status)
+	}
+	if _, ok := lfsObjects.Has(repo, missing); ok {
+		t.Error("got object uploaded without credentials")
+	}
+}
+
+// lfsTestOID returns the LFS object ID of contents.
+func lfsTestOID(contents string) string {
+	h := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(h[:])
+}
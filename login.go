@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/shurcooL/users"
+	"golang.org/x/oauth2"
+	githuboauth2 "golang.org/x/oauth2/github"
+)
+
+// loginProvider is an identity provider that users can sign in via.
+type loginProvider interface {
+	// Name returns the short name of the provider that is used in its
+	// "/login/{name}" and "/callback/{name}" routes. E.g., "github".
+	Name() string
+
+	// Title returns the human-readable name of the provider. E.g., "GitHub".
+	Title() string
+
+	// AuthCodeURL returns a URL to the provider's consent page.
+	// state is passed back unmodified to the callback.
+	AuthCodeURL(ctx context.Context, state string) (string, error)
+
+	// Exchange converts an authorization code received by the callback
+	// into the user that authorized it. state is the validated state
+	// of the authorization request that the code was issued for.
+	Exchange(ctx context.Context, state, code string) (users.User, error)
+}
+
+// newLoginProviders returns the login providers that are configured
+// via environment variables. GitHub is always available. A generic
+// OpenID Connect provider is added when HOME_SSO_ISSUER is set.
+func newLoginProviders() ([]loginProvider, error) {
+	providers := []loginProvider{githubProvider{config: githubConfig}}
+	if issuer := os.Getenv("HOME_SSO_ISSUER"); issuer != "" {
+		title := os.Getenv("HOME_SSO_TITLE")
+		if title == "" {
+			title = "SSO"
+		}
+		sso, err := newOIDCProvider("sso", title, issuer, oauth2.Config{
+			ClientID:     os.Getenv("HOME_SSO_CLIENT_ID"),
+			ClientSecret: os.Getenv("HOME_SSO_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("HOME_SSO_REDIRECT_URL"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("newOIDCProvider: %v", err)
+		}
+		providers = append(providers, sso)
+	}
+	return providers, nil
+}
+
+var githubConfig = oauth2.Config{
+	ClientID:     os.Getenv("HOME_GH_CLIENT_ID"),
+	ClientSecret: os.Getenv("HOME_GH_CLIENT_SECRET"),
+	Scopes:       nil,
+	Endpoint:     githuboauth2.Endpoint,
+}
+
+// githubProvider is a login provider that signs users in via GitHub OAuth.
+// Users have the "github.com" domain.
+type githubProvider struct {
+	config oauth2.Config
+}
+
+func (githubProvider) Name() string  { return "github" }
+func (githubProvider) Title() string { return "GitHub" }
+
+func (p githubProvider) AuthCodeURL(_ context.Context, state string) (string, error) {
+	return p.config.AuthCodeURL(state), nil
+}
+
+func (p githubProvider) Exchange(ctx context.Context, _, code string) (users.User, error) {
+	token, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return users.User{}, err
+	}
+	httpClient := p.config.Client(ctx, token)
+	httpClient.Timeout = 5 * time.Second
+	gh := github.NewClient(httpClient)
+
+	ghUser, _, err := gh.Users.Get(ctx, "")
+	if err != nil {
+		return users.User{}, err
+	}
+	if ghUser.ID == nil || *ghUser.ID == 0 {
+		return users.User{}, errors.New("GitHub user ID is nil or 0")
+	}
+	if ghUser.Login == nil || *ghUser.Login == "" {
+		return users.User{}, errors.New("GitHub user Login is nil or empty")
+	}
+	if ghUser.AvatarURL == nil {
+		return users.User{}, errors.New("GitHub user AvatarURL is nil")
+	}
+	if ghUser.HTMLURL == nil {
+		return users.User{}, errors.New("GitHub user HTMLURL is nil")
+	}
+	return users.User{
+		UserSpec:  users.UserSpec{ID: uint64(*ghUser.ID), Domain: "github.com"},
+		Login:     *ghUser.Login,
+		AvatarURL: *ghUser.AvatarURL,
+		HTMLURL:   *ghUser.HTMLURL,
+	}, nil
+}
+
+// oidcProvider is a login provider that signs users in via
+// a generic OpenID Connect identity provider.
+// Users have the domain of the issuer host, e.g., "sso.example.com".
+type oidcProvider struct {
+	name, title string
+	issuer      string
+	domain      string
+	config      oauth2.Config // Endpoint is populated by discover.
+
+	mu          sync.Mutex
+	discovered  bool
+	userInfoURL string
+}
+
+// newOIDCProvider creates an OpenID Connect login provider for issuer.
+// The provider endpoints are discovered via the issuer's
+// "/.well-known/openid-configuration" document when they're
+// first needed, so an unavailable issuer doesn't prevent startup.
+// Endpoint and Scopes fields of config are populated by oidcProvider.
+func newOIDCProvider(name, title, issuer string, config oauth2.Config) (*oidcProvider, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("issuer %q has no host", issuer)
+	}
+	config.Scopes = []string{"openid", "profile", "email"}
+	return &oidcProvider{
+		name:   name,
+		title:  title,
+		issuer: issuer,
+		domain: u.Hostname(),
+		config: config,
+	}, nil
+}
+
+func (p *oidcProvider) Name() string  { return p.name }
+func (p *oidcProvider) Title() string { return p.title }
+
+// discover fetches the issuer's provider configuration, unless
+// it's already been fetched successfully. Failures aren't cached,
+// so discovery is retried on the next sign in attempt.
+func (p *oidcProvider) discover(ctx context.Context) (oauth2.Config, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovered {
+		return p.config, p.userInfoURL, nil
+	}
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return oauth2.Config{}, "", err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return oauth2.Config{}, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return oauth2.Config{}, "", fmt.Errorf("did not get acceptable status code: %v body: %q", resp.Status, body)
+	}
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&discovery)
+	if err != nil {
+		return oauth2.Config{}, "", err
+	}
+	if discovery.Issuer != p.issuer {
+		return oauth2.Config{}, "", fmt.Errorf("issuer %q has provider configuration for issuer %q", p.issuer, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.UserInfoEndpoint == "" {
+		return oauth2.Config{}, "", fmt.Errorf("issuer %q is missing authorization, token or userinfo endpoint", p.issuer)
+	}
+	p.config.Endpoint = oauth2.Endpoint{
+		AuthURL:  discovery.AuthorizationEndpoint,
+		TokenURL: discovery.TokenEndpoint,
+	}
+	p.userInfoURL = discovery.UserInfoEndpoint
+	p.discovered = true
+	return p.config, p.userInfoURL, nil
+}
+
+func (p *oidcProvider) AuthCodeURL(ctx context.Context, state string) (string, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return config.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", oidcNonce(state))), nil
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, state, code string) (users.User, error) {
+	config, userInfoURL, err := p.discover(ctx)
+	if err != nil {
+		return users.User{}, err
+	}
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return users.User{}, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return users.User{}, fmt.Errorf("%s token response has no id_token", p.title)
+	}
+	idToken, err := p.verifyIDToken(rawIDToken, oidcNonce(state), time.Now())
+	if err != nil {
+		return users.User{}, err
+	}
+	httpClient := config.Client(ctx, token)
+	httpClient.Timeout = 5 * time.Second
+	req, err := http.NewRequest(http.MethodGet, userInfoURL, nil)
+	if err != nil {
+		return users.User{}, err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return users.User{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return users.User{}, fmt.Errorf("did not get acceptable status code: %v body: %q", resp.Status, body)
+	}
+	var info struct {
+		Sub               string `json:"sub"`
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+		Email             string `json:"email"`
+		Picture           string `json:"picture"`
+		Profile           string `json:"profile"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		return users.User{}, err
+	}
+	if info.Sub != idToken.Sub {
+		// The userinfo response must be about the user that the ID token was issued for.
+		return users.User{}, fmt.Errorf("%s userinfo sub %q doesn't match ID token sub %q", p.title, info.Sub, idToken.Sub)
+	}
+	login := info.PreferredUsername
+	if login == "" {
+		login = strings.SplitN(info.Email, "@", 2)[0]
+	}
+	if login == "" {
+		return users.User{}, fmt.Errorf("%s user has neither preferred_username nor email", p.title)
+	}
+	avatarURL := info.Picture
+	if avatarURL == "" {
+		avatarURL = "https://secure.gravatar.com/avatar?d=mm&f=y&s=96"
+	}
+	return users.User{
+		UserSpec:  users.UserSpec{ID: oidcUserID(info.Sub), Domain: p.domain},
+		Login:     login,
+		Name:      info.Name,
+		Email:     info.Email,
+		AvatarURL: avatarURL,
+		HTMLURL:   info.Profile,
+	}, nil
+}
+
+// idTokenClaims are the ID token claims that oidcProvider validates.
+type idTokenClaims struct {
+	Iss   string       `json:"iss"`
+	Sub   string       `json:"sub"`
+	Aud   oidcAudience `json:"aud"`
+	Azp   string       `json:"azp"`
+	Exp   int64        `json:"exp"`
+	Nonce string       `json:"nonce"`
+}
+
+// verifyIDToken validates the claims of an ID token received from
+// the token endpoint, as described in OpenID Connect Core 1.0, section 3.1.3.7.
+// The token signature isn't checked; it's received directly from the token
+// endpoint, so the TLS connection to the issuer authenticates it instead.
+func (p *oidcProvider) verifyIDToken(raw, nonce string, now time.Time) (idTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return idTokenClaims{}, fmt.Errorf("%s ID token is malformed", p.title)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("%s ID token is malformed: %v", p.title, err)
+	}
+	var claims idTokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("%s ID token is malformed: %v", p.title, err)
+	}
+	switch {
+	case claims.Iss != p.issuer:
+		return idTokenClaims{}, fmt.Errorf("%s ID token has issuer %q, want %q", p.title, claims.Iss, p.issuer)
+	case !claims.Aud.contains(p.config.ClientID):
+		return idTokenClaims{}, fmt.Errorf("%s ID token audience %q doesn't include %q", p.title, claims.Aud, p.config.ClientID)
+	case len(claims.Aud) > 1 && claims.Azp != p.config.ClientID:
+		return idTokenClaims{}, fmt.Errorf("%s ID token authorized party is %q, want %q", p.title, claims.Azp, p.config.ClientID)
+	case !now.Before(time.Unix(claims.Exp, 0)):
+		return idTokenClaims{}, fmt.Errorf("%s ID token has expired", p.title)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return idTokenClaims{}, fmt.Errorf("%s ID token nonce doesn't match", p.title)
+	case claims.Sub == "":
+		return idTokenClaims{}, fmt.Errorf("%s user sub is empty", p.title)
+	}
+	return claims, nil
+}
+
+// oidcAudience is the "aud" claim of an ID token,
+// which is either a single string or an array of strings.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = oidcAudience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a oidcAudience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcNonce derives the nonce of an authentication request from its state.
+// The state is kept in a cookie, so the resulting ID token
+// can only be used by the browser that started signing in.
+func oidcNonce(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// oidcUserID maps an OpenID Connect subject identifier
+// to a non-zero user ID. Numeric subjects are used as is,
+// others are hashed.
+func oidcUserID(sub string) uint64 {
+	if id, err := strconv.ParseUint(sub, 10, 64); err == nil && id != 0 {
+		return id
+	}
+	h := fnv.New64a()
+	h.Write([]byte(sub))
+	if id := h.Sum64(); id != 0 {
+		return id
+	}
+	return 1
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+	"golang.org/x/oauth2"
+)
+
+// Test signing in via an OpenID Connect provider,
+// using a local stand-in identity provider.
+func TestOIDCLogin(t *testing.T) {
+	defer func() {
+		global = state{sessions: make(map[string]session)}
+		authLimiter = newRateLimiter()
+	}()
+	global = state{sessions: make(map[string]session)}
+
+	var (
+		idpDown     = true                 // Whether the identity provider is unavailable.
+		idTokenJSON map[string]interface{} // Claims of ID tokens issued by the token endpoint.
+	)
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			if idpDown {
+				http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 "http://" + req.Host,
+				"authorization_endpoint": "http://" + req.Host + "/authorize",
+				"token_endpoint":         "http://" + req.Host + "/token",
+				"userinfo_endpoint":      "http://" + req.Host + "/userinfo",
+			})
+		case "/token":
+			if req.FormValue("code") != "good-code" {
+				http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			claims, err := json.Marshal(idTokenJSON)
+			if err != nil {
+				panic(err)
+			}
+			json.NewEncoder(w).Encode(map[string]string{
+				"access_token": "idp-token",
+				"token_type":   "Bearer",
+				"id_token": base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." +
+					base64.RawURLEncoding.EncodeToString(claims) + ".c2lnbmF0dXJl",
+			})
+		case "/userinfo":
+			if req.Header.Get("Authorization") != "Bearer idp-token" {
+				http.Error(w, `{"error": "invalid_token"}`, http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{
+				"sub":                "42",
+				"preferred_username": "gopher",
+				"email":              "gopher@example.com",
+			})
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer idp.Close()
+
+	// The identity provider being down doesn't prevent creating the provider.
+	sso, err := newOIDCProvider("sso", "Example SSO", idp.URL, oauth2.Config{ClientID: "home"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersService, userStore, err := newUsersService(webdav.NewMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &sessionsHandler{users: usersService, userStore: userStore, providers: []loginProvider{sso}}
+
+	// signIn signs in via sso. modify, if non-nil, is applied to the claims
+	// of the ID token that the identity provider issues. It returns the
+	// response to the callback request.
+	signIn := func(modify func(claims map[string]interface{})) *httptest.ResponseRecorder {
+		t.Helper()
+
+		// Start signing in.
+		req := httptest.NewRequest(http.MethodPost, "/login/sso", strings.NewReader("return=%2Fblog"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got, want := rr.Code, http.StatusSeeOther; got != want {
+			t.Fatalf("got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+		}
+		location, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := location.Path, "/authorize"; got != want {
+			t.Errorf("got redirect to %q, want %q", got, want)
+		}
+		var cookies []string
+		for _, c := range rr.Result().Cookies() {
+			cookies = append(cookies, c.Name+"="+c.Value)
+		}
+
+		// Come back from the identity provider.
+		idTokenJSON = map[string]interface{}{
+			"iss":   idp.URL,
+			"sub":   "42",
+			"aud":   "home",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": location.Query().Get("nonce"),
+		}
+		if modify != nil {
+			modify(idTokenJSON)
+		}
+		req = httptest.NewRequest(http.MethodGet, "/callback/sso?code=good-code&state="+url.QueryEscape(location.Query().Get("state")), nil)
+		req.Header.Set("Cookie", strings.Join(cookies, "; "))
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Signing in while the identity provider is down fails,
+	// and is retried once it's back up.
+	req := httptest.NewRequest(http.MethodPost, "/login/sso", strings.NewReader("return=%2Fblog"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusServiceUnavailable; got != want {
+		t.Fatalf("got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+	idpDown = false
+
+	// ID tokens that weren't issued to us for this sign in are rejected.
+	for _, tc := range []struct {
+		name   string
+		modify func(claims map[string]interface{})
+	}{
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{"other audience", func(c map[string]interface{}) { c["aud"] = "other-client" }},
+		{"other authorized party", func(c map[string]interface{}) { c["aud"] = []string{"home", "other-client"}; c["azp"] = "other-client" }},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{"other nonce", func(c map[string]interface{}) { c["nonce"] = oidcNonce("other-state") }},
+		{"no nonce", func(c map[string]interface{}) { delete(c, "nonce") }},
+		{"other subject", func(c map[string]interface{}) { c["sub"] = "43" }},
+	} {
+		authLimiter = newRateLimiter()
+		rr := signIn(tc.modify)
+		if got, want := rr.Code, http.StatusUnauthorized; got != want {
+			t.Errorf("%s: got status code %d %s, want %d %s", tc.name, got, http.StatusText(got), want, http.StatusText(want))
+		}
+		global.mu.Lock()
+		n := len(global.sessions)
+		global.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("%s: got %d sessions, want none", tc.name, n)
+		}
+	}
+	authLimiter = newRateLimiter()
+
+	rr = signIn(nil)
+	if got, want := rr.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+	if got, want := rr.Header().Get("Location"), "/blog"; got != want {
+		t.Errorf("got Location header %q, want %q", got, want)
+	}
+
+	wantUser := users.UserSpec{ID: 42, Domain: "127.0.0.1"}
+	global.mu.Lock()
+	var gotSessions []session
+	for _, s := range global.sessions {
+		gotSessions = append(gotSessions, s)
+	}
+	global.mu.Unlock()
+	if len(gotSessions) != 1 || gotSessions[0].UserSpec != wantUser {
+		t.Errorf("got sessions %+v, want one session for %+v", gotSessions, wantUser)
+	}
+	user, err := usersService.Get(context.Background(), wantUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := user.Login, "gopher"; got != want {
+		t.Errorf("got user login %q, want %q", got, want)
+	}
+}
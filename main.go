@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -27,11 +28,18 @@ import (
 
 var (
 	httpFlag       = flag.String("http", ":8080", "Listen for HTTP connections on this address.")
+	sshFlag        = flag.String("ssh", "", "Listen for git SSH connections on this address, if non-empty.")
 	productionFlag = flag.Bool("production", false, "Production mode.")
-	statefileFlag  = flag.String("statefile", "", "File to save/load state (file is deleted after loading).")
+	siteFlag       = flag.String("site", "", "Origin of the site, used for passkeys (default https://dmitri.shuralyov.com in production mode, http://localhost with the -http port otherwise).")
+	statefileFlag  = flag.String("statefile", "", "Legacy state file to import sessions from (file is deleted after loading).")
 )
 
 func main() {
+	// When git runs the home binary as a hook, enforce the push policy and exit.
+	if _, ok := os.LookupEnv(pushPolicyEnv); ok {
+		os.Exit(hookMain())
+	}
+
 	flag.Parse()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -75,13 +83,24 @@ func run(ctx context.Context) error {
 
 		// Create store directories if they're missing.
 		for _, storeName := range []string{
+			"sessions",
+			"tokens",
+			"passkeys",
+			"totp",
+			"policy",
+			"audit",
 			"users",
+			filepath.Join("users", "ssh-keys"),
+			"ssh",
 			"reactions",
 			"notifications",
 			"events",
 			"issues",
 			"usercontent",
 			"repositories",
+			"redirects",
+			"mirrors",
+			"lfs",
 		} {
 			err := os.MkdirAll(filepath.Join(storeDir, storeName), 0700)
 			if err != nil {
@@ -96,12 +115,68 @@ func run(ctx context.Context) error {
 		return err
 	}
 
+	err = global.Load(ctx, webdav.Dir(filepath.Join(storeDir, "sessions")))
+	if err != nil {
+		return fmt.Errorf("global.Load: %v", err)
+	}
+	if *statefileFlag != "" {
+		err := global.LoadAndRemove(ctx, *statefileFlag)
+		global.mu.Lock()
+		n := len(global.sessions)
+		global.mu.Unlock()
+		log.Println("sessions.LoadAndRemove:", n, err)
+	}
+	go global.sweepExpiredPeriodically(ctx, time.Hour)
+	go authLimiter.sweepPeriodically(ctx, time.Hour)
+	err = accessTokens.Load(ctx, webdav.Dir(filepath.Join(storeDir, "tokens")))
+	if err != nil {
+		return fmt.Errorf("accessTokens.Load: %v", err)
+	}
+	err = passkeys.Load(ctx, webdav.Dir(filepath.Join(storeDir, "passkeys")))
+	if err != nil {
+		return fmt.Errorf("passkeys.Load: %v", err)
+	}
+	err = totps.Load(ctx, webdav.Dir(filepath.Join(storeDir, "totp")))
+	if err != nil {
+		return fmt.Errorf("totps.Load: %v", err)
+	}
+	err = policy.Load(ctx, webdav.Dir(filepath.Join(storeDir, "policy")))
+	if err != nil {
+		return fmt.Errorf("policy.Load: %v", err)
+	}
+	err = pushPolicies.Load(ctx, webdav.Dir(filepath.Join(storeDir, "policy")))
+	if err != nil {
+		return fmt.Errorf("pushPolicies.Load: %v", err)
+	}
+	err = repoVisibilities.Load(ctx, webdav.Dir(filepath.Join(storeDir, "policy")))
+	if err != nil {
+		return fmt.Errorf("repoVisibilities.Load: %v", err)
+	}
+	err = pushMirrors.Load(ctx, webdav.Dir(filepath.Join(storeDir, "mirrors")))
+	if err != nil {
+		return fmt.Errorf("pushMirrors.Load: %v", err)
+	}
+	err = pullMirrors.Load(ctx, webdav.Dir(filepath.Join(storeDir, "mirrors")))
+	if err != nil {
+		return fmt.Errorf("pullMirrors.Load: %v", err)
+	}
+	err = lfsObjects.Load(ctx, webdav.Dir(filepath.Join(storeDir, "lfs")), filepath.Join(storeDir, "lfs", "objects"))
+	if err != nil {
+		return fmt.Errorf("lfsObjects.Load: %v", err)
+	}
+	go lfsObjects.saveUsagePeriodically(ctx, time.Minute)
+	auditLog.SetStore(webdav.Dir(filepath.Join(storeDir, "audit")))
+
 	users, userStore, err := newUsersService(
 		webdav.Dir(filepath.Join(storeDir, "users")),
 	)
 	if err != nil {
 		return fmt.Errorf("newUsersService: %v", err)
 	}
+	err = sshKeys.Load(ctx, webdav.Dir(filepath.Join(storeDir, "users", "ssh-keys")))
+	if err != nil {
+		return fmt.Errorf("sshKeys.Load: %v", err)
+	}
 	reactions, err := newReactionsService(
 		webdav.Dir(filepath.Join(storeDir, "reactions")),
 		users,
@@ -124,8 +199,9 @@ func run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("newEventsService: %v", err)
 	}
+	issuesStore := webdav.Dir(filepath.Join(storeDir, "issues"))
 	issuesService, err := newIssuesService(
-		webdav.Dir(filepath.Join(storeDir, "issues")),
+		issuesStore,
 		notifications, events, users, githubRouter,
 	)
 	if err != nil {
@@ -133,14 +209,54 @@ func run(ctx context.Context) error {
 	}
 	changeService := newChangeService(reactions, notifications, users, githubRouter)
 
-	sessionsHandler := &sessionsHandler{users, userStore}
-	http.Handle("/login/github", sessionsHandler)
-	http.Handle("/callback/github", sessionsHandler)
+	loginProviders, err := newLoginProviders()
+	if err != nil {
+		return fmt.Errorf("newLoginProviders: %v", err)
+	}
+	sessionsHandler := &sessionsHandler{users, userStore, loginProviders}
+	for _, p := range loginProviders {
+		http.Handle("/login/"+p.Name(), sessionsHandler)
+		http.Handle("/callback/"+p.Name(), sessionsHandler)
+	}
 	http.Handle("/logout", sessionsHandler)
 	http.Handle("/login", sessionsHandler)
 	http.Handle("/sessions", sessionsHandler)
+	http.Handle("/sessions/revoke", sessionsHandler)
+	http.Handle("/sessions/revoke-all", sessionsHandler)
+	http.Handle("/settings/tokens", sessionsHandler)
+	http.Handle("/settings/tokens/revoke", sessionsHandler)
+	http.Handle("/login/passkey/begin", sessionsHandler)
+	http.Handle("/login/passkey/finish", sessionsHandler)
+	http.Handle("/settings/passkeys", sessionsHandler)
+	http.Handle("/settings/passkeys/register/begin", sessionsHandler)
+	http.Handle("/settings/passkeys/register/finish", sessionsHandler)
+	http.Handle("/settings/passkeys/delete", sessionsHandler)
+	http.Handle("/settings/ssh-keys", sessionsHandler)
+	http.Handle("/settings/ssh-keys/delete", sessionsHandler)
+	http.Handle("/settings/totp", sessionsHandler)
+	http.Handle("/settings/totp/enroll", sessionsHandler)
+	http.Handle("/settings/totp/confirm", sessionsHandler)
+	http.Handle("/settings/totp/disable", sessionsHandler)
+	http.Handle("/step-up", sessionsHandler)
+	http.Handle("/admin/roles", sessionsHandler)
+	http.Handle("/admin/roles/revoke", sessionsHandler)
+	http.Handle("/admin/push-policies", sessionsHandler)
+	http.Handle("/admin/push-policies/remove", sessionsHandler)
+	http.Handle("/admin/push-mirrors", sessionsHandler)
+	http.Handle("/admin/push-mirrors/remove", sessionsHandler)
+	http.Handle("/admin/pull-mirrors", sessionsHandler)
+	http.Handle("/admin/pull-mirrors/remove", sessionsHandler)
+	http.Handle("/admin/pull-mirrors/fetch", sessionsHandler)
+	http.Handle("/admin/repositories", sessionsHandler)
+	http.Handle("/admin/repositories/rename", sessionsHandler)
+	http.Handle("/admin/repositories/delete", sessionsHandler)
+	http.Handle("/admin/repositories/visibility", sessionsHandler)
+	http.Handle("/admin/audit", sessionsHandler)
+	http.Handle("/admin/blocked", sessionsHandler)
+	http.Handle("/admin/blocked/unblock", sessionsHandler)
 
 	usersAPIHandler := httphandler.Users{Users: users}
+	http.Handle("/api/token", cookieAuth{httputil.ErrorHandler(users, serveAPIToken)})
 	http.Handle("/api/userspec", cookieAuth{httputil.ErrorHandler(users, usersAPIHandler.GetAuthenticatedSpec)})
 	http.Handle("/api/user", cookieAuth{httputil.ErrorHandler(users, usersAPIHandler.GetAuthenticated)})
 	http.Handle("/api/user/", cookieAuth{httputil.ErrorHandler(users, usersAPIHandler.Get)})
@@ -150,7 +266,10 @@ func run(ctx context.Context) error {
 	http.Handle("/api/react/list", cookieAuth{httputil.ErrorHandler(users, reactionsAPIHandler.List)})
 
 	eventsAPIHandler := httphandler.Events{Events: events}
-	http.Handle("/api/events/list", headerAuth{httputil.ErrorHandler(users, eventsAPIHandler.List)})
+	http.Handle("/api/events/list", frontendAuth{httputil.ErrorHandler(users, eventsAPIHandler.List)})
+
+	http.Handle("/api/repositories", headerAuth{httputil.ErrorHandler(users, serveRepositoriesAPI)})
+	http.Handle("/api/repositories/", headerAuth{httputil.ErrorHandler(users, serveRepositoriesAPI)})
 
 	userContentHandler := userContentHandler{
 		store: webdav.Dir(filepath.Join(storeDir, "usercontent")),
@@ -186,10 +305,15 @@ func run(ctx context.Context) error {
 
 	// Code repositories.
 	reposDir := filepath.Join(storeDir, "repositories")
-	code, err := code.Discover(reposDir)
+	code, err := code.NewStore(reposDir)
+	if err != nil {
+		return fmt.Errorf("code.NewStore: %v", err)
+	}
+	err = repositories.Load(ctx, code, issuesStore, webdav.Dir(filepath.Join(storeDir, "redirects")))
 	if err != nil {
-		return fmt.Errorf("code.Discover: %v", err)
+		return fmt.Errorf("repositories.Load: %v", err)
 	}
+	go pushMirrors.Run(ctx, reposDir)
 	gitUsers, err := initGitUsers(users)
 	if err != nil {
 		return fmt.Errorf("initGitUsers: %v", err)
@@ -198,7 +322,20 @@ func run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("initGitHandler: %v", err)
 	}
-	codeHandler := codeHandler{code, reposDir, issuesApp, changesApp, issuesService, changeService, notifications, users, gitUsers}
+	defer func() {
+		err := gitHandler.Close()
+		if err != nil {
+			log.Println("gitHandler.Close:", err)
+		}
+	}()
+	go pullMirrors.Run(ctx, gitHandler)
+	archives, err := newArchiveCache()
+	if err != nil {
+		return fmt.Errorf("newArchiveCache: %v", err)
+	}
+	codeHandler := codeHandler{code, reposDir, issuesApp, changesApp, issuesService, changeService, notifications, users, gitUsers, archives}
+	goProxyHandler := &goProxyHandler{code: code, reposDir: reposDir, cache: archives, users: users}
+	http.Handle("/api/goproxy/", http.StripPrefix("/api/goproxy", httputil.ErrorHandler(users, goProxyHandler.ServeHTTP)))
 	servePackagesMaybe := initPackages(code, notifications, users)
 
 	initTalks(
@@ -231,6 +368,10 @@ func run(ctx context.Context) error {
 		if ok := codeHandler.ServeCodeMaybe(w, req); ok {
 			return
 		}
+		// Redirect requests for renamed repos, if the request matches.
+		if ok := repositories.ServeRedirectMaybe(w, req); ok {
+			return
+		}
 		// Serve remaining import path pattern queries, if the request matches.
 		if ok := servePackagesMaybe(w, req); ok {
 			return
@@ -239,15 +380,33 @@ func run(ctx context.Context) error {
 		staticFiles.ServeHTTP(w, req)
 	})
 
-	if *statefileFlag != "" {
-		err := global.LoadAndRemove(*statefileFlag)
-		global.mu.Lock()
-		n := len(global.sessions)
-		global.mu.Unlock()
-		log.Println("sessions.LoadAndRemove:", n, err)
+	if *sshFlag != "" {
+		sshServer, err := newGitSSHServer(ctx, gitHandler, webdav.Dir(filepath.Join(storeDir, "ssh")))
+		if err != nil {
+			return fmt.Errorf("newGitSSHServer: %v", err)
+		}
+		sshListener, err := net.Listen("tcp", *sshFlag)
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-ctx.Done()
+			err := sshListener.Close()
+			if err != nil {
+				log.Println("sshListener.Close:", err)
+			}
+		}()
+		go func() {
+			log.Println("Starting SSH server.")
+			err := sshServer.Serve(sshListener)
+			if ctx.Err() == nil {
+				log.Println("sshServer.Serve:", err)
+			}
+			log.Println("Ended SSH server.")
+		}()
 	}
 
-	server := &http.Server{Addr: *httpFlag, Handler: top{httputil.GzipHandler(http.DefaultServeMux)}}
+	server := &http.Server{Addr: *httpFlag, Handler: serverHandler(http.DefaultServeMux)}
 
 	go func() {
 		<-ctx.Done()
@@ -266,14 +425,24 @@ func run(ctx context.Context) error {
 
 	log.Println("Ended HTTP server.")
 
-	if *statefileFlag != "" {
-		err := global.Save(*statefileFlag)
-		log.Println("sessions.Save:", err)
-	}
-
 	return nil
 }
 
+// serverHandler returns the top-level handler of the HTTP server that serves mux.
+// Responses are gzip compressed, except ones to git and Git LFS requests.
+// Those are streamed to the client as they're produced, and are mostly
+// compressed already.
+func serverHandler(mux http.Handler) http.Handler {
+	gzipped := httputil.GzipHandler(mux)
+	return top{http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isGitRequest(req) {
+			mux.ServeHTTP(w, req)
+			return
+		}
+		gzipped.ServeHTTP(w, req)
+	})}
+}
+
 // top adds some instrumentation on top of Handler.
 type top struct{ Handler http.Handler }
 
@@ -312,6 +481,14 @@ func (rw *responseWriter) Write(p []byte) (n int, err error) {
 	return rw.ResponseWriter.Write(p)
 }
 
+// Flush flushes buffered data to the client,
+// if the underlying http.ResponseWriter supports it.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // skipDot returns src without dot files.
 func skipDot(src http.FileSystem) http.FileSystem {
 	skip := func(path string, fi os.FileInfo) bool {
@@ -333,7 +510,7 @@ type detailedForAdmin struct {
 
 func (d detailedForAdmin) ServeError(w http.ResponseWriter, req *http.Request, err error) {
 	switch user, e := d.Users.GetAuthenticated(req.Context()); {
-	case e == nil && user.SiteAdmin:
+	case e == nil && policy.Allowed(user.UserSpec, "", roleAdmin):
 		httpgzip.Detailed(w, req, err)
 	default:
 		httpgzip.NonSpecific(w, req, err)
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/shurcooL/home/component"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// pushMirror is a secondary remote that a repository is pushed to
+// after every push to it, e.g., to keep a copy on GitHub in sync.
+// Branches and tags are mirrored, including force pushes and deletions.
+type pushMirror struct {
+	Repo string // Repository spec. E.g., "dmitri.shuralyov.com/kebabcase".
+	URL  string // Remote URL. E.g., "git@github.com:shurcooL/kebabcase.git".
+
+	// Sync status. A mirror stays pending until it's synced successfully,
+	// and failed syncs are retried with increasing delays.
+	Pending     bool      // Whether the mirror needs to be synced.
+	Seq         int64     // Incremented each time a sync is queued.
+	NextAttempt time.Time // When to sync next, if pending.
+	Attempts    int       // Number of failed syncs since the last successful one.
+	LastAttempt time.Time // Zero if never attempted.
+	LastSync    time.Time // Last successful sync. Zero if never synced.
+	LastError   string    // Error of the last sync. Empty if it was successful.
+}
+
+// DisplayURL returns the URL of m without any credentials in it,
+// so that it's safe to display.
+func (m pushMirror) DisplayURL() string { return displayRemoteURL(m.URL) }
+
+// ID returns an identifier of m that is safe to put in URLs,
+// unlike m.URL, which may contain credentials.
+// It's the hex-encoded SHA-256 digest of m's repo and URL.
+func (m pushMirror) ID() string {
+	sum := sha256.Sum256([]byte(m.Repo + "\x00" + m.URL))
+	return hex.EncodeToString(sum[:])
+}
+
+const (
+	// gitMirrorTimeout is how long syncing a push mirror may take.
+	gitMirrorTimeout = 10 * time.Minute
+
+	// Delays before retrying a failed sync start at pushMirrorMinRetryDelay,
+	// double after each failure, and are capped at pushMirrorMaxRetryDelay.
+	pushMirrorMinRetryDelay = time.Minute
+	pushMirrorMaxRetryDelay = 6 * time.Hour
+)
+
+// pushMirrorRetryDelay returns how long to wait before retrying
+// a sync that has failed attempts times in a row.
+func pushMirrorRetryDelay(attempts int) time.Duration {
+	d := pushMirrorMinRetryDelay
+	for i := 1; i < attempts && d < pushMirrorMaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > pushMirrorMaxRetryDelay {
+		d = pushMirrorMaxRetryDelay
+	}
+	return d
+}
+
+// pushMirrors is the store of push mirrors.
+// It's also the persistent queue of pending syncs.
+var pushMirrors pushMirrorStore
+
+type pushMirrorStore struct {
+	mu      sync.Mutex
+	mirrors []pushMirror // Sorted by repo, then URL.
+	sched   mirrorScheduler
+
+	// store is where mirrors are persisted. If nil, mirrors are only kept in memory.
+	store webdav.FileSystem
+}
+
+// pushMirrorsPath is the path of the file in the mirrors store
+// where push mirrors are persisted.
+const pushMirrorsPath = "/push-mirrors"
+
+// Load sets root as the push mirror store, and loads mirrors from it.
+// Syncs that were pending are resumed by Run.
+func (ms *pushMirrorStore) Load(ctx context.Context, root webdav.FileSystem) error {
+	var mirrors []pushMirror
+	err := gobDecodeFile(ctx, root, pushMirrorsPath, &mirrors)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ms.mu.Lock()
+	ms.store = root
+	ms.mirrors = mirrors
+	ms.mu.Unlock()
+	return nil
+}
+
+// List lists push mirrors of repo, sorted by URL.
+// If repo is empty, push mirrors of all repositories are listed.
+func (ms *pushMirrorStore) List(repo string) []pushMirror {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var mirrors []pushMirror
+	for _, m := range ms.mirrors {
+		if repo != "" && m.Repo != repo {
+			continue
+		}
+		mirrors = append(mirrors, m)
+	}
+	return mirrors
+}
+
+// lookUp returns the push mirror with id, if any.
+func (ms *pushMirrorStore) lookUp(id string) (pushMirror, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, m := range ms.mirrors {
+		if m.ID() == id {
+			return m, true
+		}
+	}
+	return pushMirror{}, false
+}
+
+// Add adds a push mirror to remoteURL for repo, and queues its first sync.
+// It returns os.ErrExist if repo is already mirrored to remoteURL.
+func (ms *pushMirrorStore) Add(ctx context.Context, repo, remoteURL string) error {
+	if err := checkRemoteURL(remoteURL); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mirrors := []pushMirror{{Repo: repo, URL: remoteURL, Pending: true, Seq: 1, NextAttempt: time.Now()}}
+	for _, m := range ms.mirrors {
+		if m.Repo == repo && m.URL == remoteURL {
+			return os.ErrExist
+		}
+		mirrors = append(mirrors, m)
+	}
+	sortPushMirrors(mirrors)
+	err := ms.set(ctx, mirrors)
+	if err != nil {
+		return err
+	}
+	ms.sched.wakeUp()
+	return nil
+}
+
+// Remove removes the push mirror to remoteURL of repo.
+// It returns os.ErrNotExist if there's no such mirror.
+func (ms *pushMirrorStore) Remove(ctx context.Context, repo, remoteURL string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var mirrors []pushMirror
+	for _, m := range ms.mirrors {
+		if m.Repo == repo && m.URL == remoteURL {
+			continue
+		}
+		mirrors = append(mirrors, m)
+	}
+	if len(mirrors) == len(ms.mirrors) {
+		return os.ErrNotExist
+	}
+	return ms.set(ctx, mirrors)
+}
+
+// RenameRepo moves push mirrors of repository from to repository to.
+// Push mirrors that to had before are removed.
+func (ms *pushMirrorStore) RenameRepo(ctx context.Context, from, to string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var (
+		mirrors []pushMirror
+		changed bool
+	)
+	for _, m := range ms.mirrors {
+		switch m.Repo {
+		case from:
+			m.Repo, changed = to, true
+		case to:
+			changed = true
+			continue
+		}
+		mirrors = append(mirrors, m)
+	}
+	if !changed {
+		return nil
+	}
+	sortPushMirrors(mirrors)
+	return ms.set(ctx, mirrors)
+}
+
+// RemoveRepo removes all push mirrors of repo.
+func (ms *pushMirrorStore) RemoveRepo(ctx context.Context, repo string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var mirrors []pushMirror
+	for _, m := range ms.mirrors {
+		if m.Repo == repo {
+			continue
+		}
+		mirrors = append(mirrors, m)
+	}
+	if len(mirrors) == len(ms.mirrors) {
+		return nil
+	}
+	return ms.set(ctx, mirrors)
+}
+
+// Enqueue queues syncs of all push mirrors of repo, e.g., after a push to it.
+// Syncs that are waiting to be retried are attempted right away.
+func (ms *pushMirrorStore) Enqueue(ctx context.Context, repo string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mirrors := append([]pushMirror(nil), ms.mirrors...)
+	var changed bool
+	now := time.Now()
+	for i := range mirrors {
+		if mirrors[i].Repo != repo {
+			continue
+		}
+		mirrors[i].Pending = true
+		mirrors[i].Seq++
+		mirrors[i].NextAttempt = now
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	err := ms.set(ctx, mirrors)
+	if err != nil {
+		return err
+	}
+	ms.sched.wakeUp()
+	return nil
+}
+
+// Run syncs pending push mirrors as they become due, until ctx is done.
+// The repositories are in the repository store at reposDir.
+func (ms *pushMirrorStore) Run(ctx context.Context, reposDir string) {
+	ms.sched.run(ctx, func(now time.Time) (func(), time.Duration, <-chan struct{}) {
+		m, wait, wake := ms.next(now)
+		return func() {
+			err := syncPushMirror(ctx, filepath.Join(reposDir, filepath.FromSlash(m.Repo)), m.URL)
+			if ctx.Err() != nil {
+				// Shutting down, so the sync will be resumed after restart.
+				return
+			}
+			if err != nil {
+				log.Printf("pushMirrorStore.Run: syncing %s to %s: %v\n", m.Repo, m.DisplayURL(), err)
+			}
+			ms.finish(ctx, m, err, time.Now())
+		}, wait, wake
+	})
+}
+
+// next returns the pending push mirror that is due the soonest,
+// and how long until it's due. If there are no pending mirrors, wait is
+// a long time. The returned channel is closed when a sync is queued.
+func (ms *pushMirrorStore) next(now time.Time) (_ pushMirror, wait time.Duration, wake <-chan struct{}) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var (
+		next  pushMirror
+		found bool
+	)
+	for _, m := range ms.mirrors {
+		if !m.Pending || (found && !m.NextAttempt.Before(next.NextAttempt)) {
+			continue
+		}
+		next, found = m, true
+	}
+	if !found {
+		return pushMirror{}, pushMirrorMaxRetryDelay, ms.sched.wakeChan()
+	}
+	return next, next.NextAttempt.Sub(now), ms.sched.wakeChan()
+}
+
+// finish records the result err of syncing push mirror m at time now.
+// If another sync was queued in the meantime, m stays pending.
+func (ms *pushMirrorStore) finish(ctx context.Context, m pushMirror, err error, now time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mirrors := append([]pushMirror(nil), ms.mirrors...)
+	i := sort.Search(len(mirrors), func(i int) bool {
+		return mirrors[i].Repo > m.Repo || (mirrors[i].Repo == m.Repo && mirrors[i].URL >= m.URL)
+	})
+	if i == len(mirrors) || mirrors[i].Repo != m.Repo || mirrors[i].URL != m.URL {
+		// Removed in the meantime.
+		return
+	}
+	cur := &mirrors[i]
+	requeued := cur.Seq != m.Seq
+	cur.LastAttempt = now
+	if err == nil {
+		cur.Pending = requeued
+		cur.Attempts = 0
+		cur.LastSync = now
+		cur.LastError = ""
+	} else {
+		cur.Attempts++
+		cur.LastError = err.Error()
+		if !requeued {
+			cur.NextAttempt = now.Add(pushMirrorRetryDelay(cur.Attempts))
+		}
+	}
+	if err := ms.set(ctx, mirrors); err != nil {
+		log.Println("pushMirrorStore.finish: set:", err)
+	}
+}
+
+// set persists mirrors and makes them take effect. ms.mu must be held.
+func (ms *pushMirrorStore) set(ctx context.Context, mirrors []pushMirror) error {
+	if ms.store != nil {
+		err := gobEncodeFile(ctx, ms.store, pushMirrorsPath, mirrors)
+		if err != nil {
+			return err
+		}
+	}
+	ms.mirrors = mirrors
+	return nil
+}
+
+// mirrorScheduler runs the syncs or fetches of a mirror store
+// as they become due. Its wakeUp and wakeChan methods must be called
+// with the mutex of the mirror store held.
+type mirrorScheduler struct {
+	wake chan struct{} // Wakes up run when a job is scheduled. Created lazily.
+}
+
+// run runs jobs as they become due, until ctx is done.
+// next returns the job that is due the soonest, how long until it's due,
+// and a channel from wakeChan, which is closed when another job is scheduled.
+func (s *mirrorScheduler) run(ctx context.Context, next func(now time.Time) (job func(), wait time.Duration, wake <-chan struct{})) {
+	for {
+		job, wait, wake := next(time.Now())
+		if wait <= 0 {
+			job()
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-wake:
+			t.Stop()
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// wakeChan returns a channel that is closed by the next wakeUp.
+func (s *mirrorScheduler) wakeChan() <-chan struct{} {
+	if s.wake == nil {
+		s.wake = make(chan struct{})
+	}
+	return s.wake
+}
+
+// wakeUp wakes up run, if it's waiting.
+func (s *mirrorScheduler) wakeUp() {
+	if s.wake != nil {
+		close(s.wake)
+		s.wake = nil
+	}
+}
+
+func sortPushMirrors(mirrors []pushMirror) {
+	sort.Slice(mirrors, func(i, j int) bool {
+		if mirrors[i].Repo != mirrors[j].Repo {
+			return mirrors[i].Repo < mirrors[j].Repo
+		}
+		return mirrors[i].URL < mirrors[j].URL
+	})
+}
+
+// checkRemoteURL checks that remoteURL is a git remote URL
+// that can't be mistaken for an option.
+func checkRemoteURL(remoteURL string) error {
+	if remoteURL == "" || strings.HasPrefix(remoteURL, "-") || strings.ContainsAny(remoteURL, " \t\r\n") {
+		return fmt.Errorf("bad remote URL %q", remoteURL)
+	}
+	return nil
+}
+
+// displayRemoteURL returns remoteURL without any credentials in it,
+// so that it's safe to display.
+func displayRemoteURL(remoteURL string) string {
+	u, err := url.Parse(remoteURL)
+	if err != nil || u.Scheme == "" {
+		// Not a URL, e.g., "git@github.com:shurcooL/kebabcase.git".
+		return remoteURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// syncPushMirror pushes all branches and tags of the repository at dir
+// to remoteURL, so that they're the same there. Branches and tags that
+// don't exist in the repository anymore are deleted from remoteURL.
+func syncPushMirror(ctx context.Context, dir, remoteURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, gitMirrorTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "push", "--force", "--prune", "--quiet", remoteURL,
+		"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0") // Never wait for credentials.
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git push: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// renderPushMirrorStatus renders the last sync status of mirrors
+// for the repository page. Errors are left out, since they may contain
+// details about the remotes. They're shown on the admin page.
+func renderPushMirrorStatus(mirrors []pushMirror) []*html.Node {
+	var nodes []*html.Node
+	for _, m := range mirrors {
+		var status string
+		switch {
+		case m.LastSync.IsZero() && m.LastError == "":
+			status = "not synced yet"
+		case m.LastSync.IsZero():
+			status = "sync failing, retrying"
+		case m.LastError != "":
+			status = fmt.Sprintf("last synced %s, sync failing, retrying", humanize.Time(m.LastSync))
+		default:
+			status = fmt.Sprintf("last synced %s", humanize.Time(m.LastSync))
+		}
+		div := htmlg.DivClass("push-mirror", htmlg.Text(fmt.Sprintf("Mirrored to %s (%s).", m.DisplayURL(), status)))
+		div.Attr = append(div.Attr, html.Attribute{Key: atom.Style.String(), Val: `color: gray; font-size: 13px; margin-bottom: 8px;`})
+		nodes = append(nodes, div)
+	}
+	return nodes
+}
+
+// servePushMirrors serves the push mirrors admin page,
+// and adds a push mirror when the page is POSTed to.
+func (h *sessionsHandler) servePushMirrors(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Push mirrors can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return nil, err
+	}
+
+	if req.Method == http.MethodPost {
+		repo := strings.TrimSpace(req.PostFormValue("repo"))
+		remoteURL := strings.TrimSpace(req.PostFormValue("url"))
+		if d, ok := repositories.code.Code().ByImportPath[repo]; !ok || !d.IsRepoRoot() {
+			return nil, httperror.BadRequest{Err: fmt.Errorf("repository %q doesn't exist", repo)}
+		}
+		err := pushMirrors.Add(req.Context(), repo, remoteURL)
+		if os.IsExist(err) {
+			return nil, httperror.BadRequest{Err: fmt.Errorf("repository %q is already mirrored to %q", repo, remoteURL)}
+		} else if err != nil {
+			return nil, httperror.BadRequest{Err: err}
+		}
+		auditLog.Record(req, auditPushMirrorAdd, s.UserSpec, repo, pushMirror{URL: remoteURL}.DisplayURL())
+		return nil, httperror.Redirect{URL: "/admin/push-mirrors"}
+	}
+
+	auditLog.Record(req, auditAdminView, s.UserSpec, req.URL.Path, "")
+
+	nodes := []*html.Node{htmlg.H3(htmlg.Text("Push mirrors"))}
+	mirrors := pushMirrors.List("")
+	for _, m := range mirrors {
+		status := "never synced"
+		if !m.LastSync.IsZero() {
+			status = "last synced " + humanize.Time(m.LastSync)
+		}
+		if m.Pending {
+			status += fmt.Sprintf(", next attempt %s", humanize.Time(m.NextAttempt))
+		}
+		if m.LastError != "" {
+			status += fmt.Sprintf(", %d failed attempts, last error: %s", m.Attempts, m.LastError)
+		}
+		remove := component.PostButton{
+			Action:    "/admin/push-mirrors/remove?" + url.Values{"id": {m.ID()}}.Encode(),
+			Text:      "Remove",
+			ReturnURL: "/admin/push-mirrors",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		div := htmlg.Div(htmlg.Text(fmt.Sprintf("Repo: %s URL: %s (%s) ", m.Repo, m.DisplayURL(), status)))
+		htmlg.AppendChildren(div, remove.Render()...)
+		nodes = append(nodes, div)
+	}
+	if len(mirrors) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No push mirrors.")),
+		)
+	}
+	nodes = append(nodes, addPushMirrorForm(csrfToken(s.rawAccessToken)))
+	return nodes, nil
+}
+
+// addPushMirrorForm renders a form for adding a push mirror.
+func addPushMirrorForm(csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/admin/push-mirrors"},
+			{Key: atom.Style.String(), Val: `margin-top: 20px;`},
+		},
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Repository (e.g., dmitri.shuralyov.com/kebabcase): "), textInput("repo", "")))
+	form.AppendChild(htmlg.Div(htmlg.Text("Mirror URL (e.g., git@github.com:shurcooL/kebabcase.git): "), textInput("url", "")))
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(htmlg.Div(submitInput("Add push mirror")))
+	return form
+}
+
+// serveRemovePushMirror removes the push mirror specified by the id query parameter.
+func (h *sessionsHandler) serveRemovePushMirror(req *http.Request, s *session) error {
+	// Authorization check. Push mirrors can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	m, ok := pushMirrors.lookUp(req.URL.Query().Get("id"))
+	if !ok {
+		return &os.PathError{Op: "remove", Path: req.URL.String(), Err: os.ErrNotExist}
+	}
+	err := pushMirrors.Remove(req.Context(), m.Repo, m.URL)
+	if os.IsNotExist(err) {
+		return &os.PathError{Op: "remove", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditPushMirrorRemove, s.UserSpec, m.Repo, m.DisplayURL())
+	return httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+}
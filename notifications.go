@@ -55,10 +55,10 @@ func initNotifications(mux *http.ServeMux, root webdav.FileSystem, users users.S
 
 	// Register HTTP API endpoints.
 	notificationsAPIHandler := httphandler.Notifications{Notifications: notificationsService}
-	mux.Handle(httproute.List, headerAuth{httputil.ErrorHandler(users, notificationsAPIHandler.List)})
-	mux.Handle(httproute.Count, headerAuth{httputil.ErrorHandler(users, notificationsAPIHandler.Count)})
-	mux.Handle(httproute.MarkRead, headerAuth{httputil.ErrorHandler(users, notificationsAPIHandler.MarkRead)})
-	mux.Handle(httproute.MarkAllRead, headerAuth{httputil.ErrorHandler(users, notificationsAPIHandler.MarkAllRead)})
+	mux.Handle(httproute.List, frontendAuth{httputil.ErrorHandler(users, notificationsAPIHandler.List)})
+	mux.Handle(httproute.Count, frontendAuth{httputil.ErrorHandler(users, notificationsAPIHandler.Count)})
+	mux.Handle(httproute.MarkRead, frontendAuth{httputil.ErrorHandler(users, notificationsAPIHandler.MarkRead)})
+	mux.Handle(httproute.MarkAllRead, frontendAuth{httputil.ErrorHandler(users, notificationsAPIHandler.MarkAllRead)})
 
 	// Register notifications app endpoints.
 	opt := notificationsapp.Options{
@@ -99,6 +99,7 @@ func initNotifications(mux *http.ServeMux, root webdav.FileSystem, users users.S
 		header := component.Header{
 			CurrentUser:       authenticatedUser,
 			NotificationCount: nc,
+			CSRFToken:         csrfTokenFromContext(req),
 			ReturnURL:         returnURL,
 		}
 		return []htmlg.Component{header}, nil
@@ -100,6 +100,7 @@ func (h *packageHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) err
 	header := component.Header{
 		CurrentUser:       authenticatedUser,
 		NotificationCount: nc,
+		CSRFToken:         csrfTokenFromContext(req),
 		ReturnURL:         req.RequestURI,
 	}
 	err = htmlg.RenderComponents(w, header)
@@ -32,7 +32,7 @@ var packagesHTML = template.Must(template.New("").Parse(`<html>
 	</head>
 	<body>`))
 
-func initPackages(code code.Code, notifications notifications.Service, usersService users.Service) func(w http.ResponseWriter, req *http.Request) bool {
+func initPackages(code *code.Store, notifications notifications.Service, usersService users.Service) func(w http.ResponseWriter, req *http.Request) bool {
 	packagesHandler := cookieAuth{httputil.ErrorHandler(usersService, func(w http.ResponseWriter, req *http.Request) error {
 		if req.Method != "GET" {
 			return httperror.Method{Allowed: []string{"GET"}}
@@ -81,6 +81,7 @@ func initPackages(code code.Code, notifications notifications.Service, usersServ
 		header := component.Header{
 			CurrentUser:       authenticatedUser,
 			NotificationCount: nc,
+			CSRFToken:         csrfTokenFromContext(req),
 			ReturnURL:         returnURL,
 		}
 		err = htmlg.RenderComponents(w, header)
@@ -102,7 +103,8 @@ func initPackages(code code.Code, notifications notifications.Service, usersServ
 
 		// We know that "dmitri.shuralyov.com/..." comes before "github.com/...",
 		// that's why code.Sorted, githubPackages are guaranteed to be in alphabetical order.
-		err = renderPackages(w, expandPattern(code.Sorted, githubPackages, importPathPattern))
+		packages := expandPattern(code.Code().Sorted, githubPackages, importPathPattern)
+		err = renderPackages(w, listedPackages(authenticatedUser.UserSpec, packages, importPathPattern))
 		if err != nil {
 			return err
 		}
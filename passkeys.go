@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/shurcooL/home/component"
+	"github.com/shurcooL/home/httputil"
+	"github.com/shurcooL/home/internal/webauthn"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// passkey is a WebAuthn credential that a user registered
+// to sign in with, as an alternative to a login provider.
+type passkey struct {
+	ID        string // Base64url-encoded credential ID.
+	Name      string // Name given by the user. E.g., "Laptop".
+	UserSpec  users.UserSpec
+	PublicKey []byte // COSE_Key encoded public key.
+	SignCount uint32
+	CreatedAt time.Time
+	LastUsed  time.Time // Zero if never used to sign in.
+}
+
+// passkeys is the store of passkeys.
+var passkeys = passkeyStore{passkeys: make(map[string]passkey)}
+
+type passkeyStore struct {
+	mu       sync.Mutex
+	passkeys map[string]passkey // Passkey ID -> Passkey.
+
+	// store is where passkeys are persisted. If nil, passkeys are only kept in memory.
+	store webdav.FileSystem
+}
+
+// Load sets root as the passkey store, and loads all passkeys from it.
+func (ps *passkeyStore) Load(ctx context.Context, root webdav.FileSystem) error {
+	dir, err := root.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	fis, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.store = root
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		var pk passkey
+		err := gobDecodeFile(ctx, root, "/"+fi.Name(), &pk)
+		if err != nil {
+			log.Printf("passkeyStore.Load: skipping passkey file %q: %v\n", fi.Name(), err)
+			continue
+		}
+		ps.passkeys[pk.ID] = pk
+	}
+	return nil
+}
+
+// Add adds passkey pk. It returns os.ErrExist if a passkey
+// with the same credential ID is already registered.
+func (ps *passkeyStore) Add(ctx context.Context, pk passkey) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.passkeys[pk.ID]; ok {
+		return os.ErrExist
+	}
+	return ps.put(ctx, pk)
+}
+
+// List lists passkeys of user, newest first.
+func (ps *passkeyStore) List(user users.UserSpec) []passkey {
+	var pks []passkey
+	ps.mu.Lock()
+	for _, pk := range ps.passkeys {
+		if pk.UserSpec != user {
+			continue
+		}
+		pks = append(pks, pk)
+	}
+	ps.mu.Unlock()
+	sort.Slice(pks, func(i, j int) bool { return pks[i].CreatedAt.After(pks[j].CreatedAt) })
+	return pks
+}
+
+// Remove removes the passkey with id that belongs to user.
+// It returns os.ErrNotExist if user has no such passkey.
+func (ps *passkeyStore) Remove(ctx context.Context, user users.UserSpec, id string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pk, ok := ps.passkeys[id]
+	if !ok || pk.UserSpec != user {
+		return os.ErrNotExist
+	}
+	delete(ps.passkeys, id)
+	if ps.store != nil {
+		return ps.store.RemoveAll(ctx, "/"+id)
+	}
+	return nil
+}
+
+// lookUp returns the passkey with id, if any.
+func (ps *passkeyStore) lookUp(id string) (passkey, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pk, ok := ps.passkeys[id]
+	return pk, ok
+}
+
+// Used records that the passkey with id was used to sign in,
+// and that its authenticator's signature counter is now signCount.
+// It fails if signCount doesn't increase past the stored counter,
+// so that the same assertion can't be used by two concurrent sign ins.
+func (ps *passkeyStore) Used(ctx context.Context, id string, signCount uint32) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pk, ok := ps.passkeys[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if (signCount != 0 || pk.SignCount != 0) && signCount <= pk.SignCount {
+		return fmt.Errorf("signature counter %d didn't increase past %d", signCount, pk.SignCount)
+	}
+	pk.SignCount = signCount
+	pk.LastUsed = time.Now().UTC()
+	return ps.put(ctx, pk)
+}
+
+// put stores pk. ps.mu must be held.
+func (ps *passkeyStore) put(ctx context.Context, pk passkey) error {
+	if ps.store != nil {
+		err := gobEncodeFile(ctx, ps.store, "/"+pk.ID, pk)
+		if err != nil {
+			return err
+		}
+	}
+	ps.passkeys[pk.ID] = pk
+	return nil
+}
+
+// passkeyTimeout is how long a passkey registration or sign in ceremony can take.
+const passkeyTimeout = 5 * time.Minute
+
+const passkeyChallengeCookieName = "passkeyChallenge"
+
+// passkeyChallenge is a challenge issued at the start of a ceremony.
+type passkeyChallenge struct {
+	Challenge []byte
+	UserSpec  users.UserSpec // User registering a passkey. Zero for sign ins.
+	Expiry    time.Time
+}
+
+// passkeyChallenges is the in-memory store of outstanding challenges.
+var passkeyChallenges = challengeStore{challenges: make(map[string]passkeyChallenge)}
+
+type challengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]passkeyChallenge // Challenge ID -> Challenge.
+}
+
+// New creates a new challenge for user, which is zero for sign ins.
+// It returns the challenge ID, which is meant to be put in an HttpOnly cookie,
+// so that the challenge can only be answered by the client it was issued to.
+func (cs *challengeStore) New(user users.UserSpec) (id string, challenge []byte) {
+	id = base64.RawURLEncoding.EncodeToString(cryptoRandBytes()[:16])
+	challenge = cryptoRandBytes()[:32]
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	// Forget expired challenges, so they don't accumulate.
+	for id, c := range cs.challenges {
+		if !time.Now().Before(c.Expiry) {
+			delete(cs.challenges, id)
+		}
+	}
+	cs.challenges[id] = passkeyChallenge{
+		Challenge: challenge,
+		UserSpec:  user,
+		Expiry:    time.Now().Add(passkeyTimeout),
+	}
+	return id, challenge
+}
+
+// Take removes the unexpired challenge with id and returns it, if any.
+// Each challenge can be taken at most once.
+func (cs *challengeStore) Take(id string) (passkeyChallenge, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.challenges[id]
+	delete(cs.challenges, id)
+	if !ok || !time.Now().Before(c.Expiry) {
+		return passkeyChallenge{}, false
+	}
+	return c, true
+}
+
+// beginPasskeyCeremony creates a new challenge for user,
+// and sets the challenge cookie.
+func beginPasskeyCeremony(w httputil.HeaderWriter, user users.UserSpec) []byte {
+	id, challenge := passkeyChallenges.New(user)
+	httputil.SetCookie(w, &http.Cookie{Path: "/", Name: passkeyChallengeCookieName, Value: id, MaxAge: int(passkeyTimeout / time.Second), HttpOnly: true, Secure: *productionFlag})
+	return challenge
+}
+
+// finishPasskeyCeremony takes the challenge of the ceremony that req finishes,
+// and clears the challenge cookie.
+func finishPasskeyCeremony(w httputil.HeaderWriter, req *http.Request) (passkeyChallenge, error) {
+	cookie, err := req.Cookie(passkeyChallengeCookieName)
+	if err != nil {
+		return passkeyChallenge{}, httperror.BadRequest{Err: errors.New("missing passkey challenge cookie")}
+	}
+	httputil.SetCookie(w, &http.Cookie{Path: "/", Name: passkeyChallengeCookieName, MaxAge: -1})
+	c, ok := passkeyChallenges.Take(cookie.Value)
+	if !ok {
+		return passkeyChallenge{}, httperror.BadRequest{Err: errors.New("passkey challenge expired or already used")}
+	}
+	return c, nil
+}
+
+// relyingParty returns the WebAuthn relying party of the site.
+// It's not derived from the Host header of requests, since that's
+// chosen by the client.
+func relyingParty() webauthn.RelyingParty {
+	origin := siteOrigin()
+	var host string
+	if u, err := url.Parse(origin); err == nil {
+		host = u.Hostname()
+	}
+	return webauthn.RelyingParty{
+		ID:     host,
+		Name:   "Dmitri Shuralyov",
+		Origin: origin,
+	}
+}
+
+// siteOrigin returns the origin of the site, as set by the -site flag.
+// E.g., "https://dmitri.shuralyov.com".
+func siteOrigin() string {
+	switch {
+	case *siteFlag != "":
+		return strings.TrimSuffix(*siteFlag, "/")
+	case *productionFlag:
+		return "https://dmitri.shuralyov.com"
+	default:
+		_, port, _ := net.SplitHostPort(*httpFlag)
+		return "http://localhost:" + port
+	}
+}
+
+// decodePasskeyRequest decodes the JSON body of req into v.
+func decodePasskeyRequest(req *http.Request, v interface{}) error {
+	err := json.NewDecoder(io.LimitReader(req.Body, 64*1024)).Decode(v)
+	if err != nil {
+		return httperror.BadRequest{Err: fmt.Errorf("bad request body: %v", err)}
+	}
+	return nil
+}
+
+// passkeyRegistration is the request body of /settings/passkeys/register/finish.
+type passkeyRegistration struct {
+	webauthn.AttestationResponse
+	Name string
+}
+
+// passkeySignIn is the request body of /login/passkey/finish.
+type passkeySignIn struct {
+	webauthn.AssertionResponse
+	ReturnURL string
+}
+
+// passkeyResponse is the response of a successfully finished ceremony.
+type passkeyResponse struct {
+	ReturnURL string // Where the frontend should navigate to next.
+}
+
+// servePasskeys serves the passkeys settings page.
+func (h *sessionsHandler) servePasskeys(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Passkeys can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+
+	var nodes []*html.Node
+	pks := passkeys.List(s.UserSpec)
+	for _, pk := range pks {
+		lastUsed := "never"
+		if !pk.LastUsed.IsZero() {
+			lastUsed = humanize.Time(pk.LastUsed)
+		}
+		remove := component.PostButton{
+			Action:    "/settings/passkeys/delete?" + url.Values{"id": {pk.ID}}.Encode(),
+			Text:      "Remove",
+			ReturnURL: "/settings/passkeys",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		div := htmlg.Div(htmlg.Text(fmt.Sprintf("Name: %q created: %v last used: %v ", pk.Name, humanize.Time(pk.CreatedAt), lastUsed)))
+		htmlg.AppendChildren(div, remove.Render()...)
+		nodes = append(nodes, div)
+	}
+	if len(pks) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No passkeys.")),
+		)
+	}
+	nodes = append(nodes, newPasskeyForm(), passkeyScript())
+	return nodes, nil
+}
+
+// newPasskeyForm renders a form for registering a new passkey.
+// It's handled by the passkey frontend, via the RegisterPasskey function.
+func newPasskeyForm() *html.Node {
+	name := &html.Node{
+		Type: html.ElementNode, Data: atom.Input.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "text"},
+			{Key: atom.Id.String(), Val: "passkey-name"},
+		},
+	}
+	add := &html.Node{
+		Type: html.ElementNode, Data: atom.Button.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "button"},
+			{Key: atom.Onclick.String(), Val: "RegisterPasskey(this);"},
+		},
+	}
+	add.AppendChild(htmlg.Text("Add passkey"))
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Div.String(),
+		Attr: []html.Attribute{{Key: atom.Style.String(), Val: `margin-top: 20px;`}},
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Name: "), name))
+	form.AppendChild(htmlg.Div(add))
+	return form
+}
+
+// passkeyScript returns a script element that loads the passkey frontend.
+func passkeyScript() *html.Node {
+	return &html.Node{
+		Type: html.ElementNode, Data: atom.Script.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Async.String()},
+			{Key: atom.Src.String(), Val: "/assets/passkey/passkey.js"},
+		},
+	}
+}
+
+// passkeySignInButton renders a button that signs in with a passkey,
+// and then navigates to returnURL.
+func passkeySignInButton(returnURL string) *html.Node {
+	button := &html.Node{
+		Type: html.ElementNode, Data: atom.Button.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "button"},
+			{Key: "data-return", Val: returnURL},
+			{Key: atom.Onclick.String(), Val: "SignInWithPasskey(this);"},
+		},
+	}
+	button.AppendChild(htmlg.Text("Sign in with a passkey"))
+	return button
+}
+
+// serveBeginPasskeyRegistration starts registering a new passkey for the signed in user.
+// It responds with options for navigator.credentials.create.
+func (h *sessionsHandler) serveBeginPasskeyRegistration(w httputil.HeaderWriter, req *http.Request, s *session) error {
+	// Authorization check. Passkeys can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	user, err := h.users.Get(req.Context(), s.UserSpec)
+	if err != nil {
+		return err
+	}
+	var exclude [][]byte
+	for _, pk := range passkeys.List(s.UserSpec) {
+		id, err := base64.RawURLEncoding.DecodeString(pk.ID)
+		if err != nil {
+			continue
+		}
+		exclude = append(exclude, id)
+	}
+	rp := relyingParty()
+	challenge := beginPasskeyCeremony(w, s.UserSpec)
+	return httperror.JSONResponse{V: webauthn.CreationOptions{
+		Challenge:          challenge,
+		RPID:               rp.ID,
+		RPName:             rp.Name,
+		UserID:             []byte(formatUserSpec(s.UserSpec)),
+		UserName:           user.Login,
+		UserDisplayName:    user.Name,
+		Algorithms:         []int{webauthn.AlgES256, webauthn.AlgRS256},
+		ExcludeCredentials: exclude,
+		TimeoutMillis:      int(passkeyTimeout / time.Millisecond),
+	}}
+}
+
+// serveFinishPasskeyRegistration verifies and stores the passkey
+// that was created for the signed in user.
+func (h *sessionsHandler) serveFinishPasskeyRegistration(w httputil.HeaderWriter, req *http.Request, s *session) error {
+	// Authorization check. Passkeys can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	c, err := finishPasskeyCeremony(w, req)
+	if err != nil {
+		return err
+	}
+	if c.UserSpec != s.UserSpec {
+		return httperror.BadRequest{Err: errors.New("passkey challenge was issued to another user")}
+	}
+	var r passkeyRegistration
+	err = decodePasskeyRequest(req, &r)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSpace(r.Name)
+	if name == "" {
+		return httperror.BadRequest{Err: errors.New("passkey name must be non-empty")}
+	}
+	cred, err := relyingParty().VerifyRegistration(c.Challenge, r.AttestationResponse)
+	if err != nil {
+		return httperror.BadRequest{Err: err}
+	}
+	pk := passkey{
+		ID:        base64.RawURLEncoding.EncodeToString(cred.ID),
+		Name:      name,
+		UserSpec:  s.UserSpec,
+		PublicKey: cred.PublicKey,
+		SignCount: cred.SignCount,
+		CreatedAt: time.Now().UTC(),
+	}
+	err = passkeys.Add(req.Context(), pk)
+	if err == os.ErrExist {
+		return httperror.BadRequest{Err: errors.New("passkey is already registered")}
+	} else if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditPasskeyAdd, s.UserSpec, pk.ID, fmt.Sprintf("name: %q", name))
+	return httperror.JSONResponse{V: passkeyResponse{ReturnURL: "/settings/passkeys"}}
+}
+
+// serveRemovePasskey removes the passkey specified by the id query parameter.
+func (h *sessionsHandler) serveRemovePasskey(req *http.Request, s *session) error {
+	// Authorization check. Passkeys can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	id := req.URL.Query().Get("id")
+	err := passkeys.Remove(req.Context(), s.UserSpec, id)
+	if os.IsNotExist(err) {
+		return &os.PathError{Op: "remove", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditPasskeyRemove, s.UserSpec, id, "")
+	return httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+}
+
+// serveBeginPasskeySignIn starts signing in with a passkey.
+// It responds with options for navigator.credentials.get.
+func (h *sessionsHandler) serveBeginPasskeySignIn(w httputil.HeaderWriter, req *http.Request, s *session) error {
+	if s != nil {
+		return httperror.BadRequest{Err: errors.New("already signed in")}
+	}
+	if retryAfter := authLimiter.Allow(ipKey(req)); retryAfter > 0 {
+		return rateLimitedError{RetryAfter: retryAfter}
+	}
+	challenge := beginPasskeyCeremony(w, users.UserSpec{})
+	return httperror.JSONResponse{V: webauthn.RequestOptions{
+		Challenge:     challenge,
+		RPID:          relyingParty().ID,
+		TimeoutMillis: int(passkeyTimeout / time.Millisecond),
+	}}
+}
+
+// serveFinishPasskeySignIn verifies the passkey assertion,
+// and signs in its user by creating a new session.
+func (h *sessionsHandler) serveFinishPasskeySignIn(w httputil.HeaderWriter, req *http.Request, s *session) error {
+	if s != nil {
+		return httperror.BadRequest{Err: errors.New("already signed in")}
+	}
+	key := ipKey(req)
+	if retryAfter := authLimiter.Allow(key); retryAfter > 0 {
+		return rateLimitedError{RetryAfter: retryAfter}
+	}
+	c, err := finishPasskeyCeremony(w, req)
+	if err != nil {
+		return err
+	}
+	if c.UserSpec != (users.UserSpec{}) {
+		return httperror.BadRequest{Err: errors.New("passkey challenge was issued for registration")}
+	}
+	var r passkeySignIn
+	err = decodePasskeyRequest(req, &r)
+	if err != nil {
+		return err
+	}
+
+	pk, err := func() (passkey, error) {
+		pk, ok := passkeys.lookUp(base64.RawURLEncoding.EncodeToString(r.ID))
+		if !ok {
+			return passkey{}, errors.New("unknown passkey")
+		}
+		if len(r.UserHandle) != 0 && string(r.UserHandle) != formatUserSpec(pk.UserSpec) {
+			return passkey{}, errors.New("user handle doesn't match passkey")
+		}
+		cred := webauthn.Credential{ID: r.ID, PublicKey: pk.PublicKey, SignCount: pk.SignCount}
+		signCount, err := relyingParty().VerifyAssertion(c.Challenge, cred, r.AssertionResponse)
+		if err != nil {
+			return passkey{}, err
+		}
+		return pk, passkeys.Used(req.Context(), pk.ID, signCount)
+	}()
+	if err != nil {
+		log.Println(err)
+		auditLog.Record(req, auditLoginFailed, users.UserSpec{}, "passkey", err.Error())
+		if authLimiter.Failed(key) {
+			auditLog.Record(req, auditLockout, users.UserSpec{}, key, "")
+		}
+		return httperror.HTTP{Code: http.StatusUnauthorized, Err: err}
+	}
+	if _, err := h.users.Get(req.Context(), pk.UserSpec); err != nil {
+		return fmt.Errorf("passkey %q belongs to unknown user: %v", pk.ID, err)
+	}
+
+	// Add new session.
+	expiry := time.Now().Add(7 * 24 * time.Hour)
+	session, accessToken := newSession(pk.UserSpec, expiry)
+	session.seen(req)
+	global.mu.Lock()
+	global.put(req.Context(), session)
+	global.mu.Unlock()
+	authLimiter.Succeeded(key)
+	auditLog.Record(req, auditLogin, pk.UserSpec, "passkey", pk.ID)
+
+	setAccessTokenCookie(w, accessToken, expiry)
+	return httperror.JSONResponse{V: passkeyResponse{ReturnURL: sanitizeReturn(r.ReturnURL)}}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/home/internal/webauthn"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+// Test registering a passkey and signing in with it,
+// using a software authenticator.
+func TestPasskeys(t *testing.T) {
+	defer func() {
+		global = state{sessions: make(map[string]session)}
+		passkeys = passkeyStore{passkeys: make(map[string]passkey)}
+		authLimiter = newRateLimiter()
+		totps = totpStore{enrollments: make(map[users.UserSpec]totpEnrollment), now: time.Now}
+		stepUps = stepUpStore{until: make(map[string]time.Time)}
+		*siteFlag = ""
+	}()
+	// The relying party is the configured site, not the host that requests are made to.
+	*siteFlag = "https://dmitri.shuralyov.com"
+	global = state{sessions: make(map[string]session)}
+	passkeys = passkeyStore{passkeys: make(map[string]passkey)}
+	authLimiter = newRateLimiter()
+
+	usersService, userStore, err := newUsersService(webdav.NewMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := users.User{UserSpec: users.UserSpec{ID: 1, Domain: "example.com"}, Login: "alice"}
+	err = userStore.Create(context.Background(), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &sessionsHandler{users: usersService, userStore: userStore}
+	aliceSession, accessToken := newSession(alice.UserSpec, time.Now().Add(time.Hour))
+	global.sessions[aliceSession.ID] = aliceSession
+	sessionCookie := "accessToken=" + base64.RawURLEncoding.EncodeToString([]byte(accessToken))
+
+	// do makes a POST request to path with body, and returns the response.
+	// It decodes the JSON response body into out, if the request succeeds.
+	do := func(path string, cookies []string, body, out interface{}) *http.Response {
+		t.Helper()
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Cookie", strings.Join(cookies, "; "))
+		req.Header.Set("X-CSRF-Token", csrfToken(accessToken)) // Ignored when not signed in.
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			err := json.NewDecoder(rr.Body).Decode(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Result()
+	}
+	// challengeCookie returns the passkey challenge cookie set by resp.
+	challengeCookie := func(resp *http.Response) string {
+		t.Helper()
+		for _, c := range resp.Cookies() {
+			if c.Name == passkeyChallengeCookieName && c.Value != "" {
+				return c.Name + "=" + c.Value
+			}
+		}
+		t.Fatal("no passkey challenge cookie")
+		return ""
+	}
+
+	// Register a passkey.
+	authenticator := newSoftwareAuthenticator(t)
+	var creation webauthn.CreationOptions
+	resp := do("/settings/passkeys/register/begin", []string{sessionCookie}, nil, &creation)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("register begin: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+	registration := passkeyRegistration{
+		AttestationResponse: authenticator.Create(creation),
+		Name:                "Laptop",
+	}
+	var finished passkeyResponse
+	resp = do("/settings/passkeys/register/finish", []string{sessionCookie, challengeCookie(resp)}, registration, &finished)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("register finish: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+	if pks := passkeys.List(alice.UserSpec); len(pks) != 1 || pks[0].Name != "Laptop" {
+		t.Fatalf("got passkeys %+v, want one named Laptop", pks)
+	}
+
+	// signIn signs in using authenticator, and returns the response.
+	signIn := func(authenticator *softwareAuthenticator) *http.Response {
+		t.Helper()
+		var request webauthn.RequestOptions
+		resp := do("/login/passkey/begin", nil, nil, &request)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("sign in begin: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+		}
+		signIn := passkeySignIn{
+			AssertionResponse: authenticator.Get(request),
+			ReturnURL:         "/blog",
+		}
+		var finished passkeyResponse
+		resp = do("/login/passkey/finish", []string{challengeCookie(resp)}, signIn, &finished)
+		if resp.StatusCode == http.StatusOK && finished.ReturnURL != "/blog" {
+			t.Errorf("got ReturnURL %q, want %q", finished.ReturnURL, "/blog")
+		}
+		return resp
+	}
+
+	// Sign in with the passkey.
+	global.sessions = make(map[string]session)
+	resp = signIn(authenticator)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("sign in finish: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+	if len(global.sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(global.sessions))
+	}
+	for _, s := range global.sessions {
+		if s.UserSpec != alice.UserSpec {
+			t.Errorf("got session for %+v, want %+v", s.UserSpec, alice.UserSpec)
+		}
+	}
+
+	// A cloned authenticator, whose signature counter doesn't increase, is rejected.
+	clone := *authenticator
+	clone.signCount--
+	if got, want := signIn(&clone).StatusCode, http.StatusUnauthorized; got != want {
+		t.Errorf("sign in with cloned authenticator: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+
+	// An unregistered authenticator is rejected.
+	if got, want := signIn(newSoftwareAuthenticator(t)).StatusCode, http.StatusUnauthorized; got != want {
+		t.Errorf("sign in with unregistered authenticator: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+
+	// An authenticator that doesn't verify the user is rejected.
+	unverified := *authenticator
+	unverified.skipUserVerification = true
+	if got, want := signIn(&unverified).StatusCode, http.StatusUnauthorized; got != want {
+		t.Errorf("sign in without user verification: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+
+	// The signature counter is checked again when it's stored,
+	// so an assertion can't be used twice even by concurrent sign ins.
+	id := base64.RawURLEncoding.EncodeToString(authenticator.id)
+	if err := passkeys.Used(context.Background(), id, authenticator.signCount); err == nil {
+		t.Error("Used with a signature counter that didn't increase: got nil error, want non-nil")
+	}
+
+	// Users enrolled in TOTP need to step up before managing passkeys.
+	secret, err := totps.Begin(context.Background(), alice.UserSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := totps.Confirm(context.Background(), alice.UserSpec, totpCode(secret, time.Now().Unix()/totpPeriod)); err != nil {
+		t.Fatal(err)
+	}
+	global.sessions[aliceSession.ID] = aliceSession
+	resp = do("/settings/passkeys/register/begin", []string{sessionCookie}, nil, &creation)
+	if got, want := resp.StatusCode, http.StatusSeeOther; got != want {
+		t.Errorf("register begin without step-up: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+	stepUps.Record(sessionStepUpKey(&aliceSession))
+	resp = do("/settings/passkeys/register/begin", []string{sessionCookie}, nil, &creation)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("register begin after step-up: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+}
+
+// softwareAuthenticator is a WebAuthn authenticator implemented in software,
+// for use in tests. It has a single ES256 credential.
+type softwareAuthenticator struct {
+	t          *testing.T
+	key        *ecdsa.PrivateKey
+	id         []byte
+	userHandle []byte
+	signCount  uint32
+
+	skipUserVerification bool // Sign in without verifying the user.
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	_, err = cryptorand.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softwareAuthenticator{t: t, key: key, id: id}
+}
+
+// Create creates the credential, like navigator.credentials.create does.
+func (a *softwareAuthenticator) Create(opts webauthn.CreationOptions) webauthn.AttestationResponse {
+	a.userHandle = opts.UserID
+	clientDataJSON := a.clientData("webauthn.create", opts.Challenge)
+	publicKey := cborMap(
+		int64(1), int64(2), // kty: EC2.
+		int64(3), int64(webauthn.AlgES256), // alg.
+		int64(-1), int64(1), // crv: P-256.
+		int64(-2), padTo32(a.key.X.Bytes()),
+		int64(-3), padTo32(a.key.Y.Bytes()),
+	)
+	attestedCredentialData := make([]byte, 16) // Zero AAGUID.
+	attestedCredentialData = append(attestedCredentialData, byte(len(a.id)>>8), byte(len(a.id)))
+	attestedCredentialData = append(attestedCredentialData, a.id...)
+	attestedCredentialData = append(attestedCredentialData, publicKey...)
+	authData := append(a.authData(opts.RPID, 0x45), attestedCredentialData...) // User present and verified, attested credential data.
+	return webauthn.AttestationResponse{
+		ID:             a.id,
+		ClientDataJSON: clientDataJSON,
+		AttestationObject: []byte(cborMap(
+			"fmt", "none",
+			"attStmt", cborMap(),
+			"authData", authData,
+		)),
+	}
+}
+
+// Get signs the challenge, like navigator.credentials.get does.
+func (a *softwareAuthenticator) Get(opts webauthn.RequestOptions) webauthn.AssertionResponse {
+	a.signCount++
+	clientDataJSON := a.clientData("webauthn.get", opts.Challenge)
+	flags := byte(0x05) // User present and verified.
+	if a.skipUserVerification {
+		flags = 0x01 // User present.
+	}
+	authData := a.authData(opts.RPID, flags)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	r, ss, err := ecdsa.Sign(cryptorand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, ss})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return webauthn.AssertionResponse{
+		ID:                a.id,
+		ClientDataJSON:    clientDataJSON,
+		AuthenticatorData: authData,
+		Signature:         signature,
+		UserHandle:        a.userHandle,
+	}
+}
+
+func (a *softwareAuthenticator) clientData(typ string, challenge []byte) []byte {
+	clientDataJSON, err := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    "https://dmitri.shuralyov.com", // The configured site, not example.com that httptest.NewRequest uses.
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return clientDataJSON
+}
+
+func (a *softwareAuthenticator) authData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], a.signCount)
+	return authData
+}
+
+func padTo32(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// cborEncoded is an encoded CBOR data item.
+type cborEncoded []byte
+
+// cborMap encodes a CBOR map with the given keys and values, in the order given.
+// Keys and values must be int64, string, []byte or cborEncoded.
+func cborMap(kvs ...interface{}) cborEncoded {
+	b := cborHead(5, len(kvs)/2)
+	for _, v := range kvs {
+		switch v := v.(type) {
+		case int64:
+			if v >= 0 {
+				b = append(b, cborHead(0, int(v))...)
+			} else {
+				b = append(b, cborHead(1, int(-1-v))...)
+			}
+		case string:
+			b = append(append(b, cborHead(3, len(v))...), v...)
+		case []byte:
+			b = append(append(b, cborHead(2, len(v))...), v...)
+		case cborEncoded:
+			b = append(b, v...)
+		default:
+			panic(fmt.Errorf("unsupported type %T", v))
+		}
+	}
+	return b
+}
+
+// cborHead encodes the head of a CBOR data item with major type major and argument n.
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+}
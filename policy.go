@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shurcooL/home/component"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// role is a level of access a user has to a repository, or to the entire site.
+// Each role includes all permissions of the roles below it.
+type role int
+
+const (
+	roleNone    role = iota // No access. Anonymous users have this role.
+	roleReader              // Can read, comment and react. All signed in users have at least this role.
+	roleTriager             // Can also manage issues and changes, including ones on GitHub and Gerrit.
+	rolePusher              // Can also push via git, and publish blog posts.
+	roleAdmin               // Can also manage roles of other users.
+)
+
+// roles are all roles that can be granted, in display order.
+var roles = []role{roleReader, roleTriager, rolePusher, roleAdmin}
+
+func (r role) String() string {
+	switch r {
+	case roleNone:
+		return "none"
+	case roleReader:
+		return "reader"
+	case roleTriager:
+		return "triager"
+	case rolePusher:
+		return "pusher"
+	case roleAdmin:
+		return "admin"
+	default:
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+}
+
+// parseRole parses a role that can be granted from its name.
+func parseRole(name string) (role, error) {
+	for _, r := range roles {
+		if r.String() == name {
+			return r, nil
+		}
+	}
+	return roleNone, fmt.Errorf("unknown role %q", name)
+}
+
+// roleGrant grants a role to a user.
+type roleGrant struct {
+	UserSpec users.UserSpec
+	Repo     string // Repository spec. E.g., "dmitri.shuralyov.com/kebabcase". Empty means site-wide.
+	Role     role
+}
+
+// policy is the central authorization policy of the site.
+// Handlers and services consult it before performing an action
+// on behalf of the authenticated user.
+var policy = accessPolicy{
+	// Until the policy is loaded, only shurcooL is an admin.
+	grants: []roleGrant{{UserSpec: shurcool, Role: roleAdmin}},
+}
+
+type accessPolicy struct {
+	mu     sync.Mutex
+	grants []roleGrant // Sorted by user, then repo.
+
+	// store is where grants are persisted. If nil, grants are only kept in memory.
+	store webdav.FileSystem
+}
+
+// grantsPath is the path of the file in the policy store
+// where grants are persisted.
+const grantsPath = "/grants"
+
+// Load sets root as the policy store, and loads grants from it.
+// If no grants have been persisted yet, the initial grants are kept.
+func (p *accessPolicy) Load(ctx context.Context, root webdav.FileSystem) error {
+	var grants []roleGrant
+	err := gobDecodeFile(ctx, root, grantsPath, &grants)
+	if os.IsNotExist(err) {
+		p.mu.Lock()
+		p.store = root
+		p.mu.Unlock()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.store = root
+	p.grants = grants
+	p.mu.Unlock()
+	return nil
+}
+
+// Role returns the role that user has on repo.
+// Site-wide grants apply to all repositories.
+// An empty repo means the site itself.
+func (p *accessPolicy) Role(user users.UserSpec, repo string) role {
+	if user.ID == 0 {
+		return roleNone
+	}
+	r := p.Granted(user, repo)
+	if r < roleReader {
+		r = roleReader
+	}
+	return r
+}
+
+// Granted returns the highest role explicitly granted to user on repo,
+// either on repo itself or site-wide. Unlike Role, it doesn't include
+// the reader role that all signed in users have.
+func (p *accessPolicy) Granted(user users.UserSpec, repo string) role {
+	if user.ID == 0 {
+		return roleNone
+	}
+	r := roleNone
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, g := range p.grants {
+		if g.UserSpec != user || (g.Repo != "" && g.Repo != repo) {
+			continue
+		}
+		if g.Role > r {
+			r = g.Role
+		}
+	}
+	return r
+}
+
+// Allowed reports whether user has at least role want on repo.
+func (p *accessPolicy) Allowed(user users.UserSpec, repo string, want role) bool {
+	return p.Role(user, repo) >= want
+}
+
+// Authorize returns os.ErrPermission if the authenticated user
+// doesn't have at least role want on repo.
+func (p *accessPolicy) Authorize(ctx context.Context, users users.Service, repo string, want role) error {
+	currentUser, err := users.GetAuthenticatedSpec(ctx)
+	if err != nil {
+		return err
+	}
+	if !p.Allowed(currentUser, repo, want) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// List lists all grants, sorted by user, then repo.
+func (p *accessPolicy) List() []roleGrant {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]roleGrant(nil), p.grants...)
+}
+
+// Grant grants user role r on repo, replacing the previous grant, if any.
+func (p *accessPolicy) Grant(ctx context.Context, user users.UserSpec, repo string, r role) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	grants := []roleGrant{{UserSpec: user, Repo: repo, Role: r}}
+	for _, g := range p.grants {
+		if g.UserSpec == user && g.Repo == repo {
+			continue
+		}
+		grants = append(grants, g)
+	}
+	sortGrants(grants)
+	return p.set(ctx, grants)
+}
+
+// Revoke revokes the role user has on repo.
+// It returns os.ErrNotExist if user has no such grant.
+func (p *accessPolicy) Revoke(ctx context.Context, user users.UserSpec, repo string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var grants []roleGrant
+	for _, g := range p.grants {
+		if g.UserSpec == user && g.Repo == repo {
+			continue
+		}
+		grants = append(grants, g)
+	}
+	if len(grants) == len(p.grants) {
+		return os.ErrNotExist
+	}
+	return p.set(ctx, grants)
+}
+
+// RenameRepo moves grants on repo from to repo to.
+// Grants that users already have on to are revoked either way.
+func (p *accessPolicy) RenameRepo(ctx context.Context, from, to string) error {
+	if from == "" || to == "" {
+		return errors.New("site-wide grants can't be renamed")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var (
+		grants  []roleGrant
+		changed bool
+	)
+	for _, g := range p.grants {
+		switch g.Repo {
+		case from:
+			g.Repo, changed = to, true
+		case to:
+			changed = true
+			continue
+		}
+		grants = append(grants, g)
+	}
+	if !changed {
+		return nil
+	}
+	sortGrants(grants)
+	return p.set(ctx, grants)
+}
+
+// RemoveRepo revokes all grants on repo.
+func (p *accessPolicy) RemoveRepo(ctx context.Context, repo string) error {
+	if repo == "" {
+		return errors.New("site-wide grants can't be removed")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var grants []roleGrant
+	for _, g := range p.grants {
+		if g.Repo == repo {
+			continue
+		}
+		grants = append(grants, g)
+	}
+	if len(grants) == len(p.grants) {
+		return nil
+	}
+	return p.set(ctx, grants)
+}
+
+// sortGrants sorts grants by user, then repo.
+func sortGrants(grants []roleGrant) {
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].UserSpec != grants[j].UserSpec {
+			return grants[i].UserSpec.Domain < grants[j].UserSpec.Domain ||
+				grants[i].UserSpec.Domain == grants[j].UserSpec.Domain && grants[i].UserSpec.ID < grants[j].UserSpec.ID
+		}
+		return grants[i].Repo < grants[j].Repo
+	})
+}
+
+// set persists grants and makes them take effect. p.mu must be held.
+func (p *accessPolicy) set(ctx context.Context, grants []roleGrant) error {
+	if p.store != nil {
+		err := gobEncodeFile(ctx, p.store, grantsPath, grants)
+		if err != nil {
+			return err
+		}
+	}
+	p.grants = grants
+	return nil
+}
+
+// serveRoles serves the roles admin page,
+// and grants a role when the page is POSTed to.
+func (h *sessionsHandler) serveRoles(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Roles can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return nil, err
+	}
+
+	if req.Method == http.MethodPost {
+		user, err := parseUserSpec(req.PostFormValue("user"))
+		if err != nil {
+			return nil, httperror.BadRequest{Err: err}
+		}
+		repo := strings.TrimSpace(req.PostFormValue("repo"))
+		if user == s.UserSpec && repo == "" {
+			return nil, httperror.BadRequest{Err: errors.New("can't change own site-wide role")}
+		}
+		r, err := parseRole(req.PostFormValue("role"))
+		if err != nil {
+			return nil, httperror.BadRequest{Err: err}
+		}
+		err = policy.Grant(req.Context(), user, repo, r)
+		if err != nil {
+			return nil, err
+		}
+		auditLog.Record(req, auditRoleGrant, s.UserSpec, repo, fmt.Sprintf("user: %s role: %v", formatUserSpec(user), r))
+		return nil, httperror.Redirect{URL: "/admin/roles"}
+	}
+
+	auditLog.Record(req, auditAdminView, s.UserSpec, req.URL.Path, "")
+
+	nodes := []*html.Node{htmlg.H3(htmlg.Text("Roles"))}
+	grants := policy.List()
+	for _, g := range grants {
+		login := formatUserSpec(g.UserSpec)
+		if user, err := h.users.Get(req.Context(), g.UserSpec); err == nil {
+			login = user.Login
+		} else {
+			log.Printf("h.users.Get(%+v): %v\n", g.UserSpec, err)
+		}
+		repo := g.Repo
+		if repo == "" {
+			repo = "(site-wide)"
+		}
+		revoke := component.PostButton{
+			Action:    "/admin/roles/revoke?" + url.Values{"user": {formatUserSpec(g.UserSpec)}, "repo": {g.Repo}}.Encode(),
+			Text:      "Revoke",
+			ReturnURL: "/admin/roles",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		div := htmlg.Div(htmlg.Text(fmt.Sprintf("User: %s (%s) repo: %s role: %v ", login, formatUserSpec(g.UserSpec), repo, g.Role)))
+		htmlg.AppendChildren(div, revoke.Render()...)
+		nodes = append(nodes, div)
+	}
+	if len(grants) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No roles granted.")),
+		)
+	}
+	nodes = append(nodes, grantRoleForm(csrfToken(s.rawAccessToken)))
+	return nodes, nil
+}
+
+// grantRoleForm renders a form for granting a role.
+func grantRoleForm(csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/admin/roles"},
+			{Key: atom.Style.String(), Val: `margin-top: 20px;`},
+		},
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("User (e.g., 1924134@github.com): "), textInput("user", "")))
+	form.AppendChild(htmlg.Div(htmlg.Text("Repository (empty for site-wide): "), textInput("repo", "")))
+	sel := &html.Node{
+		Type: html.ElementNode, Data: atom.Select.String(),
+		Attr: []html.Attribute{{Key: atom.Name.String(), Val: "role"}},
+	}
+	for _, r := range roles {
+		option := &html.Node{
+			Type: html.ElementNode, Data: atom.Option.String(),
+			Attr: []html.Attribute{{Key: atom.Value.String(), Val: r.String()}},
+		}
+		option.AppendChild(htmlg.Text(r.String()))
+		sel.AppendChild(option)
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Role: "), sel))
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(htmlg.Div(submitInput("Grant role")))
+	return form
+}
+
+// serveRevokeRole revokes the role specified by the user and repo query parameters.
+func (h *sessionsHandler) serveRevokeRole(req *http.Request, s *session) error {
+	// Authorization check. Roles can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	user, err := parseUserSpec(req.URL.Query().Get("user"))
+	if err != nil {
+		return httperror.BadRequest{Err: err}
+	}
+	repo := req.URL.Query().Get("repo")
+	if user == s.UserSpec && repo == "" {
+		return httperror.BadRequest{Err: errors.New("can't revoke own site-wide role")}
+	}
+	err = policy.Revoke(req.Context(), user, repo)
+	if os.IsNotExist(err) {
+		return &os.PathError{Op: "revoke", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditRoleRevoke, s.UserSpec, repo, "user: "+formatUserSpec(user))
+	return httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+}
+
+// formatUserSpec formats user as "{{.ID}}@{{.Domain}}".
+func formatUserSpec(user users.UserSpec) string {
+	return fmt.Sprintf("%d@%s", user.ID, user.Domain)
+}
+
+// parseUserSpec parses a user spec formatted as "{{.ID}}@{{.Domain}}".
+func parseUserSpec(s string) (users.UserSpec, error) {
+	i := strings.Index(s, "@")
+	if i == -1 {
+		return users.UserSpec{}, errors.New(`user must be formatted as "{{.ID}}@{{.Domain}}"`)
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(s[:i]), 10, 64)
+	if err != nil || id == 0 {
+		return users.UserSpec{}, fmt.Errorf("bad user ID %q", s[:i])
+	}
+	domain := strings.TrimSpace(s[i+1:])
+	if domain == "" {
+		return users.UserSpec{}, errors.New("user domain must be non-empty")
+	}
+	return users.UserSpec{ID: id, Domain: domain}, nil
+}
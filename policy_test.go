@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	var (
+		alice = users.UserSpec{ID: 1, Domain: "example.com"}
+		bob   = users.UserSpec{ID: 2, Domain: "example.com"}
+	)
+	const repo = "example.com/repo"
+
+	ctx := context.Background()
+	store := webdav.NewMemFS()
+	var p accessPolicy
+	err := p.Load(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Grant(ctx, alice, "", roleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Grant(ctx, bob, repo, rolePusher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user users.UserSpec
+		repo string
+		want role
+	}{
+		{users.UserSpec{}, repo, roleNone},
+		{alice, repo, roleAdmin},
+		{alice, "", roleAdmin},
+		{bob, repo, rolePusher},
+		{bob, "example.com/other", roleReader},
+		{bob, "", roleReader},
+	}
+	check := func(p *accessPolicy) {
+		for _, tc := range tests {
+			if got := p.Role(tc.user, tc.repo); got != tc.want {
+				t.Errorf("Role(%v, %q): got %v, want %v", tc.user, tc.repo, got, tc.want)
+			}
+		}
+	}
+	check(&p)
+
+	// Grants should be persisted.
+	var p2 accessPolicy
+	err = p2.Load(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(&p2)
+
+	err = p2.Revoke(ctx, bob, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p2.Role(bob, repo), roleReader; got != want {
+		t.Errorf("Role after Revoke: got %v, want %v", got, want)
+	}
+	if err := p2.Revoke(ctx, bob, repo); err == nil {
+		t.Error("second Revoke: got nil error, want non-nil")
+	}
+}
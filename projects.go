@@ -134,6 +134,7 @@ func (h *projectsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) er
 		header := component.Header{
 			CurrentUser:       authenticatedUser,
 			NotificationCount: nc,
+			CSRFToken:         csrfTokenFromContext(req),
 			ReturnURL:         returnURL,
 		}
 		err = htmlg.RenderComponents(w, header)
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AaronO/go-git-http"
+	"github.com/dustin/go-humanize"
+	"github.com/shurcooL/home/component"
+	"github.com/shurcooL/home/internal/code"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// pullMirror is a read-only repository in the repository store
+// that is kept in sync with an external repository by fetching from it
+// periodically. Branches and tags are mirrored, including force pushes
+// and deletions. Pushes to pull mirrors are rejected.
+type pullMirror struct {
+	Repo     string        // Repository spec. E.g., "dmitri.shuralyov.com/go/upstream".
+	URL      string        // Remote URL. E.g., "https://github.com/golang/example".
+	Interval time.Duration // How often to fetch.
+
+	// Fetch status.
+	NextAttempt time.Time // When to fetch next.
+	LastAttempt time.Time // Zero if never attempted.
+	LastFetch   time.Time // Last successful fetch. Zero if never fetched.
+	LastError   string    // Error of the last fetch. Empty if it was successful.
+}
+
+// DisplayURL returns the URL of m without any credentials in it,
+// so that it's safe to display.
+func (m pullMirror) DisplayURL() string { return displayRemoteURL(m.URL) }
+
+// Actor returns the user that updates fetched from m are attributed to.
+func (m pullMirror) Actor() users.User {
+	u := users.User{
+		Login:     m.DisplayURL(),
+		AvatarURL: "https://secure.gravatar.com/avatar?d=mm&f=y&s=96",
+	}
+	if strings.HasPrefix(u.Login, "https://") || strings.HasPrefix(u.Login, "http://") {
+		u.HTMLURL = u.Login
+	}
+	return u
+}
+
+const (
+	pullMirrorMinInterval     = 5 * time.Minute // Shortest interval between fetches.
+	pullMirrorDefaultInterval = time.Hour
+)
+
+// pullMirrors is the store of pull mirrors.
+var pullMirrors pullMirrorStore
+
+type pullMirrorStore struct {
+	mu      sync.Mutex
+	mirrors []pullMirror // Sorted by repo.
+	sched   mirrorScheduler
+
+	// store is where mirrors are persisted. If nil, mirrors are only kept in memory.
+	store webdav.FileSystem
+}
+
+// pullMirrorsPath is the path of the file in the mirrors store
+// where pull mirrors are persisted.
+const pullMirrorsPath = "/pull-mirrors"
+
+// Load sets root as the pull mirror store, and loads mirrors from it.
+func (ms *pullMirrorStore) Load(ctx context.Context, root webdav.FileSystem) error {
+	var mirrors []pullMirror
+	err := gobDecodeFile(ctx, root, pullMirrorsPath, &mirrors)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ms.mu.Lock()
+	ms.store = root
+	ms.mirrors = mirrors
+	ms.mu.Unlock()
+	return nil
+}
+
+// Get returns the pull mirror of repo.
+// It reports false if repo isn't a pull mirror.
+func (ms *pullMirrorStore) Get(repo string) (pullMirror, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, m := range ms.mirrors {
+		if m.Repo == repo {
+			return m, true
+		}
+	}
+	return pullMirror{}, false
+}
+
+// List lists all pull mirrors, sorted by repo.
+func (ms *pullMirrorStore) List() []pullMirror {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append([]pullMirror(nil), ms.mirrors...)
+}
+
+// Add makes repo a pull mirror of remoteURL, fetched every interval,
+// and schedules its first fetch. It returns os.ErrExist if repo is already a pull mirror.
+func (ms *pullMirrorStore) Add(ctx context.Context, repo, remoteURL string, interval time.Duration) error {
+	if err := checkRemoteURL(remoteURL); err != nil {
+		return err
+	}
+	if interval < pullMirrorMinInterval {
+		return fmt.Errorf("fetch interval %v is shorter than %v", interval, pullMirrorMinInterval)
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mirrors := []pullMirror{{Repo: repo, URL: remoteURL, Interval: interval, NextAttempt: time.Now()}}
+	for _, m := range ms.mirrors {
+		if m.Repo == repo {
+			return os.ErrExist
+		}
+		mirrors = append(mirrors, m)
+	}
+	sort.Slice(mirrors, func(i, j int) bool { return mirrors[i].Repo < mirrors[j].Repo })
+	err := ms.set(ctx, mirrors)
+	if err != nil {
+		return err
+	}
+	ms.sched.wakeUp()
+	return nil
+}
+
+// Remove stops mirroring repo. The repository is kept as is,
+// and can be pushed to from now on.
+// It returns os.ErrNotExist if repo isn't a pull mirror.
+func (ms *pullMirrorStore) Remove(ctx context.Context, repo string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var mirrors []pullMirror
+	for _, m := range ms.mirrors {
+		if m.Repo == repo {
+			continue
+		}
+		mirrors = append(mirrors, m)
+	}
+	if len(mirrors) == len(ms.mirrors) {
+		return os.ErrNotExist
+	}
+	return ms.set(ctx, mirrors)
+}
+
+// RenameRepo moves the pull mirror of repository from to repository to.
+// If to was a pull mirror before, it stops being one.
+func (ms *pullMirrorStore) RenameRepo(ctx context.Context, from, to string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var (
+		mirrors []pullMirror
+		changed bool
+	)
+	for _, m := range ms.mirrors {
+		switch m.Repo {
+		case from:
+			m.Repo, changed = to, true
+		case to:
+			changed = true
+			continue
+		}
+		mirrors = append(mirrors, m)
+	}
+	if !changed {
+		return nil
+	}
+	sort.Slice(mirrors, func(i, j int) bool { return mirrors[i].Repo < mirrors[j].Repo })
+	return ms.set(ctx, mirrors)
+}
+
+// FetchNow schedules a fetch of the pull mirror of repo right away.
+// It returns os.ErrNotExist if repo isn't a pull mirror.
+func (ms *pullMirrorStore) FetchNow(ctx context.Context, repo string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	mirrors := append([]pullMirror(nil), ms.mirrors...)
+	i := ms.index(repo)
+	if i == -1 {
+		return os.ErrNotExist
+	}
+	mirrors[i].NextAttempt = time.Now()
+	err := ms.set(ctx, mirrors)
+	if err != nil {
+		return err
+	}
+	ms.sched.wakeUp()
+	return nil
+}
+
+// Run fetches pull mirrors as they become due, until ctx is done.
+// Fetched updates are handled by h like pushes are, except
+// they're attributed to the mirror rather than a user.
+func (ms *pullMirrorStore) Run(ctx context.Context, h *gitHandler) {
+	ms.sched.run(ctx, func(now time.Time) (func(), time.Duration, <-chan struct{}) {
+		m, wait, wake := ms.next(now)
+		return func() {
+			err := h.fetchPullMirror(ctx, m)
+			if ctx.Err() != nil {
+				// Shutting down, so the fetch will happen after restart.
+				return
+			}
+			if err != nil {
+				log.Printf("pullMirrorStore.Run: fetching %s from %s: %v\n", m.Repo, m.DisplayURL(), err)
+			}
+			ms.finish(ctx, m, err, time.Now())
+		}, wait, wake
+	})
+}
+
+// next returns the pull mirror that is due to be fetched the soonest,
+// and how long until it's due. If there are no pull mirrors, wait is
+// a long time. The returned channel is closed when a fetch is scheduled.
+func (ms *pullMirrorStore) next(now time.Time) (_ pullMirror, wait time.Duration, wake <-chan struct{}) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if len(ms.mirrors) == 0 {
+		return pullMirror{}, 24 * time.Hour, ms.sched.wakeChan()
+	}
+	next := ms.mirrors[0]
+	for _, m := range ms.mirrors[1:] {
+		if m.NextAttempt.Before(next.NextAttempt) {
+			next = m
+		}
+	}
+	return next, next.NextAttempt.Sub(now), ms.sched.wakeChan()
+}
+
+// finish records the result err of fetching pull mirror m at time now,
+// and schedules its next fetch.
+func (ms *pullMirrorStore) finish(ctx context.Context, m pullMirror, err error, now time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	i := ms.index(m.Repo)
+	if i == -1 || ms.mirrors[i].URL != m.URL {
+		// Removed or changed in the meantime.
+		return
+	}
+	mirrors := append([]pullMirror(nil), ms.mirrors...)
+	cur := &mirrors[i]
+	cur.LastAttempt = now
+	if err == nil {
+		cur.LastFetch = now
+		cur.LastError = ""
+	} else {
+		cur.LastError = err.Error()
+	}
+	if !cur.NextAttempt.After(m.NextAttempt) {
+		// Unless FetchNow was called in the meantime.
+		cur.NextAttempt = now.Add(cur.Interval)
+	}
+	if err := ms.set(ctx, mirrors); err != nil {
+		log.Println("pullMirrorStore.finish: set:", err)
+	}
+}
+
+// index returns the index of the pull mirror of repo in ms.mirrors,
+// or -1 if there isn't one. ms.mu must be held.
+func (ms *pullMirrorStore) index(repo string) int {
+	for i, m := range ms.mirrors {
+		if m.Repo == repo {
+			return i
+		}
+	}
+	return -1
+}
+
+// set persists mirrors and makes them take effect. ms.mu must be held.
+func (ms *pullMirrorStore) set(ctx context.Context, mirrors []pullMirror) error {
+	if ms.store != nil {
+		err := gobEncodeFile(ctx, ms.store, pullMirrorsPath, mirrors)
+		if err != nil {
+			return err
+		}
+	}
+	ms.mirrors = mirrors
+	return nil
+}
+
+// checkPushable returns an error if repo can't be pushed to
+// because it's a pull mirror.
+func checkPushable(repo string) error {
+	if m, ok := pullMirrors.Get(repo); ok {
+		return fmt.Errorf("%s is a read-only mirror of %s", repo, m.DisplayURL())
+	}
+	return nil
+}
+
+// fetchPullMirror fetches all branches and tags of pull mirror m
+// from its remote, so that they're the same as there, and makes its
+// default branch the same as the remote's. The updated refs are then
+// handled like a push: code is discovered again, events are logged,
+// and push mirrors are synced. Events aren't logged for the first fetch,
+// since that's an import of existing history rather than new commits.
+func (h *gitHandler) fetchPullMirror(ctx context.Context, m pullMirror) error {
+	repo := repoInfo{
+		Spec: m.Repo,
+		Path: m.Repo[len("dmitri.shuralyov.com"):],
+		Dir:  filepath.Join(h.reposDir, filepath.FromSlash(m.Repo)),
+	}
+	before, err := listRefs(ctx, repo.Dir)
+	if err != nil {
+		return err
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, gitMirrorTimeout)
+	defer cancel()
+	branch, err := remoteDefaultBranch(fetchCtx, m.URL)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(fetchCtx, "git", "fetch", "--force", "--prune", "--no-tags", "--quiet", m.URL,
+		"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*")
+	cmd.Dir = repo.Dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0") // Never wait for credentials.
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git fetch: %v: %s", err, bytes.TrimSpace(out))
+	}
+	after, err := listRefs(ctx, repo.Dir)
+	if err != nil {
+		return err
+	}
+	branchChanged := false
+	if cur, err := code.DefaultBranch(repo.Dir); err != nil {
+		return err
+	} else if branch != "" && branch != cur {
+		cmd := exec.CommandContext(ctx, "git", "symbolic-ref", "HEAD", "refs/heads/"+branch)
+		cmd.Dir = repo.Dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git symbolic-ref: %v: %s", err, bytes.TrimSpace(out))
+		}
+		branchChanged = true
+	}
+
+	events := refUpdateEvents(before, after)
+	if !m.LastFetch.IsZero() {
+		h.logPush(ctx, auditClient{UserAgent: "pull-mirror"}, m.Actor(), repo, events)
+	}
+	if branchChanged {
+		// Discover the code on the new default branch,
+		// even if the branch itself wasn't updated.
+		err := h.code.UpdateRepository(repo.Spec)
+		if err != nil {
+			log.Println("fetchPullMirror: UpdateRepository:", err)
+		}
+	} else {
+		h.updateCode(repo, events)
+	}
+	h.mirrorPush(ctx, repo, events)
+	return nil
+}
+
+// remoteDefaultBranch returns the default branch of the remote repository
+// at remoteURL, which is the branch that its HEAD points to. It returns
+// the empty string if the remote doesn't say, e.g., because it's empty.
+func remoteDefaultBranch(ctx context.Context, remoteURL string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--symref", remoteURL, "HEAD")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0") // Never wait for credentials.
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// E.g., "ref: refs/heads/main\tHEAD".
+		if strings.HasPrefix(line, "ref: refs/heads/") && strings.HasSuffix(line, "\tHEAD") {
+			return line[len("ref: refs/heads/") : len(line)-len("\tHEAD")], nil
+		}
+	}
+	return "", nil
+}
+
+// refUpdateEvents returns git events for the branches and tags
+// that are different in refs after than in refs before.
+func refUpdateEvents(before, after map[string]string) []githttp.Event {
+	const zero = "0000000000000000000000000000000000000000"
+	var names []string
+	for ref := range before {
+		names = append(names, ref)
+	}
+	for ref := range after {
+		if _, ok := before[ref]; !ok {
+			names = append(names, ref)
+		}
+	}
+	sort.Strings(names)
+	var events []githttp.Event
+	for _, ref := range names {
+		last, commit := before[ref], after[ref]
+		if last == commit {
+			continue
+		}
+		if last == "" {
+			last = zero
+		}
+		if commit == "" {
+			commit = zero
+		}
+		switch {
+		case strings.HasPrefix(ref, "refs/heads/"):
+			events = append(events, githttp.Event{Type: githttp.PUSH, Branch: ref[len("refs/heads/"):], Last: last, Commit: commit})
+		case strings.HasPrefix(ref, "refs/tags/"):
+			events = append(events, githttp.Event{Type: githttp.TAG, Tag: ref[len("refs/tags/"):], Last: last, Commit: commit})
+		}
+	}
+	return events
+}
+
+// renderPullMirrorStatus renders the fetch status of pull mirror m
+// for the repository page. Errors are left out, since they may contain
+// details about the remote. They're shown on the admin page.
+func renderPullMirrorStatus(m pullMirror) *html.Node {
+	status := "not fetched yet"
+	switch {
+	case m.LastFetch.IsZero() && m.LastError != "":
+		status = "fetch failing"
+	case m.LastError != "":
+		status = fmt.Sprintf("last fetched %s, fetch failing", humanize.Time(m.LastFetch))
+	case !m.LastFetch.IsZero():
+		status = fmt.Sprintf("last fetched %s", humanize.Time(m.LastFetch))
+	}
+	div := htmlg.DivClass("pull-mirror", htmlg.Text(fmt.Sprintf("Read-only mirror of %s (%s).", m.DisplayURL(), status)))
+	div.Attr = append(div.Attr, html.Attribute{Key: atom.Style.String(), Val: `color: gray; font-size: 13px; margin-bottom: 8px;`})
+	return div
+}
+
+// servePullMirrors serves the pull mirrors admin page, and creates
+// a repository that is a pull mirror when the page is POSTed to.
+func (h *sessionsHandler) servePullMirrors(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Pull mirrors can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return nil, err
+	}
+
+	if req.Method == http.MethodPost {
+		repoRoot, err := parseRepoRoot(req.PostFormValue("repo"))
+		if err != nil {
+			return nil, httperror.BadRequest{Err: err}
+		}
+		remoteURL := strings.TrimSpace(req.PostFormValue("url"))
+		if err := checkRemoteURL(remoteURL); err != nil {
+			return nil, httperror.BadRequest{Err: err}
+		}
+		interval := pullMirrorDefaultInterval
+		if v := strings.TrimSpace(req.PostFormValue("interval")); v != "" {
+			interval, err = time.ParseDuration(v)
+			if err != nil || interval < pullMirrorMinInterval {
+				return nil, httperror.BadRequest{Err: fmt.Errorf("bad fetch interval %q, must be at least %v", v, pullMirrorMinInterval)}
+			}
+		}
+		err = repositories.Create(req.Context(), repoRoot)
+		if err != nil {
+			return nil, repoOpError(repoRoot, err)
+		}
+		auditLog.Record(req, auditRepoCreate, s.UserSpec, repoRoot, "")
+		err = pullMirrors.Add(req.Context(), repoRoot, remoteURL, interval)
+		if err != nil {
+			// Don't leave behind an empty repository that isn't a mirror.
+			if err := repositories.Delete(req.Context(), repoRoot); err != nil {
+				log.Println("servePullMirrors: repositories.Delete:", err)
+			} else {
+				auditLog.Record(req, auditRepoDelete, s.UserSpec, repoRoot, "")
+			}
+		}
+		if os.IsExist(err) {
+			return nil, httperror.BadRequest{Err: fmt.Errorf("repository %q is already a pull mirror", repoRoot)}
+		} else if err != nil {
+			return nil, err
+		}
+		auditLog.Record(req, auditPullMirrorAdd, s.UserSpec, repoRoot, displayRemoteURL(remoteURL))
+		return nil, httperror.Redirect{URL: "/admin/pull-mirrors"}
+	}
+
+	auditLog.Record(req, auditAdminView, s.UserSpec, req.URL.Path, "")
+
+	nodes := []*html.Node{htmlg.H3(htmlg.Text("Pull mirrors"))}
+	mirrors := pullMirrors.List()
+	for _, m := range mirrors {
+		status := "never fetched"
+		if !m.LastFetch.IsZero() {
+			status = "last fetched " + humanize.Time(m.LastFetch)
+		}
+		status += fmt.Sprintf(", next fetch %s", humanize.Time(m.NextAttempt))
+		if m.LastError != "" {
+			status += ", last error: " + m.LastError
+		}
+		fetch := component.PostButton{
+			Action:    "/admin/pull-mirrors/fetch?" + url.Values{"repo": {m.Repo}}.Encode(),
+			Text:      "Fetch now",
+			ReturnURL: "/admin/pull-mirrors",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		remove := component.PostButton{
+			Action:    "/admin/pull-mirrors/remove?" + url.Values{"repo": {m.Repo}}.Encode(),
+			Text:      "Stop mirroring",
+			ReturnURL: "/admin/pull-mirrors",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		div := htmlg.Div(htmlg.Text(fmt.Sprintf("Repo: %s URL: %s every %v (%s) ", m.Repo, m.DisplayURL(), m.Interval, status)))
+		htmlg.AppendChildren(div, fetch.Render()...)
+		htmlg.AppendChildren(div, remove.Render()...)
+		nodes = append(nodes, div)
+	}
+	if len(mirrors) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No pull mirrors.")),
+		)
+	}
+	nodes = append(nodes, addPullMirrorForm(csrfToken(s.rawAccessToken)))
+	return nodes, nil
+}
+
+// addPullMirrorForm renders a form for creating a repository that is a pull mirror.
+func addPullMirrorForm(csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/admin/pull-mirrors"},
+			{Key: atom.Style.String(), Val: `margin-top: 20px;`},
+		},
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("New repository root (e.g., dmitri.shuralyov.com/go/example): "), textInput("repo", "dmitri.shuralyov.com/")))
+	form.AppendChild(htmlg.Div(htmlg.Text("Remote URL (e.g., https://github.com/golang/example): "), textInput("url", "")))
+	form.AppendChild(htmlg.Div(htmlg.Text(fmt.Sprintf("Fetch interval (e.g., 30m, at least %v): ", pullMirrorMinInterval)), textInput("interval", pullMirrorDefaultInterval.String())))
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(htmlg.Div(submitInput("Create pull mirror")))
+	return form
+}
+
+// serveFetchPullMirror schedules a fetch of a pull mirror right away.
+func (h *sessionsHandler) serveFetchPullMirror(req *http.Request, s *session) error {
+	// Authorization check. Pull mirrors can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	err := pullMirrors.FetchNow(req.Context(), req.URL.Query().Get("repo"))
+	if os.IsNotExist(err) {
+		return &os.PathError{Op: "fetch", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	return httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+}
+
+// serveRemovePullMirror stops mirroring a repository.
+// The repository is kept, and can be pushed to from then on.
+func (h *sessionsHandler) serveRemovePullMirror(req *http.Request, s *session) error {
+	// Authorization check. Pull mirrors can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	repo := req.URL.Query().Get("repo")
+	err := pullMirrors.Remove(req.Context(), repo)
+	if os.IsNotExist(err) {
+		return &os.PathError{Op: "remove", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditPullMirrorRemove, s.UserSpec, repo, "")
+	return httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AaronO/go-git-http"
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/home/internal/code"
+	"golang.org/x/net/webdav"
+)
+
+// Test that pull mirrors are fetched from their remote, that code is
+// discovered after fetching, that events are logged for new commits,
+// but not for the initial fetch, and that the default branch follows the remote.
+func TestPullMirrors(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-pullmirrors-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	git := testGit(t, tempDir)
+	const repo = "dmitri.shuralyov.com/upstream"
+	var (
+		reposDir    = filepath.Join(tempDir, "repositories")
+		repoDir     = filepath.Join(reposDir, "dmitri.shuralyov.com", "upstream")
+		workDir     = filepath.Join(tempDir, "work")
+		upstreamDir = filepath.Join(tempDir, "upstream.git")
+		storeDir    = filepath.Join(tempDir, "mirrors")
+	)
+	for _, dir := range []string{reposDir, workDir, upstreamDir, storeDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(upstreamDir, "init", "--bare")
+	git(workDir, "init")
+	if err := ioutil.WriteFile(filepath.Join(workDir, "upstream.go"), []byte("package upstream\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(workDir, "add", ".")
+	git(workDir, "commit", "-m", "Initial commit.")
+	git(workDir, "tag", "-a", "-m", "Release.", "v1.0.0")
+	git(workDir, "push", upstreamDir, "HEAD:refs/heads/master", "HEAD:refs/heads/dev", "v1.0.0")
+
+	codeStore, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codeStore.Create(repo); err != nil {
+		t.Fatal(err)
+	}
+	events := &recordedEvents{}
+	h := &gitHandler{code: codeStore, reposDir: reposDir, events: events}
+	refs := func(dir string) string {
+		return git(dir, "for-each-ref", "--format=%(objectname) %(refname)")
+	}
+
+	ms := &pullMirrorStore{store: webdav.Dir(storeDir)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		ms.Run(ctx, h)
+		close(done)
+	}()
+	// waitFor waits for the pull mirror of repo to satisfy cond.
+	waitFor := func(cond func(pullMirror) bool) pullMirror {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if m, ok := ms.Get(repo); ok && cond(m) {
+				return m
+			}
+		}
+		m, _ := ms.Get(repo)
+		t.Fatalf("timed out waiting for pull mirror of %s, have %+v", repo, m)
+		return pullMirror{}
+	}
+
+	// Adding a mirror fetches it right away.
+	if err := ms.Add(ctx, repo, upstreamDir, time.Minute); err == nil {
+		t.Error("adding mirror with too short interval: got no error")
+	}
+	if err := ms.Add(ctx, repo, "--upload-pack=touch /tmp/pwned", time.Hour); err == nil {
+		t.Error("adding mirror with option as URL: got no error")
+	}
+	if err := ms.Add(ctx, repo, upstreamDir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Add(ctx, repo, upstreamDir, time.Hour); !os.IsExist(err) {
+		t.Errorf("adding duplicate mirror: got error %v, want os.ErrExist", err)
+	}
+	fetched := waitFor(func(m pullMirror) bool { return !m.LastFetch.IsZero() })
+	if fetched.LastError != "" {
+		t.Errorf("got mirror %+v, want fetched", fetched)
+	}
+	if d := fetched.NextAttempt.Sub(fetched.LastAttempt); d != time.Hour {
+		t.Errorf("got next fetch in %v, want %v", d, time.Hour)
+	}
+	if got, want := refs(repoDir), refs(upstreamDir); got != want {
+		t.Errorf("got mirror refs:\n%s\nwant:\n%s", got, want)
+	}
+	if _, ok := codeStore.Code().ByImportPath[repo]; !ok {
+		t.Errorf("package %s not discovered after initial fetch", repo)
+	}
+	if got := events.Payloads(); len(got) != 0 {
+		t.Errorf("got events %+v after initial fetch, want none", got)
+	}
+
+	// New commits, tags and deleted branches are fetched, and logged as events.
+	before := git(workDir, "rev-parse", "HEAD")
+	git(workDir, "commit", "--allow-empty", "-m", "Second commit.")
+	head := git(workDir, "rev-parse", "HEAD")
+	git(workDir, "tag", "v1.1.0")
+	git(workDir, "push", upstreamDir, "HEAD:refs/heads/master", ":refs/heads/dev", "v1.1.0")
+	if err := ms.FetchNow(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	fetched = waitFor(func(m pullMirror) bool { return m.LastFetch.After(fetched.LastFetch) })
+	if got, want := refs(repoDir), refs(upstreamDir); got != want {
+		t.Errorf("got mirror refs:\n%s\nwant:\n%s", got, want)
+	}
+	var got []interface{}
+	for _, p := range events.Payloads() {
+		if push, ok := p.(event.Push); ok {
+			push.Commits = nil // Not checked here.
+			p = push
+		}
+		got = append(got, p)
+	}
+	want := []interface{}{
+		event.Delete{Type: "branch", Name: "dev"},
+		event.Push{Branch: "master", Head: head, Before: before},
+		event.Create{Type: "tag", Name: "v1.1.0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events:\n%+v\nwant:\n%+v", got, want)
+	}
+
+	// When the remote's default branch changes, so does the mirror's,
+	// and the code on the new default branch is discovered.
+	if err := os.MkdirAll(filepath.Join(workDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workDir, "sub", "sub.go"), []byte("package sub\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(workDir, "add", ".")
+	git(workDir, "commit", "-m", "Add sub.")
+	git(workDir, "push", upstreamDir, "HEAD:refs/heads/main")
+	git(upstreamDir, "symbolic-ref", "HEAD", "refs/heads/main")
+	if err := ms.FetchNow(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func(m pullMirror) bool { return m.LastFetch.After(fetched.LastFetch) })
+	if got, want := git(repoDir, "symbolic-ref", "HEAD"), "refs/heads/main"; got != want {
+		t.Errorf("got mirror HEAD %q, want %q", got, want)
+	}
+	if _, ok := codeStore.Code().ByImportPath[repo+"/sub"]; !ok {
+		t.Errorf("package %s/sub on new default branch not discovered", repo)
+	}
+
+	// Stopping mirroring keeps the repository.
+	cancel()
+	<-done
+	if err := ms.Remove(context.Background(), repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Remove(context.Background(), repo); !os.IsNotExist(err) {
+		t.Errorf("removing mirror again: got error %v, want os.ErrNotExist", err)
+	}
+	if _, err := os.Stat(repoDir); err != nil {
+		t.Error(err)
+	}
+	var loaded pullMirrorStore
+	if err := loaded.Load(context.Background(), webdav.Dir(storeDir)); err != nil {
+		t.Fatal(err)
+	}
+	if mirrors := loaded.List(); len(mirrors) != 0 {
+		t.Errorf("got loaded mirrors %+v, want none", mirrors)
+	}
+}
+
+func TestRefUpdateEvents(t *testing.T) {
+	const (
+		zero = "0000000000000000000000000000000000000000"
+		a    = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		b    = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	)
+	before := map[string]string{
+		"refs/heads/master": a,
+		"refs/heads/dev":    a,
+		"refs/heads/same":   a,
+		"refs/tags/v1.0.0":  a,
+	}
+	after := map[string]string{
+		"refs/heads/master":  b,
+		"refs/heads/same":    a,
+		"refs/heads/feature": b,
+		"refs/tags/v1.0.0":   a,
+		"refs/tags/v1.1.0":   b,
+		"refs/notes/commits": b,
+	}
+	got := refUpdateEvents(before, after)
+	want := []githttp.Event{
+		{Type: githttp.PUSH, Branch: "dev", Last: a, Commit: zero},
+		{Type: githttp.PUSH, Branch: "feature", Last: zero, Commit: b},
+		{Type: githttp.PUSH, Branch: "master", Last: a, Commit: b},
+		{Type: githttp.TAG, Tag: "v1.1.0", Last: zero, Commit: b},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events:\n%+v\nwant:\n%+v", got, want)
+	}
+}
+
+// recordedEvents is an events.Service that records logged events in memory.
+type recordedEvents struct {
+	mu     sync.Mutex
+	events []event.Event
+}
+
+func (r *recordedEvents) List(context.Context) ([]event.Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]event.Event(nil), r.events...), nil
+}
+
+func (r *recordedEvents) Log(_ context.Context, e event.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
+// Payloads returns payloads of the logged events.
+func (r *recordedEvents) Payloads() []interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var payloads []interface{}
+	for _, e := range r.events {
+		payloads = append(payloads, e.Payload)
+	}
+	return payloads
+}
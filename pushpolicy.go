@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/shurcooL/home/component"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// pushPolicy is a set of rules that pushes to a repository must follow.
+// It's enforced by a pre-receive hook, after the pushed objects are received
+// but before any refs are updated. If any ref update breaks a rule,
+// the whole push is rejected, and the reasons are shown to the git client.
+type pushPolicy struct {
+	Repo string // Repository spec. E.g., "dmitri.shuralyov.com/kebabcase". Empty means repositories without own policy.
+
+	ProtectedBranches []string // Patterns of branches that can't be deleted or force pushed, as in path.Match. E.g., "master", "release-*".
+	ProtectTags       bool     // Whether tags can't be deleted or moved.
+	NoNonFastForward  bool     // Whether no branches can be force pushed.
+	MaxObjectSize     int64    // Max size of pushed files, in bytes. Zero means no limit.
+	CommitMessage     string   // Regexp that messages of pushed commits must match. Empty means any message.
+	SignedCommits     bool     // Whether pushed commits must have a good GPG signature.
+}
+
+// empty reports whether p has no rules.
+func (p pushPolicy) empty() bool {
+	return len(p.ProtectedBranches) == 0 && !p.ProtectTags && !p.NoNonFastForward &&
+		p.MaxObjectSize == 0 && p.CommitMessage == "" && !p.SignedCommits
+}
+
+// protected reports whether branch is protected by p.
+func (p pushPolicy) protected(branch string) bool {
+	for _, pattern := range p.ProtectedBranches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pushPolicies is the store of push policies.
+var pushPolicies pushPolicyStore
+
+type pushPolicyStore struct {
+	mu       sync.Mutex
+	policies []pushPolicy // Sorted by repo.
+
+	// store is where policies are persisted. If nil, policies are only kept in memory.
+	store webdav.FileSystem
+}
+
+// pushPoliciesPath is the path of the file in the policy store
+// where push policies are persisted.
+const pushPoliciesPath = "/push-policies"
+
+// Load sets root as the push policy store, and loads policies from it.
+func (ps *pushPolicyStore) Load(ctx context.Context, root webdav.FileSystem) error {
+	var policies []pushPolicy
+	err := gobDecodeFile(ctx, root, pushPoliciesPath, &policies)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ps.mu.Lock()
+	ps.store = root
+	ps.policies = policies
+	ps.mu.Unlock()
+	return nil
+}
+
+// Get returns the push policy that applies to repo.
+// That's the policy of repo if it has one, or the default policy otherwise.
+func (ps *pushPolicyStore) Get(repo string) pushPolicy {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var def pushPolicy
+	for _, p := range ps.policies {
+		switch p.Repo {
+		case repo:
+			return p
+		case "":
+			def = p
+		}
+	}
+	def.Repo = repo
+	return def
+}
+
+// List lists all push policies, sorted by repo.
+func (ps *pushPolicyStore) List() []pushPolicy {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return append([]pushPolicy(nil), ps.policies...)
+}
+
+// Set sets the push policy of p.Repo to p, replacing the previous one, if any.
+func (ps *pushPolicyStore) Set(ctx context.Context, p pushPolicy) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	policies := []pushPolicy{p}
+	for _, pp := range ps.policies {
+		if pp.Repo == p.Repo {
+			continue
+		}
+		policies = append(policies, pp)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Repo < policies[j].Repo })
+	return ps.set(ctx, policies)
+}
+
+// Remove removes the push policy of repo.
+// It returns os.ErrNotExist if repo has no policy.
+func (ps *pushPolicyStore) Remove(ctx context.Context, repo string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var policies []pushPolicy
+	for _, p := range ps.policies {
+		if p.Repo == repo {
+			continue
+		}
+		policies = append(policies, p)
+	}
+	if len(policies) == len(ps.policies) {
+		return os.ErrNotExist
+	}
+	return ps.set(ctx, policies)
+}
+
+// RenameRepo moves the push policy of repo from, if any, to repo to.
+// A policy that to already has is removed either way.
+func (ps *pushPolicyStore) RenameRepo(ctx context.Context, from, to string) error {
+	if from == "" || to == "" {
+		return errors.New("default push policy can't be renamed")
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var (
+		policies []pushPolicy
+		changed  bool
+	)
+	for _, p := range ps.policies {
+		switch p.Repo {
+		case from:
+			p.Repo, changed = to, true
+		case to:
+			changed = true
+			continue
+		}
+		policies = append(policies, p)
+	}
+	if !changed {
+		return nil
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Repo < policies[j].Repo })
+	return ps.set(ctx, policies)
+}
+
+// set persists policies and makes them take effect. ps.mu must be held.
+func (ps *pushPolicyStore) set(ctx context.Context, policies []pushPolicy) error {
+	if ps.store != nil {
+		err := gobEncodeFile(ctx, ps.store, pushPoliciesPath, policies)
+		if err != nil {
+			return err
+		}
+	}
+	ps.policies = policies
+	return nil
+}
+
+// pushPolicyEnv is the environment variable that carries the JSON-encoded
+// push policy to the git hooks. The home binary acts as the hooks
+// when it's started with this variable set.
+const pushPolicyEnv = "HOME_PUSH_POLICY"
+
+// receivePackHooks are the hooks that git-receive-pack runs.
+// The pre-receive one enforces the push policy.
+var receivePackHooks = []string{"pre-receive", "update", "post-receive", "post-update", "reference-transaction"}
+
+// installGitHooks creates a git hooks directory whose receivePackHooks
+// are the currently running executable, and returns its path.
+// The caller is responsible for removing it when it's no longer needed.
+func installGitHooks() (hooksDir string, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	hooksDir, err = ioutil.TempDir("", "home-git-hooks-")
+	if err != nil {
+		return "", err
+	}
+	for _, hook := range receivePackHooks {
+		err = os.Symlink(exe, filepath.Join(hooksDir, hook))
+		if err != nil {
+			os.RemoveAll(hooksDir)
+			return "", err
+		}
+	}
+	return hooksDir, nil
+}
+
+// pushPolicyHookEnv returns the environment for git-receive-pack
+// that makes it enforce p with the hooks in hooksDir.
+// Since that overrides core.hooksPath, the hooks in hooksDir
+// run the repository's own hooks, if any, in turn.
+func pushPolicyHookEnv(hooksDir string, p pushPolicy) []string {
+	env := os.Environ()
+	if p.empty() {
+		return env
+	}
+	policy, err := json.Marshal(p)
+	if err != nil {
+		panic(fmt.Errorf("internal error: json.Marshal(pushPolicy) failed: %v", err))
+	}
+	return append(env,
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=core.hooksPath",
+		"GIT_CONFIG_VALUE_0="+hooksDir,
+		pushPolicyEnv+"="+string(policy),
+	)
+}
+
+// hookMain is the main function of the home binary when git runs it as
+// one of receivePackHooks, and returns the exit code. As the pre-receive hook,
+// it checks the ref updates given on stdin against the push policy
+// in the environment. Then it runs the repository's own hook, if any.
+// Anything written to stderr is shown to the git client.
+func hookMain() int {
+	hook := filepath.Base(os.Args[0])
+	var stdin io.Reader = os.Stdin
+	if hook == "pre-receive" {
+		var p pushPolicy
+		err := json.Unmarshal([]byte(os.Getenv(pushPolicyEnv)), &p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: bad push policy:", err)
+			return 1
+		}
+		updates, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: reading ref updates:", err)
+			return 1
+		}
+		violations, err := checkPush(context.Background(), ".", p, bytes.NewReader(updates))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: checking push policy:", err)
+			return 1
+		}
+		if len(violations) > 0 {
+			for _, v := range violations {
+				fmt.Fprintln(os.Stderr, "error:", v)
+			}
+			fmt.Fprintln(os.Stderr, "error: push rejected by repository policy")
+			return 1
+		}
+		stdin = bytes.NewReader(updates)
+	}
+	return runRepoHook(hook, os.Args[1:], stdin)
+}
+
+// runRepoHook runs the hook with name of the git repository in the current
+// directory, if it has one, with args and stdin, and returns its exit code.
+// Git runs hooks of bare repositories in the repository directory.
+func runRepoHook(name string, args []string, stdin io.Reader) int {
+	path := filepath.Join("hooks", name)
+	if fi, err := os.Stat(path); err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+		// No hook to run, same as git would do.
+		return 0
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Don't let the hook see the push policy and the hooks directory,
+	// which would apply to any git commands it runs.
+	for _, kv := range os.Environ() {
+		switch {
+		case strings.HasPrefix(kv, pushPolicyEnv+"="), strings.HasPrefix(kv, "GIT_CONFIG_COUNT="),
+			strings.HasPrefix(kv, "GIT_CONFIG_KEY_0="), strings.HasPrefix(kv, "GIT_CONFIG_VALUE_0="):
+			continue
+		}
+		cmd.Env = append(cmd.Env, kv)
+	}
+	err := cmd.Run()
+	if err, ok := err.(*exec.ExitError); ok {
+		return err.ExitCode()
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "error: running %s hook: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// checkPush checks the ref updates to the git repository in dir against p.
+// updates is in the format of pre-receive hook input, one "<old> <new> <ref>" line per ref.
+// It returns a description of each way the push breaks p.
+func checkPush(ctx context.Context, dir string, p pushPolicy, updates io.Reader) (violations []string, _ error) {
+	var commitMessage *regexp.Regexp
+	if p.CommitMessage != "" {
+		var err error
+		commitMessage, err = regexp.Compile(p.CommitMessage)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sc := bufio.NewScanner(updates)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("bad ref update %q", sc.Text())
+		}
+		oldID, newID, ref := fields[0], fields[1], fields[2]
+		created, deleted := isZeroID(oldID), isZeroID(newID)
+
+		switch {
+		case strings.HasPrefix(ref, "refs/heads/"):
+			branch := ref[len("refs/heads/"):]
+			if deleted && p.protected(branch) {
+				violations = append(violations, fmt.Sprintf("%s: deleting protected branch is not allowed", ref))
+			} else if !created && !deleted && (p.NoNonFastForward || p.protected(branch)) {
+				ff, err := isAncestor(ctx, dir, oldID, newID)
+				if err != nil {
+					return nil, err
+				}
+				if !ff {
+					violations = append(violations, fmt.Sprintf("%s: non-fast-forward update is not allowed", ref))
+				}
+			}
+		case strings.HasPrefix(ref, "refs/tags/"):
+			if deleted && p.ProtectTags {
+				violations = append(violations, fmt.Sprintf("%s: deleting tags is not allowed", ref))
+			} else if !created && p.ProtectTags {
+				violations = append(violations, fmt.Sprintf("%s: moving tags is not allowed", ref))
+			}
+		}
+		if deleted {
+			continue
+		}
+
+		// Check new commits and files.
+		if commitMessage != nil || p.SignedCommits {
+			v, err := checkNewCommits(ctx, dir, newID, commitMessage, p.SignedCommits)
+			if err != nil {
+				return nil, err
+			}
+			violations = append(violations, v...)
+		}
+		if p.MaxObjectSize > 0 {
+			v, err := checkNewObjectSizes(ctx, dir, newID, p.MaxObjectSize)
+			if err != nil {
+				return nil, err
+			}
+			violations = append(violations, v...)
+		}
+	}
+	return violations, sc.Err()
+}
+
+// checkNewCommits checks commits reachable from newID that aren't reachable
+// from any existing ref. Their messages must match commitMessage, if non-nil,
+// and they must have a good signature, if signed is true.
+func checkNewCommits(ctx context.Context, dir, newID string, commitMessage *regexp.Regexp, signed bool) (violations []string, _ error) {
+	format := "%H -%n%B"
+	if signed {
+		format = "%H %G?%n%B" // %G? is "G" for a good signature, "U" for a good signature with unknown validity.
+	}
+	out, err := gitOutput(ctx, dir, nil, "log", "-z", "--format="+format, newID, "--not", "--all")
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range strings.Split(string(out), "\x00") {
+		if c == "" {
+			continue
+		}
+		i := strings.Index(c, "\n")
+		if i == -1 || i < 2 {
+			return nil, fmt.Errorf("unexpected git log output %q", c)
+		}
+		commit, signature, message := c[:i-2], c[i-1:i], c[i+1:]
+		if commitMessage != nil && !commitMessage.MatchString(strings.TrimSuffix(message, "\n")) {
+			violations = append(violations, fmt.Sprintf("commit %s: message doesn't match required format %q", shortSHA(commit), commitMessage))
+		}
+		switch {
+		case !signed, signature == "G", signature == "U":
+		case signature == "N":
+			violations = append(violations, fmt.Sprintf("commit %s: commit is not signed", shortSHA(commit)))
+		default:
+			violations = append(violations, fmt.Sprintf("commit %s: signature is bad or can't be checked (%s)", shortSHA(commit), signature))
+		}
+	}
+	return violations, nil
+}
+
+// checkNewObjectSizes checks that files reachable from newID that aren't reachable
+// from any existing ref are at most maxSize bytes.
+func checkNewObjectSizes(ctx context.Context, dir, newID string, maxSize int64) (violations []string, _ error) {
+	objects, err := gitOutput(ctx, dir, nil, "rev-list", "--objects", newID, "--not", "--all")
+	if err != nil {
+		return nil, err
+	}
+	out, err := gitOutput(ctx, dir, bytes.NewReader(objects), "cat-file", "--batch-check=%(objecttype) %(objectsize) %(rest)")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 || fields[0] != "blob" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected git cat-file output %q", line)
+		}
+		if size > maxSize {
+			name := ""
+			if len(fields) == 3 {
+				name = fields[2]
+			}
+			violations = append(violations, fmt.Sprintf("file %q is %d bytes, which is more than the limit of %d bytes", name, size, maxSize))
+		}
+	}
+	return violations, nil
+}
+
+// isAncestor reports whether commit ancestor is an ancestor of commit descendant,
+// i.e., whether updating a ref from ancestor to descendant is a fast-forward.
+func isAncestor(ctx context.Context, dir, ancestor, descendant string) (bool, error) {
+	cmd := exec.CommandContext(ctx, "git", "merge-base", "--is-ancestor", ancestor, descendant)
+	cmd.Dir = dir
+	err := cmd.Run()
+	if ee, _ := err.(*exec.ExitError); ee != nil && ee.Sys().(syscall.WaitStatus).ExitStatus() == 1 {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("git merge-base: %v", err)
+	}
+	return true, nil
+}
+
+// isZeroID reports whether id is the all-zero object ID, which git uses
+// for refs that don't exist.
+func isZeroID(id string) bool {
+	return strings.Trim(id, "0") == ""
+}
+
+// gitOutput runs git with args in dir, and returns its standard output.
+func gitOutput(ctx context.Context, dir string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// servePushPolicies serves the push policies admin page,
+// and sets a push policy when the page is POSTed to.
+func (h *sessionsHandler) servePushPolicies(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Push policies can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return nil, err
+	}
+
+	if req.Method == http.MethodPost {
+		p := pushPolicy{
+			Repo:             strings.TrimSpace(req.PostFormValue("repo")),
+			ProtectTags:      req.PostFormValue("protect-tags") != "",
+			NoNonFastForward: req.PostFormValue("no-non-fast-forward") != "",
+			CommitMessage:    req.PostFormValue("commit-message"),
+			SignedCommits:    req.PostFormValue("signed-commits") != "",
+		}
+		for _, pattern := range strings.Split(req.PostFormValue("protected-branches"), ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, httperror.BadRequest{Err: fmt.Errorf("bad protected branch pattern %q: %v", pattern, err)}
+			}
+			p.ProtectedBranches = append(p.ProtectedBranches, pattern)
+		}
+		if v := strings.TrimSpace(req.PostFormValue("max-object-size")); v != "" {
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || size < 0 {
+				return nil, httperror.BadRequest{Err: fmt.Errorf("bad max object size %q", v)}
+			}
+			p.MaxObjectSize = size
+		}
+		if _, err := regexp.Compile(p.CommitMessage); err != nil {
+			return nil, httperror.BadRequest{Err: fmt.Errorf("bad commit message format: %v", err)}
+		}
+		if p.empty() {
+			return nil, httperror.BadRequest{Err: errors.New("push policy must have at least one rule")}
+		}
+		err := pushPolicies.Set(req.Context(), p)
+		if err != nil {
+			return nil, err
+		}
+		auditLog.Record(req, auditPushPolicySet, s.UserSpec, p.Repo, describePushPolicy(p))
+		return nil, httperror.Redirect{URL: "/admin/push-policies"}
+	}
+
+	auditLog.Record(req, auditAdminView, s.UserSpec, req.URL.Path, "")
+
+	nodes := []*html.Node{htmlg.H3(htmlg.Text("Push policies"))}
+	policies := pushPolicies.List()
+	for _, p := range policies {
+		repo := p.Repo
+		if repo == "" {
+			repo = "(default)"
+		}
+		remove := component.PostButton{
+			Action:    "/admin/push-policies/remove?" + url.Values{"repo": {p.Repo}}.Encode(),
+			Text:      "Remove",
+			ReturnURL: "/admin/push-policies",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		div := htmlg.Div(htmlg.Text(fmt.Sprintf("Repo: %s %s ", repo, describePushPolicy(p))))
+		htmlg.AppendChildren(div, remove.Render()...)
+		nodes = append(nodes, div)
+	}
+	if len(policies) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No push policies. All pushes by pushers are accepted.")),
+		)
+	}
+	nodes = append(nodes, setPushPolicyForm(csrfToken(s.rawAccessToken)))
+	return nodes, nil
+}
+
+// describePushPolicy returns a short description of the rules of p.
+func describePushPolicy(p pushPolicy) string {
+	var rules []string
+	if len(p.ProtectedBranches) > 0 {
+		rules = append(rules, "protected branches: "+strings.Join(p.ProtectedBranches, ", "))
+	}
+	if p.ProtectTags {
+		rules = append(rules, "protected tags")
+	}
+	if p.NoNonFastForward {
+		rules = append(rules, "no non-fast-forward")
+	}
+	if p.MaxObjectSize > 0 {
+		rules = append(rules, fmt.Sprintf("max object size: %d", p.MaxObjectSize))
+	}
+	if p.CommitMessage != "" {
+		rules = append(rules, fmt.Sprintf("commit message: %q", p.CommitMessage))
+	}
+	if p.SignedCommits {
+		rules = append(rules, "signed commits")
+	}
+	return strings.Join(rules, "; ")
+}
+
+// setPushPolicyForm renders a form for setting a push policy.
+func setPushPolicyForm(csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/admin/push-policies"},
+			{Key: atom.Style.String(), Val: `margin-top: 20px;`},
+		},
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Repository (empty for default): "), textInput("repo", "")))
+	form.AppendChild(htmlg.Div(htmlg.Text("Protected branches (comma-separated patterns, e.g., master, release-*): "), textInput("protected-branches", "")))
+	form.AppendChild(htmlg.Div(checkboxInput("protect-tags"), htmlg.Text(" Protect tags from being deleted or moved")))
+	form.AppendChild(htmlg.Div(checkboxInput("no-non-fast-forward"), htmlg.Text(" Reject non-fast-forward updates of all branches")))
+	form.AppendChild(htmlg.Div(htmlg.Text("Max file size in bytes (empty for no limit): "), textInput("max-object-size", "")))
+	form.AppendChild(htmlg.Div(htmlg.Text("Required commit message format (regexp, e.g., ^[a-z/]+: ): "), textInput("commit-message", "")))
+	form.AppendChild(htmlg.Div(checkboxInput("signed-commits"), htmlg.Text(" Require signed commits")))
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(htmlg.Div(submitInput("Set push policy")))
+	return form
+}
+
+// serveRemovePushPolicy removes the push policy specified by the repo query parameter.
+func (h *sessionsHandler) serveRemovePushPolicy(req *http.Request, s *session) error {
+	// Authorization check. Push policies can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	repo := req.URL.Query().Get("repo")
+	err := pushPolicies.Remove(req.Context(), repo)
+	if os.IsNotExist(err) {
+		return &os.PathError{Op: "remove", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditPushPolicyRemove, s.UserSpec, repo, "")
+	return httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+}
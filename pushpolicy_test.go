@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// The test binary acts as the git hooks, like the home binary does.
+	if _, ok := os.LookupEnv(pushPolicyEnv); ok {
+		os.Exit(hookMain())
+	}
+	os.Exit(m.Run())
+}
+
+// Test that pushes that break the push policy are rejected,
+// with the reasons shown to the git client, and that
+// the repository's own hooks still run.
+func TestPushPolicy(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-pushpolicy-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	hooksDir, err := installGitHooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hooksDir)
+
+	repoDir := filepath.Join(tempDir, "repo.git")
+	workDir := filepath.Join(tempDir, "work")
+	for _, dir := range []string{repoDir, workDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git := testGit(t, tempDir)
+	commit := func(file, contents, message string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(workDir, file), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git(workDir, "add", file)
+		git(workDir, "commit", "-m", message)
+	}
+	git(workDir, "init", "--bare", repoDir)
+	git(workDir, "init")
+
+	p := pushPolicy{
+		ProtectedBranches: []string{"master", "release-*"},
+		ProtectTags:       true,
+		MaxObjectSize:     1000,
+		CommitMessage:     `^[a-z/]+: `,
+	}
+	// push pushes refspecs to the repository with push policy p,
+	// and reports whether the push was accepted, and the output.
+	push := func(refspecs ...string) (bool, string) {
+		t.Helper()
+		// Local pushes don't pass git configuration in the environment on to
+		// git-receive-pack, so set the variables in its command instead.
+		receivePack := "env"
+		for _, kv := range pushPolicyHookEnv(hooksDir, p)[len(os.Environ()):] {
+			receivePack += " '" + kv + "'"
+		}
+		receivePack += " git-receive-pack"
+		cmd := testGitCommand(tempDir, workDir, append([]string{"push", "--porcelain", "--receive-pack=" + receivePack, repoDir}, refspecs...)...)
+		out, err := cmd.CombinedOutput()
+		if _, ok := err.(*exec.ExitError); !ok && err != nil {
+			t.Fatal(err)
+		}
+		return err == nil, string(out)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		setup     func()
+		refspecs  []string
+		wantOK    bool
+		wantError string // Expected rejection message, if push is rejected.
+	}{
+		{
+			name:     "new branch",
+			setup:    func() { commit("README.md", "Hello.\n", "readme: add") },
+			refspecs: []string{"HEAD:refs/heads/master"},
+			wantOK:   true,
+		},
+		{
+			name: "fast-forward",
+			setup: func() {
+				git(workDir, "branch", "first")
+				commit("README.md", "Hello, world.\n", "readme: greet world")
+			},
+			refspecs: []string{"HEAD:refs/heads/master"},
+			wantOK:   true,
+		},
+		{
+			name:      "non-fast-forward to protected branch",
+			setup:     func() { git(workDir, "commit", "--amend", "-m", "readme: greet everyone") },
+			refspecs:  []string{"+HEAD:refs/heads/master"},
+			wantError: "refs/heads/master: non-fast-forward update is not allowed",
+		},
+		{
+			name:     "non-fast-forward to unprotected branch",
+			setup:    func() { git(workDir, "push", repoDir, "master@{1}:refs/heads/dev") },
+			refspecs: []string{"+HEAD:refs/heads/dev"},
+			wantOK:   true,
+		},
+		{
+			name:      "delete protected branch",
+			refspecs:  []string{":refs/heads/master"},
+			wantError: "refs/heads/master: deleting protected branch is not allowed",
+		},
+		{
+			name:      "bad commit message",
+			setup:     func() { commit("main.go", "package main\n", "Add main.go") },
+			refspecs:  []string{"HEAD:refs/heads/feature"},
+			wantError: `message doesn't match required format "^[a-z/]+: "`,
+		},
+		{
+			name:      "large file",
+			setup:     func() { commit("big.txt", strings.Repeat("big\n", 1000), "big: add") },
+			refspecs:  []string{"HEAD:refs/heads/feature"},
+			wantError: `file "big.txt" is 4000 bytes, which is more than the limit of 1000 bytes`,
+		},
+		{
+			name:     "new tag",
+			refspecs: []string{"first:refs/tags/v1.0.0"},
+			wantOK:   true,
+		},
+		{
+			name:      "move tag",
+			refspecs:  []string{"+master:refs/tags/v1.0.0"},
+			wantError: "refs/tags/v1.0.0: moving tags is not allowed",
+		},
+		{
+			name:      "delete tag",
+			refspecs:  []string{":refs/tags/v1.0.0"},
+			wantError: "refs/tags/v1.0.0: deleting tags is not allowed",
+		},
+		{
+			name: "unsigned commit",
+			setup: func() {
+				git(workDir, "reset", "--hard", "first")
+				commit("LICENSE", "MIT\n", "license: add")
+				p.SignedCommits = true
+			},
+			refspecs:  []string{"+HEAD:refs/heads/dev"},
+			wantError: "commit is not signed",
+		},
+	} {
+		if tc.setup != nil {
+			tc.setup()
+		}
+		ok, out := push(tc.refspecs...)
+		if ok != tc.wantOK {
+			t.Errorf("%s: got accepted %v, want %v; output:\n%s", tc.name, ok, tc.wantOK, out)
+			continue
+		}
+		if !tc.wantOK && (!strings.Contains(out, tc.wantError) || !strings.Contains(out, "pre-receive hook declined")) {
+			t.Errorf("%s: got output:\n%s\nwant it to contain %q", tc.name, out, tc.wantError)
+		}
+	}
+
+	p.SignedCommits = false
+	for name, script := range map[string]string{
+		"pre-receive":  "#!/bin/sh\nwhile read old new ref; do\n\tif [ \"$ref\" = refs/heads/blocked ]; then echo 'blocked by repository hook' >&2; exit 1; fi\ndone\n",
+		"post-receive": "#!/bin/sh\ncat > received\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(repoDir, "hooks", name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, out := push("HEAD:refs/heads/blocked"); ok || !strings.Contains(out, "blocked by repository hook") {
+		t.Errorf("push rejected by repository hook: got accepted %v, output:\n%s", ok, out)
+	}
+	if ok, out := push("HEAD:refs/heads/other"); !ok {
+		t.Errorf("push accepted by repository hook: got rejected, output:\n%s", out)
+	}
+	if received, err := ioutil.ReadFile(filepath.Join(repoDir, "received")); err != nil || !strings.HasSuffix(strings.TrimSpace(string(received)), " refs/heads/other") {
+		t.Errorf("repository's post-receive hook: got input %q, error %v; want update of refs/heads/other", received, err)
+	}
+}
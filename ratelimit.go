@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/shurcooL/home/component"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"golang.org/x/net/html"
+)
+
+// authLimiter limits failed authentication attempts on git Basic Auth,
+// token-bearing API calls and login callbacks, in order to slow down
+// brute-force attacks. Clients are identified by IP address only,
+// since usernames are chosen by the client, and limiting them would
+// let anyone lock out any user.
+var authLimiter = newRateLimiter()
+
+const (
+	authAttemptRate   = 1  // Sustained number of attempts allowed per second.
+	authAttemptBurst  = 30 // Number of attempts allowed in a burst.
+	authMaxFailures   = 10 // Number of failed attempts within authFailureWindow that causes a lockout.
+	authFailureWindow = 15 * time.Minute
+	authLockout       = 15 * time.Minute
+)
+
+// rateLimiter is a per-client rate limiter with temporary lockouts.
+// Each client has a token bucket of attempts, and gets locked out
+// after too many failed attempts in a row.
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*clientLimit // Client Key -> Client Limit.
+
+	now func() time.Time // For testing. Defaults to time.Now.
+}
+
+type clientLimit struct {
+	Tokens  float64   // Attempts left in the bucket.
+	Updated time.Time // When Tokens was last updated.
+
+	Failures     int       // Number of failed attempts since FirstFailure.
+	FirstFailure time.Time // Time of the first failed attempt in the current window.
+	LockedUntil  time.Time // Zero if client is not locked out.
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{clients: make(map[string]*clientLimit), now: time.Now}
+}
+
+// ipKey returns the client key for the IP address of req.
+func ipKey(req *http.Request) string { return "ip:" + remoteIP(req) }
+
+// remoteIP returns the IP address of the client that sent req.
+func remoteIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// Allow reports whether an attempt by the client identified by keys is allowed.
+// If so, it uses up an attempt for each key and returns 0. Succeeded gives
+// the attempt back, so only failed attempts count towards the limit.
+// Otherwise it returns how long to wait before trying again.
+func (rl *rateLimiter) Allow(keys ...string) (retryAfter time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	for _, key := range keys {
+		c := rl.client(key, now)
+		if now.Before(c.LockedUntil) {
+			retryAfter = maxDuration(retryAfter, c.LockedUntil.Sub(now))
+		} else if c.Tokens < 1 {
+			retryAfter = maxDuration(retryAfter, time.Duration((1-c.Tokens)/authAttemptRate*float64(time.Second)))
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	for _, key := range keys {
+		rl.clients[key].Tokens--
+	}
+	return 0
+}
+
+// Failed records a failed attempt by the client identified by keys.
+// It reports whether that caused the client to be locked out.
+func (rl *rateLimiter) Failed(keys ...string) (locked bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	for _, key := range keys {
+		c := rl.client(key, now)
+		if now.Sub(c.FirstFailure) > authFailureWindow {
+			c.Failures, c.FirstFailure = 0, now
+		}
+		c.Failures++
+		if c.Failures >= authMaxFailures {
+			c.Failures, c.FirstFailure = 0, time.Time{}
+			c.LockedUntil = now.Add(authLockout)
+			locked = true
+		}
+	}
+	return locked
+}
+
+// Succeeded records a successful attempt by the client identified by keys.
+// It gives back the attempt used up by Allow. Failed attempts aren't reset,
+// so that a client with valid credentials can't make guesses in between
+// successful attempts without ever being locked out.
+func (rl *rateLimiter) Succeeded(keys ...string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	for _, key := range keys {
+		c := rl.client(key, now)
+		c.Tokens = math.Min(authAttemptBurst, c.Tokens+1)
+	}
+}
+
+// client returns the up to date limit of client with key, creating it if needed.
+// rl.mu must be held.
+func (rl *rateLimiter) client(key string, now time.Time) *clientLimit {
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &clientLimit{Tokens: authAttemptBurst, Updated: now}
+		rl.clients[key] = c
+		return c
+	}
+	c.Tokens = math.Min(authAttemptBurst, c.Tokens+now.Sub(c.Updated).Seconds()*authAttemptRate)
+	c.Updated = now
+	return c
+}
+
+// blockedClient is a client that is currently locked out.
+type blockedClient struct {
+	Key         string
+	LockedUntil time.Time
+}
+
+// Blocked lists clients that are currently locked out, longest lockout first.
+func (rl *rateLimiter) Blocked() []blockedClient {
+	var blocked []blockedClient
+	rl.mu.Lock()
+	now := rl.now()
+	for key, c := range rl.clients {
+		if !now.Before(c.LockedUntil) {
+			continue
+		}
+		blocked = append(blocked, blockedClient{Key: key, LockedUntil: c.LockedUntil})
+	}
+	rl.mu.Unlock()
+	sort.Slice(blocked, func(i, j int) bool { return blocked[i].LockedUntil.After(blocked[j].LockedUntil) })
+	return blocked
+}
+
+// Unblock lifts the lockout of the client with key.
+// It returns os.ErrNotExist if the client isn't locked out.
+func (rl *rateLimiter) Unblock(key string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	c, ok := rl.clients[key]
+	if !ok || !rl.now().Before(c.LockedUntil) {
+		return os.ErrNotExist
+	}
+	delete(rl.clients, key)
+	return nil
+}
+
+// Sweep forgets clients that have a full bucket of attempts,
+// no recent failed attempts, and aren't locked out.
+func (rl *rateLimiter) Sweep() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	for key, c := range rl.clients {
+		c = rl.client(key, now)
+		if c.Tokens < authAttemptBurst || now.Sub(c.FirstFailure) <= authFailureWindow || now.Before(c.LockedUntil) {
+			continue
+		}
+		delete(rl.clients, key)
+	}
+}
+
+// sweepPeriodically calls Sweep every interval until ctx is done.
+func (rl *rateLimiter) sweepPeriodically(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			rl.Sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// rateLimitedError is returned when an authentication attempt
+// is rejected because the client is rate limited or locked out.
+type rateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (err rateLimitedError) Error() string {
+	return fmt.Sprintf("too many authentication attempts, retry after %v", err.RetryAfter)
+}
+
+// handleRateLimited responds with 429 Too Many Requests and a Retry-After header.
+func handleRateLimited(w http.ResponseWriter, err rateLimitedError) {
+	seconds := int(math.Ceil(err.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+}
+
+// serveBlocked serves the admin page that lists clients
+// that are locked out for too many failed authentication attempts.
+func (h *sessionsHandler) serveBlocked(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Blocked clients can only be viewed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return nil, err
+	}
+	auditLog.Record(req, auditAdminView, s.UserSpec, req.URL.Path, "")
+
+	nodes := []*html.Node{htmlg.H3(htmlg.Text("Blocked clients"))}
+	blocked := authLimiter.Blocked()
+	for _, b := range blocked {
+		unblock := component.PostButton{
+			Action:    "/admin/blocked/unblock?" + url.Values{"key": {b.Key}}.Encode(),
+			Text:      "Unblock",
+			ReturnURL: "/admin/blocked",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		div := htmlg.Div(htmlg.Text(fmt.Sprintf("Client: %q locked until: %v ", b.Key, humanize.Time(b.LockedUntil))))
+		htmlg.AppendChildren(div, unblock.Render()...)
+		nodes = append(nodes, div)
+	}
+	if len(blocked) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No blocked clients.")),
+		)
+	}
+	return nodes, nil
+}
+
+// serveUnblock lifts the lockout of the client specified by the key query parameter.
+func (h *sessionsHandler) serveUnblock(req *http.Request, s *session) error {
+	// Authorization check. Blocked clients can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	key := req.URL.Query().Get("key")
+	err := authLimiter.Unblock(key)
+	if os.IsNotExist(err) {
+		return &os.PathError{Op: "unblock", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditUnblock, s.UserSpec, key, "")
+	return httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+}
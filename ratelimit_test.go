@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl := newRateLimiter()
+	rl.now = func() time.Time { return now }
+
+	// A burst of attempts is allowed, but not more.
+	for i := 0; i < authAttemptBurst; i++ {
+		if retryAfter := rl.Allow("ip:192.0.2.1"); retryAfter != 0 {
+			t.Fatalf("attempt %d: got retryAfter %v, want 0", i, retryAfter)
+		}
+	}
+	if retryAfter := rl.Allow("ip:192.0.2.1"); retryAfter != time.Second {
+		t.Errorf("attempt after burst: got retryAfter %v, want %v", retryAfter, time.Second)
+	}
+	if retryAfter := rl.Allow("ip:192.0.2.2"); retryAfter != 0 {
+		t.Errorf("attempt by another client: got retryAfter %v, want 0", retryAfter)
+	}
+	now = now.Add(time.Second)
+	if retryAfter := rl.Allow("ip:192.0.2.1"); retryAfter != 0 {
+		t.Errorf("attempt after waiting: got retryAfter %v, want 0", retryAfter)
+	}
+
+	// Successful attempts don't count towards the limit.
+	for i := 0; i < 2*authAttemptBurst; i++ {
+		if retryAfter := rl.Allow("ip:192.0.2.5"); retryAfter != 0 {
+			t.Fatalf("attempt %d after successful ones: got retryAfter %v, want 0", i, retryAfter)
+		}
+		rl.Succeeded("ip:192.0.2.5")
+	}
+
+	// Successful attempts don't reset failed ones, so too many failed attempts
+	// cause a lockout even if they're interleaved with successful ones.
+	for i := 0; i < authMaxFailures-1; i++ {
+		if retryAfter := rl.Allow("ip:192.0.2.3"); retryAfter != 0 {
+			t.Fatalf("attempt %d: got retryAfter %v, want 0", i, retryAfter)
+		}
+		rl.Succeeded("ip:192.0.2.3")
+		if retryAfter := rl.Allow("ip:192.0.2.3"); retryAfter != 0 {
+			t.Fatalf("attempt %d: got retryAfter %v, want 0", i, retryAfter)
+		}
+		if rl.Failed("ip:192.0.2.3") {
+			t.Fatalf("failed attempt %d: got locked, want not locked", i)
+		}
+	}
+	rl.Succeeded("ip:192.0.2.3")
+	if !rl.Failed("ip:192.0.2.3") {
+		t.Fatal("last failed attempt: got not locked, want locked")
+	}
+	if retryAfter := rl.Allow("ip:192.0.2.3"); retryAfter != authLockout {
+		t.Errorf("attempt while locked out: got retryAfter %v, want %v", retryAfter, authLockout)
+	}
+	if blocked := rl.Blocked(); len(blocked) != 1 || blocked[0].Key != "ip:192.0.2.3" {
+		t.Errorf("got blocked %v, want just ip:192.0.2.3", blocked)
+	}
+	now = now.Add(authLockout)
+	if retryAfter := rl.Allow("ip:192.0.2.3"); retryAfter != 0 {
+		t.Errorf("attempt after lockout: got retryAfter %v, want 0", retryAfter)
+	}
+
+	// Admins can lift a lockout.
+	for i := 0; i < authMaxFailures; i++ {
+		rl.Failed("ip:192.0.2.4")
+	}
+	if err := rl.Unblock("ip:192.0.2.4"); err != nil {
+		t.Fatal(err)
+	}
+	if retryAfter := rl.Allow("ip:192.0.2.4"); retryAfter != 0 {
+		t.Errorf("attempt after Unblock: got retryAfter %v, want 0", retryAfter)
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"github.com/shurcooL/home/internal/code"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// repoRedirect redirects requests for the import paths of a renamed repository.
+type repoRedirect struct {
+	From string // Old repository root. E.g., "dmitri.shuralyov.com/kebabcase".
+	To   string // New repository root. E.g., "dmitri.shuralyov.com/text/kebabcase".
+}
+
+// repositories manages the repositories in the repository store,
+// and redirects the import paths of renamed repositories.
+var repositories repositoryManager
+
+type repositoryManager struct {
+	code *code.Store // Set by Load.
+
+	mu        sync.Mutex
+	redirects []repoRedirect // Sorted by From.
+
+	// store is where redirects are persisted. If nil, redirects are only kept in memory.
+	store webdav.FileSystem
+
+	// issues is the issues store, where issue threads are kept
+	// under repository roots. If nil, there are no issue threads to manage.
+	issues webdav.FileSystem
+}
+
+// redirectsPath is the path of the file in the redirects store
+// where repository redirects are persisted.
+const redirectsPath = "/repositories"
+
+// Load sets code as the repository store to manage, issues as the store
+// of their issue threads, and root as the redirects store, and loads redirects from it.
+func (rm *repositoryManager) Load(ctx context.Context, code *code.Store, issues, root webdav.FileSystem) error {
+	var redirects []repoRedirect
+	err := gobDecodeFile(ctx, root, redirectsPath, &redirects)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	rm.mu.Lock()
+	rm.code = code
+	rm.store = root
+	rm.issues = issues
+	rm.redirects = redirects
+	rm.mu.Unlock()
+	return nil
+}
+
+// List lists repository roots of all repositories, sorted.
+func (rm *repositoryManager) List() []string {
+	var repos []string
+	for _, d := range rm.code.Code().Sorted {
+		if !d.IsRepoRoot() {
+			continue
+		}
+		repos = append(repos, d.RepoRoot)
+	}
+	return repos
+}
+
+// Create creates an empty repository at repoRoot.
+// A redirect from repoRoot, if any, stops applying.
+func (rm *repositoryManager) Create(ctx context.Context, repoRoot string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	err := rm.code.Create(repoRoot)
+	if err != nil {
+		return err
+	}
+	var redirects []repoRedirect
+	for _, r := range rm.redirects {
+		if r.From == repoRoot {
+			continue
+		}
+		redirects = append(redirects, r)
+	}
+	return rm.setRedirects(ctx, redirects)
+}
+
+// Rename renames the repository at from to be at to. Import paths of
+// from are redirected to the same import paths of to from now on.
+// Roles granted on the repository, its visibility, push policy, push mirrors,
+// pull mirror configuration, LFS objects and issue threads move along with it.
+//
+// The visibility, roles and push policy are set up at to before the code
+// is moved there, and the visibility stays at from until the code is gone,
+// so that a private repository is never readable by others at either path.
+// They're moved back if the code can't be moved.
+func (rm *repositoryManager) Rename(ctx context.Context, from, to string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	err := repoVisibilities.Set(ctx, to, repoVisibilities.Get(from))
+	if err != nil {
+		return err
+	}
+	err = policy.RenameRepo(ctx, from, to)
+	if err != nil {
+		rm.undoRename(ctx, from, to, 1)
+		return err
+	}
+	err = pushPolicies.RenameRepo(ctx, from, to)
+	if err != nil {
+		rm.undoRename(ctx, from, to, 2)
+		return err
+	}
+	err = rm.code.Rename(from, to)
+	if err != nil {
+		rm.undoRename(ctx, from, to, 3)
+		return err
+	}
+	err = repoVisibilities.RenameRepo(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	redirects := []repoRedirect{{From: from, To: to}}
+	for _, r := range rm.redirects {
+		if r.From == from || r.From == to {
+			continue
+		}
+		if r.To == from {
+			// Avoid redirect chains.
+			r.To = to
+		}
+		redirects = append(redirects, r)
+	}
+	sort.Slice(redirects, func(i, j int) bool { return redirects[i].From < redirects[j].From })
+	err = rm.setRedirects(ctx, redirects)
+	if err != nil {
+		return err
+	}
+	err = pushMirrors.RenameRepo(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	err = pullMirrors.RenameRepo(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	err = lfsObjects.RenameRepo(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	return rm.moveIssues(ctx, from, to)
+}
+
+// undoRename undoes the first n steps of renaming from to to,
+// done by Rename before the code was moved. Errors are logged,
+// since the error that caused the rename to fail is more relevant.
+func (rm *repositoryManager) undoRename(ctx context.Context, from, to string, n int) {
+	if n >= 3 {
+		if err := pushPolicies.RenameRepo(ctx, to, from); err != nil {
+			log.Println("undoRename: pushPolicies.RenameRepo:", err)
+		}
+	}
+	if n >= 2 {
+		if err := policy.RenameRepo(ctx, to, from); err != nil {
+			log.Println("undoRename: policy.RenameRepo:", err)
+		}
+	}
+	if err := repoVisibilities.Set(ctx, to, visibilityPublic); err != nil {
+		log.Println("undoRename: repoVisibilities.Set:", err)
+	}
+}
+
+// issuesDir returns the directory in the issues store
+// where issue threads of the repository at repoRoot are kept.
+func issuesDir(repoRoot string) string { return path.Join("/", repoRoot, "issues") }
+
+// moveIssues moves issue threads of the repository at from, if any,
+// to the repository at to. Issue threads that to already has are removed
+// either way. rm.mu must be held.
+func (rm *repositoryManager) moveIssues(ctx context.Context, from, to string) error {
+	if rm.issues == nil {
+		return nil
+	}
+	err := rm.issues.RemoveAll(ctx, issuesDir(to))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := rm.issues.Stat(ctx, issuesDir(from)); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Create parent directories of the new location one by one,
+	// since webdav.FileSystem has no MkdirAll.
+	var dir string
+	for _, elem := range strings.Split(to, "/") {
+		dir += "/" + elem
+		err := rm.issues.Mkdir(ctx, dir, 0700)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return rm.issues.Rename(ctx, issuesDir(from), issuesDir(to))
+}
+
+// Delete deletes the repository at repoRoot, and any redirects to it.
+// Roles granted on the repository, its visibility, push policy, push mirrors,
+// pull mirror configuration, LFS objects and issue threads are removed,
+// so that they don't apply to a future repository at the same path.
+func (rm *repositoryManager) Delete(ctx context.Context, repoRoot string) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	err := rm.code.Delete(repoRoot)
+	if err != nil {
+		return err
+	}
+	var redirects []repoRedirect
+	for _, r := range rm.redirects {
+		if r.To == repoRoot {
+			continue
+		}
+		redirects = append(redirects, r)
+	}
+	err = rm.setRedirects(ctx, redirects)
+	if err != nil {
+		return err
+	}
+	err = policy.RemoveRepo(ctx, repoRoot)
+	if err != nil {
+		return err
+	}
+	err = repoVisibilities.RemoveRepo(ctx, repoRoot)
+	if err != nil {
+		return err
+	}
+	err = pushPolicies.Remove(ctx, repoRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = pushMirrors.RemoveRepo(ctx, repoRoot)
+	if err != nil {
+		return err
+	}
+	err = pullMirrors.Remove(ctx, repoRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = lfsObjects.RemoveRepo(ctx, repoRoot)
+	if err != nil {
+		return err
+	}
+	if rm.issues == nil {
+		return nil
+	}
+	err = rm.issues.RemoveAll(ctx, issuesDir(repoRoot))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// setRedirects persists redirects and makes them take effect. rm.mu must be held.
+func (rm *repositoryManager) setRedirects(ctx context.Context, redirects []repoRedirect) error {
+	if rm.store != nil {
+		err := gobEncodeFile(ctx, rm.store, redirectsPath, redirects)
+		if err != nil {
+			return err
+		}
+	}
+	rm.redirects = redirects
+	return nil
+}
+
+// ServeRedirectMaybe redirects the request to the new location
+// if it's for an import path of a renamed repository.
+func (rm *repositoryManager) ServeRedirectMaybe(w http.ResponseWriter, req *http.Request) (ok bool) {
+	importPath := "dmitri.shuralyov.com" + req.URL.Path
+	rm.mu.Lock()
+	var to string
+	for _, r := range rm.redirects {
+		if importPath == r.From || strings.HasPrefix(importPath, r.From+"/") || strings.HasPrefix(importPath, r.From+"$") {
+			to = r.To + importPath[len(r.From):]
+			break
+		}
+	}
+	rm.mu.Unlock()
+	if to == "" {
+		return false
+	}
+	u := *req.URL
+	u.Path = to[len("dmitri.shuralyov.com"):]
+	code := http.StatusMovedPermanently
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// Keep the method and body, e.g., for git-upload-pack requests.
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, req, u.String(), code)
+	return true
+}
+
+// parseRepoRoot parses a repository root of a new repository,
+// such as "dmitri.shuralyov.com/kebabcase", from s.
+func parseRepoRoot(s string) (string, error) {
+	repoRoot := strings.TrimSpace(s)
+	if !strings.HasPrefix(repoRoot, "dmitri.shuralyov.com/") {
+		return "", fmt.Errorf("repository root %q must begin with dmitri.shuralyov.com/", repoRoot)
+	}
+	if err := code.CheckRepoRoot(repoRoot); err != nil {
+		return "", err
+	}
+	repoPath := repoRoot[len("dmitri.shuralyov.com"):]
+	if _, pattern := http.DefaultServeMux.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: repoPath}}); pattern != "/" && pattern != "" {
+		return "", fmt.Errorf("path %q is already used by the site", repoPath)
+	}
+	return repoRoot, nil
+}
+
+// repoOpError converts an error returned by a repositories operation
+// on repoRoot into an error to serve.
+func repoOpError(repoRoot string, err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return httperror.BadRequest{Err: fmt.Errorf("repository %q doesn't exist", repoRoot)}
+	case os.IsExist(err):
+		return httperror.BadRequest{Err: fmt.Errorf("repository %q already exists, or overlaps with an existing repository", repoRoot)}
+	default:
+		return err
+	}
+}
+
+// serveRepositories serves the repositories admin page,
+// and creates a repository when the page is POSTed to.
+func (h *sessionsHandler) serveRepositories(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Repositories can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return nil, err
+	}
+
+	if req.Method == http.MethodPost {
+		repoRoot, err := parseRepoRoot(req.PostFormValue("repo"))
+		if err != nil {
+			return nil, httperror.BadRequest{Err: err}
+		}
+		err = repositories.Create(req.Context(), repoRoot)
+		if err != nil {
+			return nil, repoOpError(repoRoot, err)
+		}
+		auditLog.Record(req, auditRepoCreate, s.UserSpec, repoRoot, "")
+		return nil, httperror.Redirect{URL: "/admin/repositories"}
+	}
+
+	auditLog.Record(req, auditAdminView, s.UserSpec, req.URL.Path, "")
+
+	nodes := []*html.Node{htmlg.H3(htmlg.Text("Repositories"))}
+	repos := repositories.List()
+	for _, repo := range repos {
+		div := htmlg.Div(htmlg.Text(repo + " "))
+		if lfs := lfsObjects.Usage(repo); len(lfs.Objects) > 0 || lfs.Downloads > 0 {
+			span := htmlg.Span(htmlg.Text(fmt.Sprintf("(LFS: %d objects, %s; %d uploads, %s; %d downloads, %s) ",
+				len(lfs.Objects), humanize.Bytes(uint64(lfs.Size())),
+				lfs.Uploads, humanize.Bytes(uint64(lfs.UploadedBytes)),
+				lfs.Downloads, humanize.Bytes(uint64(lfs.DownloadedBytes)))))
+			span.Attr = append(span.Attr, html.Attribute{Key: atom.Style.String(), Val: `color: gray;`})
+			div.AppendChild(span)
+		}
+		div.AppendChild(visibilityForm(repo, repoVisibilities.Get(repo), csrfToken(s.rawAccessToken)))
+		div.AppendChild(renameRepoForm(repo, csrfToken(s.rawAccessToken)))
+		div.AppendChild(deleteRepoForm(repo, csrfToken(s.rawAccessToken)))
+		nodes = append(nodes, div)
+	}
+	if len(repos) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No repositories.")),
+		)
+	}
+	nodes = append(nodes, createRepoForm(csrfToken(s.rawAccessToken)))
+	return nodes, nil
+}
+
+// createRepoForm renders a form for creating a repository.
+func createRepoForm(csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/admin/repositories"},
+			{Key: atom.Style.String(), Val: `margin-top: 20px;`},
+		},
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Repository root (e.g., dmitri.shuralyov.com/kebabcase): "), textInput("repo", "dmitri.shuralyov.com/")))
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(htmlg.Div(submitInput("Create repository")))
+	return form
+}
+
+// renameRepoForm renders an inline form for renaming repo.
+func renameRepoForm(repo, csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/admin/repositories/rename?" + url.Values{"repo": {repo}}.Encode()},
+			{Key: atom.Style.String(), Val: `display: inline;`},
+		},
+	}
+	form.AppendChild(textInput("to", repo))
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(submitInput("Rename"))
+	return form
+}
+
+// deleteRepoForm renders an inline form for deleting repo.
+// The repository root needs to be typed in to confirm.
+func deleteRepoForm(repo, csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/admin/repositories/delete?" + url.Values{"repo": {repo}}.Encode()},
+			{Key: atom.Style.String(), Val: `display: inline; margin-left: 10px;`},
+		},
+	}
+	confirm := textInput("confirm", "")
+	confirm.Attr = append(confirm.Attr, html.Attribute{Key: atom.Placeholder.String(), Val: "Type repository root to confirm"})
+	form.AppendChild(confirm)
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(submitInput("Delete"))
+	return form
+}
+
+// serveRenameRepository renames the repository specified by the repo query parameter.
+func (h *sessionsHandler) serveRenameRepository(req *http.Request, s *session) error {
+	// Authorization check. Repositories can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	from := req.URL.Query().Get("repo")
+	to, err := parseRepoRoot(req.PostFormValue("to"))
+	if err != nil {
+		return httperror.BadRequest{Err: err}
+	}
+	err = repositories.Rename(req.Context(), from, to)
+	if os.IsNotExist(err) {
+		return repoOpError(from, err)
+	} else if err != nil {
+		return repoOpError(to, err)
+	}
+	auditLog.Record(req, auditRepoRename, s.UserSpec, from, "to: "+to)
+	return httperror.Redirect{URL: "/admin/repositories"}
+}
+
+// serveDeleteRepository deletes the repository specified by the repo query parameter.
+func (h *sessionsHandler) serveDeleteRepository(req *http.Request, s *session) error {
+	// Authorization check. Repositories can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	repo := req.URL.Query().Get("repo")
+	if strings.TrimSpace(req.PostFormValue("confirm")) != repo {
+		return httperror.BadRequest{Err: errors.New("repository root must be typed in to confirm deletion")}
+	}
+	err := repositories.Delete(req.Context(), repo)
+	if err != nil {
+		return repoOpError(repo, err)
+	}
+	auditLog.Record(req, auditRepoDelete, s.UserSpec, repo, "")
+	return httperror.Redirect{URL: "/admin/repositories"}
+}
+
+// repositoriesAPIResponse is the response of the repositories API endpoints.
+type repositoriesAPIResponse struct {
+	Repositories []string // Repository roots of all repositories, after the operation.
+}
+
+// serveRepositoriesAPI serves the repositories API. Its endpoints are:
+//
+//	GET  /api/repositories                           lists repositories
+//	POST /api/repositories/create?repo={{.Repo}}     creates an empty repository
+//	POST /api/repositories/rename?repo={{.Repo}}&to={{.To}}
+//	                                                 renames a repository
+//	POST /api/repositories/delete?repo={{.Repo}}     deletes a repository
+//
+// It's only available to site admins, via personal access tokens with the api scope
+// or session access tokens. Site admins with two-factor authentication enabled
+// need to step up before making changes: personal access tokens do so by appending
+// the code from their authenticator app to the token, separated by gitStepUpSeparator,
+// and sessions do so at /step-up.
+func serveRepositoriesAPI(w http.ResponseWriter, req *http.Request) error {
+	// Authorization check. Frontend API tokens aren't accepted, since
+	// a script injected into a page could otherwise manage repositories.
+	s := req.Context().Value(sessionContextKey).(*session)
+	if s == nil || !s.HasScope(scopeAPI) || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return os.ErrPermission
+	}
+
+	switch req.URL.Path {
+	case "/api/repositories":
+		if req.Method != http.MethodGet {
+			return httperror.Method{Allowed: []string{http.MethodGet}}
+		}
+		return httperror.JSONResponse{V: repositoriesAPIResponse{Repositories: repositories.List()}}
+	case "/api/repositories/create", "/api/repositories/rename", "/api/repositories/delete":
+		if req.Method != http.MethodPost {
+			return httperror.Method{Allowed: []string{http.MethodPost}}
+		}
+	default:
+		return os.ErrNotExist
+	}
+
+	if s.ID == "" {
+		// A personal access token, which steps up the same way as for git.
+		err := checkAPIStepUp(req, s.UserSpec)
+		if err, ok := err.(rateLimitedError); ok {
+			handleRateLimited(w, err)
+			return nil
+		}
+		if err == errBadTOTPCode {
+			return httperror.HTTP{Code: http.StatusUnauthorized, Err: fmt.Errorf("two-factor authentication is required; append the code from your authenticator app to the access token, separated by %q", gitStepUpSeparator)}
+		} else if err != nil {
+			return err
+		}
+	} else if totps.Enabled(s.UserSpec) && !stepUps.Active(sessionStepUpKey(s)) {
+		return httperror.HTTP{Code: http.StatusForbidden, Err: errors.New("step-up required; sign in again with a second factor code at /step-up first")}
+	}
+	q := req.URL.Query()
+	switch req.URL.Path {
+	case "/api/repositories/create":
+		repoRoot, err := parseRepoRoot(q.Get("repo"))
+		if err != nil {
+			return httperror.BadRequest{Err: err}
+		}
+		err = repositories.Create(req.Context(), repoRoot)
+		if err != nil {
+			return repoOpError(repoRoot, err)
+		}
+		auditLog.Record(req, auditRepoCreate, s.UserSpec, repoRoot, "")
+	case "/api/repositories/rename":
+		from := q.Get("repo")
+		to, err := parseRepoRoot(q.Get("to"))
+		if err != nil {
+			return httperror.BadRequest{Err: err}
+		}
+		err = repositories.Rename(req.Context(), from, to)
+		if os.IsNotExist(err) {
+			return repoOpError(from, err)
+		} else if err != nil {
+			return repoOpError(to, err)
+		}
+		auditLog.Record(req, auditRepoRename, s.UserSpec, from, "to: "+to)
+	case "/api/repositories/delete":
+		repo := q.Get("repo")
+		err := repositories.Delete(req.Context(), repo)
+		if err != nil {
+			return repoOpError(repo, err)
+		}
+		auditLog.Record(req, auditRepoDelete, s.UserSpec, repo, "")
+	}
+	return httperror.JSONResponse{V: repositoriesAPIResponse{Repositories: repositories.List()}}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/shurcooL/home/internal/code"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+// Test that renamed repositories redirect from their old import paths,
+// and that redirects, roles and issue threads follow repositories as they change.
+func TestRepositoryManager(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	reposDir, err := ioutil.TempDir("", "home-repositories-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(reposDir)
+	codeStore, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rm repositoryManager
+	rm.code = codeStore
+	rm.issues = webdav.NewMemFS()
+	ctx := context.Background()
+	alice := users.UserSpec{ID: 1, Domain: "example.org"}
+
+	// issueExists reports whether issue 1 of repo exists in the issues store.
+	issueExists := func(repo string) bool {
+		_, err := rm.issues.Stat(ctx, "/"+repo+"/issues/1/0")
+		return err == nil
+	}
+
+	// redirect returns where a GET request for path is redirected to,
+	// or the empty string if it isn't redirected.
+	redirect := func(method, path string) (string, int) {
+		rr := httptest.NewRecorder()
+		if !rm.ServeRedirectMaybe(rr, httptest.NewRequest(method, path, nil)) {
+			return "", 0
+		}
+		return rr.Header().Get("Location"), rr.Code
+	}
+
+	if err := rm.Create(ctx, "dmitri.shuralyov.com/kebab"); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Grant(ctx, alice, "dmitri.shuralyov.com/kebab", rolePusher); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"/dmitri.shuralyov.com", "/dmitri.shuralyov.com/kebab", "/dmitri.shuralyov.com/kebab/issues", "/dmitri.shuralyov.com/kebab/issues/1"} {
+		if err := rm.issues.Mkdir(ctx, dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gobEncodeFile(ctx, rm.issues, "/dmitri.shuralyov.com/kebab/issues/1/0", "issue"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Rename(ctx, "dmitri.shuralyov.com/kebab", "dmitri.shuralyov.com/text/kebabcase"); err != nil {
+		t.Fatal(err)
+	}
+	if issueExists("dmitri.shuralyov.com/kebab") || !issueExists("dmitri.shuralyov.com/text/kebabcase") {
+		t.Error("issue threads didn't move along with renamed repository")
+	}
+	if got, want := rm.List(), []string{"dmitri.shuralyov.com/text/kebabcase"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got repositories %q, want %q", got, want)
+	}
+	if policy.Allowed(alice, "dmitri.shuralyov.com/kebab", rolePusher) || !policy.Allowed(alice, "dmitri.shuralyov.com/text/kebabcase", rolePusher) {
+		t.Error("role grant didn't move along with renamed repository")
+	}
+	for _, tc := range []struct {
+		method, path string
+		wantURL      string
+		wantCode     int
+	}{
+		{"GET", "/kebab", "/text/kebabcase", http.StatusMovedPermanently},
+		{"GET", "/kebab/...", "/text/kebabcase/...", http.StatusMovedPermanently},
+		{"GET", "/kebab$file/LICENSE", "/text/kebabcase$file/LICENSE", http.StatusMovedPermanently},
+		{"GET", "/kebab/info/refs?service=git-upload-pack", "/text/kebabcase/info/refs?service=git-upload-pack", http.StatusMovedPermanently},
+		{"POST", "/kebab/git-upload-pack", "/text/kebabcase/git-upload-pack", http.StatusPermanentRedirect},
+		{"GET", "/kebabcase", "", 0},
+	} {
+		url, code := redirect(tc.method, tc.path)
+		if url != tc.wantURL || code != tc.wantCode {
+			t.Errorf("%s %s: got redirect to %q with %d, want %q with %d", tc.method, tc.path, url, code, tc.wantURL, tc.wantCode)
+		}
+	}
+
+	// Renaming again should update the existing redirect rather than chain them.
+	if err := rm.Rename(ctx, "dmitri.shuralyov.com/text/kebabcase", "dmitri.shuralyov.com/kebabcase"); err != nil {
+		t.Fatal(err)
+	}
+	if url, _ := redirect("GET", "/kebab"); url != "/kebabcase" {
+		t.Errorf("got redirect to %q, want %q", url, "/kebabcase")
+	}
+
+	// Creating a repository at the old path should stop redirecting it.
+	if err := rm.Create(ctx, "dmitri.shuralyov.com/kebab"); err != nil {
+		t.Fatal(err)
+	}
+	if url, _ := redirect("GET", "/kebab"); url != "" {
+		t.Errorf("got redirect to %q, want none", url)
+	}
+
+	// Deleting a repository should remove redirects to it and its role grants.
+	if err := rm.Delete(ctx, "dmitri.shuralyov.com/kebabcase"); err != nil {
+		t.Fatal(err)
+	}
+	if url, _ := redirect("GET", "/text/kebabcase"); url != "" {
+		t.Errorf("got redirect to %q, want none", url)
+	}
+	if policy.Allowed(alice, "dmitri.shuralyov.com/kebabcase", rolePusher) {
+		t.Error("role grant of deleted repository wasn't removed")
+	}
+	if issueExists("dmitri.shuralyov.com/kebabcase") {
+		t.Error("issue threads of deleted repository weren't removed")
+	}
+	if err := rm.Delete(ctx, "dmitri.shuralyov.com/kebabcase"); !os.IsNotExist(err) {
+		t.Errorf("deleting missing repository: got error %v, want os.ErrNotExist", err)
+	}
+
+	// A failed rename should leave the visibility and roles where they were.
+	if err := rm.Create(ctx, "dmitri.shuralyov.com/secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repoVisibilities.Set(ctx, "dmitri.shuralyov.com/secret", visibilityPrivate); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Grant(ctx, alice, "dmitri.shuralyov.com/secret", rolePusher); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Rename(ctx, "dmitri.shuralyov.com/secret", "dmitri.shuralyov.com/kebab"); !os.IsExist(err) {
+		t.Errorf("renaming onto existing repository: got error %v, want os.ErrExist", err)
+	}
+	if got := repoVisibilities.Get("dmitri.shuralyov.com/secret"); got != visibilityPrivate {
+		t.Errorf("after failed rename: got visibility %v, want private", got)
+	}
+	if got := repoVisibilities.Get("dmitri.shuralyov.com/kebab"); got != visibilityPublic {
+		t.Errorf("after failed rename: got visibility %v of existing repository, want public", got)
+	}
+	if !policy.Allowed(alice, "dmitri.shuralyov.com/secret", rolePusher) || policy.Allowed(alice, "dmitri.shuralyov.com/kebab", rolePusher) {
+		t.Error("after failed rename: role grant didn't stay with repository")
+	}
+	if err := rm.Delete(ctx, "dmitri.shuralyov.com/secret"); err != nil {
+		t.Fatal(err)
+	}
+}
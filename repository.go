@@ -98,6 +98,7 @@ func (h *repositoryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	header := component.Header{
 		CurrentUser:       authenticatedUser,
 		NotificationCount: nc,
+		CSRFToken:         csrfTokenFromContext(req),
 		ReturnURL:         req.RequestURI,
 	}
 	err = htmlg.RenderComponents(w, header)
@@ -109,6 +110,18 @@ func (h *repositoryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	if err != nil {
 		return err
 	}
+	if m, ok := pullMirrors.Get(h.Repo.Spec); ok {
+		err = html.Render(w, renderPullMirrorStatus(m))
+		if err != nil {
+			return err
+		}
+	}
+	for _, n := range renderPushMirrorStatus(pushMirrors.List(h.Repo.Spec)) {
+		err = html.Render(w, n)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Render the tabnav.
 	err = htmlg.RenderComponents(w, repositoryTabnav(packagesTab, h.Repo, openIssues, openChanges))
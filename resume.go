@@ -63,7 +63,7 @@ func initResume(reactions reactions.Service, notifications notifications.Service
 				authenticatedUser = users.User{} // THINK: Should it be a fatal error or not? What about on frontend vs backend?
 			}
 			returnURL := req.RequestURI
-			err = resume.RenderBodyInnerHTML(req.Context(), w, reactions, notifications, usersService, authenticatedUser, returnURL)
+			err = resume.RenderBodyInnerHTML(req.Context(), w, reactions, notifications, usersService, authenticatedUser, csrfTokenFromContext(req), returnURL)
 			if err != nil {
 				return err
 			}
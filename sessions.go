@@ -1,23 +1,28 @@
 package main
 
 import (
+	"context"
 	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/google/go-github/github"
 	"github.com/shurcooL/home/component"
 	"github.com/shurcooL/home/httputil"
 	"github.com/shurcooL/htmlg"
@@ -25,29 +30,77 @@ import (
 	"github.com/shurcooL/users"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
-	"golang.org/x/oauth2"
-	githuboauth2 "golang.org/x/oauth2/github"
+	"golang.org/x/net/webdav"
 )
 
-var githubConfig = oauth2.Config{
-	ClientID:     os.Getenv("HOME_GH_CLIENT_ID"),
-	ClientSecret: os.Getenv("HOME_GH_CLIENT_SECRET"),
-	Scopes:       nil,
-	Endpoint:     githuboauth2.Endpoint,
-}
-
 // global server state.
 var global = state{sessions: make(map[string]session)}
 
 type state struct {
 	mu       sync.Mutex
-	sessions map[string]session // Access Token -> User Session.
+	sessions map[string]session // Session ID -> User Session.
+
+	// store is where sessions are persisted. Changes to sessions are written through to it.
+	// If nil, sessions are only kept in memory.
+	store webdav.FileSystem
+}
+
+// Load sets root as the session store, and loads all unexpired sessions from it.
+// Expired sessions that are found are removed from the store.
+func (s *state) Load(ctx context.Context, root webdav.FileSystem) error {
+	dir, err := root.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	fis, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store = root
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		var session session
+		err := gobDecodeFile(ctx, root, "/"+fi.Name(), &session)
+		if err != nil {
+			log.Printf("state.Load: skipping session file %q: %v\n", fi.Name(), err)
+			continue
+		}
+		migrated := session.migrate()
+		if !time.Now().Before(session.Expiry) {
+			err := root.RemoveAll(ctx, "/"+fi.Name())
+			if err != nil {
+				log.Println("state.Load: error removing expired session:", err)
+			}
+			continue
+		}
+		s.sessions[session.ID] = session
+		if migrated {
+			s.persist(ctx, session)
+		}
+		if "/"+fi.Name() != sessionPath(session.ID) {
+			// Session was persisted under a name derived from its access token.
+			err := root.RemoveAll(ctx, "/"+fi.Name())
+			if err != nil {
+				log.Println("state.Load: error removing migrated session:", err)
+			}
+		}
+	}
+	return nil
 }
 
 // LoadAndRemove first loads state from file at path, then,
 // if loading was successful, it removes the file.
-func (s *state) LoadAndRemove(path string) error {
-	err := s.load(path)
+//
+// It's used to import sessions from legacy state files, which contain
+// raw access tokens. Loaded sessions are migrated to hashed access tokens,
+// and written through to the session store, if there is one.
+func (s *state) LoadAndRemove(ctx context.Context, path string) error {
+	err := s.load(ctx, path)
 	if err != nil {
 		return err
 	}
@@ -55,29 +108,136 @@ func (s *state) LoadAndRemove(path string) error {
 	return os.Remove(path)
 }
 
-func (s *state) load(path string) error {
+func (s *state) load(ctx context.Context, path string) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	var sessions map[string]session
+	err = gob.NewDecoder(f).Decode(&sessions)
+	if err != nil {
+		return err
+	}
 	s.mu.Lock()
-	err = gob.NewDecoder(f).Decode(&s.sessions)
-	s.mu.Unlock()
-	return err
+	defer s.mu.Unlock()
+	for accessToken, session := range sessions {
+		session.AccessToken = accessToken
+		session.migrate()
+		if !time.Now().Before(session.Expiry) {
+			continue
+		}
+		s.sessions[session.ID] = session
+		s.persist(ctx, session)
+	}
+	return nil
+}
+
+// put adds or updates session, and writes it through to the session store.
+// s.mu must be held.
+func (s *state) put(ctx context.Context, session session) {
+	session.rawAccessToken = "" // Never keep raw access tokens around.
+	s.sessions[session.ID] = session
+	s.persist(ctx, session)
+}
+
+// persist writes session to the session store, if there is one.
+// Errors are logged rather than returned, since the in-memory session remains valid.
+// s.mu must be held.
+func (s *state) persist(ctx context.Context, session session) {
+	if s.store == nil {
+		return
+	}
+	err := gobEncodeFile(ctx, s.store, sessionPath(session.ID), session)
+	if err != nil {
+		log.Println("state.persist:", err)
+	}
+}
+
+// lookUp returns the unexpired session with accessToken, if any.
+// The session is found by its ID, and the rest of accessToken
+// is verified in constant time. Expired sessions are removed.
+// s.mu must be held.
+func (s *state) lookUp(ctx context.Context, accessToken string) (session, bool) {
+	id, _ := parseAccessToken(accessToken)
+	session, ok := s.sessions[id]
+	if !ok || !session.verify(accessToken) {
+		return session, false
+	}
+	if !time.Now().Before(session.Expiry) {
+		s.remove(ctx, id) // This is unlikely to happen for cookies because they expire by then.
+		return session, false
+	}
+	return session, true
+}
+
+// remove deletes the session with id, and removes it from the session store.
+// s.mu must be held.
+func (s *state) remove(ctx context.Context, id string) {
+	delete(s.sessions, id)
+	if s.store == nil {
+		return
+	}
+	err := s.store.RemoveAll(ctx, sessionPath(id))
+	if err != nil {
+		log.Println("state.remove:", err)
+	}
+}
+
+// SweepExpired removes all expired sessions.
+func (s *state) SweepExpired(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if time.Now().Before(session.Expiry) {
+			continue
+		}
+		s.remove(ctx, id)
+	}
+}
+
+// sweepExpiredPeriodically calls SweepExpired every interval until ctx is done.
+func (s *state) sweepExpiredPeriodically(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.SweepExpired(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sessionPath returns the path of the file in the session store
+// where the session with id is persisted.
+func sessionPath(id string) string {
+	return "/" + id
+}
+
+// gobEncodeFile gob encodes v into file at path, overwriting or creating it.
+func gobEncodeFile(ctx context.Context, fs webdav.FileSystem, path string, v interface{}) error {
+	f, err := fs.OpenFile(ctx, path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(v)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-// Save saves state to path with permission 0600.
-func (s *state) Save(path string) error {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+// gobDecodeFile decodes contents of file at path into v.
+func gobDecodeFile(ctx context.Context, fs webdav.FileSystem, path string, v interface{}) error {
+	f, err := fs.OpenFile(ctx, path, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	s.mu.Lock()
-	err = gob.NewEncoder(f).Encode(s.sessions)
-	s.mu.Unlock()
-	return err
+	return gob.NewDecoder(f).Decode(v)
 }
 
 func cryptoRandBytes() []byte {
@@ -108,20 +268,174 @@ func (k *contextKey) String() string { return "github.com/shurcooL/home context
 // session is a user session. Nil session pointer represents no session.
 // Non-nil session pointers are expected to have valid users.
 type session struct {
-	// GitHubUserID is a valid (i.e., non-zero) GitHub user ID. Domain is "github.com".
+	UserSpec users.UserSpec // UserSpec is a valid (i.e., non-zero ID) user.
+
+	Expiry time.Time
+
+	// ID is an opaque identifier of the session. It's the first part of the
+	// session's access token. Unlike the rest of the access token,
+	// it's not a secret, and is used to look up, display and revoke the session.
+	ID string
+
+	// TokenSalt and TokenDigest are used to verify the secret part of the access token.
+	// TokenDigest is the SHA-256 digest of TokenSalt followed by the secret.
+	// The access token itself is never stored.
+	TokenSalt   []byte
+	TokenDigest []byte
+
+	// rawAccessToken is the access token that the session was looked up with.
+	// It's set only on sessions returned by lookups, and is never stored.
+	// It's needed to refresh the access token cookie and to compute the CSRF token.
+	rawAccessToken string
+
+	CreatedAt  time.Time // Zero for sessions created before it was tracked.
+	LastSeen   time.Time // Approximate time the session was last used.
+	RemoteAddr string    // IP address the session was last used from.
+	UserAgent  string    // User agent the session was last used from.
+
+	// Scopes limits what the session is allowed to do. It's set only for sessions
+	// that come from personal access tokens. Nil means no limits.
+	Scopes []tokenScope
+
+	// AccessToken is only set in sessions persisted before access tokens were hashed.
+	// Such sessions are migrated to TokenSalt and TokenDigest when they're loaded.
+	AccessToken string
+
+	// GitHubUserID is only set in sessions persisted before UserSpec was added.
+	// Such sessions are migrated to UserSpec when they're loaded.
 	GitHubUserID uint64
+}
+
+// HasScope reports whether session s is allowed to act within scope.
+// Sessions that don't come from personal access tokens have all scopes.
+func (s *session) HasScope(scope tokenScope) bool {
+	if s.Scopes == nil {
+		return true
+	}
+	for _, sc := range s.Scopes {
+		if sc == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// migrate migrates a session persisted in an older format to the current one.
+// It reports whether s was modified.
+func (s *session) migrate() (migrated bool) {
+	if s.UserSpec.ID == 0 && s.GitHubUserID != 0 {
+		s.UserSpec = users.UserSpec{ID: s.GitHubUserID, Domain: "github.com"}
+		s.GitHubUserID = 0
+		migrated = true
+	}
+	if s.AccessToken != "" {
+		// Legacy access tokens don't contain the session ID,
+		// so derive it from the access token instead.
+		id, secret := parseAccessToken(s.AccessToken)
+		s.ID = id
+		s.TokenSalt, s.TokenDigest = hashAccessTokenSecret(secret)
+		s.AccessToken = ""
+		migrated = true
+	}
+	return migrated
+}
+
+// newSession creates a new session for user that expires at expiry.
+// It returns the session and its access token.
+func newSession(user users.UserSpec, expiry time.Time) (session, string) {
+	id := make([]byte, 8)
+	_, err := cryptorand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+	secret := make([]byte, 32)
+	_, err = cryptorand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	accessToken := hex.EncodeToString(id) + "." + hex.EncodeToString(secret)
+	s := session{
+		UserSpec:       user,
+		Expiry:         expiry,
+		ID:             hex.EncodeToString(id),
+		CreatedAt:      time.Now().UTC(),
+		rawAccessToken: accessToken,
+	}
+	s.TokenSalt, s.TokenDigest = hashAccessTokenSecret(hex.EncodeToString(secret))
+	return s, accessToken
+}
+
+// parseAccessToken splits accessToken into a session ID and a secret.
+// Access tokens have the form "{id}.{secret}", where id is 16 hex digits.
+// Legacy access tokens are random bytes, their session ID is derived
+// from the SHA-256 digest of the entire access token.
+func parseAccessToken(accessToken string) (id, secret string) {
+	if i := strings.IndexByte(accessToken, '.'); i == 16 {
+		if _, err := hex.DecodeString(accessToken[:i]); err == nil {
+			return accessToken[:i], accessToken[i+1:]
+		}
+	}
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:8]), accessToken
+}
+
+// hashAccessTokenSecret hashes secret with a new random salt.
+func hashAccessTokenSecret(secret string) (salt, digest []byte) {
+	salt = make([]byte, 16)
+	_, err := cryptorand.Read(salt)
+	if err != nil {
+		panic(err)
+	}
+	return salt, accessTokenDigest(salt, secret)
+}
 
-	Expiry      time.Time
-	AccessToken string // Access token. Needed to be able to clear session when the user signs out.
+func accessTokenDigest(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
 }
 
+// verify reports whether accessToken is the access token of session s.
+func (s *session) verify(accessToken string) bool {
+	id, secret := parseAccessToken(accessToken)
+	if id != s.ID {
+		return false
+	}
+	return subtle.ConstantTimeCompare(accessTokenDigest(s.TokenSalt, secret), s.TokenDigest) == 1
+}
+
+// seen records that session s was used by req.
+// To avoid writing to the session store on every request,
+// LastSeen is only updated when it's more than lastSeenResolution old.
+// It reports whether s was modified.
+func (s *session) seen(req *http.Request) bool {
+	remoteAddr := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+	userAgent := req.UserAgent()
+	if time.Since(s.LastSeen) < lastSeenResolution && s.RemoteAddr == remoteAddr && s.UserAgent == userAgent {
+		return false
+	}
+	s.LastSeen = time.Now().UTC()
+	s.RemoteAddr = remoteAddr
+	s.UserAgent = userAgent
+	return true
+}
+
+const lastSeenResolution = 5 * time.Minute
+
 func setAccessTokenCookie(w httputil.HeaderWriter, accessToken string, expiry time.Time) {
 	// TODO: Is base64 the best encoding for cookie values? Factor it out maybe?
 	encodedAccessToken := base64.RawURLEncoding.EncodeToString([]byte(accessToken))
-	httputil.SetCookie(w, &http.Cookie{Path: "/", Name: accessTokenCookieName, Value: encodedAccessToken, Expires: expiry, HttpOnly: false, Secure: *productionFlag})
+	// The cookie is HttpOnly so that scripts can't read it. Frontends use /api/token instead.
+	httputil.SetCookie(w, &http.Cookie{Path: "/", Name: accessTokenCookieName, Value: encodedAccessToken, Expires: expiry, HttpOnly: true, Secure: *productionFlag})
+	setCSRFTokenCookie(w, accessToken, expiry)
 }
 func clearAccessTokenCookie(w httputil.HeaderWriter) {
 	httputil.SetCookie(w, &http.Cookie{Path: "/", Name: accessTokenCookieName, MaxAge: -1})
+	clearCSRFTokenCookie(w)
 }
 
 // cookieAuth is a middleware that parses authentication information
@@ -137,24 +451,59 @@ func (mw cookieAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		clearAccessTokenCookie(w)
 	} else if err == nil && extended {
 		// TODO: Is it okay if we later set the same cookie again? Or should we avoid doing this here?
-		setAccessTokenCookie(w, s.AccessToken, s.Expiry)
+		setAccessTokenCookie(w, s.rawAccessToken, s.Expiry)
+	} else if s != nil && !hasCSRFTokenCookie(req, s) {
+		// Sessions created before CSRF tokens were added don't have the cookie yet.
+		setCSRFTokenCookie(w, s.rawAccessToken, s.Expiry)
+	}
+	if err := checkCSRF(req, s); err != nil {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
 	}
 	mw.Handler.ServeHTTP(w, withSession(req, s))
 }
 
 // headerAuth is a middleware that parses authentication information
 // from request headers, and sets session as a context value.
+// It rejects frontend API tokens.
 type headerAuth struct {
 	Handler http.Handler
 }
 
 func (mw headerAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serveHeaderAuth(w, req, mw.Handler, false)
+}
+
+// frontendAuth is a middleware like headerAuth, except it also accepts
+// frontend API tokens. It's only for the APIs that frontends use.
+type frontendAuth struct {
+	Handler http.Handler
+}
+
+func (mw frontendAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serveHeaderAuth(w, req, mw.Handler, true)
+}
+
+// serveHeaderAuth serves req with h, if it's authorized by the
+// access token in its Authorization header, or has none.
+// Frontend API tokens are only accepted if frontend is true.
+func serveHeaderAuth(w http.ResponseWriter, req *http.Request, h http.Handler, frontend bool) {
 	s, err := lookUpSessionViaHeader(req)
+	if err, ok := err.(rateLimitedError); ok {
+		handleRateLimited(w, err)
+		return
+	}
 	if err != nil {
 		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	mw.Handler.ServeHTTP(w, withSession(req, s))
+	if s != nil && !s.HasScope(scopeAPI) &&
+		!(s.HasScope(scopeRead) && (req.Method == http.MethodGet || req.Method == http.MethodHead)) &&
+		!(frontend && s.HasScope(scopeFrontend)) {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	h.ServeHTTP(w, withSession(req, s))
 }
 
 var errBadAccessToken = errors.New("bad access token")
@@ -177,19 +526,19 @@ func lookUpSessionViaCookie(req *http.Request) (s *session, extended bool, err e
 	}
 	accessToken := string(accessTokenBytes)
 	global.mu.Lock()
-	if session, ok := global.sessions[accessToken]; ok {
-		if time.Now().Before(session.Expiry) {
-			// Extend expiry if 6 days or less left.
-			if time.Until(session.Expiry) <= 6*24*time.Hour {
-				session.Expiry = time.Now().Add(7 * 24 * time.Hour)
-				global.sessions[accessToken] = session
-				extended = true
-			}
-
-			s = &session
-		} else {
-			delete(global.sessions, accessToken) // This is unlikely to happen because cookie expires by then.
+	if session, ok := global.lookUp(req.Context(), accessToken); ok {
+		changed := session.seen(req)
+		// Extend expiry if 6 days or less left.
+		if time.Until(session.Expiry) <= 6*24*time.Hour {
+			session.Expiry = time.Now().Add(7 * 24 * time.Hour)
+			changed, extended = true, true
 		}
+		if changed {
+			global.put(req.Context(), session)
+		}
+
+		session.rawAccessToken = accessToken
+		s = &session
 	}
 	global.mu.Unlock()
 	if s == nil {
@@ -198,15 +547,53 @@ func lookUpSessionViaCookie(req *http.Request) (s *session, extended bool, err e
 	return s, extended, nil // Existing session.
 }
 
+// lookUpAccessToken looks up accessToken in the sessions map, and then
+// among personal access tokens. It returns nil if there's no valid match.
+// Sessions that come from personal access tokens have Scopes set,
+// and an empty ID.
+func lookUpAccessToken(ctx context.Context, accessToken string) *session {
+	global.mu.Lock()
+	s, ok := global.lookUp(ctx, accessToken)
+	global.mu.Unlock()
+	if ok {
+		s.rawAccessToken = accessToken
+		return &s
+	}
+	if t, ok := accessTokens.lookUp(ctx, accessToken); ok {
+		scopes := append([]tokenScope{}, t.Scopes...) // Non-nil, even if t has no scopes.
+		return &session{UserSpec: t.UserSpec, Expiry: t.Expiry, Scopes: scopes}
+	}
+	return nil
+}
+
 // lookUpSessionViaHeader retrieves the session from req by looking up
-// the request's access token (via Authorization header) in the sessions map.
+// the request's access token (via Authorization header) in the sessions map,
+// among personal access tokens, or among frontend API tokens.
 // It returns a valid session (possibly nil) and nil error,
-// or nil session and errBadAccessToken.
+// or nil session and errBadAccessToken or rateLimitedError.
 func lookUpSessionViaHeader(req *http.Request) (*session, error) {
 	authorization, ok := req.Header["Authorization"]
 	if !ok {
 		return nil, nil // No session.
 	}
+	key := ipKey(req)
+	if retryAfter := authLimiter.Allow(key); retryAfter > 0 {
+		return nil, rateLimitedError{RetryAfter: retryAfter}
+	}
+	s, err := lookUpAuthorization(req, authorization)
+	if err == errBadAccessToken {
+		if authLimiter.Failed(key) {
+			auditLog.Record(req, auditLockout, users.UserSpec{}, key, "")
+		}
+		return nil, err
+	}
+	authLimiter.Succeeded(key)
+	return s, err
+}
+
+// lookUpAuthorization looks up the access token in
+// the Authorization header values of req.
+func lookUpAuthorization(req *http.Request, authorization []string) (*session, error) {
 	if len(authorization) != 1 {
 		return nil, errBadAccessToken
 	}
@@ -214,60 +601,66 @@ func lookUpSessionViaHeader(req *http.Request) (*session, error) {
 		return nil, errBadAccessToken
 	}
 	encodedAccessToken := authorization[0][len("Bearer "):] // THINK: Should access token be base64 encoded?
+	if i := strings.Index(encodedAccessToken, gitStepUpSeparator); i != -1 {
+		encodedAccessToken = encodedAccessToken[:i] // The rest is a step-up code, checked by checkAPIStepUp.
+	}
 	accessTokenBytes, err := base64.RawURLEncoding.DecodeString(encodedAccessToken)
 	if err != nil {
 		return nil, errBadAccessToken
 	}
-	accessToken := string(accessTokenBytes)
-	var s *session
-	global.mu.Lock()
-	if session, ok := global.sessions[accessToken]; ok {
-		if time.Now().Before(session.Expiry) {
-			s = &session
-		} else {
-			delete(global.sessions, accessToken)
-		}
+	if s := lookUpAccessToken(req.Context(), string(accessTokenBytes)); s != nil {
+		return s, nil // Existing session.
 	}
-	global.mu.Unlock()
-	if s == nil {
-		return nil, errBadAccessToken
+	if t, ok := apiTokens.lookUp(string(accessTokenBytes)); ok {
+		return &session{ID: t.SessionID, UserSpec: t.UserSpec, Expiry: t.Expiry, Scopes: []tokenScope{scopeFrontend}}, nil // Frontend API token.
 	}
-	return s, nil // Existing session.
+	return nil, errBadAccessToken
 }
 
 // lookUpSessionUserViaBasicAuth retrieves the session+user from req by looking up
-// the request's access token (via Basic Auth) in the sessions map,
-// and then getting the user via usersService.
+// the request's access token (via Basic Auth) in the sessions map
+// or among personal access tokens, and then getting the user via usersService.
 // It returns a valid session+user (possibly nil) and nil error,
-// or nil session+user and errBadAccessToken.
+// or nil session+user and errBadAccessToken or rateLimitedError.
 func lookUpSessionUserViaBasicAuth(req *http.Request, usersService users.Service) (*session, *users.User, error) {
 	username, password, ok := req.BasicAuth()
 	if !ok {
 		return nil, nil, nil // No session+user.
 	}
+	ip := ipKey(req)
+	if retryAfter := authLimiter.Allow(ip); retryAfter > 0 {
+		return nil, nil, rateLimitedError{RetryAfter: retryAfter}
+	}
+	s, u, err := lookUpBasicAuth(req, usersService, username, password)
+	if err == errBadAccessToken {
+		if authLimiter.Failed(ip) {
+			auditLog.Record(req, auditLockout, users.UserSpec{}, ip, "")
+		}
+		return nil, nil, err
+	}
+	authLimiter.Succeeded(ip)
+	return s, u, err
+}
+
+// lookUpBasicAuth looks up the session+user that
+// the Basic Auth username and password of req belong to.
+func lookUpBasicAuth(req *http.Request, usersService users.Service, username, password string) (*session, *users.User, error) {
 	encodedAccessToken := password
+	if i := strings.Index(password, gitStepUpSeparator); i != -1 {
+		encodedAccessToken = password[:i] // The rest is a step-up code, checked by checkGitStepUp.
+	}
 	accessTokenBytes, err := base64.RawURLEncoding.DecodeString(encodedAccessToken)
 	if err != nil {
 		return nil, nil, errBadAccessToken
 	}
-	accessToken := string(accessTokenBytes)
-	var s *session
-	global.mu.Lock()
-	if session, ok := global.sessions[accessToken]; ok {
-		if time.Now().Before(session.Expiry) {
-			s = &session
-		} else {
-			delete(global.sessions, accessToken)
-		}
-	}
-	global.mu.Unlock()
+	s := lookUpAccessToken(req.Context(), string(accessTokenBytes))
 	if s == nil {
 		return nil, nil, errBadAccessToken
 	}
 	// Existing session, now get user and verify the username matches.
-	user, err := usersService.Get(req.Context(), users.UserSpec{ID: s.GitHubUserID, Domain: "github.com"})
+	user, err := usersService.Get(req.Context(), s.UserSpec)
 	if err != nil {
-		log.Println("lookUpSessionUserViaBasicAuth: failed to get user:", err)
+		log.Println("lookUpBasicAuth: failed to get user:", err)
 		return nil, nil, errBadAccessToken
 	}
 	if username != user.Login {
@@ -279,17 +672,40 @@ func lookUpSessionUserViaBasicAuth(req *http.Request, usersService users.Service
 type sessionsHandler struct {
 	users     users.Service
 	userStore userCreator
+	providers []loginProvider
+}
+
+// provider returns the login provider with the given name, if any.
+func (h *sessionsHandler) provider(name string) (loginProvider, bool) {
+	for _, p := range h.providers {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return nil, false
 }
 
 func (h *sessionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// HACK: Manually check that method is allowed for the given path.
-	switch req.URL.Path {
+	switch path := req.URL.Path; {
 	default:
 		if req.Method != "GET" {
 			httperror.HandleMethod(w, httperror.Method{Allowed: []string{"GET"}})
 			return
 		}
-	case "/login/github", "/logout":
+	case path == "/settings/tokens", path == "/settings/ssh-keys", path == "/admin/roles", path == "/admin/push-policies", path == "/admin/push-mirrors", path == "/admin/pull-mirrors", path == "/admin/repositories", path == "/step-up":
+		if req.Method != "GET" && req.Method != "POST" {
+			httperror.HandleMethod(w, httperror.Method{Allowed: []string{"GET", "POST"}})
+			return
+		}
+	case strings.HasPrefix(path, "/login/"), path == "/logout", path == "/settings/tokens/revoke",
+		path == "/settings/passkeys/register/begin", path == "/settings/passkeys/register/finish", path == "/settings/passkeys/delete",
+		path == "/settings/ssh-keys/delete",
+		path == "/settings/totp/enroll", path == "/settings/totp/confirm", path == "/settings/totp/disable",
+		path == "/admin/roles/revoke", path == "/admin/push-policies/remove", path == "/admin/push-mirrors/remove",
+		path == "/admin/pull-mirrors/remove", path == "/admin/pull-mirrors/fetch", path == "/admin/repositories/rename", path == "/admin/repositories/delete",
+		path == "/admin/repositories/visibility",
+		path == "/admin/blocked/unblock", path == "/sessions/revoke", path == "/sessions/revoke-all":
 		if req.Method != "POST" {
 			httperror.HandleMethod(w, httperror.Method{Allowed: []string{"POST"}})
 			return
@@ -304,7 +720,13 @@ func (h *sessionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		clearAccessTokenCookie(w)
 	} else if err == nil && extended {
 		// TODO: Is it okay if we later set the same cookie again? Or should we avoid doing this here?
-		setAccessTokenCookie(w, s.AccessToken, s.Expiry)
+		setAccessTokenCookie(w, s.rawAccessToken, s.Expiry)
+	} else if s != nil && !hasCSRFTokenCookie(req, s) {
+		setCSRFTokenCookie(w, s.rawAccessToken, s.Expiry)
+	}
+	if err := checkCSRF(req, s); err != nil {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
 	}
 	req = withSession(req, s)
 
@@ -322,10 +744,14 @@ func (h *sessionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		httperror.HandleBadRequest(w, err)
 		return
 	}
+	if err, ok := err.(rateLimitedError); ok {
+		handleRateLimited(w, err)
+		return
+	}
 	if err, ok := httperror.IsHTTP(err); ok {
 		code := err.Code
 		error := fmt.Sprintf("%d %s", code, http.StatusText(code))
-		if user, e := h.users.GetAuthenticated(req.Context()); e == nil && user.SiteAdmin {
+		if user, e := h.users.GetAuthenticated(req.Context()); e == nil && policy.Allowed(user.UserSpec, "", roleAdmin) {
 			error += "\n\n" + err.Error()
 		}
 		http.Error(w, error, code)
@@ -344,7 +770,7 @@ func (h *sessionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if os.IsNotExist(err) {
 		log.Println(err)
 		error := "404 Not Found"
-		if user, e := h.users.GetAuthenticated(req.Context()); e == nil && user.SiteAdmin {
+		if user, e := h.users.GetAuthenticated(req.Context()); e == nil && policy.Allowed(user.UserSpec, "", roleAdmin) {
 			error += "\n\n" + err.Error()
 		}
 		http.Error(w, error, http.StatusNotFound)
@@ -362,7 +788,7 @@ func (h *sessionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		log.Println(err)
 		error := "403 Forbidden"
-		if user, e := h.users.GetAuthenticated(req.Context()); e == nil && user.SiteAdmin {
+		if user, e := h.users.GetAuthenticated(req.Context()); e == nil && policy.Allowed(user.UserSpec, "", roleAdmin) {
 			error += "\n\n" + err.Error()
 		}
 		http.Error(w, error, http.StatusForbidden)
@@ -371,7 +797,7 @@ func (h *sessionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	log.Println(err)
 	error := "500 Internal Server Error"
-	if user, e := h.users.GetAuthenticated(req.Context()); e == nil && user.SiteAdmin {
+	if user, e := h.users.GetAuthenticated(req.Context()); e == nil && policy.Allowed(user.UserSpec, "", roleAdmin) {
 		error += "\n\n" + err.Error()
 	}
 	http.Error(w, error, http.StatusInternalServerError)
@@ -380,72 +806,72 @@ func (h *sessionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func (h *sessionsHandler) serve(w httputil.HeaderWriter, req *http.Request, s *session) ([]*html.Node, error) {
 	// Simple switch-based router for now. For a larger project, a more sophisticated router should be used.
 	switch {
-	case req.Method == "POST" && req.URL.Path == "/login/github":
+	case req.Method == "POST" && req.URL.Path == "/login/passkey/begin":
+		return nil, h.serveBeginPasskeySignIn(w, req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/login/passkey/finish":
+		return nil, h.serveFinishPasskeySignIn(w, req, s)
+
+	case req.Method == "POST" && strings.HasPrefix(req.URL.Path, "/login/"):
+		provider, ok := h.provider(req.URL.Path[len("/login/"):])
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrNotExist}
+		}
 		returnURL := sanitizeReturn(req.PostFormValue("return"))
 
 		if s != nil {
 			return nil, httperror.Redirect{URL: returnURL}
 		}
 
+		callbackPath := "/callback/" + provider.Name()
 		state := base64.RawURLEncoding.EncodeToString(cryptoRandBytes()) // GitHub doesn't handle all non-ASCII bytes in state, so use base64.
-		httputil.SetCookie(w, &http.Cookie{Path: "/callback/github", Name: stateCookieName, Value: state, HttpOnly: true, Secure: *productionFlag})
+		httputil.SetCookie(w, &http.Cookie{Path: callbackPath, Name: stateCookieName, Value: state, HttpOnly: true, Secure: *productionFlag})
 
 		// TODO, THINK.
-		httputil.SetCookie(w, &http.Cookie{Path: "/callback/github", Name: returnCookieName, Value: returnURL, HttpOnly: true, Secure: *productionFlag})
+		httputil.SetCookie(w, &http.Cookie{Path: callbackPath, Name: returnCookieName, Value: returnURL, HttpOnly: true, Secure: *productionFlag})
 
-		url := githubConfig.AuthCodeURL(state)
+		url, err := provider.AuthCodeURL(req.Context(), state)
+		if err != nil {
+			log.Printf("%s: error getting consent page URL: %v\n", req.URL.Path, err)
+			return nil, httperror.HTTP{Code: http.StatusServiceUnavailable, Err: err}
+		}
 		return nil, httperror.Redirect{URL: url}
 
-	case req.Method == "GET" && req.URL.Path == "/callback/github":
+	case req.Method == "GET" && strings.HasPrefix(req.URL.Path, "/callback/"):
+		provider, ok := h.provider(req.URL.Path[len("/callback/"):])
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrNotExist}
+		}
 		if s != nil {
 			return nil, httperror.Redirect{URL: "/"}
 		}
 
+		key := ipKey(req)
+		if retryAfter := authLimiter.Allow(key); retryAfter > 0 {
+			return nil, rateLimitedError{RetryAfter: retryAfter}
+		}
+
+		callbackPath := "/callback/" + provider.Name()
 		us, err := func() (users.User, error) {
 			// Validate state (to prevent CSRF).
 			cookie, err := req.Cookie(stateCookieName)
 			if err != nil {
 				return users.User{}, err
 			}
-			httputil.SetCookie(w, &http.Cookie{Path: "/callback/github", Name: stateCookieName, MaxAge: -1})
+			httputil.SetCookie(w, &http.Cookie{Path: callbackPath, Name: stateCookieName, MaxAge: -1})
 			state := req.FormValue("state")
 			if cookie.Value != state {
 				return users.User{}, errors.New("state doesn't match")
 			}
 
-			token, err := githubConfig.Exchange(req.Context(), req.FormValue("code"))
-			if err != nil {
-				return users.User{}, err
-			}
-			httpClient := githubConfig.Client(req.Context(), token)
-			httpClient.Timeout = 5 * time.Second
-			gh := github.NewClient(httpClient)
-
-			ghUser, _, err := gh.Users.Get(req.Context(), "")
-			if err != nil {
-				return users.User{}, err
-			}
-			if ghUser.ID == nil || *ghUser.ID == 0 {
-				return users.User{}, errors.New("GitHub user ID is nil or 0")
-			}
-			if ghUser.Login == nil || *ghUser.Login == "" {
-				return users.User{}, errors.New("GitHub user Login is nil or empty")
-			}
-			if ghUser.AvatarURL == nil {
-				return users.User{}, errors.New("GitHub user AvatarURL is nil")
-			}
-			if ghUser.HTMLURL == nil {
-				return users.User{}, errors.New("GitHub user HTMLURL is nil")
-			}
-			return users.User{
-				UserSpec:  users.UserSpec{ID: uint64(*ghUser.ID), Domain: "github.com"},
-				Login:     *ghUser.Login,
-				AvatarURL: *ghUser.AvatarURL,
-				HTMLURL:   *ghUser.HTMLURL,
-			}, nil
+			return provider.Exchange(req.Context(), state, req.FormValue("code"))
 		}()
 		if err != nil {
 			log.Println(err)
+			auditLog.Record(req, auditLoginFailed, users.UserSpec{}, provider.Name(), err.Error())
+			if authLimiter.Failed(key) {
+				auditLog.Record(req, auditLockout, users.UserSpec{}, key, "")
+			}
 			// TODO: Redirect to an "problem with logging in" page, if, for example, error came from gh.Users.Get("") due to GitHub being down.
 			return nil, httperror.HTTP{Code: http.StatusUnauthorized, Err: err}
 		}
@@ -456,26 +882,19 @@ func (h *sessionsHandler) serve(w httputil.HeaderWriter, req *http.Request, s *s
 		case nil, os.ErrExist:
 			// Do nothing.
 		default:
-			log.Println("/callback/github: error creating user:", err)
+			log.Printf("%s: error creating user: %v\n", callbackPath, err)
 			return nil, httperror.HTTP{Code: http.StatusInternalServerError, Err: err}
 		}
 
 		// Add new session.
-		accessToken := string(cryptoRandBytes())
 		expiry := time.Now().Add(7 * 24 * time.Hour)
+		session, accessToken := newSession(us.UserSpec, expiry)
+		session.seen(req)
 		global.mu.Lock()
-		for token, user := range global.sessions { // Clean up expired sesions.
-			if time.Now().Before(user.Expiry) {
-				continue
-			}
-			delete(global.sessions, token)
-		}
-		global.sessions[accessToken] = session{
-			GitHubUserID: us.ID,
-			Expiry:       expiry,
-			AccessToken:  accessToken,
-		}
+		global.put(req.Context(), session)
 		global.mu.Unlock()
+		authLimiter.Succeeded(key)
+		auditLog.Record(req, auditLogin, us.UserSpec, provider.Name(), "")
 
 		// TODO, THINK.
 		returnURL, err := func() (string, error) {
@@ -483,11 +902,11 @@ func (h *sessionsHandler) serve(w httputil.HeaderWriter, req *http.Request, s *s
 			if err != nil {
 				return "", err
 			}
-			httputil.SetCookie(w, &http.Cookie{Path: "/callback/github", Name: returnCookieName, MaxAge: -1})
+			httputil.SetCookie(w, &http.Cookie{Path: callbackPath, Name: returnCookieName, MaxAge: -1})
 			return sanitizeReturn(cookie.Value), nil
 		}()
 		if err != nil {
-			log.Println("/callback/github: problem with returnCookieName:", err)
+			log.Printf("%s: problem with returnCookieName: %v\n", callbackPath, err)
 			returnURL = "/"
 		}
 
@@ -497,8 +916,9 @@ func (h *sessionsHandler) serve(w httputil.HeaderWriter, req *http.Request, s *s
 	case req.Method == "POST" && req.URL.Path == "/logout":
 		if s != nil {
 			global.mu.Lock()
-			delete(global.sessions, s.AccessToken)
+			global.remove(req.Context(), s.ID)
 			global.mu.Unlock()
+			auditLog.Record(req, auditLogout, s.UserSpec, "", "")
 		}
 
 		clearAccessTokenCookie(w)
@@ -515,54 +935,225 @@ func (h *sessionsHandler) serve(w httputil.HeaderWriter, req *http.Request, s *s
 			Type: html.ElementNode, Data: atom.Div.String(),
 			Attr: []html.Attribute{{Key: atom.Style.String(), Val: `margin-top: 100px; text-align: center;`}},
 		}
-		signInViaGitHub := component.PostButton{
-			Action:    "/login/github",
-			Text:      "Sign in via GitHub",
-			ReturnURL: returnURL,
+		for i, provider := range h.providers {
+			if i > 0 {
+				centered.AppendChild(htmlg.Text(" "))
+			}
+			signIn := component.PostButton{
+				Action:    "/login/" + provider.Name(),
+				Text:      "Sign in via " + provider.Title(),
+				ReturnURL: returnURL,
+			}
+			htmlg.AppendChildren(centered, signIn.Render()...)
+		}
+		if len(h.providers) > 0 {
+			centered.AppendChild(htmlg.Text(" "))
 		}
-		htmlg.AppendChildren(centered, signInViaGitHub.Render()...)
-		return []*html.Node{centered}, nil
+		centered.AppendChild(passkeySignInButton(returnURL))
+		return []*html.Node{centered, passkeyScript()}, nil
+
+	case req.URL.Path == "/settings/tokens":
+		return h.serveTokens(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/settings/tokens/revoke":
+		return nil, h.serveRevokeToken(req, s)
+
+	case req.Method == "GET" && req.URL.Path == "/settings/passkeys":
+		return h.servePasskeys(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/settings/passkeys/register/begin":
+		return nil, h.serveBeginPasskeyRegistration(w, req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/settings/passkeys/register/finish":
+		return nil, h.serveFinishPasskeyRegistration(w, req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/settings/passkeys/delete":
+		return nil, h.serveRemovePasskey(req, s)
+
+	case req.URL.Path == "/settings/ssh-keys":
+		return h.serveSSHKeys(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/settings/ssh-keys/delete":
+		return nil, h.serveRemoveSSHKey(req, s)
+
+	case req.Method == "GET" && req.URL.Path == "/settings/totp":
+		return h.serveTOTP(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/settings/totp/enroll":
+		return h.serveEnrollTOTP(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/settings/totp/confirm":
+		return h.serveConfirmTOTP(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/settings/totp/disable":
+		return nil, h.serveDisableTOTP(req, s)
+
+	case req.URL.Path == "/step-up":
+		return h.serveStepUp(req, s)
+
+	case req.URL.Path == "/admin/roles":
+		return h.serveRoles(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/admin/roles/revoke":
+		return nil, h.serveRevokeRole(req, s)
+
+	case req.URL.Path == "/admin/push-policies":
+		return h.servePushPolicies(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/admin/push-policies/remove":
+		return nil, h.serveRemovePushPolicy(req, s)
+
+	case req.URL.Path == "/admin/push-mirrors":
+		return h.servePushMirrors(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/admin/push-mirrors/remove":
+		return nil, h.serveRemovePushMirror(req, s)
+
+	case req.URL.Path == "/admin/pull-mirrors":
+		return h.servePullMirrors(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/admin/pull-mirrors/remove":
+		return nil, h.serveRemovePullMirror(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/admin/pull-mirrors/fetch":
+		return nil, h.serveFetchPullMirror(req, s)
+
+	case req.URL.Path == "/admin/repositories":
+		return h.serveRepositories(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/admin/repositories/rename":
+		return nil, h.serveRenameRepository(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/admin/repositories/delete":
+		return nil, h.serveDeleteRepository(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/admin/repositories/visibility":
+		return nil, h.serveSetRepositoryVisibility(req, s)
+
+	case req.Method == "GET" && req.URL.Path == "/admin/audit":
+		return h.serveAudit(req, s)
+
+	case req.Method == "GET" && req.URL.Path == "/admin/blocked":
+		return h.serveBlocked(req, s)
+
+	case req.Method == "POST" && req.URL.Path == "/admin/blocked/unblock":
+		return nil, h.serveUnblock(req, s)
 
 	case req.Method == "GET" && req.URL.Path == "/sessions":
 		// Authorization check.
-		if s == nil {
+		if s == nil || s.Scopes != nil {
 			return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
 		}
-		if user, err := h.users.Get(req.Context(), users.UserSpec{ID: s.GitHubUserID, Domain: "github.com"}); err != nil {
-			log.Println("/sessions: h.users.Get:", err)
-			return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
-		} else if !user.SiteAdmin {
-			log.Printf("/sessions: non-SiteAdmin %q tried to access\n", user.Login)
-			return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+		siteAdmin := policy.Allowed(s.UserSpec, "", roleAdmin)
+		if siteAdmin {
+			if err := requireStepUp(req, s); err != nil {
+				return nil, err
+			}
 		}
 
-		var ss []session
+		var own, all []session
 		global.mu.Lock()
-		for _, s := range global.sessions {
-			ss = append(ss, s)
+		for _, ss := range global.sessions {
+			if ss.UserSpec == s.UserSpec {
+				own = append(own, ss)
+			}
+			if siteAdmin {
+				all = append(all, ss)
+			}
 		}
 		global.mu.Unlock()
-		var nodes []*html.Node
-		for _, s := range ss {
-			user, err := h.users.Get(req.Context(), users.UserSpec{ID: s.GitHubUserID, Domain: "github.com"})
+		sort.Slice(own, func(i, j int) bool { return own[i].LastSeen.After(own[j].LastSeen) })
+
+		nodes := []*html.Node{htmlg.H3(htmlg.Text("Your sessions"))}
+		for _, ss := range own {
+			created := "unknown"
+			if !ss.CreatedAt.IsZero() {
+				created = humanize.Time(ss.CreatedAt)
+			}
+			div := htmlg.Div(htmlg.Text(fmt.Sprintf("Created: %v last seen: %v IP: %q user agent: %q expiry: %v ", created, humanize.Time(ss.LastSeen), ss.RemoteAddr, ss.UserAgent, humanize.Time(ss.Expiry))))
+			if ss.ID == s.ID {
+				div.AppendChild(htmlg.Strong("(current session)"))
+			} else {
+				revoke := component.PostButton{
+					Action:    "/sessions/revoke?" + url.Values{"id": {ss.ID}}.Encode(),
+					Text:      "Revoke",
+					ReturnURL: "/sessions",
+					CSRFToken: csrfToken(s.rawAccessToken),
+				}
+				htmlg.AppendChildren(div, revoke.Render()...)
+			}
+			nodes = append(nodes, div)
+		}
+		signOutEverywhere := component.PostButton{
+			Action:    "/sessions/revoke-all",
+			Text:      "Sign out everywhere",
+			ReturnURL: "/",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		nodes = append(nodes, htmlg.Div(signOutEverywhere.Render()...))
+
+		if !siteAdmin {
+			return nodes, nil
+		}
+		auditLog.Record(req, auditAdminView, s.UserSpec, req.URL.Path, "")
+		nodes = append(nodes, htmlg.H3(htmlg.Text("All sessions")))
+		for _, s := range all {
+			user, err := h.users.Get(req.Context(), s.UserSpec)
 			if err != nil {
-				log.Printf("h.users.Get(%+v): %v\n", users.UserSpec{ID: s.GitHubUserID, Domain: "github.com"}, err)
+				log.Printf("h.users.Get(%+v): %v\n", s.UserSpec, err)
 				user = users.User{
-					UserSpec: users.UserSpec{ID: s.GitHubUserID, Domain: "github.com"},
-					Login:    fmt.Sprintf("??? (GitHubUserID=%d)", s.GitHubUserID),
+					UserSpec: s.UserSpec,
+					Login:    fmt.Sprintf("??? (UserSpec=%d@%s)", s.UserSpec.ID, s.UserSpec.Domain),
 				}
 			}
 			nodes = append(nodes,
-				htmlg.Div(htmlg.Text(fmt.Sprintf("Login: %q Domain: %q expiry: %v accessToken: %q...", user.Login, user.Domain, humanize.Time(s.Expiry), base64.RawURLEncoding.EncodeToString([]byte(s.AccessToken)[:15])))),
+				htmlg.Div(htmlg.Text(fmt.Sprintf("Login: %q Domain: %q expiry: %v last seen: %v id: %q", user.Login, user.Domain, humanize.Time(s.Expiry), humanize.Time(s.LastSeen), s.ID))),
 			)
 		}
-		if len(ss) == 0 {
+		if len(all) == 0 {
 			nodes = append(nodes,
 				htmlg.Div(htmlg.Text("-")),
 			)
 		}
 		return nodes, nil
 
+	case req.Method == "POST" && req.URL.Path == "/sessions/revoke":
+		// Authorization check.
+		if s == nil || s.Scopes != nil {
+			return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+		}
+		id := req.URL.Query().Get("id")
+		found := false
+		global.mu.Lock()
+		if ss, ok := global.sessions[id]; ok && ss.UserSpec == s.UserSpec {
+			global.remove(req.Context(), id)
+			found = true
+		}
+		global.mu.Unlock()
+		if !found {
+			return nil, &os.PathError{Op: "revoke", Path: req.URL.String(), Err: os.ErrNotExist}
+		}
+		auditLog.Record(req, auditSessionRevoke, s.UserSpec, id, "")
+		return nil, httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+
+	case req.Method == "POST" && req.URL.Path == "/sessions/revoke-all":
+		// Authorization check.
+		if s == nil || s.Scopes != nil {
+			return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+		}
+		global.mu.Lock()
+		for id, ss := range global.sessions {
+			if ss.UserSpec != s.UserSpec {
+				continue
+			}
+			global.remove(req.Context(), id)
+		}
+		global.mu.Unlock()
+		auditLog.Record(req, auditSessionRevoke, s.UserSpec, "all", "")
+
+		clearAccessTokenCookie(w)
+		return nil, httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+
 	default:
 		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrNotExist}
 	}
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
 )
 
 func TestLookUpSessionViaCookie(t *testing.T) {
@@ -11,21 +22,29 @@ func TestLookUpSessionViaCookie(t *testing.T) {
 		global = state{sessions: make(map[string]session)}
 	}()
 	var (
+		// Sessions A and B have legacy access tokens.
 		sessionA = session{
-			GitHubUserID: 1,
-			Expiry:       time.Now().Add(6*24*time.Hour + time.Minute),
-			AccessToken:  "aaa",
+			UserSpec:    users.UserSpec{ID: 1, Domain: "github.com"},
+			Expiry:      time.Now().Add(6*24*time.Hour + time.Minute),
+			AccessToken: "aaa",
 		}
 		sessionB = session{
-			GitHubUserID: 2,
-			Expiry:       time.Now().Add(6*24*time.Hour - time.Minute),
-			AccessToken:  "bbb",
+			UserSpec:    users.UserSpec{ID: 2, Domain: "github.com"},
+			Expiry:      time.Now().Add(6*24*time.Hour - time.Minute),
+			AccessToken: "bbb",
 		}
+		sessionC, accessTokenC = newSession(users.UserSpec{ID: 3, Domain: "github.com"}, time.Now().Add(7*24*time.Hour))
 	)
+	sessionA.migrate()
+	sessionB.migrate()
 	global = state{sessions: map[string]session{
-		sessionA.AccessToken: sessionA,
-		sessionB.AccessToken: sessionB,
+		sessionA.ID: sessionA,
+		sessionB.ID: sessionB,
+		sessionC.ID: sessionC,
 	}}
+	cookie := func(accessToken string) http.Header {
+		return http.Header{"Cookie": {"accessToken=" + base64.RawURLEncoding.EncodeToString([]byte(accessToken))}}
+	}
 
 	tests := []struct {
 		in           *http.Request
@@ -54,12 +73,21 @@ func TestLookUpSessionViaCookie(t *testing.T) {
 				},
 			},
 			wantSession: &session{
-				GitHubUserID: 2,
-				Expiry:       time.Now().Add(7 * 24 * time.Hour), // Extended expiry.
-				AccessToken:  "bbb",
+				UserSpec: users.UserSpec{ID: 2, Domain: "github.com"},
+				Expiry:   time.Now().Add(7 * 24 * time.Hour), // Extended expiry.
+				ID:       sessionB.ID,
 			},
 			wantExtended: true,
 		},
+		{
+			in:           &http.Request{Header: cookie(accessTokenC)},
+			wantSession:  &sessionC,
+			wantExtended: false,
+		},
+		{
+			in:        &http.Request{Header: cookie(sessionC.ID + ".bad")}, // Right session ID, wrong secret.
+			wantError: errBadAccessToken,
+		},
 		{
 			in: &http.Request{
 				Header: http.Header{
@@ -94,13 +122,146 @@ func TestLookUpSessionViaCookie(t *testing.T) {
 	}
 }
 
+// Test that sessions written through to the session store
+// survive a restart, and that expired sessions don't.
+func TestStateLoad(t *testing.T) {
+	ctx := context.Background()
+	store := webdav.NewMemFS()
+	var (
+		sessionA, _ = newSession(users.UserSpec{ID: 1, Domain: "github.com"}, time.Now().Add(7*24*time.Hour))
+		sessionB, _ = newSession(users.UserSpec{ID: 2, Domain: "github.com"}, time.Now().Add(7*24*time.Hour))
+		expired, _  = newSession(users.UserSpec{ID: 3, Domain: "github.com"}, time.Now().Add(-time.Minute))
+	)
+
+	s1 := state{sessions: make(map[string]session)}
+	err := s1.Load(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1.mu.Lock()
+	s1.put(ctx, sessionA)
+	s1.put(ctx, sessionB)
+	s1.put(ctx, expired)
+	s1.remove(ctx, sessionB.ID) // Sign out of session B.
+	s1.mu.Unlock()
+
+	// Start over, as if the server was restarted.
+	s2 := state{sessions: make(map[string]session)}
+	err = s2.Load(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(s2.sessions), 1; got != want {
+		t.Fatalf("got %d sessions, want %d", got, want)
+	}
+	if got, want := s2.sessions[sessionA.ID], sessionA; !equalSession(&got, &want) {
+		t.Errorf("got session: %v, want: %v", got, want)
+	}
+	if _, err := store.Stat(ctx, sessionPath(expired.ID)); !os.IsNotExist(err) {
+		t.Errorf("expired session was not removed from store: %v", err)
+	}
+}
+
+// Test that sessions imported from a legacy state file, which has raw access tokens,
+// keep working, and that their access tokens are only stored hashed.
+func TestStateLoadAndRemove(t *testing.T) {
+	ctx := context.Background()
+	f, err := ioutil.TempFile("", "statefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	err = gob.NewEncoder(f).Encode(map[string]session{
+		"aaa": {GitHubUserID: 1, Expiry: time.Now().Add(time.Hour), AccessToken: "aaa"},
+	})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := webdav.NewMemFS()
+	s := state{sessions: make(map[string]session)}
+	err = s.Load(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.LoadAndRemove(ctx, f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("state file was not removed: %v", err)
+	}
+
+	s.mu.Lock()
+	got, ok := s.lookUp(ctx, "aaa")
+	s.mu.Unlock()
+	if want := (users.UserSpec{ID: 1, Domain: "github.com"}); !ok || got.UserSpec != want {
+		t.Fatalf("got session %v, ok %v, want session for %+v", got, ok, want)
+	}
+	if got.AccessToken != "" {
+		t.Errorf("got session with raw access token %q, want none", got.AccessToken)
+	}
+	sf, err := store.OpenFile(ctx, sessionPath(got.ID), os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(sf)
+	sf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("aaa")) {
+		t.Error("session store contains raw access token")
+	}
+}
+
+// Test that signing out everywhere removes all sessions of the user,
+// and only theirs.
+func TestSignOutEverywhere(t *testing.T) {
+	defer func() {
+		global = state{sessions: make(map[string]session)}
+	}()
+	var (
+		sessionA1, accessTokenA1 = newSession(users.UserSpec{ID: 1, Domain: "github.com"}, time.Now().Add(time.Hour))
+		sessionA2, _             = newSession(users.UserSpec{ID: 1, Domain: "github.com"}, time.Now().Add(time.Hour))
+		sessionB, _              = newSession(users.UserSpec{ID: 2, Domain: "github.com"}, time.Now().Add(time.Hour))
+	)
+	global = state{sessions: map[string]session{
+		sessionA1.ID: sessionA1,
+		sessionA2.ID: sessionA2,
+		sessionB.ID:  sessionB,
+	}}
+	usersService, userStore, err := newUsersService(webdav.NewMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &sessionsHandler{users: usersService, userStore: userStore}
+
+	req := httptest.NewRequest(http.MethodPost, "/sessions/revoke-all", strings.NewReader("return=%2F"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", "accessToken="+base64.RawURLEncoding.EncodeToString([]byte(accessTokenA1)))
+	req.Header.Set("X-CSRF-Token", csrfToken(accessTokenA1))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+	if got, want := len(global.sessions), 1; got != want {
+		t.Fatalf("got %d sessions, want %d", got, want)
+	}
+	if _, ok := global.sessions[sessionB.ID]; !ok {
+		t.Error("session of another user was removed")
+	}
+}
+
 // equalSession reports whether sessions a and b are considered equal.
 // They're equal if both are nil, or both are not nil and have equal fields.
 func equalSession(a, b *session) bool {
 	return a == nil && b == nil || a != nil && b != nil &&
-		a.GitHubUserID == b.GitHubUserID &&
+		a.UserSpec == b.UserSpec &&
 		-time.Second < a.Expiry.Sub(b.Expiry) && a.Expiry.Sub(b.Expiry) < time.Second && // Expiry times within a second.
-		a.AccessToken == b.AccessToken
+		a.ID == b.ID
 }
 
 // equalError reports whether errors a and b are considered equal.
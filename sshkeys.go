@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/shurcooL/home/component"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// sshKey is an SSH public key that a user added
+// to authenticate with the SSH git server.
+type sshKey struct {
+	ID          string // Hex-encoded SHA-256 digest of PublicKey.
+	Fingerprint string // SHA-256 fingerprint, as shown by ssh-keygen. E.g., "SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s".
+	Name        string // Name given by the user, or the key comment. E.g., "Laptop".
+	UserSpec    users.UserSpec
+	PublicKey   []byte // Public key in SSH wire format.
+	CreatedAt   time.Time
+	LastUsed    time.Time // Zero if never used.
+}
+
+// sshKeys is the store of users' authorized SSH public keys.
+// It's kept in the "ssh-keys" directory of the users store.
+var sshKeys = sshKeyStore{keys: make(map[string]sshKey)}
+
+type sshKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]sshKey // SSH Key ID -> SSH Key.
+
+	// store is where keys are persisted. If nil, keys are only kept in memory.
+	store webdav.FileSystem
+}
+
+// Load sets root as the SSH key store, and loads all keys from it.
+func (ks *sshKeyStore) Load(ctx context.Context, root webdav.FileSystem) error {
+	dir, err := root.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	fis, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.store = root
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		var k sshKey
+		err := gobDecodeFile(ctx, root, "/"+fi.Name(), &k)
+		if err != nil {
+			log.Printf("sshKeyStore.Load: skipping SSH key file %q: %v\n", fi.Name(), err)
+			continue
+		}
+		ks.keys[k.ID] = k
+	}
+	return nil
+}
+
+// Add adds public key pub named name for user. It returns os.ErrExist
+// if the key has already been added, by any user.
+func (ks *sshKeyStore) Add(ctx context.Context, user users.UserSpec, name string, pub ssh.PublicKey) (sshKey, error) {
+	k := sshKey{
+		ID:          sshKeyID(pub),
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		Name:        name,
+		UserSpec:    user,
+		PublicKey:   pub.Marshal(),
+		CreatedAt:   time.Now().UTC(),
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, ok := ks.keys[k.ID]; ok {
+		return sshKey{}, os.ErrExist
+	}
+	return k, ks.put(ctx, k)
+}
+
+// List lists SSH keys of user, newest first.
+func (ks *sshKeyStore) List(user users.UserSpec) []sshKey {
+	var keys []sshKey
+	ks.mu.Lock()
+	for _, k := range ks.keys {
+		if k.UserSpec != user {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	ks.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys
+}
+
+// Remove removes the SSH key with id that belongs to user.
+// It returns os.ErrNotExist if user has no such key.
+func (ks *sshKeyStore) Remove(ctx context.Context, user users.UserSpec, id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[id]
+	if !ok || k.UserSpec != user {
+		return os.ErrNotExist
+	}
+	delete(ks.keys, id)
+	if ks.store != nil {
+		return ks.store.RemoveAll(ctx, "/"+id)
+	}
+	return nil
+}
+
+// lookUp returns the SSH key with id, if any.
+func (ks *sshKeyStore) lookUp(id string) (sshKey, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[id]
+	return k, ok
+}
+
+// Used records that the SSH key with id was used to authenticate.
+func (ks *sshKeyStore) Used(ctx context.Context, id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+	k.LastUsed = time.Now().UTC()
+	return ks.put(ctx, k)
+}
+
+// put stores k. ks.mu must be held.
+func (ks *sshKeyStore) put(ctx context.Context, k sshKey) error {
+	if ks.store != nil {
+		err := gobEncodeFile(ctx, ks.store, "/"+k.ID, k)
+		if err != nil {
+			return err
+		}
+	}
+	ks.keys[k.ID] = k
+	return nil
+}
+
+// sshKeyID returns the ID of public key pub.
+func sshKeyID(pub ssh.PublicKey) string {
+	sum := sha256.Sum256(pub.Marshal())
+	return hex.EncodeToString(sum[:])
+}
+
+// serveSSHKeys serves the SSH keys settings page,
+// and adds a new key when the page is POSTed to.
+func (h *sessionsHandler) serveSSHKeys(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. SSH keys can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+
+	if req.Method == http.MethodPost {
+		pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PostFormValue("key")))
+		if err != nil {
+			return nil, httperror.BadRequest{Err: fmt.Errorf("bad public key: %v", err)}
+		}
+		if pub.Type() == ssh.KeyAlgoDSA {
+			return nil, httperror.BadRequest{Err: errors.New("DSA keys are not supported")}
+		}
+		name := strings.TrimSpace(req.PostFormValue("name"))
+		if name == "" {
+			name = comment
+		}
+		if name == "" {
+			return nil, httperror.BadRequest{Err: errors.New("key name must be non-empty")}
+		}
+		k, err := sshKeys.Add(req.Context(), s.UserSpec, name, pub)
+		if os.IsExist(err) {
+			return nil, httperror.BadRequest{Err: errors.New("key has already been added")}
+		} else if err != nil {
+			return nil, err
+		}
+		auditLog.Record(req, auditSSHKeyAdd, s.UserSpec, k.ID, fmt.Sprintf("name: %q fingerprint: %s", name, k.Fingerprint))
+		return nil, httperror.Redirect{URL: "/settings/ssh-keys"}
+	}
+
+	var nodes []*html.Node
+	keys := sshKeys.List(s.UserSpec)
+	for _, k := range keys {
+		lastUsed := "never"
+		if !k.LastUsed.IsZero() {
+			lastUsed = humanize.Time(k.LastUsed)
+		}
+		remove := component.PostButton{
+			Action:    "/settings/ssh-keys/delete?" + url.Values{"id": {k.ID}}.Encode(),
+			Text:      "Remove",
+			ReturnURL: "/settings/ssh-keys",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		div := htmlg.Div(htmlg.Text(fmt.Sprintf("Name: %q fingerprint: %s created: %v last used: %v ", k.Name, k.Fingerprint, humanize.Time(k.CreatedAt), lastUsed)))
+		htmlg.AppendChildren(div, remove.Render()...)
+		nodes = append(nodes, div)
+	}
+	if len(keys) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No SSH keys.")),
+		)
+	}
+	nodes = append(nodes, newSSHKeyForm(csrfToken(s.rawAccessToken)))
+	return nodes, nil
+}
+
+// newSSHKeyForm renders a form for adding a new SSH key.
+func newSSHKeyForm(csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/settings/ssh-keys"},
+			{Key: atom.Style.String(), Val: `margin-top: 20px;`},
+		},
+	}
+	name := &html.Node{
+		Type: html.ElementNode, Data: atom.Input.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "text"},
+			{Key: atom.Name.String(), Val: "name"},
+			{Key: atom.Placeholder.String(), Val: "Defaults to key comment"},
+		},
+	}
+	key := &html.Node{
+		Type: html.ElementNode, Data: atom.Textarea.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Name.String(), Val: "key"},
+			{Key: atom.Rows.String(), Val: "4"},
+			{Key: atom.Cols.String(), Val: "80"},
+			{Key: atom.Placeholder.String(), Val: "Begins with ssh-ed25519, ecdsa-sha2-nistp256, ssh-rsa, ..."},
+		},
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Name: "), name))
+	form.AppendChild(htmlg.Div(htmlg.Text("Public key:")))
+	form.AppendChild(htmlg.Div(key))
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(htmlg.Div(submitInput("Add SSH key")))
+	return form
+}
+
+// serveRemoveSSHKey removes the SSH key specified by the id query parameter.
+func (h *sessionsHandler) serveRemoveSSHKey(req *http.Request, s *session) error {
+	// Authorization check. SSH keys can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	id := req.URL.Query().Get("id")
+	err := sshKeys.Remove(req.Context(), s.UserSpec, id)
+	if os.IsNotExist(err) {
+		return &os.PathError{Op: "remove", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditSSHKeyRemove, s.UserSpec, id, "")
+	return httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/AaronO/go-git-http"
+	"github.com/shurcooL/users"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+)
+
+// sshHandshakeTimeout is how long an SSH client has to authenticate.
+const sshHandshakeTimeout = 30 * time.Second
+
+// gitSSHServer serves git fetches and pushes over SSH.
+// Clients authenticate with the SSH keys that users add in their settings,
+// and can use any username. E.g., "git clone ssh://git@dmitri.shuralyov.com/kebabcase".
+type gitSSHServer struct {
+	git    *gitHandler
+	config *ssh.ServerConfig
+}
+
+// newGitSSHServer returns a git SSH server that serves the repositories of h.
+// Its host key is loaded from hostKeyStore, and generated there if it doesn't exist yet.
+func newGitSSHServer(ctx context.Context, h *gitHandler, hostKeyStore webdav.FileSystem) (*gitSSHServer, error) {
+	hostKey, err := loadSSHHostKey(ctx, hostKeyStore)
+	if err != nil {
+		return nil, fmt.Errorf("loadSSHHostKey: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+			k, ok := sshKeys.lookUp(sshKeyID(pub))
+			if !ok {
+				return nil, errors.New("unknown public key")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"key-id": k.ID}}, nil
+		},
+		ServerVersion: "SSH-2.0-home",
+	}
+	config.AddHostKey(hostKey)
+	return &gitSSHServer{git: h, config: config}, nil
+}
+
+// loadSSHHostKey loads the SSH host key from store.
+// If there isn't one yet, it generates a new Ed25519 key and stores it.
+func loadSSHHostKey(ctx context.Context, store webdav.FileSystem) (ssh.Signer, error) {
+	var der []byte // PKCS #8 encoded private key.
+	err := gobDecodeFile(ctx, store, "/host_key", &der)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(cryptorand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		err = gobEncodeFile(ctx, store, "/host_key", der)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Generated new SSH host key.")
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// Serve accepts SSH connections on l, and serves each in a new goroutine.
+// It returns when l.Accept fails, e.g., because l was closed.
+func (s *gitSSHServer) Serve(l net.Listener) error {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(nc)
+	}
+}
+
+func (s *gitSSHServer) serveConn(nc net.Conn) {
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		// Most often, the client didn't have an authorized key. Not worth logging.
+		return
+	}
+	nc.SetDeadline(time.Time{})
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k, user, err := s.authenticatedUser(ctx, conn)
+	if err != nil {
+		log.Println("gitSSHServer: authenticatedUser:", err)
+		return
+	}
+	// Act as if the key were a personal access token for fetching and pushing.
+	ctx = context.WithValue(ctx, sessionContextKey, &session{
+		UserSpec: user.UserSpec,
+		Scopes:   []tokenScope{scopeRead, scopeGitPush},
+	})
+	err = sshKeys.Used(ctx, k.ID)
+	if err != nil {
+		log.Println("gitSSHServer: sshKeys.Used:", err)
+	}
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Println("gitSSHServer: newChannel.Accept:", err)
+			continue
+		}
+		go s.serveSession(ctx, conn, user, ch, requests)
+	}
+}
+
+// authenticatedUser returns the SSH key that conn authenticated with, and its user.
+func (s *gitSSHServer) authenticatedUser(ctx context.Context, conn *ssh.ServerConn) (sshKey, users.User, error) {
+	id := conn.Permissions.Extensions["key-id"]
+	k, ok := sshKeys.lookUp(id)
+	if !ok {
+		return sshKey{}, users.User{}, fmt.Errorf("SSH key %q was removed", id)
+	}
+	user, err := s.git.users.Get(ctx, k.UserSpec)
+	if err != nil {
+		return sshKey{}, users.User{}, err
+	}
+	return k, user, nil
+}
+
+// serveSession serves a session channel. It runs at most one command.
+func (s *gitSSHServer) serveSession(ctx context.Context, conn *ssh.ServerConn, user users.User, ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	var gitProtocol string // Value of GIT_PROTOCOL environment variable, if set by client.
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			var env struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &env); err != nil || env.Name != "GIT_PROTOCOL" || !validGitProtocol(env.Value) {
+				req.Reply(false, nil)
+				continue
+			}
+			gitProtocol = env.Value
+			req.Reply(true, nil)
+		case "exec":
+			var command struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &command); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			status := s.runCommand(ctx, conn, user, ch, command.Command, gitProtocol)
+			_, err := ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			if err != nil && err != io.EOF {
+				log.Println("gitSSHServer: sending exit-status:", err)
+			}
+			return
+		case "shell":
+			req.Reply(true, nil)
+			fmt.Fprintf(ch.Stderr(), "Hi %s! You've successfully authenticated, but shell access is not provided.\n", user.Login)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+			return
+		default:
+			// E.g., "pty-req". Not supported.
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// runCommand runs the git command that user sent over ch, and returns its exit status.
+// Errors are reported to the client over stderr.
+func (s *gitSSHServer) runCommand(ctx context.Context, conn *ssh.ServerConn, user users.User, ch ssh.Channel, command, gitProtocol string) (status uint32) {
+	fail := func(format string, v ...interface{}) uint32 {
+		fmt.Fprintf(ch.Stderr(), "fatal: "+format+"\n", v...)
+		return 128
+	}
+	service, repoPath, err := parseGitSSHCommand(command)
+	if err != nil {
+		return fail("%v", err)
+	}
+	repoRoot := "dmitri.shuralyov.com/" + repoPath
+	if dir, ok := s.git.code.Code().ByImportPath[repoRoot]; !ok || !dir.IsRepoRoot() || !canRead(user.UserSpec, repoRoot) {
+		// Private repositories that user can't read are reported as not found.
+		return fail("repository %q not found", repoPath)
+	}
+	repo := repoInfo{
+		Spec: repoRoot,
+		Path: repoRoot[len("dmitri.shuralyov.com"):],
+		Dir:  filepath.Join(s.git.reposDir, filepath.FromSlash(repoRoot)),
+	}
+
+	var cmd *exec.Cmd
+	var rpc *githttp.RpcReader
+	switch service {
+	case "git-upload-pack":
+		ctx, cancel := context.WithTimeout(ctx, gitUploadPackTimeout)
+		defer cancel()
+		cmd = exec.CommandContext(ctx, s.git.gitUploadPack, "--strict", ".")
+		if gitProtocol != "" {
+			cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+gitProtocol)
+		}
+		cmd.Stdin = ch
+	case "git-receive-pack":
+		// Authorization check.
+		if !policy.Allowed(user.UserSpec, repo.Spec, rolePusher) {
+			return fail("%s does not have permission to push to %s", user.Login, repo.Spec)
+		}
+		if policy.Allowed(user.UserSpec, "", roleAdmin) && totps.Enabled(user.UserSpec) {
+			// Site admins need to step up to push, and there's no way to provide
+			// a second factor code over SSH, so they need to push over HTTPS instead.
+			return fail("site admins with two-factor authentication enabled must push over HTTPS")
+		}
+		if err := checkPushable(repo.Spec); err != nil {
+			return fail("%v", err)
+		}
+		ctx, cancel := context.WithTimeout(ctx, gitReceivePackTimeout)
+		defer cancel()
+		cmd = exec.CommandContext(ctx, s.git.gitReceivePack, ".")
+		cmd.Env = pushPolicyHookEnv(s.git.hooksDir, pushPolicies.Get(repo.Spec))
+		rpc = &githttp.RpcReader{
+			Reader: ch,
+			Rpc:    "receive-pack",
+		}
+		cmd.Stdin = rpc
+	}
+	cmd.Dir = repo.Dir
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	err = cmd.Run()
+	if ee, ok := err.(*exec.ExitError); ok && ee.Sys().(syscall.WaitStatus).ExitStatus() > 0 {
+		// The git command has already reported the error to the client.
+		log.Printf("gitSSHServer: %s command failed: %v\n", service, err)
+		return uint32(ee.Sys().(syscall.WaitStatus).ExitStatus())
+	} else if err != nil {
+		log.Printf("gitSSHServer: %s command failed: %v\n", service, err)
+		return fail("%s failed", service)
+	}
+
+	if rpc != nil {
+		client := auditClient{RemoteAddr: sshRemoteIP(conn), UserAgent: string(conn.ClientVersion())}
+		s.git.logPush(ctx, client, user, repo, rpc.Events)
+		s.git.updateCode(repo, rpc.Events)
+		s.git.mirrorPush(ctx, repo, rpc.Events)
+	}
+	return 0
+}
+
+// parseGitSSHCommand parses an SSH command sent by a git client,
+// such as "git-upload-pack '/kebabcase.git'", into the git service
+// and repository path, such as "git-upload-pack" and "kebabcase".
+func parseGitSSHCommand(command string) (service, repoPath string, err error) {
+	i := strings.IndexByte(command, ' ')
+	if i == -1 {
+		return "", "", fmt.Errorf("unsupported command %q", command)
+	}
+	service, arg := command[:i], command[i+1:]
+	switch service {
+	case "git-upload-pack", "git-receive-pack":
+	default:
+		return "", "", fmt.Errorf("unsupported command %q", service)
+	}
+	// Git quotes the path in single quotes. Repository paths don't need escaping,
+	// so paths with characters that git escapes are rejected rather than unescaped.
+	if len(arg) < 2 || arg[0] != '\'' || arg[len(arg)-1] != '\'' || strings.ContainsAny(arg[1:len(arg)-1], `'\!`) {
+		return "", "", fmt.Errorf("bad repository path %s", arg)
+	}
+	repoPath = strings.TrimSuffix(strings.Trim(arg[1:len(arg)-1], "/"), ".git")
+	if repoPath == "" || strings.Contains("/"+repoPath+"/", "/../") {
+		return "", "", fmt.Errorf("bad repository path %s", arg)
+	}
+	return service, repoPath, nil
+}
+
+// sshRemoteIP returns the IP address of the client of conn.
+func sshRemoteIP(conn ssh.ConnMetadata) string {
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		return host
+	}
+	return conn.RemoteAddr().String()
+}
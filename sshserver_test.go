@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/events/event"
+	"github.com/shurcooL/home/internal/code"
+	"github.com/shurcooL/users"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+)
+
+// Test fetching and pushing via the SSH git server, using a local git client.
+// Like pushes over HTTPS, pushes are checked against the push policy,
+// logged as events, discover code, and are synced to push mirrors.
+func TestGitSSHServer(t *testing.T) {
+	for _, name := range []string{"git", "ssh"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skip(name+" not found:", err)
+		}
+	}
+	defer func() {
+		sshKeys = sshKeyStore{keys: make(map[string]sshKey)}
+		pushPolicies = pushPolicyStore{}
+	}()
+	tempDir, err := ioutil.TempDir("", "home-sshserver-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	git := testGit(t, tempDir)
+	const repo = "dmitri.shuralyov.com/test/repo"
+	var (
+		reposDir  = filepath.Join(tempDir, "repositories")
+		repoDir   = filepath.Join(reposDir, filepath.FromSlash(repo))
+		workDir   = filepath.Join(tempDir, "work")
+		mirrorDir = filepath.Join(tempDir, "mirror.git")
+	)
+	for _, dir := range []string{reposDir, workDir, mirrorDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(mirrorDir, "init", "--bare")
+	git(workDir, "init")
+	codeStore, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codeStore.Create(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	usersService, userStore, err := newUsersService(webdav.NewMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopher := users.User{UserSpec: users.UserSpec{ID: 1, Domain: "example.org"}, Login: "gopher"}
+	if err := userStore.Create(ctx, gopher); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Grant(ctx, gopher.UserSpec, repo, rolePusher); err != nil {
+		t.Fatal(err)
+	}
+	defer policy.Revoke(ctx, gopher.UserSpec, repo)
+	if err := pushPolicies.Set(ctx, pushPolicy{Repo: repo, ProtectedBranches: []string{"master"}}); err != nil {
+		t.Fatal(err)
+	}
+	mirrorsDone := make(chan struct{})
+	go func() {
+		pushMirrors.Run(ctx, reposDir)
+		close(mirrorsDone)
+	}()
+	defer func() {
+		cancel()
+		<-mirrorsDone
+		pushMirrors = pushMirrorStore{}
+	}()
+	// Syncing the empty repository fails, and isn't retried for a while,
+	// so the mirror is only synced in time if a push queues a sync.
+	if err := pushMirrors.Add(ctx, repo, mirrorDir); err != nil {
+		t.Fatal(err)
+	}
+
+	events := &recordedEvents{}
+	h, err := initGitHandler(codeStore, reposDir, events, usersService, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	s, err := newGitSSHServer(ctx, h, webdav.NewMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.Serve(l)
+	remote := "ssh://git@" + l.Addr().String() + "/test/repo"
+
+	// sshCommand returns git configuration that makes git use ssh
+	// with a new private key, which is added for gopher if add is true.
+	sshCommand := func(name string, add bool) string {
+		t.Helper()
+		_, key, err := ed25519.GenerateKey(cryptorand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if add {
+			signer, err := ssh.NewSignerFromKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sshKeys.Add(ctx, gopher.UserSpec, name, signer.PublicKey()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyFile := filepath.Join(tempDir, name)
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Ignore the developer's ssh config and known hosts.
+		return "core.sshCommand=ssh -F /dev/null -i " + keyFile + " -o IdentitiesOnly=yes" +
+			" -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR"
+	}
+	laptop := sshCommand("laptop", true)
+	ref := func(dir, ref string) string {
+		return git(dir, "for-each-ref", "--format=%(objectname)", ref)
+	}
+
+	// Push a package. It's logged, its code is discovered, and it's mirrored.
+	if err := ioutil.WriteFile(filepath.Join(workDir, "repo.go"), []byte("package repo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(workDir, "add", "repo.go")
+	git(workDir, "commit", "-m", "Initial commit.")
+	head := git(workDir, "rev-parse", "HEAD")
+	git(workDir, "-c", laptop, "push", remote, "HEAD:refs/heads/master")
+	if got := ref(repoDir, "refs/heads/master"); got != head {
+		t.Errorf("got pushed master %q, want %q", got, head)
+	}
+	if d, ok := codeStore.Code().ByImportPath[repo]; !ok || d.Package == nil {
+		t.Errorf("package %s not discovered after push", repo)
+	}
+	var logged bool
+	for _, p := range events.Payloads() {
+		if p, ok := p.(event.Push); ok && p.Branch == "master" && p.Head == head {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("got events %+v, want push of %s to master", events.Payloads(), head)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ref(mirrorDir, "refs/heads/master") != head; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for push mirror to be synced, have %+v", pushMirrors.List(repo))
+		}
+	}
+
+	// Clone, using protocol version 2.
+	cloneDir := filepath.Join(tempDir, "clone")
+	git(tempDir, "-c", laptop, "-c", "protocol.version=2", "clone", remote, cloneDir)
+	if got := git(cloneDir, "rev-parse", "HEAD"); got != head {
+		t.Errorf("got cloned HEAD %q, want %q", got, head)
+	}
+
+	// Pushes that break the push policy are rejected,
+	// with the reason shown to the git client.
+	before := len(events.Payloads())
+	git(workDir, "commit", "--amend", "-m", "Amended commit.")
+	out, err := testGitCommand(tempDir, workDir, "-c", laptop, "push", "--force", remote, "HEAD:refs/heads/master").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "refs/heads/master: non-fast-forward update is not allowed") {
+		t.Errorf("force push to protected branch: got error %v and output:\n%s\nwant it rejected by push policy", err, out)
+	}
+	if got := ref(repoDir, "refs/heads/master"); got != head {
+		t.Errorf("got master %q after rejected push, want %q", got, head)
+	}
+	if got := events.Payloads()[before:]; len(got) != 0 {
+		t.Errorf("got events %+v after rejected push, want none", got)
+	}
+
+	// Keys that weren't added are rejected.
+	unknown := sshCommand("unknown", false)
+	if out, err := testGitCommand(tempDir, workDir, "-c", unknown, "ls-remote", remote).CombinedOutput(); err == nil {
+		t.Errorf("ls-remote with unknown key: got no error and output:\n%s\nwant failure", out)
+	}
+}
+
+func TestParseGitSSHCommand(t *testing.T) {
+	tests := []struct {
+		command      string
+		wantService  string
+		wantRepoPath string
+		wantError    bool
+	}{
+		{command: "git-upload-pack '/kebabcase'", wantService: "git-upload-pack", wantRepoPath: "kebabcase"},
+		{command: "git-upload-pack 'kebabcase.git'", wantService: "git-upload-pack", wantRepoPath: "kebabcase"},
+		{command: "git-receive-pack '/test/repo/'", wantService: "git-receive-pack", wantRepoPath: "test/repo"},
+		{command: "git-upload-archive '/kebabcase'", wantError: true},
+		{command: "rm -rf /", wantError: true},
+		{command: "git-upload-pack", wantError: true},
+		{command: "git-upload-pack /kebabcase", wantError: true},
+		{command: "git-upload-pack '/'", wantError: true},
+		{command: "git-upload-pack '/../kebabcase'", wantError: true},
+		{command: `git-upload-pack '/it'\''s'`, wantError: true},
+	}
+	for _, tc := range tests {
+		service, repoPath, err := parseGitSSHCommand(tc.command)
+		if got, want := err != nil, tc.wantError; got != want {
+			t.Errorf("parseGitSSHCommand(%q): got error %v, want error %v", tc.command, err, want)
+			continue
+		}
+		if service != tc.wantService || repoPath != tc.wantRepoPath {
+			t.Errorf("parseGitSSHCommand(%q): got %q, %q, want %q, %q", tc.command, service, repoPath, tc.wantService, tc.wantRepoPath)
+		}
+	}
+}
@@ -118,6 +118,7 @@ func (h *talksHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) error
 		header := component.Header{
 			CurrentUser:       authenticatedUser,
 			NotificationCount: nc,
+			CSRFToken:         csrfTokenFromContext(req),
 			ReturnURL:         returnURL,
 		}
 		err = htmlg.RenderComponents(w, header)
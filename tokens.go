@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/shurcooL/home/component"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// tokenScope is a scope that an access token can be granted.
+type tokenScope string
+
+const (
+	scopeRead    tokenScope = "read"     // Read-only API access and git fetch.
+	scopeGitPush tokenScope = "git-push" // Git push.
+	scopeAPI     tokenScope = "api"      // Full API access.
+
+	// scopeFrontend is the scope of frontend API tokens, which personal access tokens
+	// can't be granted. It's only accepted by the APIs that frontends use.
+	scopeFrontend tokenScope = "frontend"
+)
+
+// tokenScopes are the scopes that personal access tokens can be granted, in display order.
+var tokenScopes = []struct {
+	Scope       tokenScope
+	Description string
+}{
+	{scopeRead, "Read-only API access and git fetch"},
+	{scopeGitPush, "Git push"},
+	{scopeAPI, "Full API access"},
+}
+
+// personalAccessToken is a named, long-lived access token that a user
+// creates for use by git clients, CI and scripts.
+// Only a digest of the token itself is kept.
+type personalAccessToken struct {
+	ID        string // Opaque ID, used for display and revocation.
+	Name      string // Name given by the user. E.g., "CI".
+	UserSpec  users.UserSpec
+	Scopes    []tokenScope
+	CreatedAt time.Time
+	Expiry    time.Time
+
+	Digest string // Hex-encoded SHA-256 digest of the access token.
+}
+
+// accessTokens is the store of personal access tokens.
+var accessTokens = tokenStore{tokens: make(map[string]personalAccessToken)}
+
+type tokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]personalAccessToken // Access Token Digest -> Personal Access Token.
+
+	// store is where tokens are persisted. If nil, tokens are only kept in memory.
+	store webdav.FileSystem
+}
+
+// Load sets root as the token store, and loads all unexpired tokens from it.
+func (ts *tokenStore) Load(ctx context.Context, root webdav.FileSystem) error {
+	dir, err := root.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	fis, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.store = root
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		var t personalAccessToken
+		err := gobDecodeFile(ctx, root, "/"+fi.Name(), &t)
+		if err != nil {
+			log.Printf("tokenStore.Load: skipping token file %q: %v\n", fi.Name(), err)
+			continue
+		}
+		if !time.Now().Before(t.Expiry) {
+			err := root.RemoveAll(ctx, "/"+fi.Name())
+			if err != nil {
+				log.Println("tokenStore.Load: error removing expired token:", err)
+			}
+			continue
+		}
+		ts.tokens[t.Digest] = t
+	}
+	return nil
+}
+
+// Create creates a new personal access token for user.
+// It returns the token metadata and the access token itself,
+// which is not stored and can't be retrieved later.
+func (ts *tokenStore) Create(ctx context.Context, user users.UserSpec, name string, scopes []tokenScope, expiry time.Time) (personalAccessToken, string, error) {
+	accessToken := make([]byte, 32)
+	_, err := cryptorand.Read(accessToken)
+	if err != nil {
+		return personalAccessToken{}, "", err
+	}
+	id := make([]byte, 8)
+	_, err = cryptorand.Read(id)
+	if err != nil {
+		return personalAccessToken{}, "", err
+	}
+	t := personalAccessToken{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		UserSpec:  user,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		Expiry:    expiry,
+		Digest:    tokenDigest(string(accessToken)),
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.store != nil {
+		err := gobEncodeFile(ctx, ts.store, "/"+t.ID, t)
+		if err != nil {
+			return personalAccessToken{}, "", err
+		}
+	}
+	ts.tokens[t.Digest] = t
+	return t, string(accessToken), nil
+}
+
+// List lists unexpired tokens of user, newest first.
+func (ts *tokenStore) List(user users.UserSpec) []personalAccessToken {
+	var tokens []personalAccessToken
+	ts.mu.Lock()
+	for _, t := range ts.tokens {
+		if t.UserSpec != user || !time.Now().Before(t.Expiry) {
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	ts.mu.Unlock()
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens
+}
+
+// Revoke revokes the token with id that belongs to user.
+// It returns os.ErrNotExist if user has no such token.
+func (ts *tokenStore) Revoke(ctx context.Context, user users.UserSpec, id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for digest, t := range ts.tokens {
+		if t.ID != id || t.UserSpec != user {
+			continue
+		}
+		delete(ts.tokens, digest)
+		if ts.store != nil {
+			return ts.store.RemoveAll(ctx, "/"+t.ID)
+		}
+		return nil
+	}
+	return os.ErrNotExist
+}
+
+// lookUp returns the unexpired token that matches accessToken, if any.
+func (ts *tokenStore) lookUp(ctx context.Context, accessToken string) (personalAccessToken, bool) {
+	digest := tokenDigest(accessToken)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.tokens[digest]
+	if !ok {
+		return personalAccessToken{}, false
+	}
+	if !time.Now().Before(t.Expiry) {
+		delete(ts.tokens, digest)
+		if ts.store != nil {
+			err := ts.store.RemoveAll(ctx, "/"+t.ID)
+			if err != nil {
+				log.Println("tokenStore.lookUp: error removing expired token:", err)
+			}
+		}
+		return personalAccessToken{}, false
+	}
+	return t, true
+}
+
+// tokenDigest returns the hex-encoded SHA-256 digest of accessToken.
+func tokenDigest(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenExpiries are the expiry options offered when creating a token.
+var tokenExpiries = []struct {
+	Days  int
+	Title string
+}{
+	{30, "30 days"},
+	{90, "90 days"},
+	{365, "1 year"},
+}
+
+// serveTokens serves the personal access tokens settings page,
+// and creates a new token when the page is POSTed to.
+func (h *sessionsHandler) serveTokens(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Tokens can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+
+	var nodes []*html.Node
+	if req.Method == http.MethodPost {
+		name := strings.TrimSpace(req.PostFormValue("name"))
+		if name == "" {
+			return nil, httperror.BadRequest{Err: errors.New("token name must be non-empty")}
+		}
+		var scopes []tokenScope
+		for _, sc := range tokenScopes {
+			if req.PostFormValue("scope-"+string(sc.Scope)) != "" {
+				scopes = append(scopes, sc.Scope)
+			}
+		}
+		if len(scopes) == 0 {
+			return nil, httperror.BadRequest{Err: errors.New("at least one scope must be selected")}
+		}
+		days, err := strconv.Atoi(req.PostFormValue("expiry"))
+		if err != nil || days < 1 || days > 365 {
+			return nil, httperror.BadRequest{Err: fmt.Errorf("bad expiry %q", req.PostFormValue("expiry"))}
+		}
+		t, accessToken, err := accessTokens.Create(req.Context(), s.UserSpec, name, scopes, time.Now().Add(time.Duration(days)*24*time.Hour))
+		if err != nil {
+			return nil, err
+		}
+		var scopeNames []string
+		for _, sc := range scopes {
+			scopeNames = append(scopeNames, string(sc))
+		}
+		auditLog.Record(req, auditTokenCreate, s.UserSpec, t.ID, fmt.Sprintf("name: %q scopes: %s", name, strings.Join(scopeNames, ", ")))
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text(fmt.Sprintf("Created token %q. Make sure to copy it now, it won't be shown again:", name))),
+			htmlg.Div(&html.Node{
+				Type: html.ElementNode, Data: atom.Code.String(),
+				FirstChild: htmlg.Text(base64.RawURLEncoding.EncodeToString([]byte(accessToken))),
+			}),
+			htmlg.Div(htmlg.Text("Use it as a Bearer token in the Authorization header, or as the password when pushing via git.")),
+		)
+	}
+
+	tokens := accessTokens.List(s.UserSpec)
+	for _, t := range tokens {
+		var scopes []string
+		for _, sc := range t.Scopes {
+			scopes = append(scopes, string(sc))
+		}
+		revoke := component.PostButton{
+			Action:    "/settings/tokens/revoke?" + url.Values{"id": {t.ID}}.Encode(),
+			Text:      "Revoke",
+			ReturnURL: "/settings/tokens",
+			CSRFToken: csrfToken(s.rawAccessToken),
+		}
+		div := htmlg.Div(htmlg.Text(fmt.Sprintf("Name: %q scopes: %s created: %v expiry: %v ", t.Name, strings.Join(scopes, ", "), humanize.Time(t.CreatedAt), humanize.Time(t.Expiry))))
+		htmlg.AppendChildren(div, revoke.Render()...)
+		nodes = append(nodes, div)
+	}
+	if len(tokens) == 0 {
+		nodes = append(nodes,
+			htmlg.Div(htmlg.Text("No personal access tokens.")),
+		)
+	}
+	nodes = append(nodes, newTokenForm(csrfToken(s.rawAccessToken)))
+	return nodes, nil
+}
+
+// newTokenForm renders a form for creating a new personal access token.
+func newTokenForm(csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/settings/tokens"},
+			{Key: atom.Style.String(), Val: `margin-top: 20px;`},
+		},
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Name: "), textInput("name", "")))
+	for _, sc := range tokenScopes {
+		form.AppendChild(htmlg.Div(checkboxInput("scope-"+string(sc.Scope)), htmlg.Text(fmt.Sprintf(" %s (%s)", sc.Scope, sc.Description))))
+	}
+	expiry := &html.Node{
+		Type: html.ElementNode, Data: atom.Select.String(),
+		Attr: []html.Attribute{{Key: atom.Name.String(), Val: "expiry"}},
+	}
+	for _, e := range tokenExpiries {
+		option := &html.Node{
+			Type: html.ElementNode, Data: atom.Option.String(),
+			Attr: []html.Attribute{{Key: atom.Value.String(), Val: strconv.Itoa(e.Days)}},
+		}
+		option.AppendChild(htmlg.Text(e.Title))
+		expiry.AppendChild(option)
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Expires in: "), expiry))
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(htmlg.Div(submitInput("Generate token")))
+	return form
+}
+
+// serveRevokeToken revokes the personal access token specified by the id query parameter.
+func (h *sessionsHandler) serveRevokeToken(req *http.Request, s *session) error {
+	// Authorization check. Tokens can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	id := req.URL.Query().Get("id")
+	err := accessTokens.Revoke(req.Context(), s.UserSpec, id)
+	if os.IsNotExist(err) {
+		return &os.PathError{Op: "revoke", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditTokenRevoke, s.UserSpec, id, "")
+	return httperror.Redirect{URL: sanitizeReturn(req.PostFormValue("return"))}
+}
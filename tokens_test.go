@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+)
+
+// Test that personal access tokens are accepted by headerAuth,
+// and that their scopes are enforced.
+func TestHeaderAuthPersonalAccessToken(t *testing.T) {
+	defer func() {
+		accessTokens = tokenStore{tokens: make(map[string]personalAccessToken)}
+	}()
+	accessTokens = tokenStore{tokens: make(map[string]personalAccessToken)}
+
+	user := users.UserSpec{ID: 1, Domain: "github.com"}
+	expiry := time.Now().Add(time.Hour)
+	_, readToken, err := accessTokens.Create(context.Background(), user, "read", []tokenScope{scopeRead}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, apiToken, err := accessTokens.Create(context.Background(), user, "api", []tokenScope{scopeAPI}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedToken, err := accessTokens.Create(context.Background(), user, "revoked", []tokenScope{scopeAPI}, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = accessTokens.Revoke(context.Background(), user, revoked.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := headerAuth{http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s, ok := req.Context().Value(sessionContextKey).(*session); !ok || s == nil || s.UserSpec != user {
+			t.Errorf("got session %v, want session for %+v", req.Context().Value(sessionContextKey), user)
+		}
+	})}
+	tests := []struct {
+		method      string
+		accessToken string
+		want        int
+	}{
+		{method: http.MethodGet, accessToken: readToken, want: http.StatusOK},
+		{method: http.MethodPost, accessToken: readToken, want: http.StatusForbidden},
+		{method: http.MethodGet, accessToken: apiToken, want: http.StatusOK},
+		{method: http.MethodPost, accessToken: apiToken, want: http.StatusOK},
+		{method: http.MethodGet, accessToken: revokedToken, want: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, "/api/events/list", nil)
+		req.Header.Set("Authorization", "Bearer "+base64.RawURLEncoding.EncodeToString([]byte(tc.accessToken)))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got := rr.Code; got != tc.want {
+			t.Errorf("%s with token: got status code %d %s, want %d %s", tc.method, got, http.StatusText(got), tc.want, http.StatusText(tc.want))
+		}
+	}
+}
+
+// Test that frontend API tokens are accepted by frontendAuth but not headerAuth,
+// and stop working when their session ends.
+func TestHeaderAuthAPIToken(t *testing.T) {
+	defer func() {
+		global = state{sessions: make(map[string]session)}
+	}()
+	user := users.UserSpec{ID: 1, Domain: "github.com"}
+	s, _ := newSession(user, time.Now().Add(time.Hour))
+	global = state{sessions: map[string]session{s.ID: s}}
+
+	var calls int
+	h := frontendAuth{http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if s, ok := req.Context().Value(sessionContextKey).(*session); !ok || s == nil || s.UserSpec != user || s.HasScope(scopeAPI) {
+			t.Errorf("got session %v, want frontend-scoped session for %+v", req.Context().Value(sessionContextKey), user)
+		}
+	})}
+
+	// Create an API token the way a frontend does.
+	req := httptest.NewRequest(http.MethodPost, "/api/token", nil)
+	req = withSession(req, &s)
+	rr := httptest.NewRecorder()
+	err := serveAPIToken(rr, req)
+	resp, ok := err.(httperror.JSONResponse)
+	if !ok {
+		t.Fatalf("got error %v, want httperror.JSONResponse", err)
+	}
+	accessToken := resp.V.(apiTokenResponse).AccessToken
+
+	// Frontend API tokens aren't accepted by other APIs, such as the admin ones.
+	req = httptest.NewRequest(http.MethodGet, "/api/repositories", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rr = httptest.NewRecorder()
+	headerAuth{http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("headerAuth accepted a frontend API token")
+	})}.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusForbidden; got != want {
+		t.Errorf("headerAuth: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+
+	for _, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodPost, "/api/notifications/markread", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got := rr.Code; got != want {
+			t.Errorf("got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+		}
+
+		// End the session. The API token should no longer work.
+		global.mu.Lock()
+		global.remove(context.Background(), s.ID)
+		global.mu.Unlock()
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
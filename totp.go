@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// TOTP parameters, as defined in RFC 6238. These are the defaults
+// that all common authenticator apps support.
+const (
+	totpPeriod = 30 // Seconds.
+	totpDigits = 6
+	totpSkew   = 1 // Number of periods before and after the current one to accept.
+
+	totpRecoveryCodes = 10 // Number of recovery codes given when enrolling.
+)
+
+// totpEnrollment is a user's enrollment in TOTP two-factor authentication.
+type totpEnrollment struct {
+	UserSpec  users.UserSpec
+	Secret    []byte
+	Enabled   bool // False until the user confirms the enrollment with a valid code.
+	CreatedAt time.Time
+
+	// LastStep is the time step of the last accepted code.
+	// Codes from it and earlier time steps are rejected, so they can't be replayed.
+	LastStep int64
+
+	RecoveryCodes []string // Hex-encoded SHA-256 digests of unused recovery codes.
+}
+
+var errBadTOTPCode = errors.New("bad authentication code")
+
+// totps is the store of TOTP enrollments.
+var totps = totpStore{enrollments: make(map[users.UserSpec]totpEnrollment), now: time.Now}
+
+type totpStore struct {
+	mu          sync.Mutex
+	enrollments map[users.UserSpec]totpEnrollment
+
+	// store is where enrollments are persisted. If nil, enrollments are only kept in memory.
+	store webdav.FileSystem
+
+	now func() time.Time // For tests.
+}
+
+// Load sets root as the TOTP store, and loads all enrollments from it.
+func (ts *totpStore) Load(ctx context.Context, root webdav.FileSystem) error {
+	dir, err := root.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	fis, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.store = root
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		var e totpEnrollment
+		err := gobDecodeFile(ctx, root, "/"+fi.Name(), &e)
+		if err != nil {
+			log.Printf("totpStore.Load: skipping enrollment file %q: %v\n", fi.Name(), err)
+			continue
+		}
+		ts.enrollments[e.UserSpec] = e
+	}
+	return nil
+}
+
+// Enabled reports whether user has confirmed a TOTP enrollment.
+func (ts *totpStore) Enabled(user users.UserSpec) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.enrollments[user].Enabled
+}
+
+// Get returns the enrollment of user, if any.
+func (ts *totpStore) Get(user users.UserSpec) (totpEnrollment, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	e, ok := ts.enrollments[user]
+	return e, ok
+}
+
+// Begin starts enrolling user with a new secret, and returns it.
+// It replaces any unconfirmed enrollment, and returns os.ErrExist
+// if user already has a confirmed one.
+func (ts *totpStore) Begin(ctx context.Context, user users.UserSpec) ([]byte, error) {
+	secret := make([]byte, 20)
+	_, err := cryptorand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.enrollments[user].Enabled {
+		return nil, os.ErrExist
+	}
+	return secret, ts.put(ctx, totpEnrollment{
+		UserSpec:  user,
+		Secret:    secret,
+		CreatedAt: ts.now().UTC(),
+	})
+}
+
+// Confirm confirms the unconfirmed enrollment of user with code,
+// and returns newly generated recovery codes. Only their digests
+// are stored, so they can't be retrieved later.
+func (ts *totpStore) Confirm(ctx context.Context, user users.UserSpec, code string) ([]string, error) {
+	var recoveryCodes, digests []string
+	for i := 0; i < totpRecoveryCodes; i++ {
+		b := make([]byte, 5)
+		_, err := cryptorand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		c := hex.EncodeToString(b)
+		recoveryCodes = append(recoveryCodes, c[:5]+"-"+c[5:])
+		digests = append(digests, tokenDigest(c))
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	e, ok := ts.enrollments[user]
+	if !ok || e.Enabled {
+		return nil, os.ErrNotExist
+	}
+	if !ts.verifyCode(&e, strings.TrimSpace(code)) {
+		return nil, errBadTOTPCode
+	}
+	e.Enabled = true
+	e.RecoveryCodes = digests
+	return recoveryCodes, ts.put(ctx, e)
+}
+
+// Verify verifies code for user. It accepts the current TOTP code,
+// or one of the unused recovery codes, which is then used up.
+// It returns errBadTOTPCode if code isn't valid,
+// and os.ErrNotExist if user isn't enrolled.
+func (ts *totpStore) Verify(ctx context.Context, user users.UserSpec, code string) error {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	e, ok := ts.enrollments[user]
+	if !ok || !e.Enabled {
+		return os.ErrNotExist
+	}
+	if ts.verifyCode(&e, code) {
+		return ts.put(ctx, e)
+	}
+	digest := tokenDigest(code)
+	for i, d := range e.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(d), []byte(digest)) != 1 {
+			continue
+		}
+		e.RecoveryCodes = append(e.RecoveryCodes[:i:i], e.RecoveryCodes[i+1:]...)
+		return ts.put(ctx, e)
+	}
+	return errBadTOTPCode
+}
+
+// Disable removes the enrollment of user.
+// It returns os.ErrNotExist if user isn't enrolled.
+func (ts *totpStore) Disable(ctx context.Context, user users.UserSpec) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.enrollments[user]; !ok {
+		return os.ErrNotExist
+	}
+	delete(ts.enrollments, user)
+	if ts.store != nil {
+		return ts.store.RemoveAll(ctx, totpPath(user))
+	}
+	return nil
+}
+
+// verifyCode reports whether code is a valid TOTP code for enrollment e,
+// and if so, records its time step in e. ts.mu must be held.
+func (ts *totpStore) verifyCode(e *totpEnrollment, code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	step := ts.now().Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s <= e.LastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(e.Secret, s)), []byte(code)) {
+			e.LastStep = s
+			return true
+		}
+	}
+	return false
+}
+
+// put stores e. ts.mu must be held.
+func (ts *totpStore) put(ctx context.Context, e totpEnrollment) error {
+	if ts.store != nil {
+		err := gobEncodeFile(ctx, ts.store, totpPath(e.UserSpec), e)
+		if err != nil {
+			return err
+		}
+	}
+	ts.enrollments[e.UserSpec] = e
+	return nil
+}
+
+func totpPath(user users.UserSpec) string {
+	return "/" + formatUserSpec(user)
+}
+
+// totpCode computes the TOTP code for secret at time step,
+// as specified in RFC 6238 and RFC 4226.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	modulus := uint32(1) // 10^totpDigits.
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, code%modulus)
+}
+
+// stepUpLifetime is how long step-up authentication lasts.
+const stepUpLifetime = 15 * time.Minute
+
+// stepUps is the in-memory store of recent step-up authentications.
+// Keys identify what was stepped up, e.g., a session or an access token.
+var stepUps = stepUpStore{until: make(map[string]time.Time)}
+
+type stepUpStore struct {
+	mu    sync.Mutex
+	until map[string]time.Time // Key -> Step-up expiry.
+}
+
+// Record records a step-up authentication for key.
+func (ss *stepUpStore) Record(key string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	// Forget expired step-ups, so they don't accumulate.
+	for k, t := range ss.until {
+		if !time.Now().Before(t) {
+			delete(ss.until, k)
+		}
+	}
+	ss.until[key] = time.Now().Add(stepUpLifetime)
+}
+
+// Active reports whether key has stepped up recently.
+func (ss *stepUpStore) Active(key string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return time.Now().Before(ss.until[key])
+}
+
+func sessionStepUpKey(s *session) string { return "session:" + s.ID }
+
+// requireStepUp checks that session s, which is used for an admin-only operation,
+// has stepped up recently, if its user is enrolled in TOTP.
+// Otherwise, it returns a redirect to the step-up page,
+// which comes back to the page the operation was started from.
+func requireStepUp(req *http.Request, s *session) error {
+	if !totps.Enabled(s.UserSpec) || stepUps.Active(sessionStepUpKey(s)) {
+		return nil
+	}
+	returnURL := req.URL.RequestURI()
+	if req.Method != http.MethodGet {
+		returnURL = req.URL.Path
+		if r := req.PostFormValue("return"); r != "" {
+			returnURL = r
+		}
+	}
+	return httperror.Redirect{URL: "/step-up?" + url.Values{returnQueryName: {sanitizeReturn(returnURL)}}.Encode()}
+}
+
+// gitStepUpSeparator separates the access token from the TOTP code in
+// Basic Auth passwords of git clients, and in bearer tokens of API clients.
+// It's not in the base64url alphabet.
+const gitStepUpSeparator = "+"
+
+// checkGitStepUp checks that a site admin pushing via git has stepped up recently,
+// if they're enrolled in TOTP. Git clients can't visit the step-up page, so they
+// give the code by appending it to the password, separated by gitStepUpSeparator.
+// A step-up lasts for stepUpLifetime, so that all requests of a push can reuse it.
+func checkGitStepUp(req *http.Request, user users.UserSpec) error {
+	_, password, _ := req.BasicAuth()
+	return checkTokenStepUp(req, user, password)
+}
+
+// checkAPIStepUp is like checkGitStepUp, but for a site admin using
+// a personal access token with the API. The code is appended to
+// the bearer token in the Authorization header instead.
+func checkAPIStepUp(req *http.Request, user users.UserSpec) error {
+	return checkTokenStepUp(req, user, strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+}
+
+// checkTokenStepUp checks that user has stepped up recently with the access token
+// in password, or steps up with the code appended to it, if any.
+func checkTokenStepUp(req *http.Request, user users.UserSpec, password string) error {
+	if !totps.Enabled(user) {
+		return nil
+	}
+	accessToken, code := password, ""
+	if i := strings.Index(password, gitStepUpSeparator); i != -1 {
+		accessToken, code = password[:i], password[i+len(gitStepUpSeparator):]
+	}
+	key := "token:" + tokenDigest(accessToken)
+	if stepUps.Active(key) {
+		return nil
+	}
+	if code == "" {
+		return errBadTOTPCode
+	}
+	err := verifyStepUp(req, user, code)
+	if err != nil {
+		return err
+	}
+	stepUps.Record(key)
+	return nil
+}
+
+// handleGitStepUpError handles an error from checkGitStepUp.
+func handleGitStepUpError(w http.ResponseWriter, err error) {
+	if err, ok := err.(rateLimitedError); ok {
+		handleRateLimited(w, err)
+		return
+	}
+	if err != errBadTOTPCode {
+		log.Println("checkGitStepUp:", err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+	http.Error(w, "401 Unauthorized\n\nTwo-factor authentication is required. Append the code from your authenticator app to the password, separated by "+strconv.Quote(gitStepUpSeparator)+".", http.StatusUnauthorized)
+}
+
+// verifyStepUp verifies a step-up code of user, with rate limiting.
+func verifyStepUp(req *http.Request, user users.UserSpec, code string) error {
+	key := "totp:" + formatUserSpec(user)
+	if retryAfter := authLimiter.Allow(key); retryAfter > 0 {
+		return rateLimitedError{RetryAfter: retryAfter}
+	}
+	err := totps.Verify(req.Context(), user, code)
+	if err == errBadTOTPCode {
+		auditLog.Record(req, auditStepUpFailed, user, "", "")
+		if authLimiter.Failed(key) {
+			auditLog.Record(req, auditLockout, user, key, "")
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+	authLimiter.Succeeded(key)
+	auditLog.Record(req, auditStepUp, user, "", "")
+	return nil
+}
+
+// serveStepUp serves the step-up page, and verifies the code when it's POSTed to.
+func (h *sessionsHandler) serveStepUp(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Only browser sessions can step up.
+	if s == nil || s.Scopes != nil {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	returnURL := sanitizeReturn(req.URL.Query().Get(returnQueryName))
+	if !totps.Enabled(s.UserSpec) {
+		return nil, httperror.Redirect{URL: returnURL}
+	}
+
+	var nodes []*html.Node
+	if req.Method == http.MethodPost {
+		err := verifyStepUp(req, s.UserSpec, req.PostFormValue("code"))
+		switch err {
+		case nil:
+			stepUps.Record(sessionStepUpKey(s))
+			return nil, httperror.Redirect{URL: returnURL}
+		case errBadTOTPCode:
+			nodes = append(nodes, htmlg.Div(htmlg.Text("That code didn't work. Please try again.")))
+		default:
+			return nil, err
+		}
+	}
+	nodes = append(nodes,
+		htmlg.Div(htmlg.Text("This is an admin operation. Please confirm it's you by entering the code from your authenticator app, or a recovery code.")),
+		totpCodeForm(req.URL.RequestURI(), "Confirm", csrfToken(s.rawAccessToken)),
+	)
+	return nodes, nil
+}
+
+// serveTOTP serves the two-factor authentication settings page.
+func (h *sessionsHandler) serveTOTP(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Two-factor authentication can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	e, ok := totps.Get(s.UserSpec)
+	if !ok || !e.Enabled {
+		begin := &html.Node{
+			Type: html.ElementNode, Data: atom.Form.String(),
+			Attr: []html.Attribute{
+				{Key: atom.Method.String(), Val: "post"},
+				{Key: atom.Action.String(), Val: "/settings/totp/enroll"},
+			},
+		}
+		begin.AppendChild(hiddenInput(csrfTokenFormName, csrfToken(s.rawAccessToken)))
+		begin.AppendChild(submitInput("Set up authenticator app"))
+		return []*html.Node{
+			htmlg.Div(htmlg.Text("Two-factor authentication is not enabled. If you're a site admin, it will be required before admin operations once enabled.")),
+			begin,
+		}, nil
+	}
+	return []*html.Node{
+		htmlg.Div(htmlg.Text(fmt.Sprintf("Two-factor authentication is enabled. Recovery codes left: %d.", len(e.RecoveryCodes)))),
+		htmlg.Div(htmlg.Text("To disable it, enter a code from your authenticator app, or a recovery code.")),
+		totpCodeForm("/settings/totp/disable", "Disable", csrfToken(s.rawAccessToken)),
+	}, nil
+}
+
+// serveEnrollTOTP starts enrolling the user in TOTP, and shows the new secret.
+func (h *sessionsHandler) serveEnrollTOTP(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Two-factor authentication can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	user, err := h.users.Get(req.Context(), s.UserSpec)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := totps.Begin(req.Context(), s.UserSpec)
+	if err == os.ErrExist {
+		return nil, httperror.BadRequest{Err: errors.New("two-factor authentication is already enabled")}
+	} else if err != nil {
+		return nil, err
+	}
+	encodedSecret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	otpauth := (&url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + req.Host + ":" + user.Login,
+		RawQuery: url.Values{
+			"secret": {encodedSecret},
+			"issuer": {req.Host},
+		}.Encode(),
+	}).String()
+	return []*html.Node{
+		htmlg.Div(htmlg.Text("Add this account to your authenticator app using the following key or URI:")),
+		htmlg.Div(codeNode(encodedSecret)),
+		htmlg.Div(codeNode(otpauth)),
+		htmlg.Div(htmlg.Text("Then enter the code it shows to finish setting it up.")),
+		totpCodeForm("/settings/totp/confirm", "Enable", csrfToken(s.rawAccessToken)),
+	}, nil
+}
+
+// serveConfirmTOTP confirms the TOTP enrollment of the user, and shows the recovery codes.
+func (h *sessionsHandler) serveConfirmTOTP(req *http.Request, s *session) ([]*html.Node, error) {
+	// Authorization check. Two-factor authentication can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return nil, &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	recoveryCodes, err := totps.Confirm(req.Context(), s.UserSpec, req.PostFormValue("code"))
+	if err == errBadTOTPCode {
+		return nil, httperror.BadRequest{Err: errors.New("code didn't match, please set up your authenticator app again")}
+	} else if os.IsNotExist(err) {
+		return nil, httperror.BadRequest{Err: errors.New("no two-factor authentication setup is in progress")}
+	} else if err != nil {
+		return nil, err
+	}
+	auditLog.Record(req, auditTOTPEnable, s.UserSpec, "", "")
+	// The user just proved possession of the authenticator, so consider the session stepped up.
+	stepUps.Record(sessionStepUpKey(s))
+
+	nodes := []*html.Node{
+		htmlg.Div(htmlg.Text("Two-factor authentication is enabled. Save these recovery codes somewhere safe. Each can be used once if you lose your authenticator, and they won't be shown again:")),
+	}
+	for _, c := range recoveryCodes {
+		nodes = append(nodes, htmlg.Div(codeNode(c)))
+	}
+	return nodes, nil
+}
+
+// serveDisableTOTP disables TOTP for the user, after verifying a code.
+func (h *sessionsHandler) serveDisableTOTP(req *http.Request, s *session) error {
+	// Authorization check. Two-factor authentication can only be managed from a browser session.
+	if s == nil || s.Scopes != nil {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	err := verifyStepUp(req, s.UserSpec, req.PostFormValue("code"))
+	if err == errBadTOTPCode {
+		return httperror.BadRequest{Err: err}
+	} else if os.IsNotExist(err) {
+		return &os.PathError{Op: "disable", Path: req.URL.String(), Err: os.ErrNotExist}
+	} else if err != nil {
+		return err
+	}
+	err = totps.Disable(req.Context(), s.UserSpec)
+	if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditTOTPDisable, s.UserSpec, "", "")
+	return httperror.Redirect{URL: "/settings/totp"}
+}
+
+// totpCodeForm renders a form for entering a code, which is POSTed to action.
+func totpCodeForm(action, submit, csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: action},
+			{Key: atom.Style.String(), Val: `margin-top: 20px;`},
+		},
+	}
+	codeInput := &html.Node{
+		Type: html.ElementNode, Data: atom.Input.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Type.String(), Val: "text"},
+			{Key: atom.Name.String(), Val: "code"},
+			{Key: atom.Autocomplete.String(), Val: "one-time-code"},
+		},
+	}
+	form.AppendChild(htmlg.Div(htmlg.Text("Code: "), codeInput))
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(htmlg.Div(submitInput(submit)))
+	return form
+}
+
+func codeNode(text string) *html.Node {
+	return &html.Node{
+		Type: html.ElementNode, Data: atom.Code.String(),
+		FirstChild: htmlg.Text(text),
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/home/httputil"
+	"github.com/shurcooL/home/internal/code"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, Appendix B, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tc := range tests {
+		if got := totpCode(secret, tc.time/totpPeriod); got != tc.want {
+			t.Errorf("totpCode at time %d: got %q, want %q", tc.time, got, tc.want)
+		}
+	}
+}
+
+// Test that site admins enrolled in TOTP need to step up before admin operations.
+func TestStepUp(t *testing.T) {
+	defer func() {
+		global = state{sessions: make(map[string]session)}
+		totps = totpStore{enrollments: make(map[users.UserSpec]totpEnrollment), now: time.Now}
+		stepUps = stepUpStore{until: make(map[string]time.Time)}
+		authLimiter = newRateLimiter()
+	}()
+	now := time.Now()
+	totps = totpStore{enrollments: make(map[users.UserSpec]totpEnrollment), now: func() time.Time { return now }}
+
+	usersService, userStore, err := newUsersService(webdav.NewMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &sessionsHandler{users: usersService, userStore: userStore}
+	adminSession, accessToken := newSession(shurcool, time.Now().Add(time.Hour))
+	global = state{sessions: map[string]session{adminSession.ID: adminSession}}
+
+	// do makes a request as the admin, and returns the response.
+	do := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Cookie", "accessToken="+base64.RawURLEncoding.EncodeToString([]byte(accessToken)))
+		req.Header.Set("X-CSRF-Token", csrfToken(accessToken))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Admins that aren't enrolled don't need to step up.
+	if got, want := do(http.MethodGet, "/admin/blocked", nil).Code, http.StatusOK; got != want {
+		t.Fatalf("before enrolling: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+
+	secret, err := totps.Begin(context.Background(), shurcool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoveryCodes, err := totps.Confirm(context.Background(), shurcool, totpCode(secret, now.Unix()/totpPeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(recoveryCodes), totpRecoveryCodes; got != want {
+		t.Fatalf("got %d recovery codes, want %d", got, want)
+	}
+
+	// Once enrolled, admin pages redirect to the step-up page.
+	rr := do(http.MethodGet, "/admin/blocked", nil)
+	if got, want := rr.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("after enrolling: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+	stepUpURL := rr.Header().Get("Location")
+	if got, want := stepUpURL, "/step-up?return=%2Fadmin%2Fblocked"; got != want {
+		t.Errorf("got Location header %q, want %q", got, want)
+	}
+
+	// A replayed code doesn't work.
+	rr = do(http.MethodPost, stepUpURL, url.Values{"code": {totpCode(secret, now.Unix()/totpPeriod)}})
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Fatalf("step-up with replayed code: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+
+	// A recovery code works, but only once.
+	if err := totps.Verify(context.Background(), shurcool, recoveryCodes[0]); err != nil {
+		t.Errorf("Verify with recovery code: %v", err)
+	}
+	if err := totps.Verify(context.Background(), shurcool, recoveryCodes[0]); err != errBadTOTPCode {
+		t.Errorf("Verify with used recovery code: got error %v, want %v", err, errBadTOTPCode)
+	}
+
+	// The next code works, and the admin page can then be used.
+	now = now.Add(totpPeriod * time.Second)
+	rr = do(http.MethodPost, stepUpURL, url.Values{"code": {totpCode(secret, now.Unix()/totpPeriod)}})
+	if got, want := rr.Code, http.StatusSeeOther; got != want {
+		t.Fatalf("step-up: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+	if got, want := rr.Header().Get("Location"), "/admin/blocked"; got != want {
+		t.Errorf("got Location header %q, want %q", got, want)
+	}
+	if got, want := do(http.MethodGet, "/admin/blocked", nil).Code, http.StatusOK; got != want {
+		t.Errorf("after step-up: got status code %d %s, want %d %s", got, http.StatusText(got), want, http.StatusText(want))
+	}
+}
+
+// Test that site admins enrolled in TOTP can step up with a personal access token
+// by appending a code to it, in order to use the repositories API.
+func TestRepositoriesAPIStepUp(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	defer func() {
+		accessTokens = tokenStore{tokens: make(map[string]personalAccessToken)}
+		totps = totpStore{enrollments: make(map[users.UserSpec]totpEnrollment), now: time.Now}
+		stepUps = stepUpStore{until: make(map[string]time.Time)}
+		authLimiter = newRateLimiter()
+		repositories = repositoryManager{}
+	}()
+	now := time.Now()
+	accessTokens = tokenStore{tokens: make(map[string]personalAccessToken)}
+	totps = totpStore{enrollments: make(map[users.UserSpec]totpEnrollment), now: func() time.Time { return now }}
+	reposDir, err := ioutil.TempDir("", "home-repositories-api-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(reposDir)
+	repositories.code, err = code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersService, _, err := newUsersService(webdav.NewMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := headerAuth{httputil.ErrorHandler(usersService, serveRepositoriesAPI)}
+
+	_, accessToken, err := accessTokens.Create(context.Background(), shurcool, "api", []tokenScope{scopeAPI}, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totps.Begin(context.Background(), shurcool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := totps.Confirm(context.Background(), shurcool, totpCode(secret, now.Unix()/totpPeriod)); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(totpPeriod * time.Second)
+
+	for _, tc := range []struct {
+		code string
+		want int
+	}{
+		{code: "", want: http.StatusUnauthorized},
+		{code: "000000", want: http.StatusUnauthorized},
+		{code: totpCode(secret, now.Unix()/totpPeriod), want: http.StatusOK},
+		{code: "", want: http.StatusOK}, // The step-up lasts for a while.
+	} {
+		bearer := base64.RawURLEncoding.EncodeToString([]byte(accessToken))
+		if tc.code != "" {
+			bearer += gitStepUpSeparator + tc.code
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/repositories/create?repo=dmitri.shuralyov.com/kebab"+tc.code, nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got := rr.Code; got != tc.want {
+			t.Errorf("with code %q: got status code %d %s, want %d %s", tc.code, got, http.StatusText(got), tc.want, http.StatusText(tc.want))
+		}
+	}
+}
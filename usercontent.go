@@ -33,7 +33,7 @@ func (uc userContentHandler) Upload(w http.ResponseWriter, req *http.Request) er
 	if err != nil {
 		return httperror.JSONResponse{V: uploadResponse{Error: err.Error()}}
 	}
-	if user.ID == 0 {
+	if !policy.Allowed(user.UserSpec, "", roleReader) {
 		return httperror.JSONResponse{V: uploadResponse{Error: os.ErrPermission.Error()}}
 	}
 
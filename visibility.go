@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shurcooL/home/internal/code"
+	"github.com/shurcooL/htmlg"
+	"github.com/shurcooL/httperror"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/webdav"
+)
+
+// visibility is who can see a repository.
+type visibility int
+
+const (
+	visibilityPublic   visibility = iota // Anyone can read and clone it, and it's listed. Repositories are public by default.
+	visibilityUnlisted                   // Anyone who knows its path can read and clone it, but it's not listed.
+	visibilityPrivate                    // Only users granted a role on it can read and clone it, and only they see it listed.
+)
+
+// visibilities are all visibilities, in display order.
+var visibilities = []visibility{visibilityPublic, visibilityUnlisted, visibilityPrivate}
+
+func (v visibility) String() string {
+	switch v {
+	case visibilityPublic:
+		return "public"
+	case visibilityUnlisted:
+		return "unlisted"
+	case visibilityPrivate:
+		return "private"
+	default:
+		return fmt.Sprintf("visibility(%d)", int(v))
+	}
+}
+
+// parseVisibility parses a visibility from its name.
+func parseVisibility(name string) (visibility, error) {
+	for _, v := range visibilities {
+		if v.String() == name {
+			return v, nil
+		}
+	}
+	return visibilityPublic, fmt.Errorf("unknown visibility %q", name)
+}
+
+// repoVisibility is the visibility of a repository.
+type repoVisibility struct {
+	Repo       string // Repository spec. E.g., "dmitri.shuralyov.com/kebabcase".
+	Visibility visibility
+}
+
+// repoVisibilities is the store of visibilities of repositories
+// that aren't public.
+var repoVisibilities repoVisibilityStore
+
+type repoVisibilityStore struct {
+	mu           sync.Mutex
+	visibilities []repoVisibility // Sorted by repo. Public repositories aren't included.
+
+	// store is where visibilities are persisted. If nil, visibilities are only kept in memory.
+	store webdav.FileSystem
+}
+
+// repoVisibilitiesPath is the path of the file in the policy store
+// where visibilities of repositories are persisted.
+const repoVisibilitiesPath = "/visibility"
+
+// Load sets root as the visibility store, and loads visibilities from it.
+func (vs *repoVisibilityStore) Load(ctx context.Context, root webdav.FileSystem) error {
+	var visibilities []repoVisibility
+	err := gobDecodeFile(ctx, root, repoVisibilitiesPath, &visibilities)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	vs.mu.Lock()
+	vs.store = root
+	vs.visibilities = visibilities
+	vs.mu.Unlock()
+	return nil
+}
+
+// Get returns the visibility of repo.
+func (vs *repoVisibilityStore) Get(repo string) visibility {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for _, rv := range vs.visibilities {
+		if rv.Repo == repo {
+			return rv.Visibility
+		}
+	}
+	return visibilityPublic
+}
+
+// List lists visibilities of repositories that aren't public, sorted by repo.
+func (vs *repoVisibilityStore) List() []repoVisibility {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	return append([]repoVisibility(nil), vs.visibilities...)
+}
+
+// Set sets the visibility of repo to v.
+func (vs *repoVisibilityStore) Set(ctx context.Context, repo string, v visibility) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	var visibilities []repoVisibility
+	if v != visibilityPublic {
+		visibilities = append(visibilities, repoVisibility{Repo: repo, Visibility: v})
+	}
+	for _, rv := range vs.visibilities {
+		if rv.Repo == repo {
+			continue
+		}
+		visibilities = append(visibilities, rv)
+	}
+	sort.Slice(visibilities, func(i, j int) bool { return visibilities[i].Repo < visibilities[j].Repo })
+	return vs.set(ctx, visibilities)
+}
+
+// RenameRepo moves the visibility of repository from to repository to.
+func (vs *repoVisibilityStore) RenameRepo(ctx context.Context, from, to string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	var visibilities []repoVisibility
+	for _, rv := range vs.visibilities {
+		switch rv.Repo {
+		case from:
+			rv.Repo = to
+		case to:
+			continue
+		}
+		visibilities = append(visibilities, rv)
+	}
+	sort.Slice(visibilities, func(i, j int) bool { return visibilities[i].Repo < visibilities[j].Repo })
+	return vs.set(ctx, visibilities)
+}
+
+// RemoveRepo removes the visibility of repo, making a future
+// repository at the same path public.
+func (vs *repoVisibilityStore) RemoveRepo(ctx context.Context, repo string) error {
+	return vs.Set(ctx, repo, visibilityPublic)
+}
+
+// set persists visibilities and makes them take effect. vs.mu must be held.
+func (vs *repoVisibilityStore) set(ctx context.Context, visibilities []repoVisibility) error {
+	if vs.store != nil {
+		err := gobEncodeFile(ctx, vs.store, repoVisibilitiesPath, visibilities)
+		if err != nil {
+			return err
+		}
+	}
+	vs.visibilities = visibilities
+	return nil
+}
+
+// canRead reports whether user can read repo.
+// Private repositories can only be read by users
+// explicitly granted a role on them, or site-wide.
+func canRead(user users.UserSpec, repo string) bool {
+	if repoVisibilities.Get(repo) != visibilityPrivate {
+		return true
+	}
+	return policy.Granted(user, repo) >= roleReader
+}
+
+// canReadViaRequest reports whether the client of req can read repo.
+// Browsers are authenticated via the session cookie, and git and
+// the go command via Basic Auth with an access token (e.g., from .netrc).
+// It should only be used where the request isn't authenticated by a middleware.
+func canReadViaRequest(w http.ResponseWriter, req *http.Request, usersService users.Service, repo string) bool {
+	if repoVisibilities.Get(repo) != visibilityPrivate {
+		return true
+	}
+	if s, extended, err := lookUpSessionViaCookie(req); err == nil && s != nil {
+		if extended {
+			// Same as cookieAuth, since this request may not go through it.
+			setAccessTokenCookie(w, s.rawAccessToken, s.Expiry)
+		}
+		return canRead(s.UserSpec, repo)
+	}
+	s, user, err := lookUpSessionUserViaBasicAuth(req, usersService)
+	if err != nil || user == nil {
+		return false
+	}
+	return (s.HasScope(scopeRead) || s.HasScope(scopeGitPush)) && canRead(user.UserSpec, repo)
+}
+
+// setImmutableCacheControl sets response headers that let a response
+// for repo, which never changes, be cached. Responses for private
+// repositories are only cached by the client, since they depend on
+// its credentials.
+func setImmutableCacheControl(w http.ResponseWriter, repo string) {
+	if repoVisibilities.Get(repo) == visibilityPrivate {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		w.Header().Add("Vary", "Authorization, Cookie")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+// listedPackages returns the packages that are listed for user
+// when they query import path pattern. Packages in public repositories
+// are listed for everyone, in private ones only for users who can read them,
+// and in unlisted ones only when pattern is within the repository.
+func listedPackages(user users.UserSpec, packages []*code.Directory, pattern string) []*code.Directory {
+	var listed []*code.Directory
+	for _, p := range packages {
+		if strings.HasPrefix(p.ImportPath, "dmitri.shuralyov.com/") {
+			switch repoVisibilities.Get(p.RepoRoot) {
+			case visibilityUnlisted:
+				if pattern != p.RepoRoot && !strings.HasPrefix(pattern, p.RepoRoot+"/") {
+					continue
+				}
+			case visibilityPrivate:
+				if !canRead(user, p.RepoRoot) {
+					continue
+				}
+			}
+		}
+		listed = append(listed, p)
+	}
+	return listed
+}
+
+// authorizeGitFetch checks that the client of req is allowed to fetch from repo.
+// Clients of private repositories are authenticated with the same Basic Auth scheme
+// as for pushing. If not allowed, it responds with an error and reports false.
+// Private repositories are reported as not found to users who can't read them.
+func (h *gitHandler) authorizeGitFetch(w http.ResponseWriter, req *http.Request, repo repoInfo) bool {
+	if repoVisibilities.Get(repo.Spec) != visibilityPrivate {
+		return true
+	}
+	session, user, err := lookUpSessionUserViaBasicAuth(req, h.users)
+	if err, ok := err.(rateLimitedError); ok {
+		handleRateLimited(w, err)
+		return false
+	}
+	if err == errBadAccessToken {
+		username, _, _ := req.BasicAuth()
+		auditLog.Record(req, auditGitAuthFailed, users.UserSpec{}, repo.Spec, "username: "+username)
+	}
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return false
+	} else if !canRead(user.UserSpec, repo.Spec) || !(session.HasScope(scopeRead) || session.HasScope(scopeGitPush)) {
+		http.Error(w, "404 Not Found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// visibilityForm renders an inline form for setting the visibility of repo.
+func visibilityForm(repo string, current visibility, csrfToken string) *html.Node {
+	form := &html.Node{
+		Type: html.ElementNode, Data: atom.Form.String(),
+		Attr: []html.Attribute{
+			{Key: atom.Method.String(), Val: "post"},
+			{Key: atom.Action.String(), Val: "/admin/repositories/visibility?" + url.Values{"repo": {repo}}.Encode()},
+			{Key: atom.Style.String(), Val: `display: inline; margin-right: 10px;`},
+		},
+	}
+	sel := &html.Node{
+		Type: html.ElementNode, Data: atom.Select.String(),
+		Attr: []html.Attribute{{Key: atom.Name.String(), Val: "visibility"}},
+	}
+	for _, v := range visibilities {
+		option := &html.Node{
+			Type: html.ElementNode, Data: atom.Option.String(),
+			Attr: []html.Attribute{{Key: atom.Value.String(), Val: v.String()}},
+		}
+		if v == current {
+			option.Attr = append(option.Attr, html.Attribute{Key: atom.Selected.String()})
+		}
+		option.AppendChild(htmlg.Text(v.String()))
+		sel.AppendChild(option)
+	}
+	form.AppendChild(sel)
+	form.AppendChild(hiddenInput(csrfTokenFormName, csrfToken))
+	form.AppendChild(submitInput("Set visibility"))
+	return form
+}
+
+// serveSetRepositoryVisibility sets the visibility of the repository
+// specified by the repo query parameter.
+func (h *sessionsHandler) serveSetRepositoryVisibility(req *http.Request, s *session) error {
+	// Authorization check. Repositories can only be managed by site admins from a browser session.
+	if s == nil || s.Scopes != nil || !policy.Allowed(s.UserSpec, "", roleAdmin) {
+		return &os.PathError{Op: "open", Path: req.URL.String(), Err: os.ErrPermission}
+	}
+	if err := requireStepUp(req, s); err != nil {
+		return err
+	}
+	repo := req.URL.Query().Get("repo")
+	if d, ok := repositories.code.Code().ByImportPath[repo]; !ok || !d.IsRepoRoot() {
+		return repoOpError(repo, os.ErrNotExist)
+	}
+	v, err := parseVisibility(req.PostFormValue("visibility"))
+	if err != nil {
+		return httperror.BadRequest{Err: err}
+	}
+	err = repoVisibilities.Set(req.Context(), repo, v)
+	if err != nil {
+		return err
+	}
+	auditLog.Record(req, auditRepoVisibility, s.UserSpec, repo, "visibility: "+v.String())
+	return httperror.Redirect{URL: "/admin/repositories"}
+}
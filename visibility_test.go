@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/home/internal/code"
+	"github.com/shurcooL/users"
+	"golang.org/x/net/webdav"
+)
+
+func TestRepoVisibilities(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "home-visibility-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	ctx := context.Background()
+	var vs repoVisibilityStore
+	if err := vs.Load(ctx, webdav.Dir(tempDir)); err != nil {
+		t.Fatal(err)
+	}
+	const (
+		repoA = "dmitri.shuralyov.com/a"
+		repoB = "dmitri.shuralyov.com/b"
+		repoC = "dmitri.shuralyov.com/c"
+	)
+
+	// Repositories are public by default.
+	if got := vs.Get(repoA); got != visibilityPublic {
+		t.Errorf("got default visibility %v, want public", got)
+	}
+	for repo, v := range map[string]visibility{repoA: visibilityPrivate, repoB: visibilityUnlisted, repoC: visibilityPrivate} {
+		if err := vs.Set(ctx, repo, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Public repositories aren't stored.
+	if err := vs.Set(ctx, repoC, visibilityPublic); err != nil {
+		t.Fatal(err)
+	}
+	want := []repoVisibility{{repoA, visibilityPrivate}, {repoB, visibilityUnlisted}}
+	if got := vs.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got visibilities %+v, want %+v", got, want)
+	}
+
+	// Visibility moves along with renamed repositories, and doesn't
+	// apply to future repositories at the path of removed ones.
+	if err := vs.RenameRepo(ctx, repoA, repoC); err != nil {
+		t.Fatal(err)
+	}
+	if err := vs.RemoveRepo(ctx, repoB); err != nil {
+		t.Fatal(err)
+	}
+	var loaded repoVisibilityStore
+	if err := loaded.Load(ctx, webdav.Dir(tempDir)); err != nil {
+		t.Fatal(err)
+	}
+	want = []repoVisibility{{repoC, visibilityPrivate}}
+	if got := loaded.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got loaded visibilities %+v, want %+v", got, want)
+	}
+}
+
+// Test that packages in private repositories are only listed for users
+// granted a role on them, and ones in unlisted repositories are only listed
+// when the pattern is within the repository. Matching packages against
+// the pattern is up to expandPattern, so it's not checked here.
+func TestListedPackages(t *testing.T) {
+	ctx := context.Background()
+	defer func() { repoVisibilities = repoVisibilityStore{} }()
+	if err := repoVisibilities.Set(ctx, "dmitri.shuralyov.com/private", visibilityPrivate); err != nil {
+		t.Fatal(err)
+	}
+	if err := repoVisibilities.Set(ctx, "dmitri.shuralyov.com/unlisted", visibilityUnlisted); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		reader  = users.UserSpec{ID: 1, Domain: "example.org"}
+		visitor = users.UserSpec{ID: 2, Domain: "example.org"}
+	)
+	if err := policy.Grant(ctx, reader, "dmitri.shuralyov.com/private", roleReader); err != nil {
+		t.Fatal(err)
+	}
+	defer policy.Revoke(ctx, reader, "dmitri.shuralyov.com/private")
+	packages := []*code.Directory{
+		{ImportPath: "dmitri.shuralyov.com/private", RepoRoot: "dmitri.shuralyov.com/private"},
+		{ImportPath: "dmitri.shuralyov.com/public", RepoRoot: "dmitri.shuralyov.com/public"},
+		{ImportPath: "dmitri.shuralyov.com/unlisted/sub", RepoRoot: "dmitri.shuralyov.com/unlisted"},
+		{ImportPath: "github.com/goxjs/gl", RepoRoot: "github.com/goxjs/gl"},
+	}
+
+	for _, tc := range []struct {
+		user    users.UserSpec
+		pattern string
+		want    []string
+	}{
+		{
+			user:    users.UserSpec{},
+			pattern: "...",
+			want:    []string{"dmitri.shuralyov.com/public", "github.com/goxjs/gl"},
+		},
+		{
+			user:    visitor,
+			pattern: "...",
+			want:    []string{"dmitri.shuralyov.com/public", "github.com/goxjs/gl"},
+		},
+		{
+			user:    reader,
+			pattern: "...",
+			want:    []string{"dmitri.shuralyov.com/private", "dmitri.shuralyov.com/public", "github.com/goxjs/gl"},
+		},
+		{
+			user:    users.UserSpec{},
+			pattern: "dmitri.shuralyov.com/unlisted/...",
+			want:    []string{"dmitri.shuralyov.com/public", "dmitri.shuralyov.com/unlisted/sub", "github.com/goxjs/gl"},
+		},
+	} {
+		var got []string
+		for _, p := range listedPackages(tc.user, packages, tc.pattern) {
+			got = append(got, p.ImportPath)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("listedPackages(%v, %q): got %q, want %q", tc.user, tc.pattern, got, tc.want)
+		}
+	}
+}
+
+// Test that private repositories can't be cloned without credentials,
+// while public and unlisted ones can.
+func TestPrivateRepositoryFetch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-visibility-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	reposDir := filepath.Join(tempDir, "repositories")
+	if err := os.Mkdir(reposDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	codeStore, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := initGitHandler(codeStore, reposDir, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	defer func() { repoVisibilities = repoVisibilityStore{} }()
+	for repo, v := range map[string]visibility{
+		"dmitri.shuralyov.com/public":   visibilityPublic,
+		"dmitri.shuralyov.com/unlisted": visibilityUnlisted,
+		"dmitri.shuralyov.com/private":  visibilityPrivate,
+	} {
+		if err := codeStore.Create(repo); err != nil {
+			t.Fatal(err)
+		}
+		if err := repoVisibilities.Set(ctx, repo, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !h.ServeGitMaybe(w, req) {
+			http.NotFound(w, req)
+		}
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/public/info/refs?service=git-upload-pack", http.StatusOK},
+		{"/unlisted/info/refs?service=git-upload-pack", http.StatusOK},
+		{"/private/info/refs?service=git-upload-pack", http.StatusUnauthorized},
+	} {
+		resp, err := http.Get(ts.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("GET %s: got status %v, want %v", tc.path, resp.Status, tc.want)
+		}
+		if tc.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("GET %s: got no WWW-Authenticate header", tc.path)
+		}
+	}
+}
+
+// Test that private modules are only served by the module proxy to clients
+// that can read them, authenticated via Basic Auth like the go command does
+// with .netrc, while public modules are served to anonymous clients.
+// Private modules must not be cached by shared caches.
+func TestPrivateModuleFetch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found:", err)
+	}
+	tempDir, err := ioutil.TempDir("", "home-visibility-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	git := testGit(t, tempDir)
+	reposDir := filepath.Join(tempDir, "repositories")
+	if err := os.Mkdir(reposDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	codeStore, err := code.NewStore(reposDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	defer func() { repoVisibilities = repoVisibilityStore{} }()
+	for repo, v := range map[string]visibility{
+		"dmitri.shuralyov.com/public":  visibilityPublic,
+		"dmitri.shuralyov.com/private": visibilityPrivate,
+	} {
+		if err := codeStore.Create(repo); err != nil {
+			t.Fatal(err)
+		}
+		if err := repoVisibilities.Set(ctx, repo, v); err != nil {
+			t.Fatal(err)
+		}
+		workDir := filepath.Join(tempDir, "work", filepath.FromSlash(repo))
+		if err := os.MkdirAll(workDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		git(workDir, "init")
+		if err := ioutil.WriteFile(filepath.Join(workDir, "go.mod"), []byte("module "+repo+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git(workDir, "add", ".")
+		git(workDir, "commit", "-m", "Initial commit.")
+		git(workDir, "tag", "v1.0.0")
+		git(workDir, "push", filepath.Join(reposDir, filepath.FromSlash(repo)), "HEAD:refs/heads/master", "--tags")
+	}
+
+	defer func() {
+		accessTokens = tokenStore{tokens: make(map[string]personalAccessToken)}
+		authLimiter = newRateLimiter()
+	}()
+	usersService, userStore, err := newUsersService(webdav.NewMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		reader  = users.User{UserSpec: users.UserSpec{ID: 1, Domain: "example.org"}, Login: "reader"}
+		visitor = users.User{UserSpec: users.UserSpec{ID: 2, Domain: "example.org"}, Login: "visitor"}
+	)
+	accessToken := make(map[string]string) // Login -> encoded access token.
+	for _, u := range []users.User{reader, visitor} {
+		if err := userStore.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		_, token, err := accessTokens.Create(ctx, u.UserSpec, "netrc", []tokenScope{scopeRead}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		accessToken[u.Login] = base64.RawURLEncoding.EncodeToString([]byte(token))
+	}
+	if err := policy.Grant(ctx, reader.UserSpec, "dmitri.shuralyov.com/private", roleReader); err != nil {
+		t.Fatal(err)
+	}
+	defer policy.Revoke(ctx, reader.UserSpec, "dmitri.shuralyov.com/private")
+
+	cache, err := newArchiveCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache.dir)
+	h := &goProxyHandler{code: codeStore, reposDir: reposDir, cache: cache, users: usersService}
+
+	for _, tc := range []struct {
+		path  string
+		login string // Login of user to authenticate as, or empty for anonymous.
+		want  string // Wanted response body, or empty for not found.
+
+		wantCacheControl string
+		wantVary         string
+	}{
+		{"/dmitri.shuralyov.com/public/@v/v1.0.0.mod", "", "module dmitri.shuralyov.com/public\n", "public, max-age=31536000, immutable", ""},
+		{"/dmitri.shuralyov.com/private/@v/v1.0.0.mod", "", "", "", ""},
+		{"/dmitri.shuralyov.com/private/@v/v1.0.0.mod", "visitor", "", "", ""},
+		{"/dmitri.shuralyov.com/private/@v/v1.0.0.mod", "reader", "module dmitri.shuralyov.com/private\n", "private, max-age=31536000, immutable", "Authorization, Cookie"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.login != "" {
+			req.SetBasicAuth(tc.login, accessToken[tc.login])
+		}
+		rr := httptest.NewRecorder()
+		err := h.ServeHTTP(rr, req)
+		if tc.want == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s as %q: got error %v, want not exist", tc.path, tc.login, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s as %q: %v", tc.path, tc.login, err)
+		}
+		if got := rr.Body.String(); got != tc.want {
+			t.Errorf("%s as %q: got %q, want %q", tc.path, tc.login, got, tc.want)
+		}
+		if got := rr.Header().Get("Cache-Control"); got != tc.wantCacheControl {
+			t.Errorf("%s as %q: got Cache-Control %q, want %q", tc.path, tc.login, got, tc.wantCacheControl)
+		}
+		if got := rr.Header().Get("Vary"); got != tc.wantVary {
+			t.Errorf("%s as %q: got Vary %q, want %q", tc.path, tc.login, got, tc.wantVary)
+		}
+	}
+}